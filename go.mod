@@ -5,6 +5,9 @@ go 1.19
 require (
 	github.com/antlr4-go/antlr/v4 v4.13.0
 	github.com/cockroachdb/errors v1.9.1
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.17.4
+	github.com/pierrec/lz4/v4 v4.1.18
 	github.com/spf13/viper v1.8.1
 	github.com/stretchr/testify v1.8.3
 	github.com/urfave/cli/v2 v2.25.7
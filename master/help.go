@@ -1,15 +1,89 @@
 package master
 
-import "fmt"
+import (
+	"fmt"
+	"github.com/linkbase/cli"
+	"strings"
+)
 
-// [main/stop/update] [serverType]  -f -p -v
-// main master -f
 var (
-	usageCommand = fmt.Sprintf("Usage:\n "+"%s\n%s\n%s\n", runCommand, serverType, flagCommand)
+	appUsage = "run and operate linkbase servers"
+
+	appDescription = `linkbase runs as one master and several slave nodes, the server type is one of:
+     master   embedded etcd and rocksmq
+     proxy    task scheduler, grpc server and http gateway
+     query    task scheduler and grpc server`
 
-	runCommand = ``
+	serverTypeArgsUsage = "<" + strings.Join(serverTypeNames(), "|") + ">"
 
-	flagCommand = ``
+	// bashCompletionScript is sourced by bash to complete the commands, flags and server types
+	bashCompletionScript = `_linkbase_bash_autocomplete() {
+  local cur opts
+  COMPREPLY=()
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  opts=$( "${COMP_WORDS[@]:0:$COMP_CWORD}" --generate-bash-completion )
+  COMPREPLY=( $(compgen -W "${opts}" -- "${cur}") )
+  return 0
+}
+complete -o default -F _linkbase_bash_autocomplete linkbase
+`
+)
+
+// Flags shared by the commands operating on a local server
+var (
+	configFlag = cli.StringFlag{
+		Name:   "config, c",
+		Usage:  "path of the yaml config file",
+		EnvVar: "LINKBASE_CONFIG",
+	}
+	dataDirFlag = cli.StringFlag{
+		Name:   "data-dir, d",
+		Usage:  "root directory of the local data, overrides common.dataDir",
+		EnvVar: "LINKBASE_DATA_DIR",
+	}
+	logLevelFlag = cli.StringFlag{
+		Name:   "log-level, l",
+		Usage:  "log level, one of debug, info, warn, error",
+		EnvVar: "LINKBASE_LOG_LEVEL",
+	}
 
-	serverType = ``
+	serverFlags = []cli.Flag{configFlag, dataDirFlag, logLevelFlag}
 )
+
+var completionCommand = cli.Command{
+	Name:      "completion",
+	Usage:     "print the bash completion script",
+	UsageText: "source <(linkbase completion)",
+	Action: func(c *cli.Context) error {
+		_, err := fmt.Fprint(c.App.Writer, bashCompletionScript)
+		return err
+	},
+}
+
+func serverTypeNames() []string {
+	names := make([]string, 0, len(serverTypes))
+	for _, t := range serverTypes {
+		names = append(names, t.String())
+	}
+	return names
+}
+
+// completeServerType completes the server type argument of a command
+func completeServerType(c *cli.Context) {
+	if c.Args().Present() {
+		return
+	}
+	for _, name := range serverTypeNames() {
+		fmt.Fprintln(c.App.Writer, name)
+	}
+}
+
+// exitOnError converts the error of an action to an exit error, so the cli prints it and exits with code 1
+func exitOnError(action func(c *cli.Context) error) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		if err := action(c); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return nil
+	}
+}
@@ -1,8 +1,8 @@
 package master
 
 import (
-	"flag"
 	"fmt"
+	"github.com/linkbase/cli"
 	"os"
 )
 
@@ -15,28 +15,74 @@ const (
 	SLAVE_QUERY
 )
 
-type command interface {
-	execute(args []string, flags *flag.FlagSet)
+// server type names accepted by the command line
+const (
+	serverTypeMaster = "master"
+	serverTypeProxy  = "proxy"
+	serverTypeQuery  = "query"
+)
+
+var serverTypes = []ServerType{MASTER, SLAVE_PROXY, SLAVE_QUERY}
+
+// Version of the linkbase binary, overridden by -ldflags "-X github.com/linkbase/master.Version=..."
+var Version = "0.1.0"
+
+func (t ServerType) String() string {
+	switch t {
+	case MASTER:
+		return serverTypeMaster
+	case SLAVE_PROXY:
+		return serverTypeProxy
+	case SLAVE_QUERY:
+		return serverTypeQuery
+	default:
+		return fmt.Sprintf("ServerType(%d)", int(t))
+	}
 }
 
-// RunLinkbaseMaster main linkbase mastergit
-func RunLinkbaseMaster(args []string) {
-	if len(args) < 2 {
-		fmt.Fprintf(os.Stderr, usageCommand)
-		return
+// ParseServerType parses the server type name of the command line
+func ParseServerType(name string) (ServerType, error) {
+	switch name {
+	case serverTypeMaster:
+		return MASTER, nil
+	case serverTypeProxy:
+		return SLAVE_PROXY, nil
+	case serverTypeQuery:
+		return SLAVE_QUERY, nil
+	default:
+		return 0, fmt.Errorf("unknown server type %q", name)
+	}
+}
+
+// NewApp creates the linkbase command line application
+func NewApp() *cli.App {
+	app := cli.NewApp()
+	app.Name = "linkbase"
+	app.HelpName = "linkbase"
+	app.Usage = appUsage
+	app.Description = appDescription
+	app.Version = Version
+	app.EnableBashCompletion = true
+	app.Commands = []cli.Command{
+		runCommand,
+		updateCommand,
+		stopCommand,
+		statusCommand,
+		rocksmqCommand,
+		completionCommand,
 	}
-	cmd := args[1]
-	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
-	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, usageCommand)
+	app.Action = func(c *cli.Context) error {
+		if c.Args().Present() {
+			return cli.NewExitError(fmt.Sprintf("unknown command %q, see 'linkbase help'", c.Args().First()), 1)
+		}
+		return cli.ShowAppHelp(c)
 	}
+	return app
+}
 
-	var c command
-	switch cmd {
-	case CMD_RUN:
-		c = &run{}
-	case CMD_UPDATE:
-		c = &update{}
+// RunLinkbaseMaster main linkbase mastergit
+func RunLinkbaseMaster(args []string) {
+	if err := NewApp().Run(args); err != nil {
+		os.Exit(1)
 	}
-	c.execute(args, flags)
 }
@@ -0,0 +1,38 @@
+package master
+
+import (
+	"bytes"
+	"github.com/linkbase/cli"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewApp(t *testing.T) {
+	exitCode := -1
+	osExiter, errWriter := cli.OsExiter, cli.ErrWriter
+	cli.OsExiter = func(code int) { exitCode = code }
+	cli.ErrWriter = &bytes.Buffer{}
+	defer func() {
+		cli.OsExiter, cli.ErrWriter = osExiter, errWriter
+	}()
+
+	app := NewApp()
+	out := &bytes.Buffer{}
+	app.Writer = out
+	app.Setup()
+	for _, name := range []string{"run", "update", "stop", "status", "rocksmq", "rmq", "completion", "help"} {
+		assert.NotNil(t, app.Command(name), name)
+	}
+
+	assert.NoError(t, app.Run([]string{"linkbase", "run", "--generate-bash-completion"}))
+	assert.Equal(t, "master\nproxy\nquery\n", out.String())
+
+	err := app.Run([]string{"linkbase", "unknown"})
+	assert.Error(t, err)
+	assert.Equal(t, 1, exitCode)
+
+	exitCode = -1
+	err = app.Run([]string{"linkbase", "run", "unknown"})
+	assert.Error(t, err)
+	assert.Equal(t, 1, exitCode)
+}
@@ -0,0 +1,64 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"github.com/linkbase/utils/paramtable"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// pidFilePath returns the pid file of the server type under the data dir, paramtable must be initialized
+func pidFilePath(serverType ServerType) string {
+	return filepath.Join(paramtable.Get().CommonCfg.DataDir.GetValue(), serverType.String()+".pid")
+}
+
+// checkPidFile fails if the pid file belongs to another live process
+func checkPidFile(path string) error {
+	if pid, err := readPidFile(path); err == nil && pid != os.Getpid() && processAlive(pid) {
+		return fmt.Errorf("server is already running with pid %d, pid file %s", pid, path)
+	}
+	return nil
+}
+
+// writePidFile records the pid of the current process, it fails if the file belongs to another live process
+func writePidFile(path string) error {
+	if err := checkPidFile(path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+// readPidFile returns the pid recorded in the pid file
+func readPidFile(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s: %w", path, err)
+	}
+	return pid, nil
+}
+
+func removePidFile(path string) {
+	if pid, err := readPidFile(path); err == nil && pid == os.Getpid() {
+		_ = os.Remove(path)
+	}
+}
+
+// processAlive checks whether the process exists by sending signal 0
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
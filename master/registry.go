@@ -0,0 +1,97 @@
+package master
+
+import (
+	"context"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/registry"
+	"github.com/linkbase/utils/etcd"
+	"github.com/linkbase/utils/paramtable"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"time"
+)
+
+// newEtcdClient connects to the embedded etcd in master, or to etcd.endpoints otherwise
+func newEtcdClient(serverType ServerType) (*clientv3.Client, error) {
+	cfg := &paramtable.Get().EtcdCfg
+	if serverType == MASTER && cfg.UseEmbedEtcd.GetAsBool() && etcd.HasServer() {
+		return etcd.GetEmbedEtcdClient()
+	}
+	return etcd.GetRemoteEtcdClient(cfg.Endpoints.GetAsStrings())
+}
+
+// advertiseAddress replaces the unspecified host of a listen address with the hostname
+func advertiseAddress(address string) string {
+	hostname, _ := os.Hostname()
+	if len(address) == 0 {
+		return hostname
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		return net.JoinHostPort(hostname, port)
+	}
+	return address
+}
+
+// registryComponent registers the node in etcd under a session lease, master also watches the
+// membership of all the nodes and logs their join and leave events
+type registryComponent struct {
+	serverType ServerType
+	address    string
+	client     *clientv3.Client
+	registry   *registry.Registry
+	membership *registry.Membership
+}
+
+func (r *registryComponent) component() component {
+	return component{
+		name: "registry",
+		start: func() error {
+			client, err := newEtcdClient(r.serverType)
+			if err != nil {
+				return err
+			}
+			r.client = client
+			cfg := &paramtable.Get().RegCfg
+			r.registry = registry.NewRegistry(client, registry.DefaultPrefix, cfg.TTL.GetAsInt64(),
+				cfg.StatsInterval.GetAsDuration(time.Second))
+
+			if r.serverType == MASTER {
+				r.membership = registry.NewMembership(r.registry, "")
+				if err := r.membership.Start(context.Background()); err != nil {
+					client.Close()
+					return err
+				}
+			}
+
+			node, err := r.registry.Register(context.Background(), registry.NodeInfo{
+				ServerType: r.serverType.String(),
+				Address:    advertiseAddress(r.address),
+				Version:    Version,
+			})
+			if err != nil {
+				if r.membership != nil {
+					r.membership.Stop()
+				}
+				client.Close()
+				return err
+			}
+			log.Info("node joined the cluster", zap.Int64("nodeID", node.NodeID), zap.String("address", node.Address))
+			return nil
+		},
+		stop: func() {
+			if err := r.registry.Deregister(context.Background()); err != nil {
+				log.Warn("failed to deregister node", zap.Error(err))
+			}
+			if r.membership != nil {
+				r.membership.Stop()
+			}
+			r.client.Close()
+		},
+	}
+}
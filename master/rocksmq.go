@@ -0,0 +1,274 @@
+package master
+
+import (
+	"fmt"
+	"github.com/linkbase/cli"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/middleware/rocksmq/broker"
+	"github.com/linkbase/middleware/rocksmq/server"
+	"github.com/linkbase/utils/paramtable"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	rocksmqAddressFlag = cli.StringFlag{
+		Name:  "address, a",
+		Usage: "address of the rocksmq broker, overrides rocksmq.address",
+	}
+	rocksmqTopicFlag = cli.StringFlag{
+		Name:  "topic, t",
+		Usage: "name of the topic",
+	}
+	rocksmqFromFlag = cli.Int64Flag{
+		Name:  "from",
+		Usage: "first message id to export, -1 means the earliest message",
+		Value: rocksmq.EarliestMessageID,
+	}
+	rocksmqToFlag = cli.Int64Flag{
+		Name:  "to",
+		Usage: "last message id to export, -1 means the latest message when the export starts",
+		Value: -1,
+	}
+	rocksmqOutputFlag = cli.StringFlag{
+		Name:  "output, o",
+		Usage: "file to export to, stdout if not set",
+	}
+	rocksmqForceFlag = cli.BoolFlag{
+		Name:  "force, f",
+		Usage: "remove the existing rocksmq before restoring",
+	}
+)
+
+var rocksmqCommand = cli.Command{
+	Name:    "rocksmq",
+	Aliases: []string{"rmq"},
+	Usage:   "inspect, back up and restore the rocksmq served by master",
+	Subcommands: []cli.Command{
+		{
+			Name:  "topics",
+			Usage: "list the topics",
+			Flags: []cli.Flag{configFlag, rocksmqAddressFlag},
+			Action: exitOnError(func(c *cli.Context) error {
+				return withBroker(c, func(rmq rocksmq.RocksMQ) error {
+					return printTopics(c.App.Writer, rmq)
+				})
+			}),
+		},
+		{
+			Name:      "stats",
+			Usage:     "show the messages, pages and retention of a topic, and the backlog of its consumer groups",
+			ArgsUsage: "<topic>",
+			Flags:     []cli.Flag{configFlag, rocksmqAddressFlag},
+			Action: exitOnError(func(c *cli.Context) error {
+				if !c.Args().Present() {
+					return fmt.Errorf("missing topic, see 'linkbase rocksmq stats --help'")
+				}
+				return withBroker(c, func(rmq rocksmq.RocksMQ) error {
+					stats, err := rmq.GetTopicStats(c.Args().First())
+					if err != nil {
+						return err
+					}
+					printTopicStats(c.App.Writer, stats)
+					return nil
+				})
+			}),
+		},
+		{
+			Name:      "backup",
+			Usage:     "take a consistent checkpoint of the rocksmq while it is serving, dir is relative to rocksmq.backupPath on the host of master",
+			ArgsUsage: "<dir>",
+			Flags:     []cli.Flag{configFlag, rocksmqAddressFlag},
+			Action: exitOnError(func(c *cli.Context) error {
+				if !c.Args().Present() {
+					return fmt.Errorf("missing backup dir, see 'linkbase rocksmq backup --help'")
+				}
+				dir := c.Args().First()
+				return withBroker(c, func(rmq rocksmq.RocksMQ) error {
+					if err := rmq.Backup(dir); err != nil {
+						return err
+					}
+					fmt.Fprintf(c.App.Writer, "rocksmq backed up to %s\n", dir)
+					return nil
+				})
+			}),
+		},
+		{
+			Name:      "restore",
+			Usage:     "restore the rocksmq of master from a backup, master should be stopped",
+			ArgsUsage: "<dir>",
+			Flags:     []cli.Flag{configFlag, rocksmqForceFlag},
+			Action: exitOnError(func(c *cli.Context) error {
+				if !c.Args().Present() {
+					return fmt.Errorf("missing backup dir, see 'linkbase rocksmq restore --help'")
+				}
+				if err := restoreRocksmq(c.Args().First(), c.String("config"), c.Bool("force")); err != nil {
+					return err
+				}
+				fmt.Fprintln(c.App.Writer, "rocksmq restored, start master to serve it")
+				return nil
+			}),
+		},
+		{
+			Name:  "export",
+			Usage: "export a range of messages of a topic to a file that import can replay",
+			Flags: []cli.Flag{configFlag, rocksmqAddressFlag, rocksmqTopicFlag, rocksmqFromFlag, rocksmqToFlag, rocksmqOutputFlag},
+			Action: exitOnError(func(c *cli.Context) error {
+				topic := c.String("topic")
+				if len(topic) == 0 {
+					return fmt.Errorf("missing topic, see 'linkbase rocksmq export --help'")
+				}
+				to := c.Int64("to")
+				if to < 0 {
+					to = rocksmq.LatestMessageID
+				}
+				w := c.App.Writer
+				if output := c.String("output"); len(output) > 0 {
+					f, err := os.Create(output)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					w = f
+				}
+				return withBroker(c, func(rmq rocksmq.RocksMQ) error {
+					n, err := rocksmq.ExportTopic(rmq, topic, c.Int64("from"), to, w)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(cli.ErrWriter, "exported %d messages of %s\n", n, topic)
+					if stats, err := rmq.GetTopicStats(topic); err == nil && stats.Scheduled > 0 {
+						fmt.Fprintf(cli.ErrWriter, "%d scheduled messages of %s are not due yet and not exported\n", stats.Scheduled, topic)
+					}
+					return nil
+				})
+			}),
+		},
+		{
+			Name:      "import",
+			Usage:     "produce the messages of an export file into a topic",
+			ArgsUsage: "<file>",
+			Flags:     []cli.Flag{configFlag, rocksmqAddressFlag, rocksmqTopicFlag},
+			Action: exitOnError(func(c *cli.Context) error {
+				topic := c.String("topic")
+				if len(topic) == 0 || !c.Args().Present() {
+					return fmt.Errorf("missing topic or file, see 'linkbase rocksmq import --help'")
+				}
+				f, err := os.Open(c.Args().First())
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				return withBroker(c, func(rmq rocksmq.RocksMQ) error {
+					n, err := rocksmq.ImportTopic(rmq, topic, f)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(c.App.Writer, "imported %d messages into %s\n", n, topic)
+					return nil
+				})
+			}),
+		},
+	},
+}
+
+// withBroker dials the rocksmq broker of master and calls f with it
+func withBroker(c *cli.Context, f func(rmq rocksmq.RocksMQ) error) error {
+	opts := &serverOptions{configFile: c.String("config")}
+	if err := opts.initParams(); err != nil {
+		return err
+	}
+	address := c.String("address")
+	if len(address) == 0 {
+		address = paramtable.Get().RocksmqCfg.Address.GetValue()
+	}
+	remote, err := broker.Dial(address)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	return f(remote)
+}
+
+// restoreRocksmq restores the rocksmq at rocksmq.path from the backup, a relative backupDir is under
+// rocksmq.backupPath. The existing rocksmq is removed if force is set
+func restoreRocksmq(backupDir, configFile string, force bool) error {
+	opts := &serverOptions{configFile: configFile}
+	if err := opts.initParams(); err != nil {
+		return err
+	}
+	if getServerStatus(MASTER, 0).running {
+		return fmt.Errorf("master is running, stop it before restoring the rocksmq")
+	}
+	if !filepath.IsAbs(backupDir) {
+		backupDir = filepath.Join(paramtable.Get().RocksmqCfg.BackupPath.GetValue(), backupDir)
+	}
+	path := paramtable.Get().RocksmqCfg.Path.GetValue()
+	if force {
+		if err := server.RemoveRocksMQ(path); err != nil {
+			return err
+		}
+	}
+	return server.RestoreRocksMQ(backupDir, path)
+}
+
+// printTopics lists the topics with their message count and size
+func printTopics(w io.Writer, rmq rocksmq.RocksMQ) error {
+	topics, err := rmq.ListTopics()
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		stats, err := rmq.GetTopicStats(topic)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%-32s %10d msgs %12d bytes  %d groups\n", topic, stats.MsgCount, stats.Bytes, len(stats.Groups))
+	}
+	return nil
+}
+
+// printTopicStats prints the stats of a topic and of its consumer groups
+func printTopicStats(w io.Writer, stats *rocksmq.TopicStats) {
+	fmt.Fprintf(w, "topic:      %s\n", stats.Topic)
+	if !stats.CreatedAt.IsZero() {
+		fmt.Fprintf(w, "created:    %s\n", stats.CreatedAt.Format(time.RFC3339))
+	}
+	if len(stats.Partitions) > 0 {
+		fmt.Fprintf(w, "partitions: %d\n", len(stats.Partitions))
+	}
+	fmt.Fprintf(w, "messages:   %d (%d bytes), ids %d - %d\n", stats.MsgCount, stats.Bytes, stats.FirstMsgID, stats.LastMsgID)
+	if stats.RawBytes != stats.Bytes {
+		fmt.Fprintf(w, "compressed: %.2fx, %d bytes before compression\n", stats.CompressionRatio(), stats.RawBytes)
+	}
+	fmt.Fprintf(w, "pages:      %d full, %d acked\n", stats.PageCount, stats.AckedPages)
+	fmt.Fprintf(w, "retention:  %d minutes, %d MB, retain unacked %t, last run %s\n",
+		stats.Retention.TimeInMinutes, stats.Retention.SizeInMB, stats.Retention.RetainUnacked, formatTime(stats.LastRetention))
+	if stats.Compacted {
+		fmt.Fprintln(w, "compacted:  true")
+	}
+	if stats.Scheduled > 0 {
+		fmt.Fprintf(w, "scheduled:  %d\n", stats.Scheduled)
+	}
+	if len(stats.Groups) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "consumer groups:")
+	for _, g := range stats.Groups {
+		mode := "auto"
+		if g.AckMode {
+			mode = fmt.Sprintf("ack (%d pending)", g.Pending)
+		}
+		fmt.Fprintf(w, "  %-24s at %-20d backlog %d msgs %d bytes  %s  last consume %s\n",
+			g.Group, g.CurrentID, g.BacklogMsgs, g.BacklogBytes, mode, formatTime(g.LastConsume))
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
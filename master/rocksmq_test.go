@@ -0,0 +1,36 @@
+package master
+
+import (
+	"bytes"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/middleware/rocksmq/server"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"testing"
+)
+
+func TestPrintTopicStats(t *testing.T) {
+	rmq, err := server.NewRocksMQ(path.Join(t.TempDir(), "rocksmq"), nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+
+	topic := "test_print_topic"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	_, err = rmq.Produce(topic, []rocksmq.ProducerMessage{{Payload: []byte("a")}, {Payload: []byte("bc")}})
+	assert.NoError(t, err)
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "test_group"))
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, printTopics(out, rmq))
+	assert.Contains(t, out.String(), topic)
+	assert.Contains(t, out.String(), "2 msgs")
+
+	stats, err := rmq.GetTopicStats(topic)
+	assert.NoError(t, err)
+	out.Reset()
+	printTopicStats(out, stats)
+	assert.Contains(t, out.String(), "messages:   2 (3 bytes)")
+	assert.Contains(t, out.String(), "test_group")
+	assert.Contains(t, out.String(), "backlog 2 msgs 3 bytes")
+	assert.Contains(t, out.String(), "last consume never")
+}
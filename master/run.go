@@ -1,16 +1,453 @@
 package master
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/linkbase/cli"
+	"github.com/linkbase/middleware/gateway"
+	filekv "github.com/linkbase/middleware/kv/file"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq/broker"
+	"github.com/linkbase/middleware/rocksmq/client"
+	"github.com/linkbase/middleware/rocksmq/server"
+	"github.com/linkbase/middleware/task"
+	"github.com/linkbase/middleware/tso"
+	"github.com/linkbase/utils/etcd"
+	"github.com/linkbase/utils/paramtable"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
-const CMD_RUN = "run"
+const (
+	tsoKey      = "tso"
+	tsoKVSuffix = "_tso.json"
+)
+
+var runCommand = cli.Command{
+	Name:         "run",
+	Usage:        "start a linkbase server and block until SIGINT or SIGTERM",
+	ArgsUsage:    serverTypeArgsUsage,
+	Flags:        serverFlags,
+	BashComplete: completeServerType,
+	Action: exitOnError(func(c *cli.Context) error {
+		opts, err := newServerOptions(c)
+		if err != nil {
+			return err
+		}
+		return opts.serve()
+	}),
+}
+
+// serverOptions are parsed from the arguments of the commands operating on a local server
+type serverOptions struct {
+	serverType ServerType
+	configFile string
+	dataDir    string
+	logLevel   string
+}
+
+func newServerOptions(c *cli.Context) (*serverOptions, error) {
+	if !c.Args().Present() {
+		return nil, fmt.Errorf("server type is required, usage: %s %s %s", c.App.Name, c.Command.Name, serverTypeArgsUsage)
+	}
+	serverType, err := ParseServerType(c.Args().First())
+	if err != nil {
+		return nil, err
+	}
+	return &serverOptions{
+		serverType: serverType,
+		configFile: c.String("config"),
+		dataDir:    c.String("data-dir"),
+		logLevel:   c.String("log-level"),
+	}, nil
+}
+
+// serve starts the components of the server type and blocks until SIGINT or SIGTERM
+func (r *serverOptions) serve() error {
+	if err := r.initParams(); err != nil {
+		return err
+	}
+	if err := initLogger(r.serverType); err != nil {
+		return err
+	}
+	defer log.Sync()
+
+	// the pid file is written once the server is ready, it is the readiness signal of update
+	pidFile := pidFilePath(r.serverType)
+	if err := checkPidFile(pidFile); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop, err := startComponents(r.components(ctx))
+	if err != nil {
+		log.Error("failed to start server", zap.Stringer("serverType", r.serverType), zap.Error(err))
+		return err
+	}
+	if err := writePidFile(pidFile); err != nil {
+		stop()
+		return err
+	}
+	defer removePidFile(pidFile)
+	log.Info("server started", zap.Stringer("serverType", r.serverType), zap.Int("pid", os.Getpid()))
+
+	sc := make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sc)
+	sig := <-sc
+	log.Info("received signal, shutting down", zap.String("signal", sig.String()))
+
+	stop()
+	log.Info("server stopped", zap.Stringer("serverType", r.serverType))
+	return nil
+}
+
+// flags returns the command line flags to start another server with the same options
+func (r *serverOptions) flags() []string {
+	var flags []string
+	if len(r.configFile) > 0 {
+		flags = append(flags, "--config", r.configFile)
+	}
+	if len(r.dataDir) > 0 {
+		flags = append(flags, "--data-dir", r.dataDir)
+	}
+	if len(r.logLevel) > 0 {
+		flags = append(flags, "--log-level", r.logLevel)
+	}
+	return flags
+}
+
+// initParams loads the config file and applies the command line overrides
+func (r *serverOptions) initParams() error {
+	if len(r.configFile) > 0 {
+		if _, err := os.Stat(r.configFile); err != nil {
+			return fmt.Errorf("invalid config file: %w", err)
+		}
+		paramtable.Init(r.configFile)
+	} else {
+		paramtable.Init()
+	}
+	params := paramtable.Get()
+	if len(r.dataDir) > 0 {
+		params.Save(params.CommonCfg.DataDir.Key, r.dataDir)
+		params.Save(params.RocksmqCfg.Path.Key, filepath.Join(r.dataDir, "rdb_data"))
+		params.Save(params.EtcdCfg.DataDir.Key, filepath.Join(r.dataDir, "etcd"))
+	}
+	if len(r.logLevel) > 0 {
+		params.Save(params.LogCfg.Level.Key, r.logLevel)
+	}
+	return nil
+}
+
+func initLogger(serverType ServerType) error {
+	cfg := &paramtable.Get().LogCfg
+	logCfg := &log.Config{
+		Level:  cfg.Level.GetValue(),
+		Format: cfg.Format.GetValue(),
+		Stdout: cfg.Stdout.GetAsBool(),
+		File: log.FileLogConfig{
+			RootPath:   cfg.RootPath.GetValue(),
+			MaxSize:    cfg.MaxSize.GetAsInt(),
+			MaxDays:    cfg.MaxAge.GetAsInt(),
+			MaxBackups: cfg.MaxBackups.GetAsInt(),
+		},
+	}
+	if len(logCfg.File.RootPath) > 0 {
+		logCfg.File.Filename = serverType.String() + ".log"
+	}
+	logger, props, err := log.InitLogger(logCfg)
+	if err != nil {
+		return fmt.Errorf("failed to init logger: %w", err)
+	}
+	log.ReplaceGlobals(logger, props)
+	return nil
+}
+
+// component is a service started by the run command
+type component struct {
+	name  string
+	start func() error
+	stop  func()
+}
+
+// startComponents starts the components in order, the returned stop func stops them in reverse order.
+// If any of them fails to start, the started ones are stopped before returning
+func startComponents(components []component) (func(), error) {
+	started := make([]component, 0, len(components))
+	stop := func() {
+		for i := len(started) - 1; i >= 0; i-- {
+			log.Info("stopping component", zap.String("name", started[i].name))
+			started[i].stop()
+		}
+	}
+	for _, c := range components {
+		log.Info("starting component", zap.String("name", c.name))
+		if err := c.start(); err != nil {
+			stop()
+			return nil, fmt.Errorf("failed to start %s: %w", c.name, err)
+		}
+		started = append(started, c)
+	}
+	return stop, nil
+}
+
+func (r *serverOptions) components(ctx context.Context) []component {
+	switch r.serverType {
+	case MASTER:
+		reg := &registryComponent{serverType: r.serverType}
+		rmqBroker := &brokerComponent{}
+		return []component{
+			etcdComponent(),
+			rocksmqComponent(),
+			rmqBroker.component(paramtable.Get().RocksmqCfg.Address.GetValue()),
+			reg.component(),
+			supervisorComponent(r),
+		}
+	case SLAVE_PROXY:
+		scheduler := &schedulerComponent{serverType: r.serverType}
+		grpcServer := &grpcComponent{}
+		address := grpcAddress(r.serverType)
+		reg := &registryComponent{serverType: r.serverType, address: address}
+		return []component{
+			rocksmqClientComponent(),
+			scheduler.component(ctx),
+			grpcServer.component(address),
+			gatewayComponent(ctx, address),
+			reg.component(),
+		}
+	case SLAVE_QUERY:
+		scheduler := &schedulerComponent{serverType: r.serverType}
+		grpcServer := &grpcComponent{}
+		address := grpcAddress(r.serverType)
+		reg := &registryComponent{serverType: r.serverType, address: address}
+		return []component{
+			rocksmqClientComponent(),
+			scheduler.component(ctx),
+			grpcServer.component(address),
+			reg.component(),
+		}
+	default:
+		return nil
+	}
+}
+
+func etcdComponent() component {
+	cfg := &paramtable.Get().EtcdCfg
+	return component{
+		name: "etcd",
+		start: func() error {
+			return etcd.InitEtcdServer(
+				cfg.UseEmbedEtcd.GetAsBool(),
+				cfg.ConfigPath.GetValue(),
+				cfg.DataDir.GetValue(),
+				cfg.LogPath.GetValue(),
+				cfg.LogLevel.GetValue(),
+			)
+		},
+		stop: etcd.StopEtcdServer,
+	}
+}
+
+func rocksmqComponent() component {
+	return component{
+		name: "rocksmq",
+		start: func() error {
+			return server.InitRocksMQ(paramtable.Get().RocksmqCfg.Path.GetValue())
+		},
+		stop: server.CloseRocksMQ,
+	}
+}
+
+// brokerComponent serves the rocksmq of master over grpc, so that the slaves share it
+type brokerComponent struct {
+	server *grpc.Server
+	done   chan struct{}
+}
+
+func (b *brokerComponent) component(address string) component {
+	return component{
+		name: "broker",
+		start: func() error {
+			lis, err := net.Listen("tcp", address)
+			if err != nil {
+				return err
+			}
+			b.server = grpc.NewServer()
+			broker.RegisterServer(b.server, server.Rmq)
+			b.done = make(chan struct{})
+			go func() {
+				defer close(b.done)
+				if err := b.server.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+					log.Error("rocksmq broker stopped unexpectedly", zap.Error(err))
+				}
+			}()
+			log.Info("rocksmq broker listening", zap.String("address", address))
+			if addr, ok := lis.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+				log.Warn("rocksmq broker has no authentication and listens beyond loopback", zap.String("address", address))
+			}
+			return nil
+		},
+		stop: func() {
+			// the streams of remote consumers never end by themselves, so they are not waited for
+			b.server.Stop()
+			<-b.done
+		},
+	}
+}
+
+// rocksmqClientComponent dials the rocksmq broker of master at rocksmq.address, the slave shares the rocksmq of master
+// through client.Rmq
+func rocksmqClientComponent() component {
+	return component{
+		name: "rocksmq client",
+		start: func() error {
+			return client.InitClient(paramtable.Get().RocksmqCfg.Address.GetValue())
+		},
+		stop: client.CloseClient,
+	}
+}
+
+// supervisorComponent launches and watches the slaves declared by supervisor.slaves
+func supervisorComponent(opts *serverOptions) component {
+	var s *supervisor
+	return component{
+		name: "supervisor",
+		start: func() error {
+			var err error
+			s, err = newSupervisor(opts)
+			if err != nil {
+				return err
+			}
+			return s.Start()
+		},
+		stop: func() {
+			s.Stop()
+		},
+	}
+}
+
+// schedulerComponent runs the task scheduler with a tso allocator persisted in the data dir
+type schedulerComponent struct {
+	// serverType names the tso file, so the slaves sharing a data dir do not share the tso
+	serverType ServerType
+	kv         *filekv.FileKV
+	scheduler  task.Scheduler
+}
+
+func (s *schedulerComponent) component(ctx context.Context) component {
+	return component{
+		name: "scheduler",
+		start: func() error {
+			dataDir := paramtable.Get().CommonCfg.DataDir.GetValue()
+			if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
+				return err
+			}
+			kv, err := filekv.NewFileKV(filepath.Join(dataDir, s.serverType.String()+tsoKVSuffix))
+			if err != nil {
+				return err
+			}
+			s.kv = kv
+			allocator := tso.NewGlobalTSOAllocator(tsoKey, kv)
+			if err := allocator.Initialize(); err != nil {
+				kv.Close()
+				return err
+			}
+			scheduler, err := task.NewScheduler(ctx, allocator)
+			if err != nil {
+				kv.Close()
+				return err
+			}
+			s.scheduler = scheduler
+			return scheduler.Start()
+		},
+		stop: func() {
+			timeout := paramtable.Get().CommonCfg.GracefulStopTimeout.GetAsDuration(time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := s.scheduler.Drain(ctx); err != nil {
+				log.Warn("failed to drain the task queues", zap.Duration("timeout", timeout), zap.Error(err))
+			}
+			s.scheduler.Close()
+			s.kv.Close()
+		},
+	}
+}
+
+// grpcComponent runs a grpc server exposing the standard health service
+type grpcComponent struct {
+	server *grpc.Server
+	health *health.Server
+	done   chan struct{}
+}
 
-type run struct {
+func (g *grpcComponent) component(address string) component {
+	return component{
+		name: "grpc",
+		start: func() error {
+			lis, err := net.Listen("tcp", address)
+			if err != nil {
+				return err
+			}
+			g.server = grpc.NewServer()
+			g.health = health.NewServer()
+			healthpb.RegisterHealthServer(g.server, g.health)
+			g.done = make(chan struct{})
+			go func() {
+				defer close(g.done)
+				if err := g.server.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+					log.Error("grpc server stopped unexpectedly", zap.Error(err))
+				}
+			}()
+			log.Info("grpc server listening", zap.String("address", address))
+			return nil
+		},
+		stop: func() {
+			g.health.Shutdown()
+			g.server.GracefulStop()
+			<-g.done
+		},
+	}
 }
 
-func (r run) execute(args []string, flags *flag.FlagSet) {
-	fmt.Println(args)
-	fmt.Println(flags)
+// gatewayComponent serves the http gateway of the grpc server at grpcAddress
+func gatewayComponent(ctx context.Context, grpcAddress string) component {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	return component{
+		name: "gateway",
+		start: func() error {
+			address := paramtable.Get().ProxyCfg.HTTPAddress.GetValue()
+			lis, err := net.Listen("tcp", address)
+			if err != nil {
+				return err
+			}
+			go func() {
+				defer close(done)
+				err := gateway.Run(ctx, gateway.Options{
+					Addr:       address,
+					Listener:   lis,
+					GRPCServer: gateway.Endpoint{Network: "tcp", Addr: grpcAddress},
+				})
+				if err != nil {
+					log.Error("gateway stopped unexpectedly", zap.Error(err))
+				}
+			}()
+			return nil
+		},
+		stop: func() {
+			cancel()
+			<-done
+		},
+	}
 }
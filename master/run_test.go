@@ -0,0 +1,99 @@
+package master
+
+import (
+	"context"
+	"errors"
+	"github.com/linkbase/middleware/rocksmq/broker"
+	"github.com/linkbase/middleware/rocksmq/client"
+	"github.com/linkbase/middleware/rocksmq/server"
+	"github.com/linkbase/utils/paramtable"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"net"
+	"path"
+	"testing"
+)
+
+func TestParseServerType(t *testing.T) {
+	for _, st := range []ServerType{MASTER, SLAVE_PROXY, SLAVE_QUERY} {
+		parsed, err := ParseServerType(st.String())
+		assert.NoError(t, err)
+		assert.Equal(t, st, parsed)
+	}
+
+	_, err := ParseServerType("unknown")
+	assert.Error(t, err)
+}
+
+func TestStartComponents(t *testing.T) {
+	var events []string
+	newComponent := func(name string, startErr error) component {
+		return component{
+			name: name,
+			start: func() error {
+				events = append(events, "start "+name)
+				return startErr
+			},
+			stop: func() {
+				events = append(events, "stop "+name)
+			},
+		}
+	}
+
+	stop, err := startComponents([]component{newComponent("a", nil), newComponent("b", nil)})
+	assert.NoError(t, err)
+	stop()
+	assert.Equal(t, []string{"start a", "start b", "stop b", "stop a"}, events)
+
+	events = nil
+	_, err = startComponents([]component{
+		newComponent("a", nil),
+		newComponent("b", nil),
+		newComponent("c", errors.New("mock error")),
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"start a", "start b", "start c", "stop b", "stop a"}, events)
+}
+
+func TestGatewayComponent(t *testing.T) {
+	paramtable.Init()
+	params := paramtable.Get()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	params.Save(params.ProxyCfg.HTTPAddress.Key, lis.Addr().String())
+	defer params.Reset(params.ProxyCfg.HTTPAddress.Key)
+
+	// the port is taken, so the gateway fails to start instead of failing in the background
+	gw := gatewayComponent(context.Background(), "127.0.0.1:0")
+	assert.Error(t, gw.start())
+}
+
+func TestRocksmqClientComponent(t *testing.T) {
+	rmq, err := server.NewRocksMQ(path.Join(t.TempDir(), "rocksmq"), nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := grpc.NewServer()
+	broker.RegisterServer(s, rmq)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	paramtable.Init()
+	params := paramtable.Get()
+	params.Save(params.RocksmqCfg.Address.Key, lis.Addr().String())
+	defer params.Reset(params.RocksmqCfg.Address.Key)
+
+	// the slave reaches the rocksmq of master through the broker
+	c := rocksmqClientComponent()
+	assert.NoError(t, c.start())
+	defer c.stop()
+	topic := "test_slave_topic"
+	producer, err := client.Rmq.CreateProducer(client.ProducerOptions{Topic: topic})
+	assert.NoError(t, err)
+	defer producer.Close()
+	partitions, err := rmq.GetTopicPartitions(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, partitions)
+}
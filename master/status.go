@@ -0,0 +1,157 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"github.com/linkbase/cli"
+	"github.com/linkbase/middleware/registry"
+	"github.com/linkbase/utils/etcd"
+	"github.com/linkbase/utils/paramtable"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"io"
+	"sort"
+	"time"
+)
+
+const defaultHealthCheckTimeout = 3 * time.Second
+
+var healthCheckTimeoutFlag = cli.DurationFlag{
+	Name:  "timeout, t",
+	Usage: "timeout of the grpc health check",
+	Value: defaultHealthCheckTimeout,
+}
+
+var statusNodesFlag = cli.BoolFlag{
+	Name:  "nodes, n",
+	Usage: "list the nodes registered in etcd as well",
+}
+
+var statusCommand = cli.Command{
+	Name:         "status",
+	Usage:        "show the status of the linkbase servers on this machine",
+	ArgsUsage:    "[" + serverTypeArgsUsage + "]",
+	Flags:        []cli.Flag{configFlag, dataDirFlag, healthCheckTimeoutFlag, statusNodesFlag},
+	BashComplete: completeServerType,
+	Action: exitOnError(func(c *cli.Context) error {
+		types := serverTypes
+		if c.Args().Present() {
+			serverType, err := ParseServerType(c.Args().First())
+			if err != nil {
+				return err
+			}
+			types = []ServerType{serverType}
+		}
+		opts := &serverOptions{
+			configFile: c.String("config"),
+			dataDir:    c.String("data-dir"),
+		}
+		if err := opts.initParams(); err != nil {
+			return err
+		}
+		for _, serverType := range types {
+			fmt.Fprintln(c.App.Writer, getServerStatus(serverType, c.Duration("timeout")))
+		}
+		if getServerStatus(MASTER, 0).running {
+			if states, err := loadSlaveStates(); err == nil && len(states) > 0 {
+				fmt.Fprintln(c.App.Writer, "supervised slaves:")
+				for _, state := range states {
+					fmt.Fprintln(c.App.Writer, "  "+state.String())
+				}
+			}
+		}
+		if c.Bool("nodes") {
+			return printNodes(c.App.Writer)
+		}
+		return nil
+	}),
+}
+
+// printNodes lists the nodes registered in etcd.endpoints
+func printNodes(w io.Writer) error {
+	client, err := etcd.GetRemoteEtcdClient(paramtable.Get().EtcdCfg.Endpoints.GetAsStrings())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	nodes, _, err := registry.NewRegistry(client, registry.DefaultPrefix, 0, 0).ListNodes(context.Background(), "")
+	if err != nil {
+		return err
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].ServerType != nodes[j].ServerType {
+			return nodes[i].ServerType < nodes[j].ServerType
+		}
+		return nodes[i].NodeID < nodes[j].NodeID
+	})
+	fmt.Fprintln(w, "cluster nodes:")
+	for _, node := range nodes {
+		fmt.Fprintf(w, "  %-8s %-20d %-24s %-8s cpu %d (%.1f%%)  mem %d/%d MB  updated %s\n",
+			node.ServerType, node.NodeID, node.Address, node.Version,
+			node.Hardware.CPUNum, node.Hardware.CPUUsage, node.Hardware.MemoryUsed>>20, node.Hardware.MemoryTotal>>20,
+			node.UpdatedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// serverStatus is the status of a local server
+type serverStatus struct {
+	serverType ServerType
+	pid        int
+	running    bool
+	health     string
+}
+
+func (s serverStatus) String() string {
+	if !s.running {
+		return fmt.Sprintf("%-8s stopped", s.serverType)
+	}
+	ret := fmt.Sprintf("%-8s running  pid %d", s.serverType, s.pid)
+	if len(s.health) > 0 {
+		ret += "  " + s.health
+	}
+	return ret
+}
+
+func getServerStatus(serverType ServerType, timeout time.Duration) serverStatus {
+	status := serverStatus{serverType: serverType}
+	pid, err := readPidFile(pidFilePath(serverType))
+	if err != nil || !processAlive(pid) {
+		return status
+	}
+	status.pid = pid
+	status.running = true
+	if address := grpcAddress(serverType); len(address) > 0 {
+		status.health = checkHealth(address, timeout)
+	}
+	return status
+}
+
+// grpcAddress returns the address of the grpc server of the server type, empty if it has none
+func grpcAddress(serverType ServerType) string {
+	switch serverType {
+	case SLAVE_PROXY:
+		return paramtable.Get().ProxyCfg.GRPCAddress.GetValue()
+	case SLAVE_QUERY:
+		return paramtable.Get().QueryCfg.GRPCAddress.GetValue()
+	default:
+		return ""
+	}
+}
+
+// checkHealth calls the standard grpc health service and returns the serving status
+func checkHealth(address string, timeout time.Duration) string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		return "UNREACHABLE"
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return "UNKNOWN"
+	}
+	return resp.GetStatus().String()
+}
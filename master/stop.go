@@ -0,0 +1,95 @@
+package master
+
+import (
+	"fmt"
+	"github.com/linkbase/cli"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultStopTimeout = 30 * time.Second
+	processPollPeriod  = 100 * time.Millisecond
+)
+
+var (
+	stopTimeoutFlag = cli.DurationFlag{
+		Name:  "timeout, t",
+		Usage: "time to wait for the server to exit after SIGTERM",
+		Value: defaultStopTimeout,
+	}
+	stopForceFlag = cli.BoolFlag{
+		Name:  "force, f",
+		Usage: "send SIGKILL if the server does not exit in time",
+	}
+)
+
+var stopCommand = cli.Command{
+	Name:         "stop",
+	Usage:        "stop a linkbase server running on this machine",
+	ArgsUsage:    serverTypeArgsUsage,
+	Flags:        []cli.Flag{configFlag, dataDirFlag, stopTimeoutFlag, stopForceFlag},
+	BashComplete: completeServerType,
+	Action: exitOnError(func(c *cli.Context) error {
+		opts, err := newServerOptions(c)
+		if err != nil {
+			return err
+		}
+		if err := opts.initParams(); err != nil {
+			return err
+		}
+		pid, err := stopServer(pidFilePath(opts.serverType), c.Duration("timeout"), c.Bool("force"))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.Writer, "%s stopped, pid %d\n", opts.serverType, pid)
+		return nil
+	}),
+}
+
+// stopServer sends SIGTERM to the process recorded in pidFile and waits for it to exit,
+// with force the process is killed if it is still alive after timeout
+func stopServer(pidFile string, timeout time.Duration, force bool) (int, error) {
+	pid, err := readPidFile(pidFile)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("server is not running, pid file %s not found", pidFile)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !processAlive(pid) {
+		_ = os.Remove(pidFile)
+		return pid, fmt.Errorf("server is not running, removed stale pid file %s", pidFile)
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return pid, err
+	}
+	if waitProcessExit(pid, timeout) {
+		return pid, nil
+	}
+	if !force {
+		return pid, fmt.Errorf("server pid %d did not exit in %s", pid, timeout)
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		return pid, err
+	}
+	if !waitProcessExit(pid, timeout) {
+		return pid, fmt.Errorf("server pid %d did not exit after SIGKILL", pid)
+	}
+	_ = os.Remove(pidFile)
+	return pid, nil
+}
+
+// waitProcessExit polls the process until it exits or timeout, returns whether it exited
+func waitProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(processPollPeriod)
+	}
+	return true
+}
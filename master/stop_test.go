@@ -0,0 +1,52 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.pid")
+	_, err := readPidFile(path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, writePidFile(path))
+	pid, err := readPidFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), pid)
+	assert.True(t, processAlive(pid))
+
+	removePidFile(path)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStopServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.pid")
+	_, err := stopServer(path, time.Second, false)
+	assert.Error(t, err)
+
+	cmd := exec.Command("sleep", "60")
+	assert.NoError(t, cmd.Start())
+	go cmd.Wait()
+	assert.NoError(t, os.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)), 0644))
+
+	// a running server can not be taken over
+	assert.Error(t, writePidFile(path))
+
+	pid, err := stopServer(path, 5*time.Second, false)
+	assert.NoError(t, err)
+	assert.Equal(t, cmd.Process.Pid, pid)
+	assert.False(t, processAlive(pid))
+
+	// stale pid file is removed
+	_, err = stopServer(path, time.Second, false)
+	assert.Error(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
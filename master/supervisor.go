@@ -0,0 +1,361 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/utils/paramtable"
+	"go.uber.org/zap"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const supervisorStateFile = "supervisor.json"
+
+// slave states reported by the supervisor
+const (
+	slaveStateStarting = "starting"
+	slaveStateRunning  = "running"
+	slaveStateBackoff  = "backoff"
+	slaveStateStopped  = "stopped"
+	// slaveStateExited is a slave which exited cleanly, e.g. stopped by the stop command, it is not restarted
+	slaveStateExited = "exited"
+)
+
+// slaveState is the state of a supervised slave, persisted for the status command
+type slaveState struct {
+	ServerType string    `json:"serverType"`
+	State      string    `json:"state"`
+	Pid        int       `json:"pid,omitempty"`
+	Restarts   int       `json:"restarts"`
+	LastExit   string    `json:"lastExit,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// backoff is the exponential delay of restarting a crashed slave
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	// reset is how long a slave has to keep running for the delay to be reset
+	reset time.Duration
+}
+
+// supervisor launches the slaves of the topology on this machine and restarts them on crash. A slave which
+// exits cleanly is left stopped, and one started by somebody else later, e.g. by update, is adopted
+type supervisor struct {
+	binary      string
+	flags       []string
+	slaves      []ServerType
+	backoff     backoff
+	stopTimeout time.Duration
+	logDir      string
+	stateFile   string
+
+	mu     sync.Mutex
+	states map[ServerType]*slaveState
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newSupervisor creates the supervisor of the slaves declared by supervisor.slaves, the slaves are
+// started with the same binary and flags as master
+func newSupervisor(opts *serverOptions) (*supervisor, error) {
+	params := paramtable.Get()
+	var slaves []ServerType
+	for _, name := range params.SuperCfg.Slaves.GetAsStrings() {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		serverType, err := ParseServerType(name)
+		if err != nil {
+			return nil, err
+		}
+		if serverType == MASTER {
+			return nil, errors.New("master can not supervise another master")
+		}
+		slaves = append(slaves, serverType)
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	dataDir := params.CommonCfg.DataDir.GetValue()
+	logDir := params.LogCfg.RootPath.GetValue()
+	if len(logDir) == 0 {
+		logDir = filepath.Join(dataDir, "logs")
+	}
+	return &supervisor{
+		binary: binary,
+		flags:  opts.flags(),
+		slaves: slaves,
+		backoff: backoff{
+			initial: params.SuperCfg.InitialBackoff.GetAsDuration(time.Second),
+			max:     params.SuperCfg.MaxBackoff.GetAsDuration(time.Second),
+			reset:   params.SuperCfg.ResetBackoff.GetAsDuration(time.Second),
+		},
+		stopTimeout: params.CommonCfg.GracefulStopTimeout.GetAsDuration(time.Second) + 10*time.Second,
+		logDir:      logDir,
+		stateFile:   filepath.Join(dataDir, supervisorStateFile),
+		states:      make(map[ServerType]*slaveState),
+	}, nil
+}
+
+// Start launches a watcher for each slave
+func (s *supervisor) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.stateFile), os.ModePerm); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for _, serverType := range s.slaves {
+		s.setState(serverType, func(state *slaveState) { state.State = slaveStateStarting })
+		s.wg.Add(1)
+		go s.watch(ctx, serverType)
+	}
+	return nil
+}
+
+// Stop terminates the slaves gracefully and waits for the watchers to exit
+func (s *supervisor) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+	_ = os.Remove(s.stateFile)
+}
+
+func (s *supervisor) watch(ctx context.Context, serverType ServerType) {
+	defer s.wg.Done()
+	delay := s.backoff.initial
+	for {
+		started := time.Now()
+		err := s.runOnce(ctx, serverType)
+		if ctx.Err() != nil {
+			s.setState(serverType, func(state *slaveState) {
+				state.State = slaveStateStopped
+				state.Pid = 0
+			})
+			return
+		}
+		if err == nil {
+			log.Info("slave exited cleanly, waiting for it to be started again", zap.Stringer("serverType", serverType))
+			s.setState(serverType, func(state *slaveState) {
+				state.State = slaveStateExited
+				state.Pid = 0
+				state.LastExit = "exited with status 0"
+			})
+			if !s.waitStarted(ctx, serverType) {
+				s.setState(serverType, func(state *slaveState) { state.State = slaveStateStopped })
+				return
+			}
+			delay = s.backoff.initial
+			continue
+		}
+		if time.Since(started) >= s.backoff.reset {
+			delay = s.backoff.initial
+		}
+		log.Warn("slave exited, restarting", zap.Stringer("serverType", serverType), zap.Duration("backoff", delay), zap.Error(err))
+		s.setState(serverType, func(state *slaveState) {
+			state.State = slaveStateBackoff
+			state.Pid = 0
+			state.LastExit = fmt.Sprint(err)
+		})
+
+		select {
+		case <-ctx.Done():
+			s.setState(serverType, func(state *slaveState) { state.State = slaveStateStopped })
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > s.backoff.max {
+			delay = s.backoff.max
+		}
+		s.setState(serverType, func(state *slaveState) {
+			state.State = slaveStateStarting
+			state.Restarts++
+		})
+	}
+}
+
+// waitStarted polls the pid file until the slave is started by somebody else, it returns false if ctx is done first
+func (s *supervisor) waitStarted(ctx context.Context, serverType ServerType) bool {
+	ticker := time.NewTicker(processPollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			if pid, err := readPidFile(pidFilePath(serverType)); err == nil && processAlive(pid) {
+				return true
+			}
+		}
+	}
+}
+
+// runOnce runs the slave until it exits or ctx is done, a slave already running, e.g. restarted by
+// update, is adopted instead of spawning a new one. It returns nil if the slave exits cleanly
+func (s *supervisor) runOnce(ctx context.Context, serverType ServerType) error {
+	if pid, err := readPidFile(pidFilePath(serverType)); err == nil && processAlive(pid) {
+		log.Info("adopt running slave", zap.Stringer("serverType", serverType), zap.Int("pid", pid))
+		s.setState(serverType, func(state *slaveState) {
+			state.State = slaveStateRunning
+			state.Pid = pid
+		})
+		return s.waitAdopted(ctx, serverType, pid)
+	}
+
+	out, err := log.NewFileWriter(&log.FileLogConfig{
+		RootPath:   s.logDir,
+		Filename:   serverType.String() + ".stdout.log",
+		MaxSize:    paramtable.Get().LogCfg.MaxSize.GetAsInt(),
+		MaxDays:    paramtable.Get().LogCfg.MaxAge.GetAsInt(),
+		MaxBackups: paramtable.Get().LogCfg.MaxBackups.GetAsInt(),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cmd := exec.Command(s.binary, append([]string{"run", serverType.String()}, s.flags...)...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// the slaves are stopped by the supervisor, not by the signals sent to the process group of master
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Info("slave started", zap.Stringer("serverType", serverType), zap.Int("pid", cmd.Process.Pid))
+	s.setState(serverType, func(state *slaveState) {
+		state.State = slaveStateRunning
+		state.Pid = cmd.Process.Pid
+	})
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		return err
+	case <-ctx.Done():
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(s.stopTimeout):
+			log.Warn("slave did not exit in time, killing it", zap.Stringer("serverType", serverType))
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+		return nil
+	}
+}
+
+// waitAdopted polls the adopted process until it exits, it is stopped as well when ctx is done. The exit status of
+// a process which is not a child is unknown, a clean exit is told by the removed pid file
+func (s *supervisor) waitAdopted(ctx context.Context, serverType ServerType, pid int) error {
+	ticker := time.NewTicker(processPollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			_ = syscall.Kill(pid, syscall.SIGTERM)
+			if !waitProcessExit(pid, s.stopTimeout) {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+			return nil
+		case <-ticker.C:
+			if !processAlive(pid) {
+				if p, err := readPidFile(pidFilePath(serverType)); err == nil && p == pid {
+					return fmt.Errorf("adopted process %d exited", pid)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+func (s *supervisor) setState(serverType ServerType, update func(state *slaveState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[serverType]
+	if !ok {
+		state = &slaveState{ServerType: serverType.String()}
+		s.states[serverType] = state
+	}
+	prev := state.State
+	update(state)
+	if state.State != prev {
+		state.Since = time.Now()
+	}
+	if err := s.saveStatesLocked(); err != nil {
+		log.Warn("failed to save supervisor state", zap.String("path", s.stateFile), zap.Error(err))
+	}
+}
+
+// States returns the states of the slaves in the order of the topology
+func (s *supervisor) States() []slaveState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]slaveState, 0, len(s.slaves))
+	for _, serverType := range s.slaves {
+		if state, ok := s.states[serverType]; ok {
+			ret = append(ret, *state)
+		}
+	}
+	return ret
+}
+
+func (s *supervisor) saveStatesLocked() error {
+	states := make([]slaveState, 0, len(s.slaves))
+	for _, serverType := range s.slaves {
+		if state, ok := s.states[serverType]; ok {
+			states = append(states, *state)
+		}
+	}
+	b, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	tmp := s.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.stateFile)
+}
+
+// loadSlaveStates reads the states saved by the supervisor of the local master
+func loadSlaveStates() ([]slaveState, error) {
+	b, err := os.ReadFile(filepath.Join(paramtable.Get().CommonCfg.DataDir.GetValue(), supervisorStateFile))
+	if err != nil {
+		return nil, err
+	}
+	var states []slaveState
+	if err := json.Unmarshal(b, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (s slaveState) String() string {
+	ret := fmt.Sprintf("%-8s %-8s", s.ServerType, s.State)
+	if s.Pid > 0 {
+		ret += fmt.Sprintf(" pid %d", s.Pid)
+	}
+	ret += fmt.Sprintf("  restarts %d  since %s", s.Restarts, s.Since.Format(time.RFC3339))
+	if len(s.LastExit) > 0 {
+		ret += "  last exit: " + s.LastExit
+	}
+	return ret
+}
@@ -0,0 +1,140 @@
+package master
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestSupervisor(t *testing.T, script string) (*supervisor, string) {
+	u, dataDir := newTestUpdater(t)
+	writeFakeServer(t, u.target, "old", script)
+	return &supervisor{
+		binary: u.target,
+		flags:  u.opts.flags(),
+		slaves: []ServerType{SLAVE_QUERY},
+		backoff: backoff{
+			initial: 50 * time.Millisecond,
+			max:     200 * time.Millisecond,
+			reset:   time.Minute,
+		},
+		stopTimeout: 5 * time.Second,
+		logDir:      filepath.Join(dataDir, "logs"),
+		stateFile:   filepath.Join(dataDir, supervisorStateFile),
+		states:      make(map[ServerType]*slaveState),
+	}, dataDir
+}
+
+func TestSupervisor_Restart(t *testing.T) {
+	s, dataDir := newTestSupervisor(t, "")
+	pidFile := filepath.Join(dataDir, "query.pid")
+	assert.NoError(t, s.Start())
+
+	assert.Eventually(t, func() bool {
+		pid, err := readPidFile(pidFile)
+		return err == nil && processAlive(pid)
+	}, 5*time.Second, 20*time.Millisecond)
+	pid, _ := readPidFile(pidFile)
+	states, err := loadSlaveStates()
+	assert.NoError(t, err)
+	assert.Equal(t, slaveStateRunning, states[0].State)
+	assert.Equal(t, pid, states[0].Pid)
+
+	// the crashed slave is restarted
+	assert.NoError(t, os.Remove(pidFile))
+	assert.NoError(t, syscall.Kill(pid, syscall.SIGKILL))
+	assert.Eventually(t, func() bool {
+		newPid, err := readPidFile(pidFile)
+		return err == nil && newPid != pid && processAlive(newPid)
+	}, 5*time.Second, 20*time.Millisecond)
+	states = s.States()
+	assert.Equal(t, 1, states[0].Restarts)
+	assert.NotEmpty(t, states[0].LastExit)
+
+	s.Stop()
+	newPid, err := readPidFile(pidFile)
+	assert.True(t, err != nil || !processAlive(newPid))
+	_, err = os.Stat(s.stateFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSupervisor_Backoff(t *testing.T) {
+	// the slave crashes right after it starts
+	s, _ := newTestSupervisor(t, "exit 1")
+	assert.NoError(t, s.Start())
+	time.Sleep(time.Second)
+	s.Stop()
+
+	states := s.States()
+	assert.Equal(t, slaveStateStopped, states[0].State)
+	// 50ms, 100ms, 200ms, 200ms... at most 7 restarts in a second
+	assert.Greater(t, states[0].Restarts, 2)
+	assert.Less(t, states[0].Restarts, 8)
+	assert.Equal(t, "exit status 1", states[0].LastExit)
+}
+
+func TestSupervisor_CleanExit(t *testing.T) {
+	s, dataDir := newTestSupervisor(t, "")
+	pidFile := filepath.Join(dataDir, "query.pid")
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+	assert.Eventually(t, func() bool {
+		pid, err := readPidFile(pidFile)
+		return err == nil && processAlive(pid)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// a slave stopped by the stop command is not restarted
+	pid, err := stopServer(pidFile, 5*time.Second, false)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return s.States()[0].State == slaveStateExited
+	}, 5*time.Second, 20*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	states := s.States()
+	assert.Equal(t, slaveStateExited, states[0].State)
+	assert.Equal(t, 0, states[0].Restarts)
+	_, err = readPidFile(pidFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// it is adopted once started again
+	u := &updater{opts: &serverOptions{dataDir: dataDir}, target: s.binary}
+	cmd, _, err := u.start(SLAVE_QUERY, u.target)
+	assert.NoError(t, err)
+	assert.NotEqual(t, pid, cmd.Process.Pid)
+	assert.Eventually(t, func() bool {
+		states := s.States()
+		return states[0].State == slaveStateRunning && states[0].Pid == cmd.Process.Pid
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestSupervisor_Adopt(t *testing.T) {
+	s, dataDir := newTestSupervisor(t, "")
+	// a slave started by update is adopted instead of spawning another one
+	u := &updater{
+		opts:          &serverOptions{dataDir: dataDir},
+		target:        s.binary,
+		stopTimeout:   5 * time.Second,
+		healthTimeout: 3 * time.Second,
+	}
+	cmd, exited, err := u.start(SLAVE_QUERY, u.target)
+	assert.NoError(t, err)
+	pid := cmd.Process.Pid
+	assert.Eventually(t, func() bool {
+		p, err := readPidFile(filepath.Join(dataDir, "query.pid"))
+		return err == nil && p == pid
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.NoError(t, s.Start())
+	assert.Eventually(t, func() bool {
+		states := s.States()
+		return len(states) == 1 && states[0].State == slaveStateRunning && states[0].Pid == pid
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// the adopted slave is stopped with the supervisor
+	s.Stop()
+	<-exited
+	assert.False(t, processAlive(pid))
+}
@@ -1,15 +1,311 @@
 package master
 
 import (
-	"flag"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/linkbase/cli"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
-var CMD_UPDATE = "update"
+const (
+	defaultUpdateStopTimeout   = 60 * time.Second
+	defaultUpdateHealthTimeout = 30 * time.Second
+	backupSuffix               = ".bak"
+	stagedSuffix               = ".new"
+	versionCheckTimeout        = 10 * time.Second
+)
+
+var (
+	updateBinaryFlag = cli.StringFlag{
+		Name:  "binary, b",
+		Usage: "path of the new linkbase binary",
+	}
+	updateTargetFlag = cli.StringFlag{
+		Name:  "target",
+		Usage: "path of the installed linkbase binary to replace, defaults to the running binary",
+	}
+	updateStopTimeoutFlag = cli.DurationFlag{
+		Name:  "stop-timeout",
+		Usage: "time to wait for a node to drain and exit before it is killed",
+		Value: defaultUpdateStopTimeout,
+	}
+	updateHealthTimeoutFlag = cli.DurationFlag{
+		Name:  "health-timeout",
+		Usage: "time to wait for a restarted node to become healthy before rolling back",
+		Value: defaultUpdateHealthTimeout,
+	}
+)
+
+var updateCommand = cli.Command{
+	Name:  "update",
+	Usage: "rolling upgrade the linkbase servers on this machine to a new binary",
+	Description: `update stages the new binary next to the installed one, then restarts the given servers one at a time:
+   the node is stopped gracefully after draining its task queues, started with the staged binary and health checked.
+   The installed binary is replaced only once a node is healthy with the new one. If a node fails, it is restarted
+   with the old binary and the update stops, the nodes updated before it keep running the new one.
+   Without server types all the running servers are updated.`,
+	ArgsUsage:    "[" + serverTypeArgsUsage + "...]",
+	Flags:        []cli.Flag{updateBinaryFlag, updateTargetFlag, configFlag, dataDirFlag, logLevelFlag, updateStopTimeoutFlag, updateHealthTimeoutFlag},
+	BashComplete: completeServerType,
+	Action: exitOnError(func(c *cli.Context) error {
+		u, err := newUpdater(c)
+		if err != nil {
+			return err
+		}
+		types := make([]ServerType, 0, len(c.Args()))
+		for _, arg := range c.Args() {
+			serverType, err := ParseServerType(arg)
+			if err != nil {
+				return err
+			}
+			types = append(types, serverType)
+		}
+		if len(types) == 0 {
+			types = runningServers()
+		}
+		if len(types) == 0 {
+			return errors.New("no running server to update")
+		}
+		return u.update(types)
+	}),
+}
+
+// updater rolls the local servers to a new binary one at a time
+type updater struct {
+	opts          *serverOptions
+	binary        string
+	target        string
+	stopTimeout   time.Duration
+	healthTimeout time.Duration
+	out           io.Writer
+}
+
+func newUpdater(c *cli.Context) (*updater, error) {
+	binary := c.String("binary")
+	if len(binary) == 0 {
+		return nil, errors.New("the new binary is required, see --binary")
+	}
+	target := c.String("target")
+	if len(target) == 0 {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		target = exe
+	}
+	opts := &serverOptions{
+		configFile: c.String("config"),
+		dataDir:    c.String("data-dir"),
+		logLevel:   c.String("log-level"),
+	}
+	if err := opts.initParams(); err != nil {
+		return nil, err
+	}
+	return &updater{
+		opts:          opts,
+		binary:        binary,
+		target:        target,
+		stopTimeout:   c.Duration("stop-timeout"),
+		healthTimeout: c.Duration("health-timeout"),
+		out:           c.App.Writer,
+	}, nil
+}
+
+// update restarts the servers in order with the new binary, which is installed once the first of them is healthy.
+// A failed server is rolled back alone, the servers updated before it keep the new binary
+func (u *updater) update(types []ServerType) error {
+	version, err := binaryVersion(u.binary)
+	if err != nil {
+		return fmt.Errorf("invalid binary %s: %w", u.binary, err)
+	}
+	fmt.Fprintf(u.out, "updating %s to %s\n", u.target, version)
+
+	if err := copyFile(u.binary, u.stagedPath()); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", u.binary, err)
+	}
+	installed := false
+	defer func() {
+		if !installed {
+			os.Remove(u.stagedPath())
+		}
+	}()
+
+	for _, serverType := range types {
+		// the installed binary is only launched once a node proved the new one healthy, so nothing else
+		// started from it meanwhile, such as a respawn by the supervisor, runs an unverified build
+		binary, old := u.stagedPath(), u.target
+		if installed {
+			binary, old = u.target, u.backupPath()
+		}
+		fmt.Fprintf(u.out, "restarting %s\n", serverType)
+		if err := u.restart(serverType, binary); err != nil {
+			fmt.Fprintf(u.out, "%s failed to update: %v, restarting it with the old binary\n", serverType, err)
+			if rbErr := u.restart(serverType, old); rbErr != nil {
+				return fmt.Errorf("update %s failed: %v, rollback failed: %w", serverType, err, rbErr)
+			}
+			return fmt.Errorf("update %s failed and was rolled back: %w", serverType, err)
+		}
+		if !installed {
+			if err := u.install(); err != nil {
+				return err
+			}
+			installed = true
+		}
+		fmt.Fprintf(u.out, "%s updated\n", serverType)
+	}
+	return nil
+}
+
+func (u *updater) backupPath() string {
+	return u.target + backupSuffix
+}
 
-type update struct {
+func (u *updater) stagedPath() string {
+	return u.target + stagedSuffix
 }
 
-func (u update) execute(args []string, flags *flag.FlagSet) {
-	//TODO implement me
-	panic("implement me")
+// install backups the installed binary and renames the staged one over it. The processes started from the staged
+// binary see the installed path as their executable afterwards, so their supervisors respawn the new binary
+func (u *updater) install() error {
+	if err := copyFile(u.target, u.backupPath()); err != nil {
+		return fmt.Errorf("failed to backup %s: %w", u.target, err)
+	}
+	if err := os.Rename(u.stagedPath(), u.target); err != nil {
+		return fmt.Errorf("failed to install %s: %w", u.binary, err)
+	}
+	return nil
+}
+
+// restart stops the server if it is running, starts it with the binary and waits for it to be healthy
+func (u *updater) restart(serverType ServerType, binary string) error {
+	pidFile := pidFilePath(serverType)
+	if pid, err := readPidFile(pidFile); err == nil && processAlive(pid) {
+		if _, err := stopServer(pidFile, u.stopTimeout, true); err != nil {
+			return err
+		}
+	}
+
+	cmd, exited, err := u.start(serverType, binary)
+	if err != nil {
+		return err
+	}
+	if err := u.waitHealthy(serverType, cmd.Process.Pid, exited); err != nil {
+		select {
+		case <-exited:
+		default:
+			_ = syscall.Kill(cmd.Process.Pid, syscall.SIGKILL)
+			<-exited
+		}
+		return err
+	}
+	return nil
+}
+
+// start launches the server from the binary in a new session, its output is appended to <type>.out in the data dir
+func (u *updater) start(serverType ServerType, binary string) (*exec.Cmd, chan struct{}, error) {
+	args := append([]string{"run", serverType.String()}, u.opts.flags()...)
+
+	outPath := strings.TrimSuffix(pidFilePath(serverType), ".pid") + ".out"
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer out.Close()
+
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	return cmd, exited, nil
+}
+
+// waitHealthy waits until the started process writes its pid file and serves the grpc health check
+func (u *updater) waitHealthy(serverType ServerType, pid int, exited <-chan struct{}) error {
+	deadline := time.Now().Add(u.healthTimeout)
+	ticker := time.NewTicker(processPollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return fmt.Errorf("%s exited before it became healthy", serverType)
+		case <-ticker.C:
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is not healthy in %s", serverType, u.healthTimeout)
+		}
+		if p, err := readPidFile(pidFilePath(serverType)); err != nil || p != pid {
+			continue
+		}
+		address := grpcAddress(serverType)
+		if len(address) == 0 || checkHealth(address, time.Until(deadline)) == "SERVING" {
+			return nil
+		}
+	}
+}
+
+// runningServers returns the server types with a live process on this machine
+func runningServers() []ServerType {
+	var ret []ServerType
+	for _, serverType := range serverTypes {
+		if pid, err := readPidFile(pidFilePath(serverType)); err == nil && processAlive(pid) {
+			ret = append(ret, serverType)
+		}
+	}
+	return ret
+}
+
+// binaryVersion runs the binary with --version, which also verifies it is executable
+func binaryVersion(binary string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), versionCheckTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, binary, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// copyFile copies src to a temp file next to dst and renames it, so dst is replaced atomically
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
 }
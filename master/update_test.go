@@ -0,0 +1,144 @@
+package master
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/linkbase/utils/paramtable"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeServerScript mocks a linkbase binary, "run master --data-dir <dir>" writes the pid file and sleeps
+const fakeServerScript = `#!/bin/sh
+if [ "$1" = "--version" ]; then
+  echo "linkbase version %s"
+  exit 0
+fi
+%s
+echo $$ > "$4/$2.pid"
+trap 'rm -f "$4/$2.pid"; exit 0' TERM
+while true; do sleep 0.05; done
+`
+
+func writeFakeServer(t *testing.T, path, version, prelude string) {
+	assert.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(fakeServerScript, version, prelude)), 0755))
+}
+
+func newTestUpdater(t *testing.T) (*updater, string) {
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	opts := &serverOptions{dataDir: dataDir}
+	assert.NoError(t, opts.initParams())
+	t.Cleanup(func() {
+		paramtable.Get().Reset(paramtable.Get().CommonCfg.DataDir.Key)
+		paramtable.Get().Reset(paramtable.Get().RocksmqCfg.Path.Key)
+		paramtable.Get().Reset(paramtable.Get().EtcdCfg.DataDir.Key)
+	})
+	assert.NoError(t, os.MkdirAll(dataDir, os.ModePerm))
+	return &updater{
+		opts:          opts,
+		binary:        filepath.Join(dir, "linkbase-new"),
+		target:        filepath.Join(dir, "linkbase"),
+		stopTimeout:   5 * time.Second,
+		healthTimeout: 3 * time.Second,
+		out:           &bytes.Buffer{},
+	}, dataDir
+}
+
+func TestUpdater_Update(t *testing.T) {
+	u, dataDir := newTestUpdater(t)
+	writeFakeServer(t, u.target, "old", "")
+	// the new binary records the path it is launched from
+	writeFakeServer(t, u.binary, "new", `echo "$0" > "$4/$2.exe"`)
+
+	// start the old server, then update it
+	assert.NoError(t, u.restart(MASTER, u.target))
+	oldPid, err := readPidFile(filepath.Join(dataDir, "master.pid"))
+	assert.NoError(t, err)
+	assert.Equal(t, []ServerType{MASTER}, runningServers())
+
+	assert.NoError(t, u.update([]ServerType{MASTER}))
+	newPid, err := readPidFile(filepath.Join(dataDir, "master.pid"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, oldPid, newPid)
+	assert.False(t, processAlive(oldPid))
+	version, err := binaryVersion(u.target)
+	assert.NoError(t, err)
+	assert.Equal(t, "linkbase version new", version)
+	// the node was started from the staged binary, which was installed after it became healthy
+	exe, err := os.ReadFile(filepath.Join(dataDir, "master.exe"))
+	assert.NoError(t, err)
+	assert.Equal(t, u.stagedPath()+"\n", string(exe))
+	_, err = os.Stat(u.stagedPath())
+	assert.True(t, os.IsNotExist(err))
+	version, err = binaryVersion(u.backupPath())
+	assert.NoError(t, err)
+	assert.Equal(t, "linkbase version old", version)
+
+	_, err = stopServer(filepath.Join(dataDir, "master.pid"), 5*time.Second, true)
+	assert.NoError(t, err)
+}
+
+func TestUpdater_Rollback(t *testing.T) {
+	u, dataDir := newTestUpdater(t)
+	writeFakeServer(t, u.target, "old", "")
+	// the new binary exits before it is healthy
+	writeFakeServer(t, u.binary, "broken", "exit 1")
+
+	assert.NoError(t, u.restart(MASTER, u.target))
+	oldPid, err := readPidFile(filepath.Join(dataDir, "master.pid"))
+	assert.NoError(t, err)
+
+	err = u.update([]ServerType{MASTER})
+	assert.Error(t, err)
+
+	// the old binary was never replaced and is running again
+	version, err := binaryVersion(u.target)
+	assert.NoError(t, err)
+	assert.Equal(t, "linkbase version old", version)
+	_, err = os.Stat(u.stagedPath())
+	assert.True(t, os.IsNotExist(err))
+	pid, err := readPidFile(filepath.Join(dataDir, "master.pid"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, oldPid, pid)
+	assert.True(t, processAlive(pid))
+
+	_, err = stopServer(filepath.Join(dataDir, "master.pid"), 5*time.Second, true)
+	assert.NoError(t, err)
+}
+
+func TestUpdater_PartialFailure(t *testing.T) {
+	u, dataDir := newTestUpdater(t)
+	params := paramtable.Get()
+	params.Save(params.QueryCfg.GRPCAddress.Key, "")
+	defer params.Reset(params.QueryCfg.GRPCAddress.Key)
+	writeFakeServer(t, u.target, "old", "")
+	// the new binary runs as master but fails as query
+	writeFakeServer(t, u.binary, "new", `[ "$2" = "query" ] && exit 1`)
+
+	assert.NoError(t, u.restart(MASTER, u.target))
+	assert.NoError(t, u.restart(SLAVE_QUERY, u.target))
+	queryPid, err := readPidFile(filepath.Join(dataDir, "query.pid"))
+	assert.NoError(t, err)
+
+	err = u.update([]ServerType{MASTER, SLAVE_QUERY})
+	assert.Error(t, err)
+
+	// master keeps the new binary, only query is rolled back to the old one
+	version, err := binaryVersion(u.target)
+	assert.NoError(t, err)
+	assert.Equal(t, "linkbase version new", version)
+	pid, err := readPidFile(filepath.Join(dataDir, "query.pid"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, queryPid, pid)
+	assert.True(t, processAlive(pid))
+	assert.Equal(t, []ServerType{MASTER, SLAVE_QUERY}, runningServers())
+
+	for _, serverType := range []ServerType{MASTER, SLAVE_QUERY} {
+		_, err = stopServer(pidFilePath(serverType), 5*time.Second, true)
+		assert.NoError(t, err)
+	}
+}
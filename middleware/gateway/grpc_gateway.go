@@ -21,6 +21,8 @@ type Options struct {
 	GRPCServer Endpoint
 	OpenAPIDir string
 	Mux        []gwruntime.ServeMuxOption
+	// Listener is served instead of listening on Addr if it is set, so that the caller sees the listen errors
+	Listener net.Listener
 }
 
 func Run(ctx context.Context, opts Options) error {
@@ -29,6 +31,9 @@ func Run(ctx context.Context, opts Options) error {
 
 	conn, err := dial(ctx, opts.GRPCServer.Network, opts.GRPCServer.Addr)
 	if err != nil {
+		if opts.Listener != nil {
+			opts.Listener.Close()
+		}
 		return err
 	}
 
@@ -41,7 +46,29 @@ func Run(ctx context.Context, opts Options) error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/openapiv2/", openAPIServer(opts.OpenAPIDir))
+	mux.HandleFunc("/healthz", healthzServer(conn))
+
+	s := &http.Server{
+		Addr:    opts.Addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		log.Info("Shutting down the http server")
+		if err := s.Shutdown(context.Background()); err != nil {
+			log.Error("Failed to shutdown http server", zap.Error(err))
+		}
+	}()
 
+	serve := s.ListenAndServe
+	if opts.Listener != nil {
+		serve = func() error { return s.Serve(opts.Listener) }
+	}
+	log.Info("Starting listening", zap.String("addr", opts.Addr))
+	if err := serve(); err != http.ErrServerClosed {
+		log.Error("Failed to listen and serve", zap.Error(err))
+		return err
+	}
 	return nil
 }
 
@@ -1,9 +1,40 @@
 package gateway
 
-import "net/http"
+import (
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"net/http"
+	"path"
+	"strings"
+)
 
+// openAPIServer returns OpenAPI specification files located under "/openapiv2/"
 func openAPIServer(dir string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".swagger.json") {
+			log.Warn("Not Found", zap.String("path", r.URL.Path))
+			http.NotFound(w, r)
+			return
+		}
 
+		p := strings.TrimPrefix(r.URL.Path, "/openapiv2/")
+		p = path.Join(dir, path.Clean("/"+p))
+		http.ServeFile(w, r, p)
+	}
+}
+
+// healthzServer returns a simple health handler which returns ok when the grpc server is connected
+func healthzServer(conn *grpc.ClientConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if s := conn.GetState(); s != connectivity.Ready {
+			conn.Connect()
+			http.Error(w, fmt.Sprintf("grpc server is %s", s), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintln(w, "ok")
 	}
 }
@@ -122,6 +122,12 @@ type CachedGenerator struct {
 	Role          string
 }
 
+// Init initializes the request channels, it must be called before Start.
+func (cg *CachedGenerator) Init() {
+	cg.ForceSyncChan = make(chan Request, maxConcurrentRequest)
+	cg.Reqs = make(chan Request, maxConcurrentRequest)
+}
+
 // Start starts the loop of checking whether to synchronize with the global allocator.
 func (cg *CachedGenerator) Start() error {
 	cg.TChan.Init()
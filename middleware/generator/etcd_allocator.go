@@ -0,0 +1,70 @@
+package generator
+
+import (
+	"context"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+var _ RemoteAllocator = (*EtcdAllocator)(nil)
+
+// EtcdAllocator persists the id high-water mark in etcd and allocates ranges with a
+// compare-and-swap on the key, so it is safe to share by multiple processes.
+type EtcdAllocator struct {
+	client *clientv3.Client
+	key    string
+}
+
+// NewEtcdAllocator creates an EtcdAllocator which saves its high-water mark under key,
+// client can be a remote etcd client or the one of the embedded etcd from utils/etcd
+func NewEtcdAllocator(client *clientv3.Client, key string) *EtcdAllocator {
+	return &EtcdAllocator{
+		client: client,
+		key:    key,
+	}
+}
+
+// AllocID allocates count ids after the current high-water mark
+func (ea *EtcdAllocator) AllocID(ctx context.Context, count uint32) (UniqueID, uint32, error) {
+	if count == 0 {
+		return 0, 0, fmt.Errorf("id count should be positive")
+	}
+	for {
+		resp, err := ea.client.Get(ctx, ea.key)
+		if err != nil {
+			return 0, 0, err
+		}
+		var start UniqueID
+		var cmp clientv3.Cmp
+		if len(resp.Kvs) == 0 {
+			cmp = clientv3.Compare(clientv3.CreateRevision(ea.key), "=", 0)
+		} else {
+			start, err = strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid id high-water mark %s=%s: %w", ea.key, resp.Kvs[0].Value, err)
+			}
+			cmp = clientv3.Compare(clientv3.ModRevision(ea.key), "=", resp.Kvs[0].ModRevision)
+		}
+		if base := timeBasedID(time.Now()); start < base {
+			start = base
+		}
+		end := start + UniqueID(count)
+
+		txnResp, err := ea.client.Txn(ctx).If(cmp).Then(clientv3.OpPut(ea.key, strconv.FormatInt(end, 10))).Commit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if txnResp.Succeeded {
+			return start, count, nil
+		}
+		// another process moved the high-water mark, try again
+		log.Debug("EtcdAllocator lost the race, retry", zap.String("key", ea.key))
+		if err := ctx.Err(); err != nil {
+			return 0, 0, err
+		}
+	}
+}
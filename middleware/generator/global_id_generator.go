@@ -0,0 +1,126 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/kv"
+	"github.com/linkbase/middleware/log"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// physicalShiftBits is the number of bits reserved below the physical milliseconds
+	// when an id base is derived from the wall clock
+	physicalShiftBits = 18
+
+	// defaultLeaseSize is the number of ids reserved by one write of the high-water mark
+	defaultLeaseSize = 100000
+)
+
+var _ Generator = (*GlobalIDGenerator)(nil)
+
+// GlobalIDGenerator allocates ids from a high-water mark persisted in a kv.BaseKV, it needs
+// no external service and fits single node deployments.
+// The high-water mark is leased ahead: it is saved as the end of a window of leaseSize ids
+// before any id of the window is handed out, and ids are served from memory afterwards.
+// A restart, clean or not, continues from the saved mark, so an id is never reissued and at
+// most one window is skipped. Crash safety is as good as the durability of base, FileKV
+// fsyncs every write.
+type GlobalIDGenerator struct {
+	mu        sync.Mutex
+	key       string
+	kv        kv.BaseKV
+	leaseSize UniqueID
+
+	// next is the first id not handed out yet
+	next UniqueID
+	// leaseEnd is the persisted high-water mark, ids in [next, leaseEnd) can be handed out
+	leaseEnd UniqueID
+}
+
+// NewGlobalIDGenerator creates a GlobalIDGenerator which saves its high-water mark under key
+func NewGlobalIDGenerator(key string, base kv.BaseKV) *GlobalIDGenerator {
+	return &GlobalIDGenerator{
+		key:       key,
+		kv:        base,
+		leaseSize: defaultLeaseSize,
+	}
+}
+
+// Initialize loads the persisted high-water mark. A fresh generator starts from a base
+// derived from the current time, which keeps the decimal form of the ids at a fixed width
+// so that they sort the same way as strings and as numbers.
+func (gg *GlobalIDGenerator) Initialize() error {
+	gg.mu.Lock()
+	defer gg.mu.Unlock()
+	mark, err := loadHighWaterMark(gg.kv, gg.key)
+	if err != nil {
+		return err
+	}
+	next := mark
+	if base := timeBasedID(time.Now()); next < base {
+		next = base
+	}
+	gg.next = next
+	// nothing is leased until the first allocation
+	gg.leaseEnd = next
+	log.Info("GlobalIDGenerator initialized", zap.String("key", gg.key),
+		zap.Int64("highWaterMark", mark), zap.Int64("next", next))
+	return nil
+}
+
+// Gen allocates count ids, returns the range [start, end)
+func (gg *GlobalIDGenerator) Gen(count uint32) (UniqueID, UniqueID, error) {
+	if count == 0 {
+		return 0, 0, errors.New("id count should be positive")
+	}
+	gg.mu.Lock()
+	defer gg.mu.Unlock()
+	if gg.next == 0 {
+		return 0, 0, errors.New("GlobalIDGenerator is not initialized")
+	}
+	start := gg.next
+	end := start + UniqueID(count)
+	if end > gg.leaseEnd {
+		leaseEnd := start + gg.leaseSize
+		if leaseEnd < end {
+			leaseEnd = end
+		}
+		// persist the new window before handing out any id of it
+		if err := gg.kv.Save(gg.key, strconv.FormatInt(leaseEnd, 10)); err != nil {
+			return 0, 0, err
+		}
+		gg.leaseEnd = leaseEnd
+	}
+	gg.next = end
+	return start, end, nil
+}
+
+// GenOne allocates one id
+func (gg *GlobalIDGenerator) GenOne() (UniqueID, error) {
+	start, _, err := gg.Gen(1)
+	return start, err
+}
+
+func loadHighWaterMark(base kv.BaseKV, key string) (UniqueID, error) {
+	exist, err := base.Has(key)
+	if err != nil || !exist {
+		return 0, err
+	}
+	val, err := base.Load(key)
+	if err != nil {
+		return 0, err
+	}
+	mark, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id high-water mark %s=%s: %w", key, val, err)
+	}
+	return mark, nil
+}
+
+func timeBasedID(t time.Time) UniqueID {
+	return t.UnixMilli() << physicalShiftBits
+}
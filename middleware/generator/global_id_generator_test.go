@@ -0,0 +1,61 @@
+package generator
+
+import (
+	filekv "github.com/linkbase/middleware/kv/file"
+	memkv "github.com/linkbase/middleware/kv/mem"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"testing"
+)
+
+func TestGlobalIDGenerator_Gen(t *testing.T) {
+	base := memkv.NewMemoryKV()
+	g := NewGlobalIDGenerator("test_id", base)
+	g.leaseSize = 10
+
+	_, _, err := g.Gen(1)
+	assert.Error(t, err)
+	assert.NoError(t, g.Initialize())
+
+	_, _, err = g.Gen(0)
+	assert.Error(t, err)
+
+	start, end, err := g.Gen(3)
+	assert.NoError(t, err)
+	assert.Equal(t, UniqueID(3), end-start)
+
+	// the whole window is persisted ahead
+	mark, err := loadHighWaterMark(base, "test_id")
+	assert.NoError(t, err)
+	assert.Equal(t, start+10, mark)
+
+	// a request larger than the window extends the lease to cover it
+	start, end, err = g.Gen(20)
+	assert.NoError(t, err)
+	mark, err = loadHighWaterMark(base, "test_id")
+	assert.NoError(t, err)
+	assert.Equal(t, end, mark)
+}
+
+func TestGlobalIDGenerator_Crash(t *testing.T) {
+	name := path.Join(t.TempDir(), "id.json")
+	base, err := filekv.NewFileKV(name)
+	assert.NoError(t, err)
+	g := NewGlobalIDGenerator("rmq_id", base)
+	assert.NoError(t, g.Initialize())
+
+	var last UniqueID
+	for i := 0; i < 100; i++ {
+		last, err = g.GenOne()
+		assert.NoError(t, err)
+	}
+
+	// simulate an unclean shutdown: reopen the kv without closing anything
+	base, err = filekv.NewFileKV(name)
+	assert.NoError(t, err)
+	g = NewGlobalIDGenerator("rmq_id", base)
+	assert.NoError(t, g.Initialize())
+	next, err := g.GenOne()
+	assert.NoError(t, err)
+	assert.Greater(t, next, last)
+}
@@ -2,10 +2,23 @@ package generator
 
 import (
 	"context"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"go.uber.org/zap"
+	"time"
 )
 
+const (
+	idCountPerRPC = 200000
+	syncTimeout   = 5 * time.Second
+)
+
+var _ Generator = (*IDGenerator)(nil)
+
+// IDGenerator caches id ranges allocated by a RemoteAllocator and serves requests from the cache
 type IDGenerator struct {
 	CachedGenerator
+	remote      RemoteAllocator
 	countPerRPC uint32
 
 	idStart UniqueID
@@ -14,7 +27,7 @@ type IDGenerator struct {
 	PeerID UniqueID
 }
 
-func NewIDGenerator(ctx context.Context, peerID UniqueID) (*IDGenerator, error) {
+func NewIDGenerator(ctx context.Context, remote RemoteAllocator, peerID UniqueID) (*IDGenerator, error) {
 	ctx1, cancel := context.WithCancel(ctx)
 	g := &IDGenerator{
 		CachedGenerator: CachedGenerator{
@@ -22,24 +35,64 @@ func NewIDGenerator(ctx context.Context, peerID UniqueID) (*IDGenerator, error)
 			CancelFunc: cancel,
 			Role:       "IDGenerator",
 		},
-		countPerRPC: 200000,
+		remote:      remote,
+		countPerRPC: idCountPerRPC,
 		PeerID:      peerID,
 	}
 	g.TChan = &EmptyTicker{}
 	g.CachedGenerator.SyncFunc = g.syncID
-	//todo
+	g.CachedGenerator.ProcessFunc = g.processFunc
+	g.CachedGenerator.CheckSyncFunc = g.checkSyncFunc
+	g.CachedGenerator.PickCanDoFunc = g.pickCanDoFunc
+	g.Init()
 	return g, nil
 }
 
+func (idg *IDGenerator) checkSyncFunc(timeout bool) bool {
+	return timeout || len(idg.ToDoReqs) > 0
+}
+
+func (idg *IDGenerator) pickCanDoFunc() {
+	total := uint32(idg.idEnd - idg.idStart)
+	need := uint32(0)
+	idx := 0
+	for _, req := range idg.ToDoReqs {
+		tReq := req.(*IDRequest)
+		need += tReq.count
+		if need > total {
+			break
+		}
+		idg.CanDoReqs = append(idg.CanDoReqs, req)
+		idx++
+	}
+	idg.ToDoReqs = idg.ToDoReqs[idx:]
+}
+
 func (idg *IDGenerator) syncID() (bool, error) {
 	need := idg.gatherReqIDCount()
 	if need < idg.countPerRPC {
 		need = idg.countPerRPC
 	}
-	//todo
+	ctx, cancel := context.WithTimeout(idg.Ctx, syncTimeout)
+	defer cancel()
+	start, count, err := idg.remote.AllocID(ctx, need)
+	if err != nil {
+		return false, fmt.Errorf("syncID failed: %w", err)
+	}
+	idg.idStart = start
+	idg.idEnd = start + UniqueID(count)
+	log.Debug("IDGenerator sync id", zap.Int64("peerID", idg.PeerID),
+		zap.Int64("idStart", idg.idStart), zap.Int64("idEnd", idg.idEnd))
 	return true, nil
 }
 
+func (idg *IDGenerator) processFunc(req Request) error {
+	tReq := req.(*IDRequest)
+	tReq.id = idg.idStart
+	idg.idStart += UniqueID(tReq.count)
+	return nil
+}
+
 func (idg *IDGenerator) gatherReqIDCount() uint32 {
 	need := uint32(0)
 	for _, req := range idg.ToDoReqs {
@@ -49,12 +102,19 @@ func (idg *IDGenerator) gatherReqIDCount() uint32 {
 	return need
 }
 
+// Gen allocates count ids, returns the range [start, end)
 func (idg *IDGenerator) Gen(count uint32) (UniqueID, UniqueID, error) {
-	//TODO implement me
-	panic("implement me")
+	req := &IDRequest{BaseRequest: BaseRequest{Done: make(chan error), Valid: false}}
+	req.count = count
+	idg.Reqs <- req
+	if err := req.Wait(); err != nil {
+		return 0, 0, err
+	}
+	return req.id, req.id + UniqueID(req.count), nil
 }
 
+// GenOne allocates one id
 func (idg *IDGenerator) GenOne() (UniqueID, error) {
-	//TODO implement me
-	panic("implement me")
+	start, _, err := idg.Gen(1)
+	return start, err
 }
@@ -0,0 +1,89 @@
+package generator
+
+import (
+	"context"
+	"github.com/linkbase/utils/etcd"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"os"
+	"sync"
+	"testing"
+)
+
+func newTestEtcdClient(t *testing.T) *clientv3.Client {
+	server, dir, err := etcd.StartTestEmbedEtcdServer()
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+	client, err := etcd.GetRemoteEtcdClient(etcd.GetEmbedEtcdEndpoints(server))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+func TestIDGenerator_Gen(t *testing.T) {
+	client := newTestEtcdClient(t)
+	ctx := context.Background()
+
+	g, err := NewIDGenerator(ctx, NewEtcdAllocator(client, "test/id"), 1)
+	assert.NoError(t, err)
+	assert.NoError(t, g.Start())
+
+	start, end, err := g.Gen(100)
+	assert.NoError(t, err)
+	assert.Equal(t, UniqueID(100), end-start)
+
+	one, err := g.GenOne()
+	assert.NoError(t, err)
+	assert.Equal(t, end, one)
+
+	// a request larger than one batch triggers a bigger sync
+	start, end, err = g.Gen(idCountPerRPC + 1)
+	assert.NoError(t, err)
+	assert.Equal(t, UniqueID(idCountPerRPC+1), end-start)
+	assert.Greater(t, start, one)
+	g.Close()
+
+	// a restarted generator never reissues ids handed out before
+	g, err = NewIDGenerator(ctx, NewEtcdAllocator(client, "test/id"), 1)
+	assert.NoError(t, err)
+	assert.NoError(t, g.Start())
+	defer g.Close()
+	next, err := g.GenOne()
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, next, end)
+}
+
+func TestIDGenerator_MultiPeers(t *testing.T) {
+	client := newTestEtcdClient(t)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	ids := make(map[UniqueID]struct{})
+	wg := sync.WaitGroup{}
+	for peer := 0; peer < 4; peer++ {
+		g, err := NewIDGenerator(ctx, NewEtcdAllocator(client, "test/multi"), UniqueID(peer))
+		assert.NoError(t, err)
+		g.countPerRPC = 10
+		assert.NoError(t, g.Start())
+		defer g.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id, err := g.GenOne()
+				assert.NoError(t, err)
+				mu.Lock()
+				ids[id] = struct{}{}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, ids, 400)
+}
@@ -1 +1,9 @@
 package generator
+
+import "context"
+
+// RemoteAllocator hands out continuous id ranges from a source shared by all processes.
+// AllocID returns the first id of the range and the number of ids in it.
+type RemoteAllocator interface {
+	AllocID(ctx context.Context, count uint32) (UniqueID, uint32, error)
+}
@@ -0,0 +1,200 @@
+package filekv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/kv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var _ kv.BaseKV = (*FileKV)(nil)
+
+// FileKV implements BaseKV on top of a single json file. Every mutation rewrites the
+// whole file through a fsynced temp file and a rename, so a value is durable once the
+// call returns, even if the process or the host crashes right after.
+// It is meant for a handful of small metadata, e.g. id high-water marks.
+type FileKV struct {
+	sync.RWMutex
+	path string
+	data map[string]string
+}
+
+// NewFileKV opens the kv stored at path, the file is created on the first write
+func NewFileKV(path string) (*FileKV, error) {
+	if path == "" {
+		return nil, errors.New("path cannot be empty")
+	}
+	data := make(map[string]string)
+	bs, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, &data); err != nil {
+			return nil, fmt.Errorf("file kv %s is corrupted: %w", path, err)
+		}
+	}
+	return &FileKV{
+		path: path,
+		data: data,
+	}, nil
+}
+
+// Load returns the value of key, or an empty string if the key does not exist
+func (kv *FileKV) Load(key string) (string, error) {
+	kv.RLock()
+	defer kv.RUnlock()
+	return kv.data[key], nil
+}
+
+func (kv *FileKV) MultiLoad(keys []string) ([]string, error) {
+	kv.RLock()
+	defer kv.RUnlock()
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, kv.data[key])
+	}
+	return values, nil
+}
+
+// LoadWithPrefix returns all keys & values with given prefix in key order
+func (kv *FileKV) LoadWithPrefix(prefix string) ([]string, []string, error) {
+	kv.RLock()
+	defer kv.RUnlock()
+	keys := kv.keysWithPrefix(prefix)
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, kv.data[key])
+	}
+	return keys, values, nil
+}
+
+func (kv *FileKV) Save(key, value string) error {
+	return kv.MultiSave(map[string]string{key: value})
+}
+
+func (kv *FileKV) MultiSave(kvs map[string]string) error {
+	for key := range kvs {
+		if key == "" {
+			return errors.New("file kv does not support empty key")
+		}
+	}
+	return kv.mutate(func(data map[string]string) {
+		for key, value := range kvs {
+			data[key] = value
+		}
+	})
+}
+
+func (kv *FileKV) Remove(key string) error {
+	return kv.MultiRemove([]string{key})
+}
+
+func (kv *FileKV) MultiRemove(keys []string) error {
+	return kv.mutate(func(data map[string]string) {
+		for _, key := range keys {
+			delete(data, key)
+		}
+	})
+}
+
+func (kv *FileKV) RemoveWithPrefix(prefix string) error {
+	return kv.mutate(func(data map[string]string) {
+		for key := range data {
+			if strings.HasPrefix(key, prefix) {
+				delete(data, key)
+			}
+		}
+	})
+}
+
+func (kv *FileKV) Has(key string) (bool, error) {
+	kv.RLock()
+	defer kv.RUnlock()
+	_, ok := kv.data[key]
+	return ok, nil
+}
+
+func (kv *FileKV) HasPrefix(prefix string) (bool, error) {
+	kv.RLock()
+	defer kv.RUnlock()
+	for key := range kv.data {
+		if strings.HasPrefix(key, prefix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Close does nothing, every mutation is already persisted
+func (kv *FileKV) Close() {
+}
+
+func (kv *FileKV) keysWithPrefix(prefix string) []string {
+	var keys []string
+	for key := range kv.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mutate applies fn on a copy of the data and only swaps it in after it is persisted
+func (kv *FileKV) mutate(fn func(data map[string]string)) error {
+	kv.Lock()
+	defer kv.Unlock()
+	data := make(map[string]string, len(kv.data))
+	for key, value := range kv.data {
+		data[key] = value
+	}
+	fn(data)
+	if err := kv.persist(data); err != nil {
+		return err
+	}
+	kv.data = data
+	return nil
+}
+
+func (kv *FileKV) persist(data map[string]string) error {
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(kv.path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(kv.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), kv.path); err != nil {
+		return err
+	}
+	// fsync the directory so that the rename itself is durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
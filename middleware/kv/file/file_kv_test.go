@@ -0,0 +1,44 @@
+package filekv
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path"
+	"testing"
+)
+
+func TestFileKV(t *testing.T) {
+	name := path.Join(t.TempDir(), "meta.json")
+	kv, err := NewFileKV(name)
+	assert.NoError(t, err)
+
+	val, err := kv.Load("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "", val)
+
+	assert.NoError(t, kv.Save("a", "1"))
+	assert.NoError(t, kv.MultiSave(map[string]string{"p/1": "x", "p/2": "y", "q": "z"}))
+	assert.Error(t, kv.Save("", "1"))
+
+	keys, values, err := kv.LoadWithPrefix("p/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"p/1", "p/2"}, keys)
+	assert.Equal(t, []string{"x", "y"}, values)
+
+	has, err := kv.HasPrefix("p/")
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	assert.NoError(t, kv.RemoveWithPrefix("p/"))
+	assert.NoError(t, kv.Remove("q"))
+	kv.Close()
+
+	// reopen and check the data is persisted
+	kv, err = NewFileKV(name)
+	assert.NoError(t, err)
+	values, err = kv.MultiLoad([]string{"a", "q"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", ""}, values)
+	has, err = kv.Has("p/1")
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
@@ -31,6 +31,7 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -130,6 +131,19 @@ func InitLoggerWithWriteSyncer(cfg *Config, output zapcore.WriteSyncer, opts ...
 	return lg, r, nil
 }
 
+// NewFileWriter creates a writer to the rotated file described by cfg, e.g. to capture the
+// output of a child process with the same rotation policy as the file log.
+func NewFileWriter(cfg *FileLogConfig) (io.WriteCloser, error) {
+	if err := os.MkdirAll(cfg.RootPath, 0755); err != nil {
+		return nil, err
+	}
+	lg, err := initFileLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return lg, nil
+}
+
 // initFileLog initializes file based logging options.
 func initFileLog(cfg *FileLogConfig) (*lumberjack.Logger, error) {
 	logPath := strings.Join([]string{cfg.RootPath, cfg.Filename}, string(filepath.Separator))
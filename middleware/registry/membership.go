@@ -0,0 +1,224 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/linkbase/middleware/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// NodeEventType is the type of a membership change
+type NodeEventType int
+
+const (
+	NodeJoin NodeEventType = iota
+	NodeLeave
+	NodeUpdate
+)
+
+func (t NodeEventType) String() string {
+	switch t {
+	case NodeJoin:
+		return "join"
+	case NodeLeave:
+		return "leave"
+	case NodeUpdate:
+		return "update"
+	default:
+		return "unknown"
+	}
+}
+
+// NodeEvent is a membership change of a node
+type NodeEvent struct {
+	Type NodeEventType
+	Node NodeInfo
+}
+
+// eventBufferSize is the buffer of each subscriber, events are dropped for a subscriber lagging behind
+const eventBufferSize = 1024
+
+// Membership watches the registered nodes and emits the join, leave and update events to its subscribers
+type Membership struct {
+	registry   *Registry
+	serverType string
+
+	mu          sync.RWMutex
+	nodes       map[int64]NodeInfo
+	subscribers []chan NodeEvent
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewMembership creates a membership of the nodes of serverType, all the nodes if serverType is empty
+func NewMembership(registry *Registry, serverType string) *Membership {
+	return &Membership{
+		registry:   registry,
+		serverType: serverType,
+		nodes:      make(map[int64]NodeInfo),
+	}
+}
+
+// Subscribe returns a channel of the membership events, it must be called before Start to receive
+// the join events of the existing nodes
+func (m *Membership) Subscribe() <-chan NodeEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan NodeEvent, eventBufferSize)
+	m.subscribers = append(m.subscribers, ch)
+	return ch
+}
+
+// Start lists the current nodes and watches the changes in the background
+func (m *Membership) Start(ctx context.Context) error {
+	revision, err := m.sync(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.wg.Add(1)
+	go m.watch(ctx, revision)
+	return nil
+}
+
+// Stop stops watching and closes the subscriber channels
+func (m *Membership) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ch := range m.subscribers {
+		close(ch)
+	}
+	m.subscribers = nil
+}
+
+// Nodes returns the live nodes
+func (m *Membership) Nodes() []NodeInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]NodeInfo, 0, len(m.nodes))
+	for _, node := range m.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// sync lists the nodes and emits the differences against the known nodes, returns the revision listed at
+func (m *Membership) sync(ctx context.Context) (int64, error) {
+	nodes, revision, err := m.registry.ListNodes(ctx, m.serverType)
+	if err != nil {
+		return 0, err
+	}
+	listed := make(map[int64]NodeInfo, len(nodes))
+	for _, node := range nodes {
+		listed[node.NodeID] = node
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, node := range m.nodes {
+		if _, ok := listed[id]; !ok {
+			m.applyLocked(NodeEvent{Type: NodeLeave, Node: node})
+		}
+	}
+	for id, node := range listed {
+		if _, ok := m.nodes[id]; !ok {
+			m.applyLocked(NodeEvent{Type: NodeJoin, Node: node})
+		} else {
+			m.applyLocked(NodeEvent{Type: NodeUpdate, Node: node})
+		}
+	}
+	return revision, nil
+}
+
+// watch applies the changes after revision, on compaction or error it lists the nodes again
+func (m *Membership) watch(ctx context.Context, revision int64) {
+	defer m.wg.Done()
+	for {
+		wch := m.registry.client.Watch(clientv3.WithRequireLeader(ctx), m.registry.typePrefix(m.serverType),
+			clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithRev(revision+1))
+		for resp := range wch {
+			if err := resp.Err(); err != nil {
+				log.Warn("membership watch failed", zap.Error(err))
+				break
+			}
+			for _, ev := range resp.Events {
+				m.handleEvent(ev)
+			}
+			revision = resp.Header.Revision
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		for {
+			rev, err := m.sync(ctx)
+			if err == nil {
+				revision = rev
+				break
+			}
+			log.Warn("failed to list nodes", zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+		}
+	}
+}
+
+func (m *Membership) handleEvent(ev *clientv3.Event) {
+	var event NodeEvent
+	switch ev.Type {
+	case clientv3.EventTypePut:
+		if err := json.Unmarshal(ev.Kv.Value, &event.Node); err != nil {
+			log.Warn("invalid node registration", zap.ByteString("key", ev.Kv.Key), zap.Error(err))
+			return
+		}
+		event.Type = NodeUpdate
+		if ev.IsCreate() {
+			event.Type = NodeJoin
+		}
+	case clientv3.EventTypeDelete:
+		if ev.PrevKv == nil {
+			return
+		}
+		if err := json.Unmarshal(ev.PrevKv.Value, &event.Node); err != nil {
+			return
+		}
+		event.Type = NodeLeave
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applyLocked(event)
+}
+
+func (m *Membership) applyLocked(event NodeEvent) {
+	switch event.Type {
+	case NodeJoin, NodeUpdate:
+		m.nodes[event.Node.NodeID] = event.Node
+	case NodeLeave:
+		delete(m.nodes, event.Node.NodeID)
+	}
+	if event.Type != NodeUpdate {
+		log.Info("node "+event.Type.String(), zap.String("serverType", event.Node.ServerType),
+			zap.Int64("nodeID", event.Node.NodeID), zap.String("address", event.Node.Address))
+	}
+	for _, ch := range m.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Warn("membership subscriber is lagging behind, event dropped", zap.Stringer("type", event.Type),
+				zap.Int64("nodeID", event.Node.NodeID))
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cockroachdb/errors"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/utils/hardware"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPrefix is the etcd key prefix the nodes register under
+	DefaultPrefix = "linkbase/nodes"
+
+	requestTimeout = 5 * time.Second
+	retryInterval  = time.Second
+)
+
+// NodeInfo is the registration of a node, refreshed with its hardware stats periodically
+type NodeInfo struct {
+	NodeID     int64         `json:"nodeID"`
+	ServerType string        `json:"serverType"`
+	Address    string        `json:"address"`
+	Version    string        `json:"version"`
+	Hostname   string        `json:"hostname"`
+	Pid        int           `json:"pid"`
+	Hardware   HardwareStats `json:"hardware"`
+	StartedAt  time.Time     `json:"startedAt"`
+	UpdatedAt  time.Time     `json:"updatedAt"`
+}
+
+// HardwareStats are the resources of the machine a node runs on
+type HardwareStats struct {
+	CPUNum      int     `json:"cpuNum"`
+	CPUUsage    float64 `json:"cpuUsage"`
+	MemoryTotal uint64  `json:"memoryTotal"`
+	MemoryUsed  uint64  `json:"memoryUsed"`
+}
+
+// GetHardwareStats collects the hardware stats by utils/hardware
+func GetHardwareStats() HardwareStats {
+	return HardwareStats{
+		CPUNum:      hardware.GetCPUNum(),
+		CPUUsage:    hardware.GetCPUUsage(),
+		MemoryTotal: hardware.GetMemoryCount(),
+		MemoryUsed:  hardware.GetUsedMemoryCount(),
+	}
+}
+
+// Registry registers a node under a session lease in etcd, the key is removed by etcd once the node
+// stops keeping the lease alive, so the liveness of a node is the liveness of its key
+type Registry struct {
+	client        *clientv3.Client
+	prefix        string
+	ttl           int64
+	statsInterval time.Duration
+
+	mu      sync.Mutex
+	node    NodeInfo
+	leaseID clientv3.LeaseID
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewRegistry creates a registry, ttl is the lease ttl in seconds and statsInterval the period of
+// refreshing the hardware stats of the registered node
+func NewRegistry(client *clientv3.Client, prefix string, ttl int64, statsInterval time.Duration) *Registry {
+	return &Registry{
+		client:        client,
+		prefix:        prefix,
+		ttl:           ttl,
+		statsInterval: statsInterval,
+	}
+}
+
+// nodeKey returns the key of a node, e.g. linkbase/nodes/proxy/7587864413495787011
+func (r *Registry) nodeKey(serverType string, nodeID int64) string {
+	return path.Join(r.prefix, serverType, fmt.Sprint(nodeID))
+}
+
+// typePrefix returns the prefix of the nodes of serverType, all the nodes if serverType is empty
+func (r *Registry) typePrefix(serverType string) string {
+	if len(serverType) == 0 {
+		return r.prefix + "/"
+	}
+	return path.Join(r.prefix, serverType) + "/"
+}
+
+// Register grants a lease and puts the node under it, the lease is kept alive until Deregister.
+// The node id is the lease id, which is unique in the etcd cluster
+func (r *Registry) Register(ctx context.Context, node NodeInfo) (NodeInfo, error) {
+	if r.cancel != nil {
+		return NodeInfo{}, errors.New("node is already registered")
+	}
+	if len(node.Hostname) == 0 {
+		node.Hostname, _ = os.Hostname()
+	}
+	if node.Pid == 0 {
+		node.Pid = os.Getpid()
+	}
+	node.StartedAt = time.Now()
+	r.node = node
+	if err := r.register(ctx); err != nil {
+		return NodeInfo{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.wg.Add(1)
+	go r.keepAlive(ctx)
+	return r.Node(), nil
+}
+
+// register grants a new lease and puts the node under it
+func (r *Registry) register(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	lease, err := r.client.Grant(ctx, r.ttl)
+	if err != nil {
+		return errors.Wrap(err, "failed to grant lease")
+	}
+
+	r.mu.Lock()
+	r.leaseID = lease.ID
+	r.node.NodeID = int64(lease.ID)
+	r.mu.Unlock()
+	if err := r.put(ctx); err != nil {
+		_, _ = r.client.Revoke(context.Background(), lease.ID)
+		return err
+	}
+	log.Info("node registered", zap.String("serverType", r.node.ServerType), zap.Int64("nodeID", r.node.NodeID),
+		zap.String("address", r.node.Address), zap.Int64("ttl", r.ttl))
+	return nil
+}
+
+// put saves the node with the latest hardware stats under the current lease
+func (r *Registry) put(ctx context.Context) error {
+	r.mu.Lock()
+	r.node.Hardware = GetHardwareStats()
+	r.node.UpdatedAt = time.Now()
+	node, leaseID := r.node, r.leaseID
+	r.mu.Unlock()
+
+	b, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Put(ctx, r.nodeKey(node.ServerType, node.NodeID), string(b), clientv3.WithLease(leaseID))
+	return errors.Wrap(err, "failed to put node")
+}
+
+// keepAlive keeps the lease alive and refreshes the stats, if the lease is lost, e.g. etcd was
+// unreachable longer than the ttl, the node registers again with a new node id
+func (r *Registry) keepAlive(ctx context.Context) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.statsInterval)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		leaseID := r.leaseID
+		r.mu.Unlock()
+		ch, err := r.client.KeepAlive(ctx, leaseID)
+		if err == nil {
+			err = r.heartbeat(ctx, ch, ticker.C)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn("node lease lost, registering again", zap.Int64("nodeID", int64(leaseID)), zap.Error(err))
+		for {
+			if err := r.register(ctx); err == nil {
+				break
+			} else if ctx.Err() != nil {
+				return
+			} else {
+				log.Warn("failed to register node", zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+		}
+	}
+}
+
+// heartbeat consumes the keepalive responses and refreshes the stats until the lease is lost
+func (r *Registry) heartbeat(ctx context.Context, ch <-chan *clientv3.LeaseKeepAliveResponse, tick <-chan time.Time) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case resp, ok := <-ch:
+			if !ok || resp == nil {
+				return errors.New("keepalive channel closed")
+			}
+		case <-tick:
+			putCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+			err := r.put(putCtx)
+			cancel()
+			if err != nil {
+				log.Warn("failed to refresh node stats", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Node returns the registered node
+func (r *Registry) Node() NodeInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.node
+}
+
+// Deregister stops the keepalive and revokes the lease, so the node leaves immediately
+func (r *Registry) Deregister(ctx context.Context) error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	r.wg.Wait()
+	r.cancel = nil
+
+	r.mu.Lock()
+	leaseID := r.leaseID
+	r.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	_, err := r.client.Revoke(ctx, leaseID)
+	return err
+}
+
+// ListNodes returns the live nodes of serverType, all the nodes if serverType is empty, and the
+// revision of the result for watching the changes after it
+func (r *Registry) ListNodes(ctx context.Context, serverType string) ([]NodeInfo, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := r.client.Get(ctx, r.typePrefix(serverType), clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	nodes := make([]NodeInfo, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var node NodeInfo
+		if err := json.Unmarshal(kv.Value, &node); err != nil {
+			log.Warn("invalid node registration", zap.ByteString("key", kv.Key), zap.Error(err))
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, resp.Header.Revision, nil
+}
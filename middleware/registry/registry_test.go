@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"context"
+	"github.com/linkbase/utils/etcd"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestEtcdClient(t *testing.T) *clientv3.Client {
+	server, dir, err := etcd.StartTestEmbedEtcdServer()
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+	client, err := etcd.GetRemoteEtcdClient(etcd.GetEmbedEtcdEndpoints(server))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+func nextEvent(t *testing.T, ch <-chan NodeEvent) NodeEvent {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(10 * time.Second):
+		t.Fatal("no membership event")
+		return NodeEvent{}
+	}
+}
+
+func TestRegistry_Register(t *testing.T) {
+	client := newTestEtcdClient(t)
+	ctx := context.Background()
+
+	proxy := NewRegistry(client, DefaultPrefix, 5, time.Minute)
+	node, err := proxy.Register(ctx, NodeInfo{ServerType: "proxy", Address: "localhost:19530", Version: "0.1.0"})
+	assert.NoError(t, err)
+	assert.NotZero(t, node.NodeID)
+	assert.NotEmpty(t, node.Hostname)
+	assert.Greater(t, node.Hardware.CPUNum, 0)
+	_, err = proxy.Register(ctx, NodeInfo{ServerType: "proxy"})
+	assert.Error(t, err)
+
+	query := NewRegistry(client, DefaultPrefix, 5, time.Minute)
+	_, err = query.Register(ctx, NodeInfo{ServerType: "query", Address: "localhost:19531"})
+	assert.NoError(t, err)
+
+	nodes, _, err := proxy.ListNodes(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+	nodes, _, err = proxy.ListNodes(ctx, "proxy")
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Equal(t, node.NodeID, nodes[0].NodeID)
+	assert.Equal(t, "localhost:19530", nodes[0].Address)
+
+	assert.NoError(t, proxy.Deregister(ctx))
+	assert.NoError(t, query.Deregister(ctx))
+	nodes, _, err = proxy.ListNodes(ctx, "")
+	assert.NoError(t, err)
+	assert.Empty(t, nodes)
+}
+
+func TestMembership(t *testing.T) {
+	client := newTestEtcdClient(t)
+	ctx := context.Background()
+
+	existing := NewRegistry(client, DefaultPrefix, 5, time.Minute)
+	existingNode, err := existing.Register(ctx, NodeInfo{ServerType: "query"})
+	assert.NoError(t, err)
+
+	membership := NewMembership(NewRegistry(client, DefaultPrefix, 5, time.Minute), "")
+	events := membership.Subscribe()
+	assert.NoError(t, membership.Start(ctx))
+	defer membership.Stop()
+
+	ev := nextEvent(t, events)
+	assert.Equal(t, NodeJoin, ev.Type)
+	assert.Equal(t, existingNode.NodeID, ev.Node.NodeID)
+
+	// join, stats refresh and leave of a new node
+	proxy := NewRegistry(client, DefaultPrefix, 5, 100*time.Millisecond)
+	proxyNode, err := proxy.Register(ctx, NodeInfo{ServerType: "proxy"})
+	assert.NoError(t, err)
+	ev = nextEvent(t, events)
+	assert.Equal(t, NodeJoin, ev.Type)
+	assert.Equal(t, proxyNode.NodeID, ev.Node.NodeID)
+	ev = nextEvent(t, events)
+	assert.Equal(t, NodeUpdate, ev.Type)
+	assert.Len(t, membership.Nodes(), 2)
+
+	assert.NoError(t, proxy.Deregister(ctx))
+	for ev = nextEvent(t, events); ev.Type == NodeUpdate; ev = nextEvent(t, events) {
+	}
+	assert.Equal(t, NodeLeave, ev.Type)
+	assert.Equal(t, proxyNode.NodeID, ev.Node.NodeID)
+	assert.Len(t, membership.Nodes(), 1)
+
+	// a crashed node leaves once its lease expires
+	existing.cancel()
+	existing.wg.Wait()
+	ev = nextEvent(t, events)
+	assert.Equal(t, NodeLeave, ev.Type)
+	assert.Equal(t, existingNode.NodeID, ev.Node.NodeID)
+	assert.Empty(t, membership.Nodes())
+}
@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"context"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/middleware/rocksmq/server"
+	"github.com/linkbase/utils/paramtable"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"net"
+	"path"
+	"testing"
+	"time"
+)
+
+// newTestBroker serves a new rocksmq on a local port and dials it
+func newTestBroker(t *testing.T) (*Remote, *server.RocketMQServer) {
+	rmq, err := server.NewRocksMQ(path.Join(t.TempDir(), "rocksmq"), nil)
+	assert.NoError(t, err)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := grpc.NewServer()
+	RegisterServer(s, rmq)
+	go s.Serve(lis)
+	t.Cleanup(func() {
+		s.Stop()
+		rmq.Close()
+	})
+	remote, err := Dial(lis.Addr().String())
+	assert.NoError(t, err)
+	return remote, rmq
+}
+
+func TestBroker_Unary(t *testing.T) {
+	remote, rmq := newTestBroker(t)
+	defer remote.Close()
+
+	topic := "test_broker_unary"
+	policy := rocksmq.RetentionPolicy{TimeInMinutes: 10, SizeInMB: -1, RetainUnacked: true}
+	assert.NoError(t, remote.CreateTopic(topic, rocksmq.WithRetention(policy)))
+	got, err := rmq.GetTopicRetention(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, policy, got)
+
+	ids, err := remote.Produce(topic, []rocksmq.ProducerMessage{
+		{Payload: []byte("a"), Properties: map[string]string{"k": "v"}},
+		{Payload: []byte("b")},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, ids, 2)
+	latest, err := remote.GetLatestMsg(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[1], latest)
+
+	group := "group"
+	assert.NoError(t, remote.CreateConsumerGroup(topic, group, rocksmq.WithAckMode(time.Minute)))
+	exist, _, err := remote.ExistConsumerGroup(topic, group)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+	msgs, err := remote.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, []byte("a"), msgs[0].Payload)
+	assert.Equal(t, "v", msgs[0].Properties["k"])
+	assert.NoError(t, remote.Ack(topic, group, ids...))
+
+	topics, err := remote.ListTopics()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{topic}, topics)
+	stats, err := remote.GetTopicStats(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), stats.MsgCount)
+	assert.Equal(t, policy, stats.Retention)
+	assert.Len(t, stats.Groups, 1)
+	assert.False(t, stats.Groups[0].LastConsume.IsZero())
+	params := paramtable.Get()
+	params.Save(params.RocksmqCfg.BackupPath.Key, t.TempDir())
+	defer params.Reset(params.RocksmqCfg.BackupPath.Key)
+	assert.NoError(t, remote.Backup("backup"))
+	assert.ErrorContains(t, remote.Backup("backup"), "already exists")
+	assert.ErrorContains(t, remote.Backup(t.TempDir()), "not inside")
+
+	// errors of the broker are returned as they are
+	err = remote.CreateConsumerGroup(topic, group)
+	assert.ErrorContains(t, err, "already exists")
+	assert.Error(t, remote.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group}))
+
+	reader, err := remote.CreateReader(topic, rocksmq.EarliestMessageID, true)
+	assert.NoError(t, err)
+	assert.True(t, remote.HasNext(topic, reader))
+	msg, err := remote.Next(context.Background(), topic, reader)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[0], msg.MsgID)
+	msgs, err = remote.NextBatch(topic, reader, 10)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, ids[1], msgs[0].MsgID)
+	msgs, err = remote.NextBatch(topic, reader, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+	remote.CloseReader(topic, reader)
+
+	assert.NoError(t, remote.DestroyConsumerGroup(topic, group))
+	assert.NoError(t, remote.DestroyTopic(topic))
+	assert.Error(t, remote.CheckTopicValid(topic))
+}
+
+func TestBroker_Subscribe(t *testing.T) {
+	remote, rmq := newTestBroker(t)
+	defer remote.Close()
+
+	topic := "test_broker_subscribe"
+	group := "group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+	ids, err := rmq.Produce(topic, []rocksmq.ProducerMessage{{Payload: []byte("a")}, {Payload: []byte("b")}})
+	assert.NoError(t, err)
+
+	msgMutex := make(chan struct{}, 1)
+	assert.NoError(t, remote.JoinConsumerGroup(topic, group, "a", rocksmq.SubscriptionExclusive, msgMutex))
+	assert.Error(t, remote.JoinConsumerGroup(topic, group, "b", rocksmq.SubscriptionExclusive, make(chan struct{}, 1)))
+
+	// messages are streamed to the member, the broker sends more once they are drained
+	consume := func(n int) []UniqueID {
+		var got []UniqueID
+		for len(got) < n {
+			select {
+			case <-msgMutex:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("consumed %d messages, want %d", len(got), n)
+			}
+			msgs, err := remote.ConsumeMember(topic, group, "a", 10)
+			assert.NoError(t, err)
+			for _, msg := range msgs {
+				got = append(got, msg.MsgID)
+			}
+		}
+		return got
+	}
+	assert.Equal(t, ids, consume(2))
+	more, err := rmq.Produce(topic, []rocksmq.ProducerMessage{{Payload: []byte("c")}})
+	assert.NoError(t, err)
+	assert.Equal(t, more, consume(1))
+
+	// the stream ends when the member leaves
+	assert.NoError(t, remote.LeaveConsumerGroup(topic, group, "a"))
+	for range msgMutex {
+	}
+	exist, _, err := rmq.ExistConsumerGroup(topic, group)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+
+	// the member of a broken stream leaves its group, which then takes an exclusive member again
+	msgMutex = make(chan struct{}, 1)
+	assert.NoError(t, remote.JoinConsumerGroup(topic, group, "c", rocksmq.SubscriptionFailover, msgMutex))
+	remote.Close()
+	for range msgMutex {
+	}
+	assert.Eventually(t, func() bool {
+		return rmq.JoinConsumerGroup(topic, group, "d", rocksmq.SubscriptionExclusive, make(chan struct{}, 1)) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,28 @@
+package broker
+
+import (
+	"encoding/json"
+	"google.golang.org/grpc/encoding"
+)
+
+// codecName is the content subtype of the broker calls, their messages are json encoded
+const codecName = "rmqjson"
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec encodes the broker messages, which are plain structs rather than generated protobuf messages
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return codecName
+}
@@ -0,0 +1,457 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ rocksmq.RocksMQ = (*Remote)(nil)
+
+// remoteStream buffers the messages a Subscribe stream sends to a member of a consumer group
+type remoteStream struct {
+	topic       string
+	group       string
+	member      string
+	partitioned bool
+	msgMutex    chan struct{}
+	// buffered holds the messages not consumed yet by topic, which is a partition topic for a partitioned group
+	buffered map[string][]rocksmq.ConsumerMessage
+}
+
+// owns tells whether the messages of the topic are streamed to the member
+func (rs *remoteStream) owns(topic, group string) bool {
+	if rs.group != group {
+		return false
+	}
+	if rs.partitioned {
+		return strings.HasPrefix(topic, rs.topic+"-partition-")
+	}
+	return rs.topic == topic
+}
+
+// Remote is a rocksmq.RocksMQ served by a broker over grpc, the messages of the consumer groups it joins
+// are streamed to it and handed out by Consume and ConsumeMember
+type Remote struct {
+	conn   *grpc.ClientConn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	streams []*remoteStream
+}
+
+// Dial connects to the broker listening on address
+func Dial(address string) (*Remote, error) {
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName)))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Remote{conn: conn, ctx: ctx, cancel: cancel}, nil
+}
+
+func (r *Remote) call(ctx context.Context, method string, req *Request) (*Response, error) {
+	resp := &Response{}
+	if err := r.conn.Invoke(ctx, "/"+serviceName+"/"+method, req, resp); err != nil {
+		return nil, errors.New(status.Convert(err).Message())
+	}
+	return resp, nil
+}
+
+func (r *Remote) invoke(method string, req *Request) (*Response, error) {
+	return r.call(r.ctx, method, req)
+}
+
+func (r *Remote) CreateTopic(topic string, opts ...rocksmq.TopicOption) error {
+	options := rocksmq.TopicOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	_, err := r.invoke("CreateTopic", &Request{Topic: topic, TopicOptions: options})
+	return err
+}
+
+func (r *Remote) DestroyTopic(topic string) error {
+	_, err := r.invoke("DestroyTopic", &Request{Topic: topic})
+	return err
+}
+
+func (r *Remote) CreateConsumerGroup(topic, group string, opts ...rocksmq.ConsumerGroupOption) error {
+	options := rocksmq.ConsumerGroupOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	_, err := r.invoke("CreateConsumerGroup", &Request{Topic: topic, Group: group, GroupOptions: options})
+	return err
+}
+
+func (r *Remote) DestroyConsumerGroup(topic, group string) error {
+	_, err := r.invoke("DestroyConsumerGroup", &Request{Topic: topic, Group: group})
+	return err
+}
+
+// Close ends the streams of the consumer groups joined and closes the connection, the broker keeps serving
+func (r *Remote) Close() {
+	r.cancel()
+	if err := r.conn.Close(); err != nil {
+		log.Warn("failed to close the connection to rocksmq broker", zap.Error(err))
+	}
+}
+
+// RegisterConsumer is not supported as the msgMutex cannot be signaled remotely, join the consumer group instead
+func (r *Remote) RegisterConsumer(consumer *rocksmq.Consumer) error {
+	return errors.New("register consumer is not supported by a remote rocksmq broker, join the consumer group instead")
+}
+
+func (r *Remote) GetLatestMsg(topic string) (int64, error) {
+	resp, err := r.invoke("GetLatestMsg", &Request{Topic: topic})
+	if err != nil {
+		return rocksmq.EarliestMessageID, err
+	}
+	return resp.MsgID, nil
+}
+
+func (r *Remote) CheckTopicValid(topic string) error {
+	_, err := r.invoke("CheckTopicValid", &Request{Topic: topic})
+	return err
+}
+
+func (r *Remote) SetTopicRetention(topic string, policy rocksmq.RetentionPolicy) error {
+	_, err := r.invoke("SetTopicRetention", &Request{Topic: topic, Retention: policy})
+	return err
+}
+
+func (r *Remote) GetTopicRetention(topic string) (rocksmq.RetentionPolicy, error) {
+	resp, err := r.invoke("GetTopicRetention", &Request{Topic: topic})
+	if err != nil {
+		return rocksmq.RetentionPolicy{}, err
+	}
+	return resp.Retention, nil
+}
+
+func (r *Remote) GetTopicPartitions(topic string) (int, error) {
+	resp, err := r.invoke("GetTopicPartitions", &Request{Topic: topic})
+	if err != nil {
+		return 0, err
+	}
+	return resp.N, nil
+}
+
+func (r *Remote) ListTopics() ([]string, error) {
+	resp, err := r.invoke("ListTopics", &Request{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Topics, nil
+}
+
+func (r *Remote) GetTopicStats(topic string) (*rocksmq.TopicStats, error) {
+	resp, err := r.invoke("GetTopicStats", &Request{Topic: topic})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Stats, nil
+}
+
+func (r *Remote) Backup(dir string) error {
+	_, err := r.invoke("Backup", &Request{Dir: dir})
+	return err
+}
+
+func (r *Remote) Produce(topic string, messages []rocksmq.ProducerMessage) ([]UniqueID, error) {
+	resp, err := r.invoke("Produce", &Request{Topic: topic, Messages: messages})
+	if err != nil {
+		return []UniqueID{}, err
+	}
+	return resp.MsgIDs, nil
+}
+
+// Consume hands out the streamed messages if the topic is a partition of a group joined here,
+// otherwise it reads from the broker. A partition is streamed to a single member, but it may have
+// been streamed to another one before a rebalance, so the messages of any member are handed out
+func (r *Remote) Consume(topic string, group string, n int) ([]rocksmq.ConsumerMessage, error) {
+	if rs := r.findStream(func(rs *remoteStream) bool { return rs.partitioned && rs.owns(topic, group) }); rs != nil {
+		if rs = r.findStream(func(rs *remoteStream) bool {
+			return rs.partitioned && rs.owns(topic, group) && len(rs.buffered[topic]) > 0
+		}); rs == nil {
+			return []rocksmq.ConsumerMessage{}, nil
+		}
+		return r.pop(rs, topic, n), nil
+	}
+	resp, err := r.invoke("Consume", &Request{Topic: topic, Group: group, N: n})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// ConsumeMember hands out the messages streamed to the member if it joined here, otherwise it reads from the broker
+func (r *Remote) ConsumeMember(topic, group, member string, n int) ([]rocksmq.ConsumerMessage, error) {
+	if rs := r.findStream(func(rs *remoteStream) bool {
+		return !rs.partitioned && rs.member == member && rs.owns(topic, group)
+	}); rs != nil {
+		return r.pop(rs, topic, n), nil
+	}
+	resp, err := r.invoke("ConsumeMember", &Request{Topic: topic, Group: group, Member: member, N: n})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+func (r *Remote) Ack(topic, group string, msgIDs ...UniqueID) error {
+	_, err := r.invoke("Ack", &Request{Topic: topic, Group: group, MsgIDs: msgIDs})
+	return err
+}
+
+func (r *Remote) AckCumulative(topic, group string, msgID UniqueID) error {
+	_, err := r.invoke("AckCumulative", &Request{Topic: topic, Group: group, MsgID: msgID})
+	return err
+}
+
+func (r *Remote) Nack(topic, group string, msgIDs ...UniqueID) error {
+	_, err := r.invoke("Nack", &Request{Topic: topic, Group: group, MsgIDs: msgIDs})
+	return err
+}
+
+func (r *Remote) ReplayDeadLetter(deadLetterTopic string) (int, error) {
+	resp, err := r.invoke("ReplayDeadLetter", &Request{Topic: deadLetterTopic})
+	if err != nil {
+		return 0, err
+	}
+	return resp.N, nil
+}
+
+// Seek drops the streamed messages of the group on the topic, then moves its position on the broker
+func (r *Remote) Seek(topic, group string, msgID UniqueID) error {
+	r.dropBuffered(topic, group)
+	_, err := r.invoke("Seek", &Request{Topic: topic, Group: group, MsgID: msgID})
+	return err
+}
+
+func (r *Remote) SeekByTime(topic, group string, ts time.Time) error {
+	r.dropBuffered(topic, group)
+	_, err := r.invoke("SeekByTime", &Request{Topic: topic, Group: group, Time: ts})
+	return err
+}
+
+func (r *Remote) SeekToLatest(topic, group string) error {
+	r.dropBuffered(topic, group)
+	_, err := r.invoke("SeekToLatest", &Request{Topic: topic, Group: group})
+	return err
+}
+
+// ExistConsumerGroup tells whether the group exists on the broker, the registered consumer is never returned
+func (r *Remote) ExistConsumerGroup(topic, group string) (bool, *rocksmq.Consumer, error) {
+	resp, err := r.invoke("ExistConsumerGroup", &Request{Topic: topic, Group: group})
+	if err != nil {
+		return false, nil, err
+	}
+	return resp.Ok, nil, nil
+}
+
+// JoinConsumerGroup joins the member by a Subscribe stream, msgMutex is signaled when messages are streamed
+// and closed when the stream ends
+func (r *Remote) JoinConsumerGroup(topic, group, member string, subType rocksmq.SubscriptionType, msgMutex chan struct{}) error {
+	_, err := r.subscribe(&Request{Topic: topic, Group: group, Member: member, SubscriptionType: subType}, msgMutex)
+	return err
+}
+
+func (r *Remote) LeaveConsumerGroup(topic, group, member string) error {
+	_, err := r.invoke("LeaveConsumerGroup", &Request{Topic: topic, Group: group, Member: member})
+	return err
+}
+
+// JoinPartitionedGroup joins the member by a Subscribe stream, which streams the messages of its partitions
+func (r *Remote) JoinPartitionedGroup(topic, group, member string, subType rocksmq.SubscriptionType,
+	msgMutex chan struct{}, opts ...rocksmq.ConsumerGroupOption) ([]int, error) {
+	options := rocksmq.ConsumerGroupOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	resp, err := r.subscribe(&Request{Topic: topic, Group: group, Member: member, SubscriptionType: subType,
+		GroupOptions: options, Partitioned: true}, msgMutex)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Partitions, nil
+}
+
+func (r *Remote) LeavePartitionedGroup(topic, group, member string) error {
+	_, err := r.invoke("LeavePartitionedGroup", &Request{Topic: topic, Group: group, Member: member})
+	return err
+}
+
+func (r *Remote) GetAssignedPartitions(topic, group, member string) ([]int, error) {
+	resp, err := r.invoke("GetAssignedPartitions", &Request{Topic: topic, Group: group, Member: member})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Partitions, nil
+}
+
+func (r *Remote) CreateReader(topic string, startMsgID UniqueID, messageIDInclusive bool) (string, error) {
+	resp, err := r.invoke("CreateReader", &Request{Topic: topic, MsgID: startMsgID, Inclusive: messageIDInclusive})
+	if err != nil {
+		return "", err
+	}
+	return resp.Reader, nil
+}
+
+func (r *Remote) ReaderSeek(topic, readerName string, msgID UniqueID) error {
+	_, err := r.invoke("ReaderSeek", &Request{Topic: topic, Reader: readerName, MsgID: msgID})
+	return err
+}
+
+func (r *Remote) Next(ctx context.Context, topic, readerName string) (*rocksmq.ConsumerMessage, error) {
+	resp, err := r.call(ctx, "Next", &Request{Topic: topic, Reader: readerName})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Messages) == 0 {
+		return nil, errors.New("rocksmq broker returned no message")
+	}
+	return &resp.Messages[0], nil
+}
+
+func (r *Remote) HasNext(topic, readerName string) bool {
+	resp, err := r.invoke("HasNext", &Request{Topic: topic, Reader: readerName})
+	return err == nil && resp.Ok
+}
+
+func (r *Remote) NextBatch(topic, readerName string, n int) ([]rocksmq.ConsumerMessage, error) {
+	resp, err := r.invoke("NextBatch", &Request{Topic: topic, Reader: readerName, N: n})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+func (r *Remote) CloseReader(topic, readerName string) {
+	if _, err := r.invoke("CloseReader", &Request{Topic: topic, Reader: readerName}); err != nil {
+		log.Warn("failed to close remote reader", zap.String("topic", topic), zap.String("reader", readerName), zap.Error(err))
+	}
+}
+
+func (r *Remote) Notify(topic, group string) {
+	if _, err := r.invoke("Notify", &Request{Topic: topic, Group: group}); err != nil {
+		log.Warn("failed to notify remote consumer group", zap.String("topic", topic), zap.String("group", group), zap.Error(err))
+	}
+}
+
+// subscribe opens a Subscribe stream and waits for the broker to tell the member joined
+func (r *Remote) subscribe(req *Request, msgMutex chan struct{}) (*Response, error) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	desc := &grpc.StreamDesc{StreamName: subscribeMethod, ServerStreams: true}
+	stream, err := r.conn.NewStream(ctx, desc, "/"+serviceName+"/"+subscribeMethod)
+	if err == nil {
+		err = stream.SendMsg(req)
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	first := &Response{}
+	if err == nil {
+		err = stream.RecvMsg(first)
+	}
+	if err != nil {
+		cancel()
+		return nil, errors.New(status.Convert(err).Message())
+	}
+
+	rs := &remoteStream{
+		topic:       req.Topic,
+		group:       req.Group,
+		member:      req.Member,
+		partitioned: req.Partitioned,
+		msgMutex:    msgMutex,
+		buffered:    make(map[string][]rocksmq.ConsumerMessage),
+	}
+	r.mu.Lock()
+	r.streams = append(r.streams, rs)
+	r.mu.Unlock()
+	go r.receive(stream, rs, cancel)
+	return first, nil
+}
+
+// receive buffers the streamed messages and signals the member, msgMutex is closed when the stream ends
+func (r *Remote) receive(stream grpc.ClientStream, rs *remoteStream, cancel context.CancelFunc) {
+	defer func() {
+		r.mu.Lock()
+		for i, s := range r.streams {
+			if s == rs {
+				r.streams = append(r.streams[:i], r.streams[i+1:]...)
+				break
+			}
+		}
+		r.mu.Unlock()
+		cancel()
+		close(rs.msgMutex)
+	}()
+	for {
+		resp := &Response{}
+		if err := stream.RecvMsg(resp); err != nil {
+			if err != io.EOF && r.ctx.Err() == nil {
+				log.Warn("rocksmq broker stream broken", zap.String("topic", rs.topic), zap.String("group", rs.group),
+					zap.String("member", rs.member), zap.Error(err))
+			}
+			return
+		}
+		r.mu.Lock()
+		rs.buffered[resp.Topic] = append(rs.buffered[resp.Topic], resp.Messages...)
+		r.mu.Unlock()
+		select {
+		case rs.msgMutex <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *Remote) findStream(match func(rs *remoteStream) bool) *remoteStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rs := range r.streams {
+		if match(rs) {
+			return rs
+		}
+	}
+	return nil
+}
+
+// pop hands out at most n buffered messages of the topic, the broker is asked for more once they are drained
+func (r *Remote) pop(rs *remoteStream, topic string, n int) []rocksmq.ConsumerMessage {
+	r.mu.Lock()
+	buffered := rs.buffered[topic]
+	if len(buffered) > n {
+		buffered = buffered[:n]
+	}
+	rs.buffered[topic] = rs.buffered[topic][len(buffered):]
+	drained := len(buffered) > 0 && len(rs.buffered[topic]) == 0
+	r.mu.Unlock()
+	if drained {
+		r.Notify(topic, rs.group)
+	}
+	return buffered
+}
+
+// dropBuffered drops the streamed messages of the group on the topic before its position moves
+func (r *Remote) dropBuffered(topic, group string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rs := range r.streams {
+		if rs.owns(topic, group) {
+			delete(rs.buffered, topic)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package broker
+
+import (
+	"context"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// DefaultBatchSize is the number of messages a Subscribe stream sends at a time if the request does not tell
+const DefaultBatchSize = 100
+
+// Server serves a rocksmq instance to remote clients
+type Server struct {
+	rmq rocksmq.RocksMQ
+}
+
+// RegisterServer registers the broker service of rmq on the grpc server
+func RegisterServer(s *grpc.Server, rmq rocksmq.RocksMQ) {
+	s.RegisterService(serviceDesc(), &Server{rmq: rmq})
+}
+
+func topicOptions(options rocksmq.TopicOptions) []rocksmq.TopicOption {
+	return []rocksmq.TopicOption{func(o *rocksmq.TopicOptions) { *o = options }}
+}
+
+func groupOptions(options rocksmq.ConsumerGroupOptions) []rocksmq.ConsumerGroupOption {
+	return []rocksmq.ConsumerGroupOption{func(o *rocksmq.ConsumerGroupOptions) { *o = options }}
+}
+
+var unaryMethods = map[string]unaryMethod{
+	"CreateTopic": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.CreateTopic(req.Topic, topicOptions(req.TopicOptions)...)
+	},
+	"DestroyTopic": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.DestroyTopic(req.Topic)
+	},
+	"CreateConsumerGroup": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.CreateConsumerGroup(req.Topic, req.Group, groupOptions(req.GroupOptions)...)
+	},
+	"DestroyConsumerGroup": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.DestroyConsumerGroup(req.Topic, req.Group)
+	},
+	"GetLatestMsg": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		msgID, err := rmq.GetLatestMsg(req.Topic)
+		return &Response{MsgID: msgID}, err
+	},
+	"CheckTopicValid": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.CheckTopicValid(req.Topic)
+	},
+	"SetTopicRetention": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.SetTopicRetention(req.Topic, req.Retention)
+	},
+	"GetTopicRetention": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		policy, err := rmq.GetTopicRetention(req.Topic)
+		return &Response{Retention: policy}, err
+	},
+	"GetTopicPartitions": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		n, err := rmq.GetTopicPartitions(req.Topic)
+		return &Response{N: n}, err
+	},
+	"ListTopics": func(_ context.Context, rmq rocksmq.RocksMQ, _ *Request) (*Response, error) {
+		topics, err := rmq.ListTopics()
+		return &Response{Topics: topics}, err
+	},
+	"GetTopicStats": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		stats, err := rmq.GetTopicStats(req.Topic)
+		return &Response{Stats: stats}, err
+	},
+	"Backup": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.Backup(req.Dir)
+	},
+	"Produce": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		ids, err := rmq.Produce(req.Topic, req.Messages)
+		return &Response{MsgIDs: ids}, err
+	},
+	"Consume": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		msgs, err := rmq.Consume(req.Topic, req.Group, req.N)
+		return &Response{Messages: msgs}, err
+	},
+	"ConsumeMember": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		msgs, err := rmq.ConsumeMember(req.Topic, req.Group, req.Member, req.N)
+		return &Response{Messages: msgs}, err
+	},
+	"Ack": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.Ack(req.Topic, req.Group, req.MsgIDs...)
+	},
+	"AckCumulative": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.AckCumulative(req.Topic, req.Group, req.MsgID)
+	},
+	"Nack": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.Nack(req.Topic, req.Group, req.MsgIDs...)
+	},
+	"ReplayDeadLetter": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		n, err := rmq.ReplayDeadLetter(req.Topic)
+		return &Response{N: n}, err
+	},
+	"Seek": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.Seek(req.Topic, req.Group, req.MsgID)
+	},
+	"SeekByTime": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.SeekByTime(req.Topic, req.Group, req.Time)
+	},
+	"SeekToLatest": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.SeekToLatest(req.Topic, req.Group)
+	},
+	"ExistConsumerGroup": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		exist, _, err := rmq.ExistConsumerGroup(req.Topic, req.Group)
+		return &Response{Ok: exist}, err
+	},
+	"LeaveConsumerGroup": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.LeaveConsumerGroup(req.Topic, req.Group, req.Member)
+	},
+	"LeavePartitionedGroup": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.LeavePartitionedGroup(req.Topic, req.Group, req.Member)
+	},
+	"GetAssignedPartitions": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		partitions, err := rmq.GetAssignedPartitions(req.Topic, req.Group, req.Member)
+		return &Response{Partitions: partitions}, err
+	},
+	"CreateReader": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		reader, err := rmq.CreateReader(req.Topic, req.MsgID, req.Inclusive)
+		return &Response{Reader: reader}, err
+	},
+	"ReaderSeek": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{}, rmq.ReaderSeek(req.Topic, req.Reader, req.MsgID)
+	},
+	"Next": func(ctx context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		msg, err := rmq.Next(ctx, req.Topic, req.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{Messages: []rocksmq.ConsumerMessage{*msg}}, nil
+	},
+	"HasNext": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		return &Response{Ok: rmq.HasNext(req.Topic, req.Reader)}, nil
+	},
+	"NextBatch": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		msgs, err := rmq.NextBatch(req.Topic, req.Reader, req.N)
+		return &Response{Messages: msgs}, err
+	},
+	"CloseReader": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		rmq.CloseReader(req.Topic, req.Reader)
+		return &Response{}, nil
+	},
+	"Notify": func(_ context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error) {
+		rmq.Notify(req.Topic, req.Group)
+		return &Response{}, nil
+	},
+}
+
+// subscribe joins the member to the consumer group and streams the messages consumed for it.
+// The first response tells the join succeeded, then a batch is sent each time the member is signaled,
+// the remote client asks for the next batch by Notify once it drained the previous one.
+// The member leaves the group if the stream is broken, the stream ends when the member leaves
+func (s *Server) subscribe(stream grpc.ServerStream) error {
+	req := &Request{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	if req.N <= 0 {
+		req.N = DefaultBatchSize
+	}
+	msgMutex := make(chan struct{}, 1)
+	first := &Response{}
+	var err error
+	if req.Partitioned {
+		first.Partitions, err = s.rmq.JoinPartitionedGroup(req.Topic, req.Group, req.Member, req.SubscriptionType,
+			msgMutex, groupOptions(req.GroupOptions)...)
+	} else {
+		err = s.rmq.JoinConsumerGroup(req.Topic, req.Group, req.Member, req.SubscriptionType, msgMutex)
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("remote consumer subscribed", zap.String("topic", req.Topic), zap.String("group", req.Group),
+		zap.String("member", req.Member))
+	if err = stream.SendMsg(first); err != nil {
+		s.leave(req)
+		return err
+	}
+
+	ctx := stream.Context()
+	for {
+		if err = s.send(stream, req); err != nil {
+			s.leave(req)
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.leave(req)
+			return ctx.Err()
+		case _, ok := <-msgMutex:
+			if !ok {
+				return nil
+			}
+		}
+	}
+}
+
+// send consumes a batch of messages for the member and sends it, a batch per partition assigned to it
+func (s *Server) send(stream grpc.ServerStream, req *Request) error {
+	if !req.Partitioned {
+		msgs, err := s.rmq.ConsumeMember(req.Topic, req.Group, req.Member, req.N)
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+		return stream.SendMsg(&Response{Topic: req.Topic, Messages: msgs})
+	}
+	partitions, err := s.rmq.GetAssignedPartitions(req.Topic, req.Group, req.Member)
+	if err != nil {
+		// the member left the group, the stream ends once its msgMutex is closed
+		return nil
+	}
+	for _, p := range partitions {
+		topic := rocksmq.PartitionTopic(req.Topic, p)
+		msgs, err := s.rmq.Consume(topic, req.Group, req.N)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		if err = stream.SendMsg(&Response{Topic: topic, Messages: msgs}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leave removes the member of a broken stream from its consumer group
+func (s *Server) leave(req *Request) {
+	var err error
+	if req.Partitioned {
+		err = s.rmq.LeavePartitionedGroup(req.Topic, req.Group, req.Member)
+	} else {
+		err = s.rmq.LeaveConsumerGroup(req.Topic, req.Group, req.Member)
+	}
+	if err != nil {
+		log.Warn("remote consumer failed to leave", zap.String("topic", req.Topic), zap.String("group", req.Group),
+			zap.String("member", req.Member), zap.Error(err))
+	}
+}
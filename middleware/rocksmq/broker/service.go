@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"context"
+	"github.com/linkbase/middleware/rocksmq"
+	"google.golang.org/grpc"
+	"time"
+)
+
+type UniqueID = rocksmq.UniqueID
+
+// serviceName is the full name of the grpc service of the broker
+const serviceName = "linkbase.rocksmq.RocksMQ"
+
+// subscribeMethod is the server-streaming method which joins a consumer group and streams its messages
+const subscribeMethod = "Subscribe"
+
+// Request carries the arguments of a broker call, which fields are used depends on the method
+type Request struct {
+	Topic  string `json:"topic,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Member string `json:"member,omitempty"`
+	Reader string `json:"reader,omitempty"`
+
+	MsgID     UniqueID   `json:"msg_id,omitempty"`
+	MsgIDs    []UniqueID `json:"msg_ids,omitempty"`
+	N         int        `json:"n,omitempty"`
+	Time      time.Time  `json:"time,omitempty"`
+	Inclusive bool       `json:"inclusive,omitempty"`
+
+	Messages         []rocksmq.ProducerMessage    `json:"messages,omitempty"`
+	TopicOptions     rocksmq.TopicOptions         `json:"topic_options,omitempty"`
+	GroupOptions     rocksmq.ConsumerGroupOptions `json:"group_options,omitempty"`
+	Retention        rocksmq.RetentionPolicy      `json:"retention,omitempty"`
+	SubscriptionType rocksmq.SubscriptionType     `json:"subscription_type,omitempty"`
+	// Partitioned makes Subscribe join the consumer group of a partitioned topic
+	Partitioned bool `json:"partitioned,omitempty"`
+	// Dir is the backup dir on the host of the broker
+	Dir string `json:"dir,omitempty"`
+}
+
+// Response carries the results of a broker call, a Subscribe stream sends one per batch of messages
+type Response struct {
+	MsgID      UniqueID                  `json:"msg_id,omitempty"`
+	MsgIDs     []UniqueID                `json:"msg_ids,omitempty"`
+	N          int                       `json:"n,omitempty"`
+	Ok         bool                      `json:"ok,omitempty"`
+	Reader     string                    `json:"reader,omitempty"`
+	Partitions []int                     `json:"partitions,omitempty"`
+	Retention  rocksmq.RetentionPolicy   `json:"retention,omitempty"`
+	Topic      string                    `json:"topic,omitempty"`
+	Messages   []rocksmq.ConsumerMessage `json:"messages,omitempty"`
+	Topics     []string                  `json:"topics,omitempty"`
+	Stats      *rocksmq.TopicStats       `json:"stats,omitempty"`
+}
+
+// unaryMethod serves a unary call of the broker
+type unaryMethod func(ctx context.Context, rmq rocksmq.RocksMQ, req *Request) (*Response, error)
+
+// brokerServer is the handler type of the service, any value registered by RegisterServer implements it
+type brokerServer interface{}
+
+func serviceDesc() *grpc.ServiceDesc {
+	desc := &grpc.ServiceDesc{
+		ServiceName: serviceName,
+		HandlerType: (*brokerServer)(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    subscribeMethod,
+			Handler:       func(srv interface{}, stream grpc.ServerStream) error { return srv.(*Server).subscribe(stream) },
+			ServerStreams: true,
+		}},
+	}
+	for name, method := range unaryMethods {
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{MethodName: name, Handler: unaryHandler(name, method)})
+	}
+	return desc
+}
+
+func unaryHandler(name string, method unaryMethod) func(srv interface{}, ctx context.Context,
+	dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := &Request{}
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		rmq := srv.(*Server).rmq
+		if interceptor == nil {
+			return method(ctx, rmq, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + name}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return method(ctx, rmq, req.(*Request))
+		})
+	}
+}
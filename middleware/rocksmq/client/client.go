@@ -2,6 +2,7 @@ package client
 
 import (
 	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/middleware/rocksmq/broker"
 	"github.com/linkbase/middleware/rocksmq/server"
 	"github.com/linkbase/utils"
 )
@@ -11,9 +12,26 @@ type UniqueID = utils.UniqueID
 
 type Options struct {
 	Server RocksMQ
+
+	// Address is the address of a rocksmq broker, the client dials it instead of using Server if it is set
+	Address string
 }
 
 func NewClient(options Options) (Client, error) {
+	if len(options.Address) > 0 {
+		remote, err := broker.Dial(options.Address)
+		if err != nil {
+			return nil, err
+		}
+		options.Server = remote
+		c, err := newClient(options)
+		if err != nil {
+			remote.Close()
+			return nil, err
+		}
+		c.remote = remote
+		return c, nil
+	}
 	if options.Server == nil {
 		options.Server = server.Rmq
 	}
@@ -27,6 +45,12 @@ type Client interface {
 	// Create a consumer instance and subscribe a topic
 	Subscribe(options ConsumerOptions) (Consumer, error)
 
+	// Create a reader instance of a topic
+	CreateReader(options ReaderOptions) (Reader, error)
+
+	// DestroyTopic deletes the topic with its messages and consumer groups, for every client of the rocksmq
+	DestroyTopic(topic string) error
+
 	// Close the client and free associated resources
 	Close()
 }
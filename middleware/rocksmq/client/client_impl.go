@@ -2,31 +2,246 @@ package client
 
 import (
 	"errors"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/middleware/rocksmq/broker"
+	"go.uber.org/zap"
 	"sync"
+	"sync/atomic"
 )
 
+// memberSeq makes the member names of consumers unique
+var memberSeq atomic.Int64
+
 type client struct {
-	server          RocksMQ
-	producerOptions []ProducerOptions
-	consumerOptions []ConsumerOptions
-	wg              *sync.WaitGroup
-	closeCh         chan struct{}
-	closeOnce       sync.Once
+	server    RocksMQ
+	wg        *sync.WaitGroup
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	// mu orders closeCh and the wg.Add of the consume goroutines
+	mu sync.Mutex
+
+	// remote is the connection to the rocksmq broker dialed by the client, closed with the client
+	remote *broker.Remote
+}
+
+// CreateProducer creates the topic if it is absent and returns a producer bound to it
+func (c *client) CreateProducer(options ProducerOptions) (Producer, error) {
+	// Create a topic in rocksdb, ignore if topic already exists
+	var opts []rocksmq.TopicOption
+	if options.Retention != nil {
+		opts = append(opts, rocksmq.WithRetention(*options.Retention))
+	}
+	if options.Partitions > 0 {
+		opts = append(opts, rocksmq.WithPartitions(options.Partitions))
+	}
+	if options.Compacted {
+		opts = append(opts, rocksmq.WithCompaction())
+	}
+	err := c.server.CreateTopic(options.Topic, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// the topic may exist already, so partitions are taken from rocksmq
+	options.Partitions, err = c.server.GetTopicPartitions(options.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProducer(c, options)
+}
+
+// Subscribe creates the consumer group if it is absent and joins the consumer to it
+func (c *client) Subscribe(options ConsumerOptions) (Consumer, error) {
+	if options.SubscriptionType == SubscriptionShared {
+		options.AckMode = true
+	}
+	if partitions, err := c.server.GetTopicPartitions(options.Topic); err == nil && partitions > 0 {
+		return c.subscribePartitions(options, partitions)
+	}
+	exist, _, err := c.server.ExistConsumerGroup(options.Topic, options.SubscriptionName)
+	if err != nil {
+		return nil, err
+	}
+
+	consumer, err := newConsumer(c, options)
+	if err != nil {
+		return nil, err
+	}
+	// a group in ack mode restored after a restart is resumed from where it was,
+	// an existing group is joined without moving its position
+	if !exist {
+		err = c.server.CreateConsumerGroup(options.Topic, options.SubscriptionName, groupOptions(options)...)
+		if err != nil {
+			return nil, err
+		}
+		if options.SubscriptionInitialPosition == SubscriptionPositionLatest {
+			err = c.server.SeekToLatest(options.Topic, options.SubscriptionName)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		log.Debug("ConsumerGroup already existed", zap.String("topic", options.Topic), zap.String("subscriptionName", options.SubscriptionName))
+	}
+
+	err = c.server.JoinConsumerGroup(options.Topic, options.SubscriptionName, consumer.member,
+		options.SubscriptionType, consumer.msgMutex)
+	if err != nil {
+		if !exist {
+			if err := c.server.DestroyConsumerGroup(options.Topic, options.SubscriptionName); err != nil {
+				log.Warn("Failed to destroy consumer group", zap.String("topic", options.Topic),
+					zap.String("subscriptionName", options.SubscriptionName), zap.Error(err))
+			}
+		}
+		return nil, err
+	}
+	return consumer, nil
+}
+
+// subscribePartitions joins the consumer group of a partitioned topic, the consumer reads the partitions assigned to it
+func (c *client) subscribePartitions(options ConsumerOptions, partitions int) (Consumer, error) {
+	consumer, err := newConsumer(c, options)
+	if err != nil {
+		return nil, err
+	}
+	consumer.partitions = partitions
+	created, err := c.server.JoinPartitionedGroup(options.Topic, options.SubscriptionName, consumer.member,
+		options.SubscriptionType, consumer.msgMutex, groupOptions(options)...)
+	if err != nil {
+		return nil, err
+	}
+	if options.SubscriptionInitialPosition == SubscriptionPositionLatest {
+		for _, p := range created {
+			err = c.server.SeekToLatest(rocksmq.PartitionTopic(options.Topic, p), options.SubscriptionName)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return consumer, nil
+}
+
+// CreateReader creates a reader of the topic, no consumer group is involved
+func (c *client) CreateReader(options ReaderOptions) (Reader, error) {
+	return newReader(c, options)
 }
 
-func (c client) CreateProducer(options ProducerOptions) (Producer, error) {
-	//TODO implement me
-	panic("implement me")
+// DestroyTopic deletes the topic from rocksmq, the consumers of it stop receiving messages
+func (c *client) DestroyTopic(topic string) error {
+	return c.server.DestroyTopic(topic)
+}
+
+func groupOptions(options ConsumerOptions) []rocksmq.ConsumerGroupOption {
+	var opts []rocksmq.ConsumerGroupOption
+	if options.AckMode {
+		opts = append(opts, rocksmq.WithAckMode(options.AckTimeout))
+	}
+	if options.DeadLetterTopic != "" {
+		opts = append(opts, rocksmq.WithDeadLetter(options.DeadLetterTopic, options.MaxFailures))
+	}
+	if options.Filter != "" {
+		opts = append(opts, rocksmq.WithFilter(options.Filter))
+	}
+	return opts
 }
 
-func (c client) Subscribe(options ConsumerOptions) (Consumer, error) {
-	//TODO implement me
-	panic("implement me")
+// consume takes messages from rocksmq and puts them into consumer.Chan(),
+// it is triggered by consumer.MsgMutex which is signaled by producers
+func (c *client) consume(consumer *consumer) {
+	defer c.wg.Done()
+
+	// consume the messages that were produced before the consumer started
+	c.deliver(consumer, 100)
+	for {
+		select {
+		case <-c.closeCh:
+			log.Info("Client is closed, consumer goroutine exit", zap.String("topic", consumer.topic),
+				zap.String("group", consumer.consumerName))
+			return
+		case _, ok := <-consumer.MsgMutex():
+			if !ok {
+				// consumer MsgMutex closed, goroutine exit
+				log.Info("Consumer MsgMutex closed", zap.String("topic", consumer.topic),
+					zap.String("group", consumer.consumerName))
+				return
+			}
+			c.deliver(consumer, 100)
+		}
+	}
+}
+
+// deliver reads the topic of the consumer, or the assigned partitions if the topic is partitioned
+func (c *client) deliver(consumer *consumer, batchMax int) {
+	if consumer.partitions == 0 {
+		c.deliverTopic(consumer, consumer.topic, 0, batchMax)
+		return
+	}
+	partitions, err := c.server.GetAssignedPartitions(consumer.topic, consumer.consumerName, consumer.member)
+	if err != nil {
+		log.Warn("Consumer's goroutine cannot get assigned partitions", zap.String("topic", consumer.topic),
+			zap.String("group", consumer.consumerName), zap.Error(err))
+		return
+	}
+	for _, p := range partitions {
+		c.deliverTopic(consumer, rocksmq.PartitionTopic(consumer.topic, p), p, batchMax)
+	}
+}
+
+func (c *client) deliverTopic(consumer *consumer, topic string, partition int, batchMax int) {
+	for {
+		n := cap(consumer.messageCh) - len(consumer.messageCh)
+		if n == 0 {
+			return
+		}
+		if n > batchMax {
+			n = batchMax
+		}
+		var msgs []rocksmq.ConsumerMessage
+		var err error
+		if consumer.partitions == 0 {
+			msgs, err = c.server.ConsumeMember(topic, consumer.consumerName, consumer.member, n)
+		} else {
+			msgs, err = c.server.Consume(topic, consumer.consumerName, n)
+		}
+		if err != nil {
+			log.Warn("Consumer's goroutine cannot consume", zap.String("topic", topic),
+				zap.String("group", consumer.consumerName), zap.Error(err))
+			return
+		}
+		// no more msgs
+		if len(msgs) == 0 {
+			return
+		}
+		for _, msg := range msgs {
+			select {
+			case consumer.messageCh <- Message{
+				Consumer:        consumer,
+				MsgID:           msg.MsgID,
+				Topic:           topic,
+				Partition:       partition,
+				Payload:         msg.Payload,
+				Properties:      msg.Properties,
+				RedeliveryCount: msg.RedeliveryCount,
+			}:
+			case <-c.closeCh:
+				return
+			}
+		}
+	}
 }
 
-func (c client) Close() {
-	//TODO implement me
-	panic("implement me")
+// Close stops all consumer goroutines and waits for them to exit
+func (c *client) Close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		close(c.closeCh)
+		c.mu.Unlock()
+		c.wg.Wait()
+		if c.remote != nil {
+			c.remote.Close()
+		}
+	})
 }
 
 func newClient(options Options) (*client, error) {
@@ -34,10 +249,9 @@ func newClient(options Options) (*client, error) {
 		return nil, errors.New("options.Server is nil")
 	}
 	c := &client{
-		server:          options.Server,
-		producerOptions: []ProducerOptions{},
-		wg:              &sync.WaitGroup{},
-		closeCh:         make(chan struct{}),
+		server:  options.Server,
+		wg:      &sync.WaitGroup{},
+		closeCh: make(chan struct{}),
 	}
 	return c, nil
 }
@@ -0,0 +1,402 @@
+package client
+
+import (
+	"context"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/middleware/rocksmq/broker"
+	"github.com/linkbase/middleware/rocksmq/server"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) (Client, *server.RocketMQServer) {
+	rmq, err := server.NewRocksMQ(path.Join(t.TempDir(), "rocksmq"), nil)
+	assert.NoError(t, err)
+	c, err := NewClient(Options{Server: rmq})
+	assert.NoError(t, err)
+	return c, rmq
+}
+
+// receive waits for n messages from both consumers
+func receive(t *testing.T, consumer1, consumer2 Consumer, n int) []Message {
+	msgs := make([]Message, 0, n)
+	for len(msgs) < n {
+		select {
+		case msg := <-consumer1.Chan():
+			msgs = append(msgs, msg)
+		case msg := <-consumer2.Chan():
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d messages, want %d", len(msgs), n)
+		}
+	}
+	return msgs
+}
+
+func TestClient_PartitionedTopic(t *testing.T) {
+	c, rmq := newTestClient(t)
+	defer rmq.Close()
+	defer c.Close()
+
+	topic := "test_client_partitioned"
+	producer, err := c.CreateProducer(ProducerOptions{Topic: topic, Partitions: 4})
+	assert.NoError(t, err)
+	consumer1, err := c.Subscribe(ConsumerOptions{Topic: topic, SubscriptionName: "group", SubscriptionType: SubscriptionFailover,
+		SubscriptionInitialPosition: SubscriptionPositionEarliest, MessageChannel: make(chan Message, 100)})
+	assert.NoError(t, err)
+	consumer2, err := c.Subscribe(ConsumerOptions{Topic: topic, SubscriptionName: "group", SubscriptionType: SubscriptionFailover,
+		SubscriptionInitialPosition: SubscriptionPositionEarliest, MessageChannel: make(chan Message, 100)})
+	assert.NoError(t, err)
+
+	// messages with the same key land on the same partition, the others are round-robined
+	for i := 0; i < 4; i++ {
+		_, err = producer.Send(&ProducerMessage{Payload: []byte("keyed_" + strconv.Itoa(i)), Key: "key"})
+		assert.NoError(t, err)
+		_, err = producer.Send(&ProducerMessage{Payload: []byte("plain_" + strconv.Itoa(i))})
+		assert.NoError(t, err)
+	}
+
+	msgs := receive(t, consumer1, consumer2, 8)
+	keyedPartition := -1
+	plainPartitions := make(map[int]bool)
+	for _, msg := range msgs {
+		assert.Equal(t, rocksmq.PartitionTopic(topic, msg.Partition), msg.Topic)
+		if msg.Properties[rocksmq.MessageKeyProperty] == "key" {
+			if keyedPartition == -1 {
+				keyedPartition = msg.Partition
+			}
+			assert.Equal(t, keyedPartition, msg.Partition)
+		} else {
+			plainPartitions[msg.Partition] = true
+		}
+	}
+	assert.Len(t, plainPartitions, 4)
+
+	var lastKeyed UniqueID
+	for _, msg := range msgs {
+		if msg.Partition == keyedPartition && msg.MsgID > lastKeyed {
+			lastKeyed = msg.MsgID
+		}
+	}
+	latest, err := consumer1.GetPartitionLatestMsgID(keyedPartition)
+	assert.NoError(t, err)
+	assert.Equal(t, lastKeyed, latest)
+	assert.Error(t, consumer1.Seek(latest))
+	assert.Error(t, consumer1.SeekPartition(4, latest))
+	_, err = consumer1.GetPartitionLatestMsgID(4)
+	assert.Error(t, err)
+
+	consumer1.Close()
+	consumer2.Close()
+	producer.Close()
+}
+
+func TestClient_AckPartition(t *testing.T) {
+	c, rmq := newTestClient(t)
+	defer rmq.Close()
+	defer c.Close()
+
+	topic := "test_client_ack_partition"
+	producer, err := c.CreateProducer(ProducerOptions{Topic: topic, Partitions: 2})
+	assert.NoError(t, err)
+	consumer, err := c.Subscribe(ConsumerOptions{Topic: topic, SubscriptionName: "group", SubscriptionType: SubscriptionFailover,
+		SubscriptionInitialPosition: SubscriptionPositionEarliest, MessageChannel: make(chan Message, 100), AckMode: true})
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = producer.Send(&ProducerMessage{Payload: []byte("msg_" + strconv.Itoa(i))})
+		assert.NoError(t, err)
+	}
+	msgs := receive(t, consumer, consumer, 4)
+	last, other := msgs[0], msgs[0]
+	for _, msg := range msgs {
+		if msg.MsgID > last.MsgID {
+			last = msg
+		}
+	}
+	for _, msg := range msgs {
+		if msg.Partition != last.Partition {
+			other = msg
+			break
+		}
+	}
+	assert.NotEqual(t, last.Partition, other.Partition)
+
+	// the cumulative ack stays on the partition of the message, so the other partition is still pending
+	assert.NoError(t, consumer.AckCumulative(last))
+	assert.NoError(t, consumer.Nack(other))
+	redelivered := receive(t, consumer, consumer, 1)
+	assert.Equal(t, other.MsgID, redelivered[0].MsgID)
+	assert.Equal(t, 1, redelivered[0].RedeliveryCount)
+	assert.Error(t, consumer.Ack(Message{MsgID: other.MsgID, Partition: 2}))
+
+	consumer.Close()
+	producer.Close()
+}
+
+func TestClient_SubscriptionTypes(t *testing.T) {
+	c, rmq := newTestClient(t)
+	defer rmq.Close()
+	defer c.Close()
+
+	topic := "test_client_subscription"
+	producer, err := c.CreateProducer(ProducerOptions{Topic: topic})
+	assert.NoError(t, err)
+	subscribe := func(group string, subType SubscriptionType) (Consumer, error) {
+		return c.Subscribe(ConsumerOptions{Topic: topic, SubscriptionName: group, SubscriptionType: subType,
+			SubscriptionInitialPosition: SubscriptionPositionEarliest, MessageChannel: make(chan Message, 100)})
+	}
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := producer.Send(&ProducerMessage{Payload: []byte("msg_" + strconv.Itoa(i))})
+			assert.NoError(t, err)
+		}
+	}
+
+	exclusive, err := subscribe("exclusive", SubscriptionExclusive)
+	assert.NoError(t, err)
+	_, err = subscribe("exclusive", SubscriptionExclusive)
+	assert.Error(t, err)
+	exclusive.Close()
+	// the group is kept after its consumer closes and takes a new one
+	exclusive, err = subscribe("exclusive", SubscriptionExclusive)
+	assert.NoError(t, err)
+	exclusive.Close()
+
+	active, err := subscribe("failover", SubscriptionFailover)
+	assert.NoError(t, err)
+	standby, err := subscribe("failover", SubscriptionFailover)
+	assert.NoError(t, err)
+	shared1, err := subscribe("shared", SubscriptionShared)
+	assert.NoError(t, err)
+	shared2, err := subscribe("shared", SubscriptionShared)
+	assert.NoError(t, err)
+	_, err = subscribe("shared", SubscriptionFailover)
+	assert.Error(t, err)
+
+	send(4)
+	assert.Len(t, receive(t, active, standby, 4), 4)
+	assert.Len(t, standby.Chan(), 0)
+	active.Close()
+	send(2)
+	for _, msg := range receive(t, standby, standby, 2) {
+		assert.Equal(t, standby, msg.Consumer)
+	}
+
+	msgs := receive(t, shared1, shared2, 6)
+	counts := make(map[Consumer]int)
+	for _, msg := range msgs {
+		counts[msg.Consumer]++
+		assert.NoError(t, msg.Consumer.Ack(msg))
+	}
+	assert.Equal(t, 3, counts[shared1])
+	assert.Equal(t, 3, counts[shared2])
+
+	standby.Close()
+	shared1.Close()
+	shared2.Close()
+	producer.Close()
+}
+
+func TestClient_DelayedDelivery(t *testing.T) {
+	c, rmq := newTestClient(t)
+	defer rmq.Close()
+	defer c.Close()
+
+	topic := "test_client_delayed"
+	producer, err := c.CreateProducer(ProducerOptions{Topic: topic})
+	assert.NoError(t, err)
+	consumer, err := c.Subscribe(ConsumerOptions{Topic: topic, SubscriptionName: "group",
+		SubscriptionInitialPosition: SubscriptionPositionEarliest, MessageChannel: make(chan Message, 100)})
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = producer.Send(&ProducerMessage{Payload: []byte("at"), DeliverAt: start.Add(400 * time.Millisecond)})
+	assert.NoError(t, err)
+	_, err = producer.Send(&ProducerMessage{Payload: []byte("after"), DeliverAfter: 200 * time.Millisecond})
+	assert.NoError(t, err)
+	_, err = producer.Send(&ProducerMessage{Payload: []byte("now")})
+	assert.NoError(t, err)
+
+	msgs := receive(t, consumer, consumer, 3)
+	assert.Equal(t, "now", string(msgs[0].Payload))
+	assert.Equal(t, "after", string(msgs[1].Payload))
+	assert.Equal(t, "at", string(msgs[2].Payload))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	consumer.Close()
+	producer.Close()
+}
+
+func TestClient_Compression(t *testing.T) {
+	c, rmq := newTestClient(t)
+	defer rmq.Close()
+	defer c.Close()
+
+	topic := "test_client_compression"
+	producer, err := c.CreateProducer(ProducerOptions{Topic: topic, Compression: rocksmq.CompressionLZ4})
+	assert.NoError(t, err)
+	consumer, err := c.Subscribe(ConsumerOptions{Topic: topic, SubscriptionName: "group",
+		SubscriptionInitialPosition: SubscriptionPositionEarliest, MessageChannel: make(chan Message, 100)})
+	assert.NoError(t, err)
+
+	payload := []byte(strings.Repeat("compressible ", 200))
+	_, err = producer.Send(&ProducerMessage{Payload: payload, Properties: map[string]string{"k": "v"}})
+	assert.NoError(t, err)
+	// a scheduled message is compressed once it is delivered
+	_, err = producer.Send(&ProducerMessage{Payload: payload, DeliverAfter: 100 * time.Millisecond})
+	assert.NoError(t, err)
+
+	msgs := receive(t, consumer, consumer, 2)
+	for _, msg := range msgs {
+		assert.Equal(t, payload, msg.Payload)
+		assert.NotContains(t, msg.Properties, rocksmq.CompressionProperty)
+	}
+	assert.Equal(t, "v", msgs[0].Properties["k"])
+	stats, err := rmq.GetTopicStats(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*len(payload)), stats.RawBytes)
+	assert.True(t, stats.Bytes < stats.RawBytes)
+
+	consumer.Close()
+	producer.Close()
+}
+
+func TestClient_Reader(t *testing.T) {
+	c, rmq := newTestClient(t)
+	defer rmq.Close()
+	defer c.Close()
+
+	topic := "test_client_reader"
+	_, err := c.CreateReader(ReaderOptions{Topic: topic})
+	assert.Error(t, err)
+	producer, err := c.CreateProducer(ProducerOptions{Topic: topic})
+	assert.NoError(t, err)
+	var ids []UniqueID
+	for i := 0; i < 3; i++ {
+		id, err := producer.Send(&ProducerMessage{Payload: []byte("msg_" + strconv.Itoa(i))})
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	reader, err := c.CreateReader(ReaderOptions{Topic: topic, StartMessageID: EarliestMessageID()})
+	assert.NoError(t, err)
+	assert.Equal(t, topic, reader.Topic())
+	var payloads []string
+	for reader.HasNext() {
+		msg, err := reader.Next(context.Background())
+		assert.NoError(t, err)
+		payloads = append(payloads, string(msg.Payload))
+	}
+	assert.Equal(t, []string{"msg_0", "msg_1", "msg_2"}, payloads)
+
+	assert.NoError(t, reader.Seek(ids[1]))
+	msg, err := reader.Next(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, ids[1], msg.MsgID)
+	reader.Close()
+
+	latest, err := c.CreateReader(ReaderOptions{Topic: topic, StartMessageID: LatestMessageID()})
+	assert.NoError(t, err)
+	assert.False(t, latest.HasNext())
+	latest.Close()
+	producer.Close()
+}
+
+func TestClient_RemoteBroker(t *testing.T) {
+	rmq, err := server.NewRocksMQ(path.Join(t.TempDir(), "rocksmq"), nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := grpc.NewServer()
+	broker.RegisterServer(s, rmq)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	c, err := NewClient(Options{Address: lis.Addr().String()})
+	assert.NoError(t, err)
+	defer c.Close()
+
+	topic := "test_client_remote"
+	producer, err := c.CreateProducer(ProducerOptions{Topic: topic, Partitions: 2})
+	assert.NoError(t, err)
+	subscribe := func() Consumer {
+		consumer, err := c.Subscribe(ConsumerOptions{Topic: topic, SubscriptionName: "group", SubscriptionType: SubscriptionFailover,
+			SubscriptionInitialPosition: SubscriptionPositionEarliest, MessageChannel: make(chan Message, 100), AckMode: true})
+		assert.NoError(t, err)
+		return consumer
+	}
+	consumer1, consumer2 := subscribe(), subscribe()
+	for i := 0; i < 6; i++ {
+		_, err = producer.Send(&ProducerMessage{Payload: []byte("msg_" + strconv.Itoa(i))})
+		assert.NoError(t, err)
+	}
+	msgs := receive(t, consumer1, consumer2, 6)
+	partitions := make(map[int]Consumer)
+	for _, msg := range msgs {
+		assert.NoError(t, msg.Consumer.Ack(msg))
+		if owner, ok := partitions[msg.Partition]; ok {
+			assert.Equal(t, owner, msg.Consumer)
+		}
+		partitions[msg.Partition] = msg.Consumer
+	}
+	assert.Len(t, partitions, 2)
+
+	reader, err := c.CreateReader(ReaderOptions{Topic: rocksmq.PartitionTopic(topic, 0), StartMessageID: EarliestMessageID(), StartMessageIDInclusive: true})
+	assert.NoError(t, err)
+	msg, err := reader.Next(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "msg_0", string(msg.Payload))
+	reader.Close()
+
+	consumer1.Close()
+	consumer2.Close()
+	producer.Close()
+}
+
+func TestClient_ProducerClose(t *testing.T) {
+	c, rmq := newTestClient(t)
+	defer rmq.Close()
+
+	topic := "test_client_producer_close"
+	producer, err := c.CreateProducer(ProducerOptions{Topic: topic})
+	assert.NoError(t, err)
+	other, err := c.CreateProducer(ProducerOptions{Topic: topic})
+	assert.NoError(t, err)
+	consumer, err := c.Subscribe(ConsumerOptions{Topic: topic, SubscriptionName: "group",
+		SubscriptionInitialPosition: SubscriptionPositionEarliest})
+	assert.NoError(t, err)
+	_, err = producer.Send(&ProducerMessage{Payload: []byte("before")})
+	assert.NoError(t, err)
+
+	// closing a producer keeps the topic for the other producers and consumers
+	producer.Close()
+	_, err = producer.Send(&ProducerMessage{Payload: []byte("closed")})
+	assert.Error(t, err)
+	_, err = rmq.GetTopicStats(topic)
+	assert.NoError(t, err)
+	_, err = other.Send(&ProducerMessage{Payload: []byte("after")})
+	assert.NoError(t, err)
+	msgs := receive(t, consumer, consumer, 2)
+	assert.Equal(t, "before", string(msgs[0].Payload))
+	assert.Equal(t, "after", string(msgs[1].Payload))
+
+	assert.NoError(t, c.DestroyTopic(topic))
+	_, err = rmq.GetTopicStats(topic)
+	assert.Error(t, err)
+
+	// a consumer started after the client is closed does not consume
+	_, err = c.CreateProducer(ProducerOptions{Topic: topic})
+	assert.NoError(t, err)
+	late, err := c.Subscribe(ConsumerOptions{Topic: topic, SubscriptionName: "late"})
+	assert.NoError(t, err)
+	c.Close()
+	late.Chan()
+	c.(*client).wg.Wait()
+}
@@ -1,5 +1,10 @@
 package client
 
+import (
+	"github.com/linkbase/middleware/rocksmq"
+	"time"
+)
+
 // EarliestMessageID is used to get the earliest message ID, default -1
 func EarliestMessageID() UniqueID {
 	return -1
@@ -8,6 +13,29 @@ func EarliestMessageID() UniqueID {
 // SubscriptionInitialPosition is the type of a subscription initial position
 type SubscriptionInitialPosition int
 
+const (
+	// SubscriptionPositionLatest is latest position which means the start consuming position will be the last message
+	SubscriptionPositionLatest SubscriptionInitialPosition = iota
+
+	// SubscriptionPositionEarliest is earliest position which means the start consuming position will be the first message
+	SubscriptionPositionEarliest
+)
+
+// SubscriptionType decides how the consumers of a subscription share its messages
+type SubscriptionType = rocksmq.SubscriptionType
+
+const (
+	// SubscriptionExclusive allows a single consumer on the subscription, the default
+	SubscriptionExclusive = rocksmq.SubscriptionExclusive
+
+	// SubscriptionFailover delivers the messages to the first consumer, a standby one takes over when it is closed
+	SubscriptionFailover = rocksmq.SubscriptionFailover
+
+	// SubscriptionShared round-robins the messages across the consumers, each message is acked on its own.
+	// It turns AckMode on
+	SubscriptionShared = rocksmq.SubscriptionShared
+)
+
 // ConsumerOptions is the options of a consumer
 type ConsumerOptions struct {
 	// The topic that this consumer will subscribe on
@@ -20,9 +48,29 @@ type ConsumerOptions struct {
 	// Default is `Latest`
 	SubscriptionInitialPosition
 
+	// SubscriptionType is how the consumers of the subscription share its messages
+	// Default is `Exclusive`, failover and shared consumers of a partitioned topic are assigned its partitions
+	SubscriptionType SubscriptionType
+
 	// Message for this consumer
 	// When a message is received, it will be pushed to this channel for consumption
 	MessageChannel chan Message
+
+	// AckMode keeps received messages pending until they are acked, unacked messages are redelivered
+	AckMode bool
+
+	// AckTimeout is how long a message waits for its ack before redelivery, 0 means the rocksmq config
+	AckTimeout time.Duration
+
+	// DeadLetterTopic receives the messages nacked MaxFailures times, it requires AckMode
+	DeadLetterTopic string
+
+	// MaxFailures is how many nacks a message takes before it is moved to DeadLetterTopic
+	MaxFailures int
+
+	// Filter is a filter expression over the message properties evaluated by rocksmq, see rocksmq.Filter.
+	// The messages not matching it are skipped
+	Filter string
 }
 
 // Message is the message content of a consumer message
@@ -32,6 +80,10 @@ type Message struct {
 	Topic      string
 	Payload    []byte
 	Properties map[string]string
+	// Partition is the partition of a partitioned topic the message is read from, Topic is the partition topic then
+	Partition int
+	// RedeliveryCount is how many times the message was delivered before, only counted in ack mode
+	RedeliveryCount int
 }
 
 // Consumer interface provide operations for a consumer
@@ -51,12 +103,31 @@ type Consumer interface {
 	// Seek to the uniqueID position
 	Seek(UniqueID) error //nolint:govet
 
+	// SeekPartition seeks a partition of a partitioned topic to the uniqueID position,
+	// partition 0 is the topic itself if it is not partitioned
+	SeekPartition(partition int, id UniqueID) error
+
+	// Seek to the first message produced at or after ts
+	SeekByTime(ts time.Time) error
+
+	// Ack acknowledges a message received in ack mode
+	Ack(Message) error
+
+	// AckCumulative acknowledges every message of the partition up to and including the message in ack mode
+	AckCumulative(Message) error
+
+	// Nack asks for the redelivery of a message received in ack mode
+	Nack(Message) error
+
 	// Close consumer
 	Close()
 
-	// GetLatestMsgID get the latest msgID
+	// GetLatestMsgID get the latest msgID, which is the latest of all partitions for a partitioned topic
 	GetLatestMsgID() (int64, error)
 
+	// GetPartitionLatestMsgID get the latest msgID of a partition of a partitioned topic
+	GetPartitionLatestMsgID(partition int) (int64, error)
+
 	// check created topic whether vaild or not
 	CheckTopicValid(topic string) error
 }
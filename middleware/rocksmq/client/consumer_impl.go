@@ -0,0 +1,216 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+var _ Consumer = (*consumer)(nil)
+
+type consumer struct {
+	topic        string
+	client       *client
+	consumerName string
+	options      ConsumerOptions
+
+	startOnce sync.Once
+
+	msgMutex  chan struct{}
+	messageCh chan Message
+
+	// member is the name the consumer joins the group with
+	member string
+	// partitions is the number of partitions of a partitioned topic
+	partitions int
+}
+
+func newConsumer(c *client, options ConsumerOptions) (*consumer, error) {
+	if c == nil {
+		return nil, errors.New("client is nil")
+	}
+	if options.Topic == "" {
+		return nil, errors.New("topic is empty")
+	}
+	if options.SubscriptionName == "" {
+		return nil, errors.New("subscription name is empty")
+	}
+
+	messageCh := options.MessageChannel
+	if options.MessageChannel == nil {
+		messageCh = make(chan Message, 1)
+	}
+	return &consumer{
+		topic:        options.Topic,
+		client:       c,
+		consumerName: options.SubscriptionName,
+		options:      options,
+		msgMutex:     make(chan struct{}, 1),
+		messageCh:    messageCh,
+		member:       fmt.Sprintf("%s-%d", options.SubscriptionName, memberSeq.Add(1)),
+	}, nil
+}
+
+// Subscription returns the consumer name
+func (c *consumer) Subscription() string {
+	return c.consumerName
+}
+
+// Topic returns the topic of the consumer
+func (c *consumer) Topic() string {
+	return c.topic
+}
+
+// MsgMutex returns the signal channel which is notified when new messages arrive
+func (c *consumer) MsgMutex() chan struct{} {
+	return c.msgMutex
+}
+
+// Chan starts the consume goroutine on first call and returns the message channel
+func (c *consumer) Chan() <-chan Message {
+	c.startOnce.Do(func() {
+		// a closed client may be waiting for its goroutines already
+		c.client.mu.Lock()
+		defer c.client.mu.Unlock()
+		select {
+		case <-c.client.closeCh:
+			return
+		default:
+		}
+		c.client.wg.Add(1)
+		go c.client.consume(c)
+	})
+	return c.messageCh
+}
+
+// topics returns the topic of the consumer, or all of its partition topics if it is partitioned
+func (c *consumer) topics() []string {
+	if c.partitions == 0 {
+		return []string{c.topic}
+	}
+	topics := make([]string, 0, c.partitions)
+	for p := 0; p < c.partitions; p++ {
+		topics = append(topics, rocksmq.PartitionTopic(c.topic, p))
+	}
+	return topics
+}
+
+func (c *consumer) partitionTopic(partition int) (string, error) {
+	if c.partitions == 0 && partition == 0 {
+		return c.topic, nil
+	}
+	if partition < 0 || partition >= c.partitions {
+		return "", fmt.Errorf("invalid partition %d of topic %s", partition, c.topic)
+	}
+	return rocksmq.PartitionTopic(c.topic, partition), nil
+}
+
+// Seek moves the consume position of the group to id and wakes up the consume goroutine
+func (c *consumer) Seek(id UniqueID) error { //nolint:govet
+	if c.partitions > 0 {
+		return fmt.Errorf("topic %s is partitioned, seek its partitions instead", c.topic)
+	}
+	return c.SeekPartition(0, id)
+}
+
+// SeekPartition moves the consume position of the group on the partition to id and wakes up the consume goroutine
+func (c *consumer) SeekPartition(partition int, id UniqueID) error {
+	topic, err := c.partitionTopic(partition)
+	if err != nil {
+		return err
+	}
+	err = c.client.server.Seek(topic, c.consumerName, id)
+	if err != nil {
+		return err
+	}
+	c.client.server.Notify(topic, c.consumerName)
+	return nil
+}
+
+// SeekByTime moves the consume position of the group to the first message produced at or after ts
+// and wakes up the consume goroutine
+func (c *consumer) SeekByTime(ts time.Time) error {
+	for _, topic := range c.topics() {
+		err := c.client.server.SeekByTime(topic, c.consumerName, ts)
+		if err != nil {
+			return err
+		}
+		c.client.server.Notify(topic, c.consumerName)
+	}
+	return nil
+}
+
+// Ack acknowledges a message received in ack mode on the partition it is read from
+func (c *consumer) Ack(msg Message) error {
+	topic, err := c.partitionTopic(msg.Partition)
+	if err != nil {
+		return err
+	}
+	return c.client.server.Ack(topic, c.consumerName, msg.MsgID)
+}
+
+// AckCumulative acknowledges every message of the partition up to and including msg in ack mode
+func (c *consumer) AckCumulative(msg Message) error {
+	topic, err := c.partitionTopic(msg.Partition)
+	if err != nil {
+		return err
+	}
+	return c.client.server.AckCumulative(topic, c.consumerName, msg.MsgID)
+}
+
+// Nack asks for the redelivery of a message received in ack mode on the partition it is read from
+func (c *consumer) Nack(msg Message) error {
+	topic, err := c.partitionTopic(msg.Partition)
+	if err != nil {
+		return err
+	}
+	return c.client.server.Nack(topic, c.consumerName, msg.MsgID)
+}
+
+// Close leaves the consumer group, which also stops the consume goroutine.
+// The group is kept after the last consumer leaves
+func (c *consumer) Close() {
+	var err error
+	if c.partitions > 0 {
+		err = c.client.server.LeavePartitionedGroup(c.topic, c.consumerName, c.member)
+	} else {
+		err = c.client.server.LeaveConsumerGroup(c.topic, c.consumerName, c.member)
+	}
+	if err != nil {
+		log.Warn("Consumer close failed", zap.String("topicName", c.topic),
+			zap.String("groupName", c.consumerName), zap.Error(err))
+	}
+}
+
+// GetLatestMsgID returns the latest message id of the topic, or of all its partitions
+func (c *consumer) GetLatestMsgID() (int64, error) {
+	latest := EarliestMessageID()
+	for _, topic := range c.topics() {
+		msgID, err := c.client.server.GetLatestMsg(topic)
+		if err != nil {
+			return latest, err
+		}
+		if msgID > latest {
+			latest = msgID
+		}
+	}
+	return latest, nil
+}
+
+// GetPartitionLatestMsgID returns the latest message id of the partition
+func (c *consumer) GetPartitionLatestMsgID(partition int) (int64, error) {
+	topic, err := c.partitionTopic(partition)
+	if err != nil {
+		return EarliestMessageID(), err
+	}
+	return c.client.server.GetLatestMsg(topic)
+}
+
+// CheckTopicValid checks whether the topic exists and is empty
+func (c *consumer) CheckTopicValid(topic string) error {
+	return c.client.server.CheckTopicValid(topic)
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"github.com/linkbase/middleware/log"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// Rmq is the global rocksmq client of a slave, dialed to the broker of master once
+var Rmq Client
+
+// once is used to init the global client
+var once sync.Once
+
+// InitClient dials the rocksmq broker at address and keeps the client in Rmq
+func InitClient(address string) error {
+	var finalErr error
+	once.Do(func() {
+		log.Debug("initializing global rmq client", zap.String("address", address))
+		Rmq, finalErr = NewClient(Options{Address: address})
+	})
+	return finalErr
+}
+
+// CloseClient closes the global client and its connection to the broker
+func CloseClient() {
+	log.Debug("Close Rocksmq client!")
+	if Rmq != nil {
+		Rmq.Close()
+	}
+}
@@ -1,14 +1,40 @@
 package client
 
+import (
+	"github.com/linkbase/middleware/rocksmq"
+	"time"
+)
+
 // ProducerOptions is the options of a producer
 type ProducerOptions struct {
 	Topic string
+
+	// Retention is the retention policy of the topic when it is created by the producer,
+	// nil means the rocksmq config is used
+	Retention *rocksmq.RetentionPolicy
+
+	// Partitions is the number of partitions of the topic when it is created by the producer
+	Partitions int
+
+	// Compacted makes the topic keep only the newest message of each key when it is created by the producer,
+	// send a message with the key and an empty payload to drop a key
+	Compacted bool
+
+	// Compression compresses the payloads in storage, they are decompressed on consume. Empty means none
+	Compression rocksmq.Compression
 }
 
 // ProducerMessage is the message of a producer
 type ProducerMessage struct {
 	Payload    []byte
 	Properties map[string]string
+	// Key routes the message to a partition of a partitioned topic, messages without key are round-robined
+	Key string
+	// DeliverAt delays the message until the time, it is not consumed before it. The message is delivered under
+	// a new id, not the one Send returns, and a crash while it is released may deliver it twice
+	DeliverAt time.Time
+	// DeliverAfter delays the message for the duration, it is ignored if DeliverAt is set, see DeliverAt
+	DeliverAfter time.Duration
 }
 
 // Producer provedes some operations for a producer
@@ -16,9 +42,10 @@ type Producer interface {
 	// return the topic which producer is publishing to
 	Topic() string
 
-	// publish a message
+	// publish a message and return its id, for a delayed message the id is only a schedule handle,
+	// it is not the id the message is consumed with and can not be sought or acked
 	Send(message *ProducerMessage) (UniqueID, error)
 
-	// Close a producer
+	// Close a producer, the topic and its messages are kept, see Client.DestroyTopic
 	Close()
 }
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/rocksmq"
+	"hash/fnv"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var _ Producer = (*producer)(nil)
+
+type producer struct {
+	// client which the producer belong to
+	c     *client
+	topic string
+
+	// partitions is the number of partitions of a partitioned topic, next is the round-robin cursor
+	partitions int
+	next       atomic.Uint64
+
+	compression rocksmq.Compression
+
+	closed atomic.Bool
+}
+
+func newProducer(c *client, options ProducerOptions) (*producer, error) {
+	if c == nil {
+		return nil, errors.New("client is nil")
+	}
+	if options.Topic == "" {
+		return nil, errors.New("topic is empty")
+	}
+	return &producer{
+		c:           c,
+		topic:       options.Topic,
+		partitions:  options.Partitions,
+		compression: options.Compression,
+	}, nil
+}
+
+// Topic returns the topic which producer is publishing to
+func (p *producer) Topic() string {
+	return p.topic
+}
+
+// route picks the partition by the hash of the key, or round-robin if there is no key
+func (p *producer) route(key string) int {
+	if key == "" {
+		return int((p.next.Add(1) - 1) % uint64(p.partitions))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(p.partitions))
+}
+
+// Send produces message in rocksmq, the message goes to one partition if the topic is partitioned
+func (p *producer) Send(message *ProducerMessage) (UniqueID, error) {
+	if p.closed.Load() {
+		return 0, fmt.Errorf("producer of topic %s is closed", p.topic)
+	}
+	properties := message.Properties
+	deliverAt := message.DeliverAt
+	if deliverAt.IsZero() && message.DeliverAfter > 0 {
+		deliverAt = time.Now().Add(message.DeliverAfter)
+	}
+	compressed := p.compression != "" && p.compression != rocksmq.CompressionNone
+	if message.Key != "" || !deliverAt.IsZero() || compressed {
+		properties = make(map[string]string, len(message.Properties)+3)
+		for k, v := range message.Properties {
+			properties[k] = v
+		}
+		if message.Key != "" {
+			properties[rocksmq.MessageKeyProperty] = message.Key
+		}
+		if !deliverAt.IsZero() {
+			properties[rocksmq.DeliverAtProperty] = strconv.FormatInt(deliverAt.UnixMilli(), 10)
+		}
+		if compressed {
+			properties[rocksmq.CompressionProperty] = string(p.compression)
+		}
+	}
+	topic := p.topic
+	if p.partitions > 0 {
+		topic = rocksmq.PartitionTopic(p.topic, p.route(message.Key))
+	}
+	ids, err := p.c.server.Produce(topic, []rocksmq.ProducerMessage{
+		{
+			Payload:    message.Payload,
+			Properties: properties,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// Close stops the producer from sending, the topic is kept for the other producers and consumers of the rocksmq
+func (p *producer) Close() {
+	p.closed.Store(true)
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"github.com/linkbase/middleware/rocksmq"
+)
+
+// LatestMessageID is used to start a reader from the latest message
+func LatestMessageID() UniqueID {
+	return rocksmq.LatestMessageID
+}
+
+// ReaderOptions is the options of a reader
+type ReaderOptions struct {
+	// The topic that this reader will read, each partition of a partitioned topic is read on its own
+	Topic string
+
+	// StartMessageID is the message the reader starts from, EarliestMessageID() and LatestMessageID()
+	// stand for either end of the topic
+	StartMessageID UniqueID
+
+	// StartMessageIDInclusive makes the reader read the start message itself, otherwise it starts after it
+	StartMessageIDInclusive bool
+}
+
+// Reader reads a topic from a position without a subscription, it is not persisted
+// and does not keep messages from being purged
+type Reader interface {
+	// returns the topic of the reader
+	Topic() string
+
+	// Next blocks until the next message is read or ctx is done
+	Next(ctx context.Context) (Message, error)
+
+	// HasNext tells whether a message can be read without blocking
+	HasNext() bool
+
+	// Seek moves the reader to the uniqueID position, the message itself is read next
+	Seek(UniqueID) error //nolint:govet
+
+	// Close the reader
+	Close()
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"errors"
+)
+
+var _ Reader = (*reader)(nil)
+
+type reader struct {
+	c          *client
+	topic      string
+	readerName string
+}
+
+func newReader(c *client, options ReaderOptions) (*reader, error) {
+	if c == nil {
+		return nil, errors.New("client is nil")
+	}
+	if options.Topic == "" {
+		return nil, errors.New("topic is empty")
+	}
+	readerName, err := c.server.CreateReader(options.Topic, options.StartMessageID, options.StartMessageIDInclusive)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		c:          c,
+		topic:      options.Topic,
+		readerName: readerName,
+	}, nil
+}
+
+// Topic returns the topic of the reader
+func (r *reader) Topic() string {
+	return r.topic
+}
+
+// Next blocks until the next message is read or ctx is done
+func (r *reader) Next(ctx context.Context) (Message, error) {
+	msg, err := r.c.server.Next(ctx, r.topic, r.readerName)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		MsgID:      msg.MsgID,
+		Topic:      r.topic,
+		Payload:    msg.Payload,
+		Properties: msg.Properties,
+	}, nil
+}
+
+// HasNext tells whether a message can be read without blocking
+func (r *reader) HasNext() bool {
+	return r.c.server.HasNext(r.topic, r.readerName)
+}
+
+// Seek moves the reader to id, the message itself is read next
+func (r *reader) Seek(id UniqueID) error { //nolint:govet
+	return r.c.server.ReaderSeek(r.topic, r.readerName, id)
+}
+
+// Close closes the reader
+func (r *reader) Close() {
+	r.c.server.CloseReader(r.topic, r.readerName)
+}
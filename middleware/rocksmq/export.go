@@ -0,0 +1,152 @@
+package rocksmq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// exportMagic starts an export file. Each message follows as a record of a uint32 length and a body holding the
+// uint64 message id, the uint32 length of the properties in json, the properties and the payload, all big endian
+var exportMagic = []byte("RMQEXPORT1\n")
+
+const (
+	// exportBatchSize is the number of messages ExportTopic reads at a time
+	exportBatchSize = 256
+	// importBatchSize is the number of messages ImportTopic produces at a time
+	importBatchSize = 256
+)
+
+// ExportTopic writes the messages of the topic with ids in [from, to] to w, from may be EarliestMessageID and to
+// LatestMessageID. The range is cut at the latest message when the export starts, so messages produced meanwhile are
+// left out. Scheduled messages whose deliver time has not come are not in the topic yet, so they are left out too,
+// TopicStats.Scheduled tells how many. Payloads are exported decompressed. It returns the number of messages written
+func ExportTopic(rmq RocksMQ, topic string, from, to UniqueID, w io.Writer) (int, error) {
+	partitions, err := rmq.GetTopicPartitions(topic)
+	if err != nil {
+		return 0, err
+	}
+	if partitions > 0 {
+		return 0, fmt.Errorf("topic %s has %d partitions, export them one by one", topic, partitions)
+	}
+	latest, err := rmq.GetLatestMsg(topic)
+	if err != nil {
+		return 0, err
+	}
+	if to > latest {
+		to = latest
+	}
+	bw := bufio.NewWriter(w)
+	if _, err = bw.Write(exportMagic); err != nil {
+		return 0, err
+	}
+	reader, err := rmq.CreateReader(topic, from, true)
+	if err != nil {
+		return 0, err
+	}
+	defer rmq.CloseReader(topic, reader)
+	count := 0
+	for {
+		msgs, err := rmq.NextBatch(topic, reader, exportBatchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(msgs) == 0 {
+			return count, bw.Flush()
+		}
+		for i := range msgs {
+			if msgs[i].MsgID > to {
+				return count, bw.Flush()
+			}
+			if err = writeRecord(bw, &msgs[i]); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
+
+func writeRecord(w io.Writer, msg *ConsumerMessage) error {
+	props, err := json.Marshal(msg.Properties)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 16, 16+len(props)+len(msg.Payload))
+	binary.BigEndian.PutUint32(record, uint32(12+len(props)+len(msg.Payload)))
+	binary.BigEndian.PutUint64(record[4:], uint64(msg.MsgID))
+	binary.BigEndian.PutUint32(record[12:], uint32(len(props)))
+	record = append(record, props...)
+	record = append(record, msg.Payload...)
+	_, err = w.Write(record)
+	return err
+}
+
+// ImportTopic produces the messages of an export file read from r into the topic, which is created if it does not
+// exist. The messages get new ids. It returns the number of messages produced
+func ImportTopic(rmq RocksMQ, topic string, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, exportMagic) {
+		return 0, errors.New("not a rocksmq export file")
+	}
+	if err := rmq.CreateTopic(topic); err != nil {
+		return 0, err
+	}
+	count := 0
+	batch := make([]ProducerMessage, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := rmq.Produce(topic, batch); err != nil {
+			return err
+		}
+		count += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		msg, err := readRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		batch = append(batch, msg)
+		if len(batch) == importBatchSize {
+			if err = flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, flush()
+}
+
+func readRecord(r io.Reader) (ProducerMessage, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return ProducerMessage{}, err
+	}
+	size := binary.BigEndian.Uint32(head[:])
+	if size < 12 {
+		return ProducerMessage{}, fmt.Errorf("invalid record size %d", size)
+	}
+	record := make([]byte, size)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return ProducerMessage{}, fmt.Errorf("truncated record: %w", err)
+	}
+	propsLen := binary.BigEndian.Uint32(record[8:])
+	if uint64(propsLen) > uint64(size-12) {
+		return ProducerMessage{}, fmt.Errorf("invalid properties size %d", propsLen)
+	}
+	msg := ProducerMessage{Payload: record[12+propsLen:]}
+	if err := json.Unmarshal(record[12:12+propsLen], &msg.Properties); err != nil {
+		return ProducerMessage{}, err
+	}
+	return msg, nil
+}
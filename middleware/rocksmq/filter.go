@@ -0,0 +1,373 @@
+package rocksmq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter is a compiled filter expression over the properties of a message. An expression is made of predicates
+// combined with AND, OR, NOT and parentheses, a predicate compares a property with literals:
+//
+//	region = 'eu' AND level IN ('warn', 'error')
+//	path PREFIX '/api/' OR NOT retries >= 3
+//	size BETWEEN 1024 AND 4096
+//
+// Strings are quoted with ' or ", numbers may be left unquoted. =, != and IN compare strings, <, <=, >, >= and
+// BETWEEN compare numbers. A predicate on a missing property, or a numeric one on a property which is not a number,
+// does not match
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+// ParseFilter compiles a filter expression
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", expr, err)
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", expr, err)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// Match tells whether the properties of a message match the filter
+func (f *Filter) Match(properties map[string]string) bool {
+	return f.root.match(properties)
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+type filterNode interface {
+	match(properties map[string]string) bool
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n andNode) match(properties map[string]string) bool {
+	return n.left.match(properties) && n.right.match(properties)
+}
+
+type orNode struct{ left, right filterNode }
+
+func (n orNode) match(properties map[string]string) bool {
+	return n.left.match(properties) || n.right.match(properties)
+}
+
+type notNode struct{ node filterNode }
+
+func (n notNode) match(properties map[string]string) bool {
+	return !n.node.match(properties)
+}
+
+// stringNode is =, != and IN, which is true if the property equals any of the values
+type stringNode struct {
+	key    string
+	values []string
+	negate bool
+}
+
+func (n stringNode) match(properties map[string]string) bool {
+	val, ok := properties[n.key]
+	if !ok {
+		return false
+	}
+	for _, v := range n.values {
+		if v == val {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+type prefixNode struct{ key, prefix string }
+
+func (n prefixNode) match(properties map[string]string) bool {
+	val, ok := properties[n.key]
+	return ok && strings.HasPrefix(val, n.prefix)
+}
+
+// rangeNode is the numeric comparisons, a nil bound is open
+type rangeNode struct {
+	key                  string
+	lower, upper         *float64
+	lowerOpen, upperOpen bool
+}
+
+func (n rangeNode) match(properties map[string]string) bool {
+	val, ok := properties[n.key]
+	if !ok {
+		return false
+	}
+	num, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return false
+	}
+	if n.lower != nil && (num < *n.lower || n.lowerOpen && num == *n.lower) {
+		return false
+	}
+	if n.upper != nil && (num > *n.upper || n.upperOpen && num == *n.upper) {
+		return false
+	}
+	return true
+}
+
+type tokenKind int
+
+const (
+	identToken tokenKind = iota
+	stringToken
+	numberToken
+	symbolToken
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			j := i + 1
+			for j < len(runes) && runes[j] != r {
+				j++
+			}
+			if j == len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, filterToken{kind: stringToken, text: string(runes[i+1 : j])})
+			i = j + 1
+		case r == '(' || r == ')' || r == ',' || r == '=':
+			tokens = append(tokens, filterToken{kind: symbolToken, text: string(r)})
+			i++
+		case r == '!' || r == '<' || r == '>':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, filterToken{kind: symbolToken, text: string(runes[i : i+2])})
+				i += 2
+			} else if r == '!' {
+				return nil, fmt.Errorf("unexpected ! at %d", i)
+			} else {
+				tokens = append(tokens, filterToken{kind: symbolToken, text: string(r)})
+				i++
+			}
+		case r == '-' || r == '+' || r == '.' || unicode.IsDigit(r):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || strings.ContainsRune(".eE+-", runes[j])) {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: numberToken, text: string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || strings.ContainsRune("_.-", runes[j])) {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: identToken, text: string(runes[i:j])})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %c at %d", r, i)
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser is a recursive descent parser, OR binds looser than AND, which binds looser than NOT
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// keyword consumes the next token if it is the keyword, keywords are case insensitive
+func (p *filterParser) keyword(word string) bool {
+	if t, ok := p.peek(); ok && t.kind == identToken && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) symbol(s string) bool {
+	if t, ok := p.peek(); ok && t.kind == symbolToken && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(s string) error {
+	if p.symbol(s) {
+		return nil
+	}
+	if t, ok := p.peek(); ok {
+		return fmt.Errorf("expect %s but got %s", s, t.text)
+	}
+	return fmt.Errorf("expect %s at the end", s)
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.keyword("NOT") {
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node: node}, nil
+	}
+	if p.symbol("(") {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	}
+	return p.parsePredicate()
+}
+
+func (p *filterParser) parsePredicate() (filterNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("expect a property at the end")
+	}
+	if t.kind != identToken && t.kind != stringToken {
+		return nil, fmt.Errorf("expect a property but got %s", t.text)
+	}
+	p.pos++
+	key := t.text
+
+	switch {
+	case p.symbol("="):
+		val, err := p.parseString()
+		return stringNode{key: key, values: []string{val}}, err
+	case p.symbol("!="):
+		val, err := p.parseString()
+		return stringNode{key: key, values: []string{val}, negate: true}, err
+	case p.keyword("IN"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var values []string
+		for {
+			val, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, val)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		return stringNode{key: key, values: values}, p.expect(")")
+	case p.keyword("PREFIX"):
+		val, err := p.parseString()
+		return prefixNode{key: key, prefix: val}, err
+	case p.keyword("BETWEEN"):
+		lower, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("AND") {
+			return nil, fmt.Errorf("expect AND of BETWEEN")
+		}
+		upper, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		return rangeNode{key: key, lower: &lower, upper: &upper}, nil
+	}
+	for _, op := range []string{"<=", ">=", "<", ">"} {
+		if !p.symbol(op) {
+			continue
+		}
+		num, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		node := rangeNode{key: key}
+		if op[0] == '<' {
+			node.upper, node.upperOpen = &num, op == "<"
+		} else {
+			node.lower, node.lowerOpen = &num, op == ">"
+		}
+		return node, nil
+	}
+	if t, ok := p.peek(); ok {
+		return nil, fmt.Errorf("expect an operator after %s but got %s", key, t.text)
+	}
+	return nil, fmt.Errorf("expect an operator after %s", key)
+}
+
+// parseString accepts a number as well, so that a numeric property can be compared as it is written
+func (p *filterParser) parseString() (string, error) {
+	t, ok := p.peek()
+	if !ok || (t.kind != stringToken && t.kind != numberToken) {
+		return "", fmt.Errorf("expect a string")
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *filterParser) parseNumber() (float64, error) {
+	t, ok := p.peek()
+	if !ok || (t.kind != numberToken && t.kind != stringToken) {
+		return 0, fmt.Errorf("expect a number")
+	}
+	p.pos++
+	num, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("expect a number but got %s", t.text)
+	}
+	return num, nil
+}
@@ -0,0 +1,39 @@
+package rocksmq
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	properties := map[string]string{"region": "eu-west", "level": "warn", "size": "2048", "retries": "1"}
+	cases := []struct {
+		expr  string
+		match bool
+	}{
+		{"region = 'eu-west'", true},
+		{"region != \"eu-west\"", false},
+		{"level IN ('warn', 'error')", true},
+		{"level in ('info')", false},
+		{"region PREFIX 'eu-'", true},
+		{"size BETWEEN 1024 AND 4096", true},
+		{"size > 2048", false},
+		{"size >= 2048 AND retries < 3", true},
+		{"size = 2048", true},
+		{"missing = 'x' OR level = 'warn'", true},
+		{"NOT (region PREFIX 'us' OR retries > 1)", true},
+		{"missing != 'x'", false},
+		{"region > 1", false},
+	}
+	for _, c := range cases {
+		filter, err := ParseFilter(c.expr)
+		assert.NoError(t, err, c.expr)
+		assert.Equal(t, c.match, filter.Match(properties), c.expr)
+	}
+
+	for _, expr := range []string{"", "region", "region = ", "region = 'eu", "level IN ('a'", "size > 'x'",
+		"size BETWEEN 1 OR 2", "a = 'b' c = 'd'", "(a = 'b'", "a ! 'b'"} {
+		_, err := ParseFilter(expr)
+		assert.Error(t, err, expr)
+	}
+}
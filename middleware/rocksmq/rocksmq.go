@@ -1,6 +1,12 @@
 package rocksmq
 
-import "github.com/linkbase/middleware"
+import (
+	"context"
+	"fmt"
+	"github.com/linkbase/middleware"
+	"math"
+	"time"
+)
 
 type UniqueID = middleware.UniqueID
 type RmqState = int64
@@ -12,6 +18,55 @@ const (
 	RmqStateHealthy RmqState = 1
 )
 
+// the start positions of a reader at either end of a topic
+const (
+	// EarliestMessageID starts a reader from the first message of the topic
+	EarliestMessageID UniqueID = -1
+	// LatestMessageID starts a reader from the last message of the topic
+	LatestMessageID UniqueID = math.MaxInt64
+)
+
+// MessageKeyProperty is the property holding the key of a message, it routes the message to a partition
+const MessageKeyProperty = "rmq.key"
+
+// DeliverAtProperty is the property holding the time a message is delivered at, in unix milliseconds.
+// A message is scheduled by it and not consumed before that time. Produce returns a schedule handle for it,
+// the message is delivered under a new id, so the handle can not be sought or acked. A crash while a due message
+// is released may deliver it twice
+const DeliverAtProperty = "rmq.deliverAt"
+
+// CompressionProperty is the property selecting the compression of a message payload in storage, one of the
+// Compression values. The payload is decompressed on consume, which does not return the property
+const CompressionProperty = "rmq.compression"
+
+// RawSizeProperty is the property holding the payload size before compression, it is stored along with
+// CompressionProperty and not returned on consume either
+const RawSizeProperty = "rmq.rawSize"
+
+// Compression is the codec of a message payload in storage
+type Compression string
+
+const (
+	CompressionNone   Compression = "none"
+	CompressionZstd   Compression = "zstd"
+	CompressionLZ4    Compression = "lz4"
+	CompressionSnappy Compression = "snappy"
+)
+
+// properties added to a message moved to a dead letter topic
+const (
+	// DeadLetterTopicKey is the topic the message is consumed from
+	DeadLetterTopicKey = "dlq.topic"
+	// DeadLetterGroupKey is the consumer group which rejected the message
+	DeadLetterGroupKey = "dlq.group"
+	// DeadLetterMsgIDKey is the id of the message in its topic
+	DeadLetterMsgIDKey = "dlq.msgID"
+	// DeadLetterFailuresKey is how many times the message was rejected
+	DeadLetterFailuresKey = "dlq.failures"
+	// DeadLetterDeliveryCountKey is how many times the message was delivered
+	DeadLetterDeliveryCountKey = "dlq.deliveryCount"
+)
+
 type ProducerMessage struct {
 	Payload    []byte
 	Properties map[string]string
@@ -27,24 +82,225 @@ type ConsumerMessage struct {
 	MsgID      UniqueID
 	Payload    []byte
 	Properties map[string]string
+	// RedeliveryCount is how many times the message was delivered before, only counted in ack mode
+	RedeliveryCount int
+}
+
+// RetentionPolicy decides when the messages of a topic are purged
+type RetentionPolicy struct {
+	// TimeInMinutes is how long a message is kept after it is acked, -1 means forever
+	TimeInMinutes int64
+	// SizeInMB is the size of acked messages kept in the topic, -1 means unlimited
+	SizeInMB int64
+	// RetainUnacked keeps messages until every consumer group acked them,
+	// otherwise unacked messages are aged from the time their page is full
+	RetainUnacked bool
+}
+
+// TopicStats is the state of a topic for operators, the stats of a partitioned topic sum up its partitions
+type TopicStats struct {
+	Topic string
+	// CreatedAt is when the topic is created, zero for a partitioned topic
+	CreatedAt time.Time
+	// MsgCount is the number of messages kept in the topic
+	MsgCount int64
+	// Bytes is the stored payload size of the messages kept in the topic, RawBytes is their size before compression
+	Bytes    int64
+	RawBytes int64
+	// FirstMsgID and LastMsgID are the ids of the first and last messages kept, 0 if the topic is empty
+	FirstMsgID UniqueID
+	LastMsgID  UniqueID
+	// PageCount is the number of full pages, AckedPages is how many of them are acked by every consumer group
+	PageCount  int
+	AckedPages int
+	// Retention is the retention policy of the topic, LastRetention is when retention last checked it
+	Retention     RetentionPolicy
+	LastRetention time.Time
+	Compacted     bool
+	// Scheduled is the number of messages waiting for their deliver time
+	Scheduled int64
+	Groups    []GroupStats
+	// Partitions holds the stats of each partition of a partitioned topic
+	Partitions []TopicStats
+}
+
+// CompressionRatio is the payload size before compression over the stored size, 1 if nothing is stored
+func (s *TopicStats) CompressionRatio() float64 {
+	if s.Bytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.Bytes)
+}
+
+// GroupStats is the state of a consumer group of a topic
+type GroupStats struct {
+	Group string
+	// CurrentID is the id the group consumes from next, 0 for a partitioned topic
+	CurrentID UniqueID
+	// BacklogMsgs and BacklogBytes are the messages at or after the current id
+	BacklogMsgs  int64
+	BacklogBytes int64
+	AckMode      bool
+	// Pending is the number of messages consumed but not acked yet in ack mode
+	Pending int
+	// LastConsume is when the group last consumed messages since rocksmq started, zero if it never did
+	LastConsume time.Time
+}
+
+// TopicOptions hold the options of a topic
+type TopicOptions struct {
+	// Retention is the retention policy of the topic, nil means the rocksmq config is used
+	Retention *RetentionPolicy
+	// Partitions is the number of partitions of the topic, 0 means the topic is not partitioned
+	Partitions int
+	// Compacted makes retention keep only the newest message of each key instead of purging expired pages,
+	// see WithCompaction
+	Compacted bool
+}
+
+// TopicOption is a func
+type TopicOption func(options *TopicOptions)
+
+// WithRetention sets the retention policy of the topic
+func WithRetention(policy RetentionPolicy) TopicOption {
+	return func(options *TopicOptions) {
+		options.Retention = &policy
+	}
+}
+
+// WithCompaction makes the topic compacted. The retention of a compacted topic rewrites its full pages keeping
+// only the newest message of each key, a keyed message with an empty payload is a tombstone which drops the key.
+// Messages without key are kept as they are
+func WithCompaction() TopicOption {
+	return func(options *TopicOptions) {
+		options.Compacted = true
+	}
+}
+
+// ConsumerGroupOptions hold the options of a consumer group
+type ConsumerGroupOptions struct {
+	// AckMode keeps consumed messages pending until they are acked,
+	// the group position and its pending messages are persisted
+	AckMode bool
+	// AckTimeout is how long a pending message waits for its ack before it is redelivered,
+	// 0 means the rocksmq config is used
+	AckTimeout time.Duration
+	// DeadLetterTopic receives the messages nacked MaxFailures times, it requires ack mode
+	DeadLetterTopic string
+	// MaxFailures is how many nacks a message takes before it is moved to DeadLetterTopic
+	MaxFailures int
+	// Filter is a filter expression over the message properties, see Filter. The group skips the messages
+	// not matching it, empty means every message is consumed
+	Filter string
+}
+
+// ConsumerGroupOption is a func
+type ConsumerGroupOption func(options *ConsumerGroupOptions)
+
+// WithAckMode enables ack mode for the consumer group
+func WithAckMode(ackTimeout time.Duration) ConsumerGroupOption {
+	return func(options *ConsumerGroupOptions) {
+		options.AckMode = true
+		options.AckTimeout = ackTimeout
+	}
+}
+
+// WithDeadLetter moves the messages nacked maxFailures times to the dead letter topic
+func WithDeadLetter(topic string, maxFailures int) ConsumerGroupOption {
+	return func(options *ConsumerGroupOptions) {
+		options.DeadLetterTopic = topic
+		options.MaxFailures = maxFailures
+	}
+}
+
+// WithFilter makes the consumer group consume only the messages whose properties match the filter expression
+func WithFilter(expr string) ConsumerGroupOption {
+	return func(options *ConsumerGroupOptions) {
+		options.Filter = expr
+	}
+}
+
+// SubscriptionType decides how the consumers of a consumer group share its messages
+type SubscriptionType int
+
+const (
+	// SubscriptionExclusive allows a single consumer in the consumer group
+	SubscriptionExclusive SubscriptionType = iota
+	// SubscriptionFailover delivers the messages to the first consumer, the next one takes over when it leaves
+	SubscriptionFailover
+	// SubscriptionShared round-robins the messages across the consumers, it requires ack mode
+	SubscriptionShared
+)
+
+func (t SubscriptionType) String() string {
+	switch t {
+	case SubscriptionExclusive:
+		return "Exclusive"
+	case SubscriptionFailover:
+		return "Failover"
+	case SubscriptionShared:
+		return "Shared"
+	default:
+		return fmt.Sprintf("SubscriptionType(%d)", int(t))
+	}
+}
+
+// WithPartitions makes the topic a partitioned topic with n partitions
+func WithPartitions(n int) TopicOption {
+	return func(options *TopicOptions) {
+		options.Partitions = n
+	}
+}
+
+// PartitionTopic returns the name of the topic backing the partition of a partitioned topic
+func PartitionTopic(topic string, partition int) string {
+	return fmt.Sprintf("%s-partition-%d", topic, partition)
 }
 
 type RocksMQ interface {
-	CreateTopic(topic string) error
+	CreateTopic(topic string, opts ...TopicOption) error
 	DestroyTopic(topic string) error
-	CreateConsumerGroup(topic, gourp string) error
+	CreateConsumerGroup(topic, gourp string, opts ...ConsumerGroupOption) error
 	DestroyConsumerGroup(topic, gourp string) error
 	Close()
 
 	RegisterConsumer(consumer *Consumer) error
 	GetLatestMsg(topic string) (int64, error)
 	CheckTopicValid(topic string) error
+	SetTopicRetention(topic string, policy RetentionPolicy) error
+	GetTopicRetention(topic string) (RetentionPolicy, error)
+	GetTopicPartitions(topic string) (int, error)
 
 	Produce(topic string, messages []ProducerMessage) ([]UniqueID, error)
 	Consume(topic string, group string, n int) ([]ConsumerMessage, error)
+	ConsumeMember(topic, group, member string, n int) ([]ConsumerMessage, error)
+	Ack(topic, group string, msgIDs ...UniqueID) error
+	AckCumulative(topic, group string, msgID UniqueID) error
+	Nack(topic, group string, msgIDs ...UniqueID) error
+	ReplayDeadLetter(deadLetterTopic string) (int, error)
 	Seek(topic, group string, msgID UniqueID) error
+	SeekByTime(topic, group string, ts time.Time) error
 	SeekToLatest(topic, group string) error
 	ExistConsumerGroup(topic, group string) (bool, *Consumer, error)
 
+	JoinConsumerGroup(topic, group, member string, subType SubscriptionType, msgMutex chan struct{}) error
+	LeaveConsumerGroup(topic, group, member string) error
+	JoinPartitionedGroup(topic, group, member string, subType SubscriptionType, msgMutex chan struct{}, opts ...ConsumerGroupOption) ([]int, error)
+	LeavePartitionedGroup(topic, group, member string) error
+	GetAssignedPartitions(topic, group, member string) ([]int, error)
+
+	CreateReader(topic string, startMsgID UniqueID, messageIDInclusive bool) (string, error)
+	ReaderSeek(topic, readerName string, msgID UniqueID) error
+	Next(ctx context.Context, topic, readerName string) (*ConsumerMessage, error)
+	HasNext(topic, readerName string) bool
+	// NextBatch returns up to n messages of the reader without blocking, none once it is at the end of the topic
+	NextBatch(topic, readerName string, n int) ([]ConsumerMessage, error)
+	CloseReader(topic, readerName string)
+
+	ListTopics() ([]string, error)
+	GetTopicStats(topic string) (*TopicStats, error)
+	// Backup takes a consistent checkpoint of the rocksmq into dir on the host of the rocksmq while it is serving
+	Backup(dir string) error
+
 	Notify(topic, group string)
 }
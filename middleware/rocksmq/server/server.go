@@ -7,6 +7,7 @@ import (
 	"github.com/linkbase/middleware"
 	"github.com/linkbase/middleware/generator"
 	"github.com/linkbase/middleware/kv"
+	filekv "github.com/linkbase/middleware/kv/file"
 	"github.com/linkbase/middleware/kv/rocksdb"
 	"github.com/linkbase/middleware/log"
 	"github.com/linkbase/middleware/rocksmq"
@@ -17,6 +18,7 @@ import (
 	"go.uber.org/zap"
 	"path"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,6 +33,12 @@ const (
 
 	kvSuffix = "_meta_kv"
 
+	// idKVSuffix is the suffix of the file which keeps the message id high-water mark
+	idKVSuffix = "_id.json"
+
+	// rmqIDKey is the meta key of the default id generator high-water mark
+	rmqIDKey = "rmq_id"
+
 	// TopicIDTitle topic begin id record a topic is valid, create when topic is created, cleaned up on destroy topic
 	TopicIDTitle = "topic_id/"
 
@@ -40,15 +48,42 @@ const (
 	// PageMsgSizeTitle page_message_size/topicName/pageId record the endId of each page, it will be purged either in retention or the destroy of topic
 	PageMsgSizeTitle = "page_message_size/"
 
+	// MessageStatsTitle message_stats/topicName, the json encoded message count and raw size of the current page
+	MessageStatsTitle = "message_stats/"
+
+	// PageMsgStatsTitle page_message_stats/topicName/pageId, the json encoded message count and raw size of each page,
+	// purged together with the page message size
+	PageMsgStatsTitle = "page_message_stats/"
+
 	// PageTsTitle page_ts/topicName/pageId, record the page last ts, used for TTL functionality
 	PageTsTitle = "page_ts/"
 
 	// AckedTsTitle acked_ts/topicName/pageId, record the latest ack ts of each page, will be purged on retention or destroy of the topic
 	AckedTsTitle = "acked_ts/"
 
+	// RetentionTitle retention/topicName, the json encoded retention policy of a topic, only exists if it is set explicitly,
+	// cleaned up on destroy topic
+	RetentionTitle = "retention/"
+
+	// CompactedTitle compacted/topicName, exists if the topic is compacted, the end id of the pages compacted so far,
+	// cleaned up on destroy topic
+	CompactedTitle = "compacted/"
+
+	// CompactedKeyTitle compacted_key/topicName/messageKey, the id of the newest message of each key in the compacted
+	// pages of a compacted topic, cleaned up on destroy topic
+	CompactedKeyTitle = "compacted_key/"
+
+	// MsgTsTitle msg_ts/topicName/msgId, record the produce time of each message in milliseconds, used by SeekByTime,
+	// it lives in the message store and is purged together with the message
+	MsgTsTitle = "msg_ts/"
+
 	RmqNotServingErrMsg = "Rocksmq is not serving"
 )
 
+// reservedTopics are the names of the key prefixes sharing the message store with the messages, which are keyed by
+// topicName/msgId, so no topic can take them
+var reservedTopics = []string{strings.TrimSuffix(DelayTitle, "/"), strings.TrimSuffix(MsgTsTitle, "/"), "properties"}
+
 // RmqState Rocksmq state
 type RmqState = int64
 
@@ -67,6 +102,8 @@ var RocksDBLRUCacheMaxCapacity = uint64(4 << 30)
 var topicMu = sync.Map{}
 
 type RocketMQServer struct {
+	// name is the path of the message store, the meta kv and the id file are next to it
+	name        string
 	store       *gorocksdb.DB
 	kv          kv.BaseKV
 	idGenerator generator.Generator
@@ -76,11 +113,51 @@ type RocketMQServer struct {
 	consumersID sync.Map
 
 	retentionIndo *retentionInfo
-	readers       sync.Map
 	state         rocksmq.RmqState
+
+	// readers holds a sync.Map of the readers of each topic, keyed by reader name
+	readers sync.Map
+
+	// ackGroups holds the consumer groups in ack mode, key is the same as consumersID
+	ackGroups sync.Map
+	closeCh   chan struct{}
+	closeWg   sync.WaitGroup
+	closeOnce sync.Once
+
+	// partitions holds the number of partitions of each partitioned topic
+	partitions      sync.Map
+	partitionMu     sync.Mutex
+	partitionGroups map[string]*partitionedGroup
+
+	// subscriptions holds the members of the consumer groups joined with a subscription type, key is the same as consumersID
+	subscriptions sync.Map
+
+	// delayed holds the earliest deliver time of each topic with scheduled messages, updated under delayMu
+	delayed sync.Map
+	delayMu sync.Mutex
+	// releaseMu serializes the releases of scheduled messages
+	releaseMu sync.Mutex
+
+	// groupCommitEnabled makes Produce queue its messages to be written with the ones of concurrent calls
+	groupCommitEnabled bool
+	commitMu           sync.Mutex
+	commitQueue        []*produceReq
+	commitSize         int64
+	commitCh           chan struct{}
+	// commitDone is closed once the group commit stops, after the queued requests are flushed
+	commitDone chan struct{}
+
+	// lastConsume holds the time a consumer group last got messages, key is the same as consumersID
+	lastConsume sync.Map
+
+	// filters holds the compiled filter of the consumer groups with one, key is the same as consumersID
+	filters sync.Map
 }
 
+// NewRocksMQ opens (or creates) the message store at name and the meta kv at name+"_meta_kv",
+// idGenerator is used to allocate message ids, a kv based generator is used if it is nil
 func NewRocksMQ(name string, idGenerator generator.Generator) (*RocketMQServer, error) {
+	paramtable.Init()
 	params := paramtable.Get()
 	maxProcs := runtime.GOMAXPROCS(0)
 	parallelism := 1
@@ -110,14 +187,144 @@ func NewRocksMQ(name string, idGenerator generator.Generator) (*RocketMQServer,
 	bbto.SetBlockSize(64 << 10)
 	bbto.SetBlockCache(gorocksdb.NewLRUCache(rocksDBLRUCacheCapacity))
 
-	return nil, nil
+	compressionTypes := make([]gorocksdb.CompressionType, 0)
+	for _, compressionType := range params.RocksmqCfg.CompressionTypes.GetAsInts() {
+		if compressionType != int(gorocksdb.NoCompression) && compressionType != int(gorocksdb.ZSTDCompression) {
+			return nil, fmt.Errorf("unsupported rocksmq compression type %d, only support 0 and 7", compressionType)
+		}
+		compressionTypes = append(compressionTypes, gorocksdb.CompressionType(compressionType))
+	}
+	if len(compressionTypes) == 0 {
+		return nil, errors.New("rocksmq compression types should not be empty")
+	}
+
+	// finish rocks KV
+	optsKV := gorocksdb.NewDefaultOptions()
+	optsKV.SetBlockBasedTableFactory(bbto)
+	optsKV.SetCreateIfMissing(true)
+	// by default there is only 1 thread for flush and compaction, which may block each other
+	optsKV.IncreaseParallelism(parallelism)
+	optsKV.SetMaxBackgroundFlushes(1)
+	kvName := name + kvSuffix
+	metaKV, err := rocksdb.NewRocksdbKVWithOpts(kvName, optsKV)
+	if err != nil {
+		return nil, err
+	}
+
+	// finish rocks mq store, the compression of each level follows RocksmqCfg.CompressionTypes
+	optsStore := gorocksdb.NewDefaultOptions()
+	// share block cache with kv
+	optsStore.SetBlockBasedTableFactory(bbto)
+	optsStore.SetNumLevels(len(compressionTypes))
+	optsStore.SetCompressionPerLevel(compressionTypes)
+	optsStore.SetCreateIfMissing(true)
+	optsStore.IncreaseParallelism(parallelism)
+	optsStore.SetMaxBackgroundFlushes(1)
+	db, err := gorocksdb.OpenDb(optsStore, name)
+	if err != nil {
+		metaKV.Close()
+		return nil, err
+	}
+
+	// if user didn't specify id generator, init one with a fsynced file, so that no etcd is needed
+	// and message ids are never reissued even after an unclean shutdown
+	if idGenerator == nil {
+		idKV, err := filekv.NewFileKV(name + idKVSuffix)
+		if err != nil {
+			metaKV.Close()
+			db.Close()
+			return nil, err
+		}
+		globalGenerator := generator.NewGlobalIDGenerator(rmqIDKey, idKV)
+		if err = globalGenerator.Initialize(); err != nil {
+			metaKV.Close()
+			db.Close()
+			return nil, err
+		}
+		idGenerator = globalGenerator
+	}
+
+	rmq := &RocketMQServer{
+		name:        name,
+		store:       db,
+		kv:          metaKV,
+		idGenerator: idGenerator,
+		storeMux:    &sync.Mutex{},
+		topicLastID: sync.Map{},
+		consumers:   sync.Map{},
+		consumersID: sync.Map{},
+		readers:     sync.Map{},
+		ackGroups:   sync.Map{},
+		closeCh:     make(chan struct{}),
+
+		partitionGroups: make(map[string]*partitionedGroup),
+
+		groupCommitEnabled: params.RocksmqCfg.GroupCommitEnabled.GetAsBool(),
+		commitCh:           make(chan struct{}, 1),
+		commitDone:         make(chan struct{}),
+	}
+
+	ri, err := initRetentionInfo(metaKV, db)
+	if err != nil {
+		rmq.kv.Close()
+		rmq.store.Close()
+		return nil, err
+	}
+	rmq.retentionIndo = ri
+
+	// restore the last message id of each topic, so consumers know where the data ends
+	var restoreErr error
+	ri.topicRetentionTime.Range(func(topic string, _ int64) bool {
+		lastID, err := rmq.getLatestMsg(topic)
+		if err != nil {
+			restoreErr = err
+			return false
+		}
+		if lastID != DefaultMessageID {
+			rmq.topicLastID.Store(topic, lastID)
+		}
+		return true
+	})
+	if restoreErr != nil {
+		rmq.kv.Close()
+		rmq.store.Close()
+		return nil, restoreErr
+	}
+	if err = rmq.restorePartitions(); err != nil {
+		rmq.kv.Close()
+		rmq.store.Close()
+		return nil, err
+	}
+	if err = rmq.restoreAckGroups(); err != nil {
+		rmq.kv.Close()
+		rmq.store.Close()
+		return nil, err
+	}
+	if err = rmq.restoreScheduled(); err != nil {
+		rmq.kv.Close()
+		rmq.store.Close()
+		return nil, err
+	}
+
+	if params.RocksmqCfg.TickerTimeInSeconds.GetAsInt64() > 0 {
+		rmq.retentionIndo.startRetentionInfo()
+	}
+	rmq.startRedelivery()
+	rmq.startDelivery()
+	if rmq.groupCommitEnabled {
+		rmq.startGroupCommit()
+	}
+	atomic.StoreInt64(&rmq.state, RmqStateHealthy)
+	log.Info("rocksmq is serving", zap.String("path", name), zap.Int("topics", ri.topicRetentionTime.Len()))
+	return rmq, nil
 }
 
 func (rmq *RocketMQServer) isClosed() bool {
 	return atomic.LoadInt64(&rmq.state) != rocksmq.RmqStateHealthy
 }
 
-func (rmq *RocketMQServer) CreateTopic(topic string) error {
+// CreateTopic creates the topic if it does not exist, the options are ignored for an existing topic
+func (rmq *RocketMQServer) CreateTopic(topic string, opts ...rocksmq.TopicOption) error {
 	if rmq.isClosed() {
 		return errors.New(RmqNotServingErrMsg)
 	}
@@ -126,6 +333,30 @@ func (rmq *RocketMQServer) CreateTopic(topic string) error {
 		log.Warn("rocksmq failed to create topic for topic name contains \"/\"", zap.String("topic", topic))
 		return errors.New("rocksmq failed to create topic for topic name")
 	}
+	for _, reserved := range reservedTopics {
+		if topic == reserved {
+			return fmt.Errorf("rocksmq failed to create topic for topic name %s is reserved", topic)
+		}
+	}
+	options := &rocksmq.TopicOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.Retention != nil {
+		if err := validateRetentionPolicy(*options.Retention); err != nil {
+			return err
+		}
+	}
+	if options.Partitions < 0 {
+		return fmt.Errorf("invalid partitions %d, should not be negative", options.Partitions)
+	}
+	if options.Partitions > 0 {
+		return rmq.createPartitionedTopic(topic, options)
+	}
+	if n := rmq.getPartitions(topic); n > 0 {
+		log.Warn("rocksmq topic already exists as a partitioned topic", zap.String("topic", topic), zap.Int("partitions", n))
+		return nil
+	}
 	topicIDKey := TopicIDTitle + topic
 	val, err := rmq.kv.Load(topicIDKey)
 	if err != nil {
@@ -148,18 +379,37 @@ func (rmq *RocketMQServer) CreateTopic(topic string) error {
 
 	nowTs := strconv.FormatInt(time.Now().Unix(), 10)
 	kvs[topicIDKey] = nowTs
+	if options.Retention != nil {
+		policy, err := json.Marshal(options.Retention)
+		if err != nil {
+			return err
+		}
+		kvs[RetentionTitle+topic] = string(policy)
+	}
+	if options.Compacted {
+		kvs[CompactedTitle+topic] = strconv.FormatInt(DefaultMessageID, 10)
+	}
 	if err = rmq.kv.MultiSave(kvs); err != nil {
 		return err //todo
 	}
 
 	rmq.retentionIndo.mutex.Lock()
 	defer rmq.retentionIndo.mutex.Unlock()
+	if options.Retention != nil {
+		rmq.retentionIndo.topicPolicy.Insert(topic, *options.Retention)
+	}
+	if options.Compacted {
+		rmq.retentionIndo.compactedTopics.Insert(topic, true)
+	}
 	rmq.retentionIndo.topicRetentionTime.Insert(topic, time.Now().Unix())
 	log.Debug("Rocksmq create topic successfully ", zap.String("topic", topic), zap.Int64("elapsed", time.Since(start).Milliseconds()))
 	return nil
 }
 
 func (rmq *RocketMQServer) DestroyTopic(topic string) error {
+	if n := rmq.getPartitions(topic); n > 0 {
+		return rmq.destroyPartitionedTopic(topic, n)
+	}
 	start := time.Now()
 	ll, ok := topicMu.Load(topic)
 	if !ok {
@@ -173,6 +423,13 @@ func (rmq *RocketMQServer) DestroyTopic(topic string) error {
 	defer lock.Unlock()
 
 	rmq.consumers.Delete(topic)
+	rmq.closeReaders(topic)
+	rmq.subscriptions.Range(func(key, value interface{}) bool {
+		if value.(*subscription).topic == topic {
+			rmq.subscriptions.Delete(key)
+		}
+		return true
+	})
 
 	//clean topic data itself
 	fixTopicName := topic + "/"
@@ -186,6 +443,10 @@ func (rmq *RocketMQServer) DestroyTopic(topic string) error {
 	if err != nil {
 		return err
 	}
+	//clean page stats info
+	if err = rmq.kv.RemoveWithPrefix(constructKey(PageMsgStatsTitle, topic) + "/"); err != nil {
+		return err
+	}
 	//clean page ts info
 	pageMsgTsKey := constructKey(PageTsTitle, topic)
 	err = rmq.kv.RemoveWithPrefix(pageMsgTsKey)
@@ -198,23 +459,61 @@ func (rmq *RocketMQServer) DestroyTopic(topic string) error {
 	if err != nil {
 		return err
 	}
+	// clean the key index of a compacted topic
+	if err = rmq.kv.RemoveWithPrefix(constructKey(CompactedKeyTitle, topic) + "/"); err != nil {
+		return err
+	}
+	// clean scheduled messages
+	if err = rmq.removeScheduled(topic); err != nil {
+		return err
+	}
+	// clean message ts info
+	msgTsPrefix := constructKey(MsgTsTitle, topic) + "/"
+	writeBatch := gorocksdb.NewWriteBatch()
+	defer writeBatch.Destroy()
+	writeBatch.DeleteRange([]byte(msgTsPrefix), []byte(utils.AddOne(msgTsPrefix)))
+	writeOpts := gorocksdb.NewDefaultWriteOptions()
+	defer writeOpts.Destroy()
+	err = rmq.store.Write(writeOpts, writeBatch)
+	if err != nil {
+		return err
+	}
+	// clean consumer groups in ack mode
+	for _, title := range []string{ConsumerGroupTitle, ConsumerPosTitle, PendingTitle} {
+		if err = rmq.kv.RemoveWithPrefix(constructKey(title, topic) + "/"); err != nil {
+			return err
+		}
+	}
+	rmq.ackGroups.Range(func(key, value interface{}) bool {
+		if value.(*ackGroup).topic == topic {
+			rmq.ackGroups.Delete(key)
+		}
+		return true
+	})
 	// topic info
 	topicIDKey := TopicIDTitle + topic
 	msgSizeKey := MessageSizeTitle + topic
+	msgStatsKey := MessageStatsTitle + topic
+	retentionKey := RetentionTitle + topic
+	compactedKey := CompactedTitle + topic
 	var removedKeys []string
-	removedKeys = append(removedKeys, topicIDKey, msgSizeKey)
+	removedKeys = append(removedKeys, topicIDKey, msgSizeKey, msgStatsKey, retentionKey, compactedKey)
 	err = rmq.kv.MultiRemove(removedKeys)
 	if err != nil {
 		return err
 	}
 	//clean up retention info
 	topicMu.Delete(topic)
+	rmq.topicLastID.Delete(topic)
 	rmq.retentionIndo.topicRetentionTime.GetAndRemove(topic)
+	rmq.retentionIndo.topicPolicy.GetAndRemove(topic)
+	rmq.retentionIndo.compactedTopics.GetAndRemove(topic)
 	log.Debug("Rocksmq destroy topic successfully ", zap.String("topic", topic), zap.Int64("elapsed", time.Since(start).Milliseconds()))
 	return nil
 }
 
-func (rmq *RocketMQServer) CreateConsumerGroup(topic, group string) error {
+// CreateConsumerGroup creates the consumer group starting from the earliest message
+func (rmq *RocketMQServer) CreateConsumerGroup(topic, group string, opts ...rocksmq.ConsumerGroupOption) error {
 	if rmq.isClosed() {
 		return errors.New(RmqNotServingErrMsg)
 	}
@@ -224,6 +523,28 @@ func (rmq *RocketMQServer) CreateConsumerGroup(topic, group string) error {
 	if ok {
 		return fmt.Errorf("RMQ CreateConsumerGroup key already exists, key = %s", key)
 	}
+	options := rocksmq.ConsumerGroupOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if err := rmq.checkDeadLetter(topic, options); err != nil {
+		return err
+	}
+	filter, err := compileFilter(options.Filter)
+	if err != nil {
+		return err
+	}
+	if options.AckMode {
+		if _, ok := topicMu.Load(topic); !ok {
+			return fmt.Errorf("topic name = %s not exist", topic)
+		}
+		if err := rmq.createAckGroup(topic, group, options); err != nil {
+			return err
+		}
+	}
+	if filter != nil {
+		rmq.filters.Store(key, filter)
+	}
 	rmq.consumersID.Store(key, DefaultMessageID)
 	log.Debug("Rocksmq create consumer group successfully ", zap.String("topic", topic),
 		zap.String("group", group),
@@ -235,12 +556,32 @@ func (rmq *RocketMQServer) DestroyConsumerGroup(topic, group string) error {
 	if rmq.isClosed() {
 		return errors.New(RmqNotServingErrMsg)
 	}
-	return rmq.destroyConsumerInternal(topic, group)
+	if rmq.isPartitionManaged(topic, group) {
+		return fmt.Errorf("consumer group %s of partition %s is managed by its partitioned topic", group, topic)
+	}
+	if err := rmq.destroyConsumerInternal(topic, group); err != nil {
+		return err
+	}
+	// the persisted state of a group in ack mode is only dropped on an explicit destroy, not on close
+	ll, ok := topicMu.Load(topic)
+	if !ok {
+		return fmt.Errorf("topic name = %s not exist", topic)
+	}
+	lock := ll.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+	return rmq.removeAckGroup(topic, group)
 }
 
 func (rmq *RocketMQServer) Close() {
 	atomic.StoreInt64(&rmq.state, RmqStateStopped)
 	rmq.stopRetention()
+	rmq.closeOnce.Do(func() {
+		close(rmq.closeCh)
+		rmq.closeWg.Wait()
+	})
+	rmq.closePartitionedGroups()
+	rmq.closeReaders("")
 	rmq.consumers.Range(func(k, v interface{}) bool {
 		for _, consumer := range v.([]*rocksmq.Consumer) {
 			err := rmq.destroyConsumerInternal(consumer.Topic, consumer.GroupName)
@@ -313,6 +654,46 @@ func (rmq *RocketMQServer) CheckTopicValid(topic string) error {
 	return nil
 }
 
+// SetTopicRetention persists the retention policy of the topic, it takes effect from the next retention check
+func (rmq *RocketMQServer) SetTopicRetention(topic string, policy rocksmq.RetentionPolicy) error {
+	if rmq.isClosed() {
+		return errors.New(RmqNotServingErrMsg)
+	}
+	if _, ok := topicMu.Load(topic); !ok {
+		return fmt.Errorf("topic name = %s not exist", topic)
+	}
+	if err := validateRetentionPolicy(policy); err != nil {
+		return err
+	}
+	val, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	rmq.retentionIndo.mutex.Lock()
+	defer rmq.retentionIndo.mutex.Unlock()
+	if err = rmq.kv.Save(RetentionTitle+topic, string(val)); err != nil {
+		return err
+	}
+	rmq.retentionIndo.topicPolicy.Insert(topic, policy)
+	log.Info("rocksmq set topic retention", zap.String("topic", topic), zap.Any("policy", policy))
+	return nil
+}
+
+// GetTopicRetention returns the retention policy of the topic, which follows the rocksmq config if it is never set
+func (rmq *RocketMQServer) GetTopicRetention(topic string) (rocksmq.RetentionPolicy, error) {
+	if rmq.isClosed() {
+		return rocksmq.RetentionPolicy{}, errors.New(RmqNotServingErrMsg)
+	}
+	if _, ok := topicMu.Load(topic); !ok {
+		return rocksmq.RetentionPolicy{}, fmt.Errorf("topic name = %s not exist", topic)
+	}
+	return rmq.retentionIndo.getPolicy(topic), nil
+}
+
+// Produce writes the messages to the topic and returns their ids. A message with a rocksmq.DeliverAtProperty
+// in the future is scheduled instead, it becomes visible to consumers at that time under a new id.
+// With group commit the messages are written together with the ones of concurrent Produce calls
 func (rmq *RocketMQServer) Produce(topic string, messages []rocksmq.ProducerMessage) ([]rocksmq.UniqueID, error) {
 	if rmq.isClosed() {
 		return nil, errors.New(RmqNotServingErrMsg)
@@ -327,59 +708,23 @@ func (rmq *RocketMQServer) Produce(topic string, messages []rocksmq.ProducerMess
 		return []UniqueID{}, fmt.Errorf("get mutex failed, topic name = %s", topic)
 	}
 	lock.Lock()
-	defer lock.Unlock()
-
-	getLockTime := time.Since(start).Milliseconds()
-	msgLen := len(messages)
-	idStart, idEnd, err := rmq.idGenerator.Gen(uint32(msgLen))
-	if err != nil {
-		return []UniqueID{}, err
-	}
-	allocTime := time.Since(start).Milliseconds()
-	if UniqueID(msgLen) != idEnd-idStart {
-		return []UniqueID{}, errors.New("Obtained id length is not equal that of message")
-	}
-
-	// Insert data to store system
-	batch := gorocksdb.NewWriteBatch()
-	defer batch.Destroy()
-	msgSizes := make(map[UniqueID]int64)
-	msgIDs := make([]UniqueID, msgLen)
-	for i := 0; i < msgLen && idStart+UniqueID(i) < idEnd; i++ {
-		msgID := idStart + UniqueID(i)
-		key := path.Join(topic, strconv.FormatInt(msgID, 10))
-		batch.Put([]byte(key), messages[i].Payload)
-		properties, err := json.Marshal(messages[i].Properties)
-		if err != nil {
-			log.Warn("properties marshal failed",
-				zap.Int64("msgID", msgID),
-				zap.String("topicName", topic),
-				zap.Error(err))
-			return nil, err
-		}
-		pKey := path.Join("properties", topic, strconv.FormatInt(msgID, 10))
-		batch.Put([]byte(pKey), properties)
-		msgIDs[i] = msgID
-		msgSizes[msgID] = int64(len(messages[i].Payload))
-	}
-	opts := gorocksdb.NewDefaultWriteOptions()
-	defer opts.Destroy()
-	err = rmq.store.Write(opts, batch)
+	req, err := rmq.prepareProduce(topic, messages, start)
 	if err != nil {
+		lock.Unlock()
 		return []UniqueID{}, err
 	}
-	writeTime := time.Since(start).Milliseconds()
-	if vals, ok := rmq.consumers.Load(topic); ok {
-		for _, v := range vals.([]*rocksmq.Consumer) {
-			select {
-			case v.MsgMutex <- struct{}{}:
-				continue
-			default:
-				continue
-			}
+	if rmq.groupCommitEnabled {
+		// the requests are committed in the order they are queued, so the ids of a topic are visible in order
+		rmq.enqueue(req)
+		lock.Unlock()
+		err = rmq.waitCommitted(req)
+	} else {
+		err = rmq.writeProduce(req)
+		if err == nil {
+			err = rmq.applyProduce(req)
 		}
+		lock.Unlock()
 	}
-	err = rmq.updatePageInfo(topic, msgIDs, msgSizes)
 	if err != nil {
 		return []UniqueID{}, err
 	}
@@ -387,26 +732,28 @@ func (rmq *RocketMQServer) Produce(topic string, messages []rocksmq.ProducerMess
 	getProduceTime := time.Since(start).Milliseconds()
 	if getProduceTime > 200 {
 		log.Warn("rocksmq produce too slowly", zap.String("topic", topic),
-			zap.Int64("get lock elapse", getLockTime),
-			zap.Int64("alloc elapse", allocTime-getLockTime),
-			zap.Int64("write elapse", writeTime-allocTime),
-			zap.Int64("updatePage elapse", getProduceTime-writeTime),
+			zap.Int64("get lock elapse", req.lockTime.Milliseconds()),
+			zap.Int64("alloc elapse", (req.allocTime-req.lockTime).Milliseconds()),
+			zap.Int64("write elapse", (req.writeTime-req.allocTime).Milliseconds()),
+			zap.Int64("updatePage elapse", getProduceTime-req.writeTime.Milliseconds()),
 			zap.Int64("produce total elapse", getProduceTime),
 		)
 	}
-
-	rmq.topicLastID.Store(topic, msgIDs[len(msgIDs)-1])
-	return msgIDs, nil
+	return req.msgIDs, nil
 }
 
 // Consume steps:
-// 1. Consume n messages from rocksdb
-// 2. Update current_id to the last consumed message
-// 3. Update ack informations in rocksdb
+// 1. Release the scheduled messages which are due
+// 2. Consume n messages from rocksdb
+// 3. Update current_id to the last consumed message
+// 4. Update ack informations in rocksdb
 func (rmq *RocketMQServer) Consume(topic string, group string, n int) ([]rocksmq.ConsumerMessage, error) {
 	if rmq.isClosed() {
 		return nil, errors.New(RmqNotServingErrMsg)
 	}
+	if err := rmq.releaseScheduled(topic); err != nil {
+		log.Warn("rocksmq failed to release scheduled messages", zap.String("topic", topic), zap.Error(err))
+	}
 	start := time.Now()
 	ll, ok := topicMu.Load(topic)
 	if !ok {
@@ -419,17 +766,64 @@ func (rmq *RocketMQServer) Consume(topic string, group string, n int) ([]rocksmq
 	}
 	lock.Lock()
 	defer lock.Unlock()
+	return rmq.consume(topic, group, n, start)
+}
 
+// consume reads at most n messages from the position of the group, the caller should hold the topic mutex
+func (rmq *RocketMQServer) consume(topic string, group string, n int, start time.Time) ([]rocksmq.ConsumerMessage, error) {
 	currentID, ok := rmq.getCurrentID(topic, group)
 	if !ok {
 		return nil, fmt.Errorf("currentID of topicName=%s, groupName=%s not exist", topic, group)
 	}
+	if ag := rmq.getAckGroup(topic, group); ag != nil {
+		msgs, err := rmq.consumeWithAck(ag, currentID, n)
+		if err == nil && len(msgs) > 0 {
+			rmq.lastConsume.Store(constructCurrentID(topic, group), time.Now())
+		}
+		return msgs, err
+	}
 	lastID, ok := rmq.getLastID(topic)
 	if ok && currentID > lastID {
 		return []rocksmq.ConsumerMessage{}, nil
 	}
 
 	getLockTime := time.Since(start).Milliseconds()
+	consumerMessage, nextID, more, err := rmq.readFiltered(topic, currentID, n, rmq.getFilter(topic, group))
+	if err != nil {
+		return nil, err
+	}
+	if more {
+		rmq.Notify(topic, group)
+	}
+	iterTime := time.Since(start).Milliseconds()
+	// the messages skipped by the filter move the position as well
+	if nextID == currentID {
+		return consumerMessage, nil
+	}
+
+	moveConsumePosTime := time.Since(start).Milliseconds()
+
+	err = rmq.moveConsumePos(topic, group, nextID)
+	if err != nil {
+		return nil, err
+	}
+	if len(consumerMessage) > 0 {
+		rmq.lastConsume.Store(constructCurrentID(topic, group), time.Now())
+	}
+
+	getConsumeTime := time.Since(start).Milliseconds()
+	if getConsumeTime > 200 {
+		log.Warn("rocksmq consume too slowly", zap.String("topic", topic),
+			zap.Int64("get lock elapse", getLockTime),
+			zap.Int64("iterator elapse", iterTime-getLockTime),
+			zap.Int64("moveConsumePosTime elapse", moveConsumePosTime-iterTime),
+			zap.Int64("total consume elapse", getConsumeTime))
+	}
+	return consumerMessage, nil
+}
+
+// readMessages reads at most n messages of the topic starting from startID
+func (rmq *RocketMQServer) readMessages(topic string, startID UniqueID, n int) ([]rocksmq.ConsumerMessage, error) {
 	readOpts := gorocksdb.NewDefaultReadOptions()
 	defer readOpts.Destroy()
 	prefix := topic + "/"
@@ -437,10 +831,10 @@ func (rmq *RocketMQServer) Consume(topic string, group string, n int) ([]rocksmq
 	defer iter.Close()
 
 	var dataKey string
-	if currentID == DefaultMessageID {
+	if startID == DefaultMessageID {
 		dataKey = prefix
 	} else {
-		dataKey = path.Join(topic, strconv.FormatInt(currentID, 10))
+		dataKey = path.Join(topic, strconv.FormatInt(startID, 10))
 	}
 	iter.Seek([]byte(dataKey))
 	consumerMessage := make([]rocksmq.ConsumerMessage, 0, n)
@@ -481,6 +875,10 @@ func (rmq *RocketMQServer) Consume(topic string, group string, n int) ([]rocksmq
 			msg.Payload = make([]byte, dataLen)
 			msg.Properties = properties
 			copy(msg.Payload, origData)
+			if msg.Payload, err = decompressPayload(msg.Payload, properties); err != nil {
+				val.Free()
+				return nil, err
+			}
 		}
 		consumerMessage = append(consumerMessage, msg)
 		val.Free()
@@ -488,27 +886,6 @@ func (rmq *RocketMQServer) Consume(topic string, group string, n int) ([]rocksmq
 	if err := iter.Err(); err != nil {
 		return nil, err
 	}
-	iterTime := time.Since(start).Milliseconds()
-	if len(consumerMessage) == 0 {
-		return consumerMessage, nil
-	}
-
-	newID := consumerMessage[len(consumerMessage)-1].MsgID
-	moveConsumePosTime := time.Since(start).Milliseconds()
-
-	err := rmq.moveConsumePos(topic, group, newID+1)
-	if err != nil {
-		return nil, err
-	}
-
-	getConsumeTime := time.Since(start).Milliseconds()
-	if getConsumeTime > 200 {
-		log.Warn("rocksmq consume too slowly", zap.String("topic", topic),
-			zap.Int64("get lock elapse", getLockTime),
-			zap.Int64("iterator elapse", iterTime-getLockTime),
-			zap.Int64("moveConsumePosTime elapse", moveConsumePosTime-iterTime),
-			zap.Int64("total consume elapse", getConsumeTime))
-	}
 	return consumerMessage, nil
 }
 
@@ -536,6 +913,32 @@ func (rmq *RocketMQServer) Seek(topic, group string, msgID rocksmq.UniqueID) err
 	return nil
 }
 
+// SeekByTime moves the consume position of the group to the first message produced at or after ts,
+// or past the latest message if there is none. Unlike Seek, the position may move backward for replay.
+func (rmq *RocketMQServer) SeekByTime(topic, group string, ts time.Time) error {
+	if rmq.isClosed() {
+		return errors.New(RmqNotServingErrMsg)
+	}
+	ll, ok := topicMu.Load(topic)
+	if !ok {
+		return fmt.Errorf("topic %s not exist, %w", topic, errors.New("topic is not exit"))
+	}
+	lock, ok := ll.(*sync.Mutex)
+	if !ok {
+		return fmt.Errorf("get mutex failed, topic name = %s", topic)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	msgID, err := rmq.seekByTime(topic, group, ts)
+	if err != nil {
+		return err
+	}
+	log.Debug("successfully seek by time", zap.String("topic", topic), zap.String("group", group),
+		zap.Time("ts", ts), zap.Int64("msgId", msgID))
+	return nil
+}
+
 func (rmq *RocketMQServer) SeekToLatest(topic, group string) error {
 	if rmq.isClosed() {
 		return errors.New(RmqNotServingErrMsg)
@@ -565,19 +968,21 @@ func (rmq *RocketMQServer) SeekToLatest(topic, group string) error {
 	return nil
 }
 
+// ExistConsumerGroup returns the registered consumer of the group. A group in ack mode restored after a restart,
+// or a group whose members all left, exists without a consumer until one is registered
 func (rmq *RocketMQServer) ExistConsumerGroup(topic, group string) (bool, *rocksmq.Consumer, error) {
 	key := constructCurrentID(topic, group)
-	_, ok := rmq.consumersID.Load(key)
-	if ok {
-		if vals, ok := rmq.consumers.Load(topic); ok {
-			for _, v := range vals.([]*rocksmq.Consumer) {
-				if v.GroupName == group {
-					return true, v, nil
-				}
+	if _, ok := rmq.consumersID.Load(key); !ok {
+		return false, nil, nil
+	}
+	if vals, ok := rmq.consumers.Load(topic); ok {
+		for _, v := range vals.([]*rocksmq.Consumer) {
+			if v.GroupName == group {
+				return true, v, nil
 			}
 		}
 	}
-	return false, nil, nil
+	return true, nil, nil
 }
 
 func (rmq *RocketMQServer) Notify(topic, group string) {
@@ -615,7 +1020,15 @@ func (rmq *RocketMQServer) destroyConsumerInternal(topic string, groupName strin
 	defer lock.Unlock()
 	key := constructCurrentID(topic, groupName)
 	rmq.consumersID.Delete(key)
-	if vals, ok := rmq.consumers.Load(topic); ok {
+	rmq.lastConsume.Delete(key)
+	rmq.filters.Delete(key)
+	if sub, ok := rmq.subscriptions.LoadAndDelete(key); ok {
+		// standby members are not registered, so the msgMutex of every member is closed here
+		for _, m := range sub.(*subscription).members {
+			close(m.msgMutex)
+		}
+		rmq.setConsumers(topic, groupName)
+	} else if vals, ok := rmq.consumers.Load(topic); ok {
 		consumers := vals.([]*rocksmq.Consumer)
 		for index, v := range consumers {
 			if v.GroupName == groupName {
@@ -667,7 +1080,7 @@ func (rmq *RocketMQServer) getLatestMsg(topic string) (int64, error) {
 	return msgID, nil
 }
 
-func (rmq *RocketMQServer) updatePageInfo(topic string, msgIDs []UniqueID, msgSizes map[UniqueID]int64) error {
+func (rmq *RocketMQServer) updatePageInfo(topic string, msgIDs []UniqueID, msgSizes map[UniqueID]msgSize) error {
 	params := paramtable.Get()
 	msgSizeKey := MessageSizeTitle + topic
 	msgSizeVal, err := rmq.kv.Load(msgSizeKey)
@@ -678,31 +1091,73 @@ func (rmq *RocketMQServer) updatePageInfo(topic string, msgIDs []UniqueID, msgSi
 	if err != nil {
 		return err
 	}
+	msgStatsKey := MessageStatsTitle + topic
+	msgStatsVal, err := rmq.kv.Load(msgStatsKey)
+	if err != nil {
+		return err
+	}
+	curStats, err := parsePageStats(msgStatsVal)
+	if err != nil {
+		return err
+	}
 	fixedPageSizeKey := constructKey(PageMsgSizeTitle, topic)
+	fixedPageStatsKey := constructKey(PageMsgStatsTitle, topic)
 	fixedPageTsKey := constructKey(PageTsTitle, topic)
 	nowTs := strconv.FormatInt(time.Now().Unix(), 10)
 	mutateBuffer := make(map[string]string)
 	for _, id := range msgIDs {
-		msgSize := msgSizes[id]
-		if curMsgSize+msgSize > params.RocksmqCfg.PageSize.GetAsInt64() {
+		size := msgSizes[id].stored
+		curStats.Count++
+		curStats.RawBytes += msgSizes[id].raw
+		if curMsgSize+size > params.RocksmqCfg.PageSize.GetAsInt64() {
 			// Current page is full
-			newPageSize := curMsgSize + msgSize
+			newPageSize := curMsgSize + size
 			pageEndID := id
 			// Update page message size for current page. key is page end ID
 			pageMsgSizeKey := fixedPageSizeKey + "/" + strconv.FormatInt(pageEndID, 10)
 			mutateBuffer[pageMsgSizeKey] = strconv.FormatInt(newPageSize, 10)
+			mutateBuffer[fixedPageStatsKey+"/"+strconv.FormatInt(pageEndID, 10)] = curStats.String()
 			pageTsKey := fixedPageTsKey + "/" + strconv.FormatInt(pageEndID, 10)
 			mutateBuffer[pageTsKey] = nowTs
 			curMsgSize = 0
+			curStats = pageStats{}
 		} else {
-			curMsgSize += msgSize
+			curMsgSize += size
 		}
 	}
 	mutateBuffer[msgSizeKey] = strconv.FormatInt(curMsgSize, 10)
+	mutateBuffer[msgStatsKey] = curStats.String()
 	err = rmq.kv.MultiSave(mutateBuffer)
 	return err
 }
 
+// msgSize is the stored payload size of a message and its size before compression
+type msgSize struct {
+	stored int64
+	raw    int64
+}
+
+// pageStats is the message count and the payload size before compression of a page
+type pageStats struct {
+	Count    int64 `json:"count"`
+	RawBytes int64 `json:"raw_bytes"`
+}
+
+func (s pageStats) String() string {
+	val, _ := json.Marshal(s)
+	return string(val)
+}
+
+// parsePageStats decodes the stats of a page, a page without them is empty
+func parsePageStats(val string) (pageStats, error) {
+	stats := pageStats{}
+	if val == "" {
+		return stats, nil
+	}
+	err := json.Unmarshal([]byte(val), &stats)
+	return stats, err
+}
+
 func (rmq *RocketMQServer) getCurrentID(topic string, group string) (int64, bool) {
 	currentID, ok := rmq.consumersID.Load(constructCurrentID(topic, group))
 	if !ok {
@@ -713,11 +1168,11 @@ func (rmq *RocketMQServer) getCurrentID(topic string, group string) (int64, bool
 }
 
 func (rmq *RocketMQServer) getLastID(topic string) (int64, bool) {
-	currentID, ok := rmq.consumersID.Load(topic)
+	lastID, ok := rmq.topicLastID.Load(topic)
 	if !ok {
 		return 0, false
 	}
-	return currentID.(int64), true
+	return lastID.(int64), true
 }
 
 func (rmq *RocketMQServer) moveConsumePos(topic string, group string, msgID UniqueID) error {
@@ -732,18 +1187,44 @@ func (rmq *RocketMQServer) moveConsumePos(topic string, group string, msgID Uniq
 		panic("move consume position backward")
 	}
 
-	//update ack if position move forward
-	err := rmq.updateAckedInfo(topic, group, oldPos, msgID-1)
-	if err != nil {
-		log.Warn("failed to update acked info ", zap.String("topic", topic),
-			zap.String("groupName", group), zap.Error(err))
-		return err
+	// a group in ack mode updates ack info on ack instead
+	if rmq.getAckGroup(topic, group) == nil {
+		//update ack if position move forward
+		err := rmq.updateAckedInfo(topic, group, oldPos, msgID-1)
+		if err != nil {
+			log.Warn("failed to update acked info ", zap.String("topic", topic),
+				zap.String("groupName", group), zap.Error(err))
+			return err
+		}
 	}
 
+	return rmq.storeConsumePos(topic, group, msgID)
+}
+
+// storeConsumePos sets the current id of the group, it is persisted for a group in ack mode
+func (rmq *RocketMQServer) storeConsumePos(topic string, group string, msgID UniqueID) error {
+	if rmq.getAckGroup(topic, group) != nil {
+		err := rmq.kv.Save(ConsumerPosTitle+ackGroupKey(topic, group), strconv.FormatInt(msgID, 10))
+		if err != nil {
+			return err
+		}
+	}
 	rmq.consumersID.Store(constructCurrentID(topic, group), msgID)
 	return nil
 }
 
+// getAckedPos returns the position before which the group acked every message
+func (rmq *RocketMQServer) getAckedPos(topic string, group string) (UniqueID, bool) {
+	currentID, ok := rmq.getCurrentID(topic, group)
+	if !ok {
+		return 0, false
+	}
+	if ag := rmq.getAckGroup(topic, group); ag != nil {
+		return ag.position(currentID), true
+	}
+	return currentID, true
+}
+
 func (rmq *RocketMQServer) updateAckedInfo(topic string, group string, firstID int64, lastID UniqueID) error {
 	// 1. Try to get the page id between first ID and last ID of ids
 	pageMsgPrefix := constructKey(PageMsgSizeTitle, topic) + "/"
@@ -779,43 +1260,37 @@ func (rmq *RocketMQServer) updateAckedInfo(topic string, group string, firstID i
 	fixedAckedTsKey := constructKey(AckedTsTitle, topic)
 
 	// 2. Update acked ts and acked size for pageIDs
-	if vals, ok := rmq.consumers.Load(topic); ok {
-		consumers, ok := vals.([]*rocksmq.Consumer)
-		if !ok || len(consumers) == 0 {
-			log.Error("update ack with no consumer", zap.String("topic", topic))
+	// find the last id acked by every group of the topic, whether a consumer is registered or not, so that the
+	// pending messages of a group in ack mode restored after a restart are kept until it comes back
+	var lastAckedID UniqueID = lastID
+	for _, g := range rmq.topicGroups(topic) {
+		if g == group {
+			continue
+		}
+		beginID, ok := rmq.getAckedPos(topic, g)
+		if !ok {
+			return fmt.Errorf("currentID of topicName=%s, groupName=%s not exist", topic, g)
+		}
+		// beginID is the first message the group has not acked
+		if beginID == DefaultMessageID {
 			return nil
 		}
-
-		// find min id of all consumer
-		var minBeginID UniqueID = lastID
-		for _, consumer := range consumers {
-			if consumer.GroupName != group {
-				beginID, ok := rmq.getCurrentID(consumer.Topic, consumer.GroupName)
-				if !ok {
-					return fmt.Errorf("currentID of topicName=%s, groupName=%s not exist", consumer.Topic, consumer.GroupName)
-				}
-				if beginID < minBeginID {
-					minBeginID = beginID
-				}
-			}
+		if beginID-1 < lastAckedID {
+			lastAckedID = beginID - 1
 		}
+	}
 
-		nowTs := strconv.FormatInt(time.Now().Unix(), 10)
-		ackedTsKvs := make(map[string]string)
-		// update ackedTs, if page is all acked, then ackedTs is set
-		for _, pID := range pageIDs {
-			if pID <= minBeginID {
-				// Update acked info for message pID
-				pageAckedTsKey := path.Join(fixedAckedTsKey, strconv.FormatInt(pID, 10))
-				ackedTsKvs[pageAckedTsKey] = nowTs
-			}
-		}
-		err := rmq.kv.MultiSave(ackedTsKvs)
-		if err != nil {
-			return err
+	nowTs := strconv.FormatInt(time.Now().Unix(), 10)
+	ackedTsKvs := make(map[string]string)
+	// update ackedTs, if page is all acked, then ackedTs is set
+	for _, pID := range pageIDs {
+		if pID <= lastAckedID {
+			// Update acked info for message pID
+			pageAckedTsKey := path.Join(fixedAckedTsKey, strconv.FormatInt(pID, 10))
+			ackedTsKvs[pageAckedTsKey] = nowTs
 		}
 	}
-	return nil
+	return rmq.kv.MultiSave(ackedTsKvs)
 }
 
 func (rmq *RocketMQServer) seek(topic string, group string, msgID rocksmq.UniqueID) error {
@@ -847,6 +1322,116 @@ func (rmq *RocketMQServer) seek(topic string, group string, msgID rocksmq.Unique
 	return err
 }
 
+func (rmq *RocketMQServer) seekByTime(topic string, group string, ts time.Time) (UniqueID, error) {
+	rmq.storeMux.Lock()
+	defer rmq.storeMux.Unlock()
+	oldPos, ok := rmq.getCurrentID(topic, group)
+	if !ok {
+		return DefaultMessageID, fmt.Errorf("ConsumerGroup %s, channel %s not exists", group, topic)
+	}
+
+	startID, err := rmq.findPageStartByTime(topic, ts)
+	if err != nil {
+		return DefaultMessageID, err
+	}
+	msgID, err := rmq.findMsgByTime(topic, startID, ts)
+	if err != nil {
+		return DefaultMessageID, err
+	}
+	if msgID == DefaultMessageID {
+		// nothing produced at or after ts, behave as seek to latest
+		latestID, err := rmq.getLatestMsg(topic)
+		if err != nil {
+			return DefaultMessageID, err
+		}
+		msgID = latestID + 1
+	}
+
+	if msgID < oldPos {
+		// rewinding never acks anything, so the acked info is left untouched
+		return msgID, rmq.storeConsumePos(topic, group, msgID)
+	}
+	return msgID, rmq.moveConsumePos(topic, group, msgID)
+}
+
+// findPageStartByTime returns the first message id of the page following the last page closed before ts,
+// every message before it was produced before ts
+func (rmq *RocketMQServer) findPageStartByTime(topic string, ts time.Time) (UniqueID, error) {
+	pageTsPrefix := constructKey(PageTsTitle, topic) + "/"
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	iter := rocksdb.NewRocksIteratorWithUpperBound(rmq.kv.(*rocksdb.RocksdbKV).DB, utils.AddOne(pageTsPrefix), readOpts)
+	defer iter.Close()
+
+	var startID UniqueID
+	for iter.Seek([]byte(pageTsPrefix)); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		pageID, err := parsePageID(string(key.Data()))
+		if key != nil {
+			key.Free()
+		}
+		val := iter.Value()
+		pageTs, parseErr := strconv.ParseInt(string(val.Data()), 10, 64)
+		if val != nil {
+			val.Free()
+		}
+		if err != nil {
+			return 0, err
+		}
+		if parseErr != nil {
+			return 0, parseErr
+		}
+		// page ts is in seconds, a page closed within the same second may still hold messages after ts
+		if pageTs >= ts.Unix() {
+			break
+		}
+		startID = pageID + 1
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	return startID, nil
+}
+
+// findMsgByTime returns the first message id from startID whose produce time is at or after ts,
+// DefaultMessageID is returned if there is none
+func (rmq *RocketMQServer) findMsgByTime(topic string, startID UniqueID, ts time.Time) (UniqueID, error) {
+	msgTsPrefix := constructKey(MsgTsTitle, topic) + "/"
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	iter := rocksdb.NewRocksIteratorWithUpperBound(rmq.store, utils.AddOne(msgTsPrefix), readOpts)
+	defer iter.Close()
+
+	seekKey := msgTsPrefix
+	if startID > 0 {
+		seekKey += strconv.FormatInt(startID, 10)
+	}
+	target := ts.UnixMilli()
+	for iter.Seek([]byte(seekKey)); iter.Valid(); iter.Next() {
+		val := iter.Value()
+		msgTs, err := strconv.ParseInt(string(val.Data()), 10, 64)
+		if val != nil {
+			val.Free()
+		}
+		if err != nil {
+			return DefaultMessageID, err
+		}
+		if msgTs < target {
+			continue
+		}
+		key := iter.Key()
+		strKey := string(key.Data())
+		if key != nil {
+			key.Free()
+		}
+		return strconv.ParseInt(strKey[len(msgTsPrefix):], 10, 64)
+	}
+	if err := iter.Err(); err != nil {
+		return DefaultMessageID, err
+	}
+	return DefaultMessageID, nil
+}
+
 /**
  * Construct current id
  */
@@ -854,6 +1439,20 @@ func constructCurrentID(topicName, groupName string) string {
 	return groupName + "/" + topicName
 }
 
+// topicGroups returns the consumer groups of the topic in ascending order
+func (rmq *RocketMQServer) topicGroups(topic string) []string {
+	var groups []string
+	rmq.consumersID.Range(func(key, _ interface{}) bool {
+		k := key.(string)
+		if idx := strings.LastIndex(k, "/"); idx >= 0 && k[idx+1:] == topic {
+			groups = append(groups, k[:idx])
+		}
+		return true
+	})
+	sort.Strings(groups)
+	return groups
+}
+
 /**
  * Combine metaname together with topic
  */
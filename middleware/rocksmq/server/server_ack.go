@@ -0,0 +1,496 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/utils/paramtable"
+	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ConsumerGroupTitle consumer_group/topicName/groupName, the json encoded options of a consumer group in ack mode,
+	// cleaned up on destroy of the group or the topic
+	ConsumerGroupTitle = "consumer_group/"
+
+	// ConsumerPosTitle consumer_pos/topicName/groupName, the current id of a consumer group in ack mode
+	ConsumerPosTitle = "consumer_pos/"
+
+	// PendingTitle pending/topicName/groupName/msgId, the delivery state of a message consumed but not acked yet
+	PendingTitle = "pending/"
+
+	// redeliveryCheckInterval is the interval to wake up consumer groups which have messages to redeliver
+	redeliveryCheckInterval = time.Second
+)
+
+// pendingMsg is the delivery state of a message waiting for its ack
+type pendingMsg struct {
+	DeliveryCount int   `json:"delivery_count"`
+	Deadline      int64 `json:"deadline"` // unix milliseconds, the message is redelivered after it
+	Failures      int   `json:"failures"` // how many times the message is nacked
+}
+
+// ackGroup is the state of a consumer group in ack mode, it is guarded by the topic mutex
+type ackGroup struct {
+	topic   string
+	group   string
+	options rocksmq.ConsumerGroupOptions
+	pending map[UniqueID]*pendingMsg
+	// ackedPos is the position before which every message is acked
+	ackedPos UniqueID
+}
+
+func newAckGroup(topic, group string, options rocksmq.ConsumerGroupOptions) *ackGroup {
+	return &ackGroup{
+		topic:    topic,
+		group:    group,
+		options:  options,
+		pending:  make(map[UniqueID]*pendingMsg),
+		ackedPos: DefaultMessageID,
+	}
+}
+
+func (ag *ackGroup) ackTimeout() time.Duration {
+	if ag.options.AckTimeout > 0 {
+		return ag.options.AckTimeout
+	}
+	return paramtable.Get().RocksmqCfg.AckTimeoutInSeconds.GetAsDuration(time.Second)
+}
+
+func (ag *ackGroup) pendingKey(msgID UniqueID) string {
+	return PendingTitle + ag.topic + "/" + ag.group + "/" + strconv.FormatInt(msgID, 10)
+}
+
+// dueIDs returns at most n pending messages whose ack deadline passed, in id order
+func (ag *ackGroup) dueIDs(now time.Time, n int) []UniqueID {
+	ids := make([]UniqueID, 0)
+	for id, p := range ag.pending {
+		if p.Deadline <= now.UnixMilli() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// position returns the first message not acked yet, which is currentID if nothing is pending
+func (ag *ackGroup) position(currentID UniqueID) UniqueID {
+	pos := currentID
+	for id := range ag.pending {
+		if pos == DefaultMessageID || id < pos {
+			pos = id
+		}
+	}
+	return pos
+}
+
+func ackGroupKey(topic, group string) string {
+	return topic + "/" + group
+}
+
+func (rmq *RocketMQServer) getAckGroup(topic, group string) *ackGroup {
+	ag, ok := rmq.ackGroups.Load(constructCurrentID(topic, group))
+	if !ok {
+		return nil
+	}
+	return ag.(*ackGroup)
+}
+
+// createAckGroup persists a new consumer group in ack mode
+func (rmq *RocketMQServer) createAckGroup(topic, group string, options rocksmq.ConsumerGroupOptions) error {
+	if strings.Contains(group, "/") {
+		return fmt.Errorf("consumer group %s in ack mode should not contain \"/\"", group)
+	}
+	val, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	kvs := map[string]string{
+		ConsumerGroupTitle + ackGroupKey(topic, group): string(val),
+		ConsumerPosTitle + ackGroupKey(topic, group):   strconv.FormatInt(DefaultMessageID, 10),
+	}
+	if err = rmq.kv.MultiSave(kvs); err != nil {
+		return err
+	}
+	rmq.ackGroups.Store(constructCurrentID(topic, group), newAckGroup(topic, group, options))
+	return nil
+}
+
+// removeAckGroup drops the persisted state of a consumer group in ack mode
+func (rmq *RocketMQServer) removeAckGroup(topic, group string) error {
+	if _, ok := rmq.ackGroups.LoadAndDelete(constructCurrentID(topic, group)); !ok {
+		return nil
+	}
+	if err := rmq.kv.RemoveWithPrefix(PendingTitle + ackGroupKey(topic, group) + "/"); err != nil {
+		return err
+	}
+	return rmq.kv.MultiRemove([]string{
+		ConsumerGroupTitle + ackGroupKey(topic, group),
+		ConsumerPosTitle + ackGroupKey(topic, group),
+	})
+}
+
+// restoreAckGroups loads the consumer groups in ack mode with their positions and pending messages
+func (rmq *RocketMQServer) restoreAckGroups() error {
+	keys, vals, err := rmq.kv.LoadWithPrefix(ConsumerGroupTitle)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		topic, group, ok := strings.Cut(key[len(ConsumerGroupTitle):], "/")
+		if !ok {
+			return fmt.Errorf("invalid consumer group key %s", key)
+		}
+		if _, ok = topicMu.Load(topic); !ok {
+			log.Warn("skip consumer group of a missing topic", zap.String("topic", topic), zap.String("group", group))
+			continue
+		}
+		options := rocksmq.ConsumerGroupOptions{}
+		if err = json.Unmarshal([]byte(vals[i]), &options); err != nil {
+			return fmt.Errorf("invalid consumer group %s: %w", key, err)
+		}
+		filter, err := compileFilter(options.Filter)
+		if err != nil {
+			return fmt.Errorf("invalid consumer group %s: %w", key, err)
+		}
+		ag := newAckGroup(topic, group, options)
+
+		posVal, err := rmq.kv.Load(ConsumerPosTitle + ackGroupKey(topic, group))
+		if err != nil {
+			return err
+		}
+		currentID := DefaultMessageID
+		if posVal != "" {
+			if currentID, err = strconv.ParseInt(posVal, 10, 64); err != nil {
+				return err
+			}
+		}
+
+		pendingPrefix := PendingTitle + ackGroupKey(topic, group) + "/"
+		pendingKeys, pendingVals, err := rmq.kv.LoadWithPrefix(pendingPrefix)
+		if err != nil {
+			return err
+		}
+		for j, pendingKey := range pendingKeys {
+			msgID, err := strconv.ParseInt(pendingKey[len(pendingPrefix):], 10, 64)
+			if err != nil {
+				return err
+			}
+			p := &pendingMsg{}
+			if err = json.Unmarshal([]byte(pendingVals[j]), p); err != nil {
+				return err
+			}
+			ag.pending[msgID] = p
+		}
+		ag.ackedPos = ag.position(currentID)
+
+		rmq.consumersID.Store(constructCurrentID(topic, group), currentID)
+		rmq.ackGroups.Store(constructCurrentID(topic, group), ag)
+		if filter != nil {
+			rmq.filters.Store(constructCurrentID(topic, group), filter)
+		}
+		log.Info("restore consumer group in ack mode", zap.String("topic", topic), zap.String("group", group),
+			zap.Int64("currentID", currentID), zap.Int("pending", len(ag.pending)))
+	}
+	return nil
+}
+
+// consumeWithAck redelivers the pending messages whose ack deadline passed, then reads new messages,
+// every returned message stays pending until it is acked. The new delivery states are saved before they are
+// applied to the group, so a failed save leaves the group as it was and the messages are delivered again
+func (rmq *RocketMQServer) consumeWithAck(ag *ackGroup, currentID UniqueID, n int) ([]rocksmq.ConsumerMessage, error) {
+	now := time.Now()
+	deadline := now.Add(ag.ackTimeout()).UnixMilli()
+	kvs := make(map[string]string)
+	updated := make(map[UniqueID]*pendingMsg)
+	var purgedIDs []UniqueID
+	consumerMessage := make([]rocksmq.ConsumerMessage, 0, n)
+
+	for _, msgID := range ag.dueIDs(now, n) {
+		msgs, err := rmq.readMessages(ag.topic, msgID, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 || msgs[0].MsgID != msgID {
+			// the message is purged by retention, nothing to redeliver
+			purgedIDs = append(purgedIDs, msgID)
+			continue
+		}
+		p := *ag.pending[msgID]
+		msgs[0].RedeliveryCount = p.DeliveryCount
+		p.DeliveryCount++
+		p.Deadline = deadline
+		val, err := json.Marshal(&p)
+		if err != nil {
+			return nil, err
+		}
+		kvs[ag.pendingKey(msgID)] = string(val)
+		updated[msgID] = &p
+		consumerMessage = append(consumerMessage, msgs[0])
+	}
+
+	lastID, ok := rmq.getLastID(ag.topic)
+	// the messages skipped by the filter never become pending, they are acked once the position moves past them
+	filter := rmq.getFilter(ag.topic, ag.group)
+	nextID := currentID
+	if len(consumerMessage) < n && !(ok && currentID > lastID) {
+		var msgs []rocksmq.ConsumerMessage
+		var more bool
+		var err error
+		msgs, nextID, more, err = rmq.readFiltered(ag.topic, currentID, n-len(consumerMessage), filter)
+		if err != nil {
+			return nil, err
+		}
+		if more {
+			rmq.Notify(ag.topic, ag.group)
+		}
+		for _, msg := range msgs {
+			p := &pendingMsg{DeliveryCount: 1, Deadline: deadline}
+			val, err := json.Marshal(p)
+			if err != nil {
+				return nil, err
+			}
+			kvs[ag.pendingKey(msg.MsgID)] = string(val)
+			updated[msg.MsgID] = p
+		}
+		if nextID != currentID {
+			kvs[ConsumerPosTitle+ackGroupKey(ag.topic, ag.group)] = strconv.FormatInt(nextID, 10)
+		}
+		consumerMessage = append(consumerMessage, msgs...)
+	}
+
+	if len(kvs) > 0 {
+		if err := rmq.kv.MultiSave(kvs); err != nil {
+			return nil, err
+		}
+	}
+	for msgID, p := range updated {
+		ag.pending[msgID] = p
+	}
+	if nextID != currentID {
+		rmq.consumersID.Store(constructCurrentID(ag.topic, ag.group), nextID)
+	}
+	if len(purgedIDs) > 0 {
+		removedKeys := make([]string, 0, len(purgedIDs))
+		for _, msgID := range purgedIDs {
+			removedKeys = append(removedKeys, ag.pendingKey(msgID))
+		}
+		if err := rmq.kv.MultiRemove(removedKeys); err != nil {
+			return nil, err
+		}
+		for _, msgID := range purgedIDs {
+			delete(ag.pending, msgID)
+		}
+	}
+	if len(purgedIDs) > 0 || (filter != nil && nextID != currentID) {
+		if err := rmq.advanceAckedPos(ag); err != nil {
+			return nil, err
+		}
+	}
+	return consumerMessage, nil
+}
+
+// advanceAckedPos moves the acked position forward after pending messages are acked,
+// so that retention can purge the pages every group acked
+func (rmq *RocketMQServer) advanceAckedPos(ag *ackGroup) error {
+	currentID, ok := rmq.getCurrentID(ag.topic, ag.group)
+	if !ok {
+		return fmt.Errorf("currentID of topicName=%s, groupName=%s not exist", ag.topic, ag.group)
+	}
+	pos := ag.position(currentID)
+	if pos <= ag.ackedPos {
+		return nil
+	}
+	if err := rmq.updateAckedInfo(ag.topic, ag.group, ag.ackedPos, pos-1); err != nil {
+		return err
+	}
+	ag.ackedPos = pos
+	return nil
+}
+
+// lockAckGroup locks the topic and returns the consumer group in ack mode, the caller should unlock the topic
+func (rmq *RocketMQServer) lockAckGroup(topic, group string) (*ackGroup, *sync.Mutex, error) {
+	if rmq.isClosed() {
+		return nil, nil, errors.New(RmqNotServingErrMsg)
+	}
+	ll, ok := topicMu.Load(topic)
+	if !ok {
+		return nil, nil, fmt.Errorf("topic name = %s not exist", topic)
+	}
+	lock, ok := ll.(*sync.Mutex)
+	if !ok {
+		return nil, nil, fmt.Errorf("get mutex failed, topic name = %s", topic)
+	}
+	lock.Lock()
+	ag := rmq.getAckGroup(topic, group)
+	if ag == nil {
+		lock.Unlock()
+		return nil, nil, fmt.Errorf("consumer group %s of topic %s is not in ack mode", group, topic)
+	}
+	return ag, lock, nil
+}
+
+// Ack acknowledges the messages, unknown or already acked ids are ignored
+func (rmq *RocketMQServer) Ack(topic, group string, msgIDs ...UniqueID) error {
+	ag, lock, err := rmq.lockAckGroup(topic, group)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	acked := make(map[UniqueID]struct{}, len(msgIDs))
+	for _, msgID := range msgIDs {
+		acked[msgID] = struct{}{}
+	}
+	return rmq.removePending(ag, func(id UniqueID) bool {
+		_, ok := acked[id]
+		return ok
+	})
+}
+
+// AckCumulative acknowledges every pending message up to and including msgID
+func (rmq *RocketMQServer) AckCumulative(topic, group string, msgID UniqueID) error {
+	ag, lock, err := rmq.lockAckGroup(topic, group)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	return rmq.removePending(ag, func(id UniqueID) bool {
+		return id <= msgID
+	})
+}
+
+// removePending removes the pending messages matched by acked from the kv, then from memory,
+// so that a failed write leaves both as they were
+func (rmq *RocketMQServer) removePending(ag *ackGroup, acked func(UniqueID) bool) error {
+	var removedIDs []UniqueID
+	var removedKeys []string
+	for id := range ag.pending {
+		if acked(id) {
+			removedIDs = append(removedIDs, id)
+			removedKeys = append(removedKeys, ag.pendingKey(id))
+		}
+	}
+	if len(removedKeys) == 0 {
+		return nil
+	}
+	if err := rmq.kv.MultiRemove(removedKeys); err != nil {
+		return err
+	}
+	for _, id := range removedIDs {
+		delete(ag.pending, id)
+	}
+	return rmq.advanceAckedPos(ag)
+}
+
+// Nack marks the messages to be redelivered right away, a message nacked too many times
+// is moved to the dead letter topic of the group if there is one
+func (rmq *RocketMQServer) Nack(topic, group string, msgIDs ...UniqueID) error {
+	ag, lock, err := rmq.lockAckGroup(topic, group)
+	if err != nil {
+		return err
+	}
+	deadIDs, deadMsgs, err := rmq.nack(ag, msgIDs)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	rmq.Notify(topic, group)
+	if len(deadIDs) == 0 {
+		return nil
+	}
+	return rmq.moveToDeadLetter(ag, deadIDs, deadMsgs)
+}
+
+// nack returns the messages which should be moved to the dead letter topic,
+// they keep their ack deadline so they are redelivered if the move fails.
+// The pending messages are updated in memory only after they are saved
+func (rmq *RocketMQServer) nack(ag *ackGroup, msgIDs []UniqueID) ([]UniqueID, []rocksmq.ProducerMessage, error) {
+	kvs := make(map[string]string)
+	updated := make(map[UniqueID]*pendingMsg)
+	var deadIDs []UniqueID
+	var deadMsgs []rocksmq.ProducerMessage
+	for _, msgID := range msgIDs {
+		pending, ok := ag.pending[msgID]
+		if !ok {
+			continue
+		}
+		if p, ok := updated[msgID]; ok {
+			pending = p
+		}
+		p := *pending
+		p.Failures++
+		if ag.options.DeadLetterTopic != "" && p.Failures >= ag.options.MaxFailures {
+			msg, ok, err := rmq.deadLetterMessage(ag, msgID, &p)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				deadIDs = append(deadIDs, msgID)
+				deadMsgs = append(deadMsgs, msg)
+			}
+		} else {
+			p.Deadline = 0
+		}
+		val, err := json.Marshal(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		kvs[ag.pendingKey(msgID)] = string(val)
+		updated[msgID] = &p
+	}
+	if len(kvs) > 0 {
+		if err := rmq.kv.MultiSave(kvs); err != nil {
+			return nil, nil, err
+		}
+	}
+	for msgID, p := range updated {
+		ag.pending[msgID] = p
+	}
+	return deadIDs, deadMsgs, nil
+}
+
+func (rmq *RocketMQServer) startRedelivery() {
+	rmq.closeWg.Add(1)
+	go rmq.redelivery()
+}
+
+// redelivery wakes up the consumer groups in ack mode which have messages passed their ack deadline
+func (rmq *RocketMQServer) redelivery() {
+	defer rmq.closeWg.Done()
+	ticker := time.NewTicker(redeliveryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rmq.closeCh:
+			return
+		case now := <-ticker.C:
+			rmq.ackGroups.Range(func(_, value interface{}) bool {
+				ag := value.(*ackGroup)
+				ll, ok := topicMu.Load(ag.topic)
+				if !ok {
+					return true
+				}
+				lock := ll.(*sync.Mutex)
+				lock.Lock()
+				due := len(ag.dueIDs(now, 1)) > 0
+				lock.Unlock()
+				if due {
+					rmq.Notify(ag.topic, ag.group)
+				}
+				return true
+			})
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/kv/rocksdb"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/utils"
+	"github.com/tecbot/gorocksdb"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// pageInfo is a page of a topic
+type pageInfo struct {
+	endID UniqueID
+	size  int64
+	stats pageStats
+	acked bool
+}
+
+// ListTopics returns the topics in ascending order, a partitioned topic is listed instead of its partitions
+func (rmq *RocketMQServer) ListTopics() ([]string, error) {
+	if rmq.isClosed() {
+		return nil, errors.New(RmqNotServingErrMsg)
+	}
+	keys, _, err := rmq.kv.LoadWithPrefix(TopicIDTitle)
+	if err != nil {
+		return nil, err
+	}
+	var topics []string
+	partitionTopics := make(map[string]bool)
+	rmq.partitions.Range(func(key, value interface{}) bool {
+		topics = append(topics, key.(string))
+		for p := 0; p < value.(int); p++ {
+			partitionTopics[rocksmq.PartitionTopic(key.(string), p)] = true
+		}
+		return true
+	})
+	for _, key := range keys {
+		if topic := key[len(TopicIDTitle):]; !partitionTopics[topic] {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// GetTopicStats returns the stats of the topic and its consumer groups. They come from the page info of the topic,
+// only the page holding the current id of a group is scanned for its backlog
+func (rmq *RocketMQServer) GetTopicStats(topic string) (*rocksmq.TopicStats, error) {
+	if rmq.isClosed() {
+		return nil, errors.New(RmqNotServingErrMsg)
+	}
+	if n := rmq.getPartitions(topic); n > 0 {
+		return rmq.partitionedTopicStats(topic, n)
+	}
+	if _, ok := topicMu.Load(topic); !ok {
+		return nil, fmt.Errorf("topic name = %s not exist", topic)
+	}
+	return rmq.topicStats(topic)
+}
+
+func (rmq *RocketMQServer) topicStats(topic string) (*rocksmq.TopicStats, error) {
+	stats := &rocksmq.TopicStats{
+		Topic:     topic,
+		Retention: rmq.retentionIndo.getPolicy(topic),
+		Compacted: rmq.retentionIndo.compactedTopics.Contain(topic),
+	}
+	createdAt, err := rmq.kv.Load(TopicIDTitle + topic)
+	if err != nil {
+		return nil, err
+	}
+	if ts, err := strconv.ParseInt(createdAt, 10, 64); err == nil {
+		stats.CreatedAt = time.Unix(ts, 0)
+	}
+	if ts, ok := rmq.retentionIndo.topicRetentionTime.Get(topic); ok {
+		stats.LastRetention = time.Unix(ts, 0)
+	}
+
+	pages, open, err := rmq.loadPages(topic)
+	if err != nil {
+		return nil, err
+	}
+	stats.PageCount = len(pages)
+	for _, page := range append(pages, open) {
+		stats.MsgCount += page.stats.Count
+		stats.Bytes += page.size
+		stats.RawBytes += page.stats.RawBytes
+		if page.acked {
+			stats.AckedPages++
+		}
+	}
+	if stats.MsgCount > 0 {
+		if stats.FirstMsgID, err = rmq.getEarliestMsg(topic); err != nil {
+			return nil, err
+		}
+		if stats.LastMsgID, err = rmq.getLatestMsg(topic); err != nil {
+			return nil, err
+		}
+	}
+	if stats.Scheduled, err = rmq.countScheduled(topic); err != nil {
+		return nil, err
+	}
+
+	for _, group := range rmq.topicGroups(topic) {
+		gs, err := rmq.groupStats(topic, group, pages, open)
+		if err != nil {
+			return nil, err
+		}
+		stats.Groups = append(stats.Groups, gs)
+	}
+	return stats, nil
+}
+
+// groupStats computes the backlog of the group, the full pages after its current id are taken from the page info
+func (rmq *RocketMQServer) groupStats(topic, group string, pages []pageInfo, open pageInfo) (rocksmq.GroupStats, error) {
+	gs := rocksmq.GroupStats{Group: group}
+	lock := rmq.topicLock(topic)
+	if lock == nil {
+		return gs, fmt.Errorf("topic name = %s not exist", topic)
+	}
+	lock.Lock()
+	currentID, ok := rmq.getCurrentID(topic, group)
+	if ag := rmq.getAckGroup(topic, group); ag != nil {
+		gs.AckMode = true
+		gs.Pending = len(ag.pending)
+	}
+	lock.Unlock()
+	if !ok {
+		return gs, fmt.Errorf("consumer group %s of topic %s not exist", group, topic)
+	}
+	gs.CurrentID = currentID
+	if val, ok := rmq.lastConsume.Load(constructCurrentID(topic, group)); ok {
+		gs.LastConsume = val.(time.Time)
+	}
+
+	// the page holding the current id is scanned, the ones after it are summed up
+	p := sort.Search(len(pages), func(i int) bool { return pages[i].endID >= currentID })
+	scanEndID := DefaultMessageID
+	if p < len(pages) {
+		scanEndID = pages[p].endID
+		gs.BacklogMsgs, gs.BacklogBytes = open.stats.Count, open.size
+		for _, page := range pages[p+1:] {
+			gs.BacklogMsgs += page.stats.Count
+			gs.BacklogBytes += page.size
+		}
+	}
+	count, scanned, err := rmq.scanMessages(topic, currentID, scanEndID)
+	if err != nil {
+		return gs, err
+	}
+	gs.BacklogMsgs += count
+	gs.BacklogBytes += scanned
+	return gs, nil
+}
+
+// loadPages returns the full pages of the topic in ascending order and the open page
+func (rmq *RocketMQServer) loadPages(topic string) ([]pageInfo, pageInfo, error) {
+	keys, vals, err := rmq.kv.LoadWithPrefix(constructKey(PageMsgSizeTitle, topic) + "/")
+	if err != nil {
+		return nil, pageInfo{}, err
+	}
+	statsKeys, statsVals, err := rmq.kv.LoadWithPrefix(constructKey(PageMsgStatsTitle, topic) + "/")
+	if err != nil {
+		return nil, pageInfo{}, err
+	}
+	stats := make(map[UniqueID]pageStats, len(statsKeys))
+	for i, key := range statsKeys {
+		pageID, err := parsePageID(key)
+		if err != nil {
+			return nil, pageInfo{}, err
+		}
+		if stats[pageID], err = parsePageStats(statsVals[i]); err != nil {
+			return nil, pageInfo{}, err
+		}
+	}
+	ackedKeys, _, err := rmq.kv.LoadWithPrefix(constructKey(AckedTsTitle, topic) + "/")
+	if err != nil {
+		return nil, pageInfo{}, err
+	}
+	acked := make(map[UniqueID]bool, len(ackedKeys))
+	for _, key := range ackedKeys {
+		pageID, err := parsePageID(key)
+		if err != nil {
+			return nil, pageInfo{}, err
+		}
+		acked[pageID] = true
+	}
+	pages := make([]pageInfo, 0, len(keys))
+	for i, key := range keys {
+		pageID, err := parsePageID(key)
+		if err != nil {
+			return nil, pageInfo{}, err
+		}
+		size, err := strconv.ParseInt(vals[i], 10, 64)
+		if err != nil {
+			return nil, pageInfo{}, err
+		}
+		pages = append(pages, pageInfo{endID: pageID, size: size, stats: stats[pageID], acked: acked[pageID]})
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].endID < pages[j].endID })
+
+	open := pageInfo{}
+	val, err := rmq.kv.Load(MessageSizeTitle + topic)
+	if err != nil {
+		return nil, open, err
+	}
+	if open.size, err = strconv.ParseInt(val, 10, 64); err != nil {
+		return nil, open, err
+	}
+	if val, err = rmq.kv.Load(MessageStatsTitle + topic); err != nil {
+		return nil, open, err
+	}
+	if open.stats, err = parsePageStats(val); err != nil {
+		return nil, open, err
+	}
+	return pages, open, nil
+}
+
+// getEarliestMsg returns the id of the first message kept in the topic, DefaultMessageID if it is empty
+func (rmq *RocketMQServer) getEarliestMsg(topic string) (UniqueID, error) {
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	prefix := topic + "/"
+	iter := rocksdb.NewRocksIteratorWithUpperBound(rmq.store, utils.AddOne(prefix), readOpts)
+	defer iter.Close()
+	iter.Seek([]byte(prefix))
+	if !iter.Valid() {
+		return DefaultMessageID, iter.Err()
+	}
+	key := iter.Key()
+	defer key.Free()
+	return strconv.ParseInt(string(key.Data())[len(prefix):], 10, 64)
+}
+
+// scanMessages counts the messages from startID up to endID and sums up their payload size, startID may be
+// DefaultMessageID to start from the first message and endID to go to the last one
+func (rmq *RocketMQServer) scanMessages(topic string, startID, endID UniqueID) (int64, int64, error) {
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	prefix := topic + "/"
+	iter := rocksdb.NewRocksIteratorWithUpperBound(rmq.store, utils.AddOne(prefix), readOpts)
+	defer iter.Close()
+	if startID == DefaultMessageID {
+		iter.Seek([]byte(prefix))
+	} else {
+		iter.Seek([]byte(path.Join(topic, strconv.FormatInt(startID, 10))))
+	}
+	var count, size int64
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		msgID, err := strconv.ParseInt(string(key.Data())[len(prefix):], 10, 64)
+		key.Free()
+		if err != nil {
+			return 0, 0, err
+		}
+		if endID != DefaultMessageID && msgID > endID {
+			break
+		}
+		count++
+		val := iter.Value()
+		size += int64(len(val.Data()))
+		val.Free()
+	}
+	return count, size, iter.Err()
+}
+
+// countScheduled counts the messages of the topic waiting for their deliver time
+func (rmq *RocketMQServer) countScheduled(topic string) (int64, error) {
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	prefix := delayPrefix(topic)
+	iter := rocksdb.NewRocksIteratorWithUpperBound(rmq.store, utils.AddOne(prefix), readOpts)
+	defer iter.Close()
+	var count int64
+	for iter.Seek([]byte(prefix)); iter.Valid(); iter.Next() {
+		count++
+	}
+	return count, iter.Err()
+}
+
+// partitionedTopicStats sums up the stats of the partitions, a consumer group sums up its backlog in each of them
+func (rmq *RocketMQServer) partitionedTopicStats(topic string, n int) (*rocksmq.TopicStats, error) {
+	stats := &rocksmq.TopicStats{Topic: topic}
+	groups := make(map[string]*rocksmq.GroupStats)
+	for p := 0; p < n; p++ {
+		ps, err := rmq.topicStats(rocksmq.PartitionTopic(topic, p))
+		if err != nil {
+			return nil, err
+		}
+		stats.Retention = ps.Retention
+		stats.Compacted = ps.Compacted
+		stats.MsgCount += ps.MsgCount
+		stats.Bytes += ps.Bytes
+		stats.RawBytes += ps.RawBytes
+		stats.PageCount += ps.PageCount
+		stats.AckedPages += ps.AckedPages
+		stats.Scheduled += ps.Scheduled
+		if ps.FirstMsgID != 0 && (stats.FirstMsgID == 0 || ps.FirstMsgID < stats.FirstMsgID) {
+			stats.FirstMsgID = ps.FirstMsgID
+		}
+		if ps.LastMsgID > stats.LastMsgID {
+			stats.LastMsgID = ps.LastMsgID
+		}
+		if ps.LastRetention.After(stats.LastRetention) {
+			stats.LastRetention = ps.LastRetention
+		}
+		for _, g := range ps.Groups {
+			gs, ok := groups[g.Group]
+			if !ok {
+				gs = &rocksmq.GroupStats{Group: g.Group, AckMode: g.AckMode}
+				groups[g.Group] = gs
+			}
+			gs.BacklogMsgs += g.BacklogMsgs
+			gs.BacklogBytes += g.BacklogBytes
+			gs.Pending += g.Pending
+			if g.LastConsume.After(gs.LastConsume) {
+				gs.LastConsume = g.LastConsume
+			}
+		}
+		stats.Partitions = append(stats.Partitions, *ps)
+	}
+	for _, gs := range groups {
+		stats.Groups = append(stats.Groups, *gs)
+	}
+	sort.Slice(stats.Groups, func(i, j int) bool { return stats.Groups[i].Group < stats.Groups[j].Group })
+	return stats, nil
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/kv/rocksdb"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/utils/paramtable"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the layout of a backup directory
+const (
+	backupStoreDir = "store"
+	backupMetaDir  = "meta_kv"
+	backupIDFile   = "id.json"
+	// backupManifest is written last, a backup without it is incomplete
+	backupManifest = "BACKUP"
+)
+
+// backupInfo is the manifest of a backup
+type backupInfo struct {
+	CreatedAt time.Time `json:"created_at"`
+	Topics    int       `json:"topics"`
+}
+
+// Backup takes a checkpoint of the message store and the meta kv into dir, which should not exist. dir is relative
+// to rocksmq.backupPath or inside it. The writes of every topic are paused meanwhile, so the two are consistent.
+// A checkpoint hard links the sst files if dir is on the same file system, which makes a backup cheap
+func (rmq *RocketMQServer) Backup(dir string) error {
+	if rmq.isClosed() {
+		return errors.New(RmqNotServingErrMsg)
+	}
+	dir, err := backupDir(dir)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(dir); err == nil {
+		return fmt.Errorf("backup dir %s already exists", dir)
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	start := time.Now()
+	unlock, topics := rmq.lockTopics()
+	err = rmq.checkpoint(dir)
+	unlock()
+	pauseTime := time.Since(start)
+	if err == nil {
+		var val []byte
+		if val, err = json.Marshal(backupInfo{CreatedAt: start, Topics: topics}); err == nil {
+			err = os.WriteFile(filepath.Join(dir, backupManifest), val, 0o644)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	log.Info("rocksmq backup done", zap.String("dir", dir), zap.Int("topics", topics),
+		zap.Duration("pause", pauseTime), zap.Duration("elapse", time.Since(start)))
+	return nil
+}
+
+// backupDir resolves the dir of a backup against rocksmq.backupPath, so that a caller of the broker can not write
+// anywhere else on its host
+func backupDir(dir string) (string, error) {
+	root, err := filepath.Abs(paramtable.Get().RocksmqCfg.BackupPath.GetValue())
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	dir = filepath.Clean(dir)
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("backup dir %s is not inside rocksmq.backupPath %s", dir, root)
+	}
+	return dir, nil
+}
+
+// lockTopics locks every topic in order, it returns the func to unlock them
+func (rmq *RocketMQServer) lockTopics() (func(), int) {
+	var topics []string
+	topicMu.Range(func(key, _ interface{}) bool {
+		topics = append(topics, key.(string))
+		return true
+	})
+	sort.Strings(topics)
+	locks := make([]*sync.Mutex, 0, len(topics))
+	for _, topic := range topics {
+		if lock := rmq.topicLock(topic); lock != nil {
+			lock.Lock()
+			locks = append(locks, lock)
+		}
+	}
+	return func() {
+		for _, lock := range locks {
+			lock.Unlock()
+		}
+	}, len(locks)
+}
+
+// checkpoint writes the checkpoints and the id high-water mark, which is copied last so that it covers every id in them
+func (rmq *RocketMQServer) checkpoint(dir string) error {
+	for _, c := range []struct {
+		db  *gorocksdb.DB
+		dir string
+	}{
+		{rmq.store, backupStoreDir},
+		{rmq.kv.(*rocksdb.RocksdbKV).DB, backupMetaDir},
+	} {
+		checkpoint, err := c.db.NewCheckpoint()
+		if err != nil {
+			return err
+		}
+		err = checkpoint.CreateCheckpoint(filepath.Join(dir, c.dir), 0)
+		checkpoint.Destroy()
+		if err != nil {
+			return err
+		}
+	}
+	// there is no id file if the id generator is given by the caller
+	if _, err := os.Stat(rmq.name + idKVSuffix); err != nil {
+		return nil
+	}
+	return copyFile(rmq.name+idKVSuffix, filepath.Join(dir, backupIDFile))
+}
+
+// RestoreRocksMQ brings back the rocksmq at name from a backup, nothing should exist at name yet
+func RestoreRocksMQ(backupDir, name string) error {
+	if _, err := os.Stat(filepath.Join(backupDir, backupManifest)); err != nil {
+		return fmt.Errorf("%s is not a complete rocksmq backup: %w", backupDir, err)
+	}
+	for _, target := range []string{name, name + kvSuffix, name + idKVSuffix} {
+		if _, err := os.Stat(target); err == nil {
+			return fmt.Errorf("%s already exists", target)
+		}
+	}
+	if err := copyDir(filepath.Join(backupDir, backupStoreDir), name); err != nil {
+		return err
+	}
+	if err := copyDir(filepath.Join(backupDir, backupMetaDir), name+kvSuffix); err != nil {
+		return err
+	}
+	idFile := filepath.Join(backupDir, backupIDFile)
+	if _, err := os.Stat(idFile); err == nil {
+		if err = copyFile(idFile, name+idKVSuffix); err != nil {
+			return err
+		}
+	}
+	log.Info("rocksmq restored", zap.String("backup", backupDir), zap.String("path", name))
+	return nil
+}
+
+// RemoveRocksMQ removes the message store, the meta kv and the id file of the rocksmq at name
+func RemoveRocksMQ(name string) error {
+	for _, path := range []string{name, name + kvSuffix, name + idKVSuffix} {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0o755)
+		}
+		return copyFile(path, filepath.Join(dst, rel))
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
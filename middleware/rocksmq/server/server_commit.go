@@ -0,0 +1,293 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/utils/paramtable"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// produceReq is the messages of a Produce call, prepared under the topic mutex and waiting to be committed
+type produceReq struct {
+	topic  string
+	msgIDs []UniqueID
+	// visibleIDs are the messages written to the topic, the others are scheduled for later delivery
+	visibleIDs []UniqueID
+	msgSizes   map[UniqueID]msgSize
+	scheduled  []int64
+	keys       [][]byte
+	values     [][]byte
+	// size is the bytes written by the request, it bounds a group commit
+	size int64
+
+	start     time.Time
+	lockTime  time.Duration
+	allocTime time.Duration
+	writeTime time.Duration
+	done      chan error
+}
+
+func (req *produceReq) put(key, value []byte) {
+	req.keys = append(req.keys, key)
+	req.values = append(req.values, value)
+	req.size += int64(len(key) + len(value))
+}
+
+// prepareProduce allocates the ids of the messages and builds the entries to write, the caller should hold the topic mutex
+func (rmq *RocketMQServer) prepareProduce(topic string, messages []rocksmq.ProducerMessage, start time.Time) (*produceReq, error) {
+	req := &produceReq{topic: topic, start: start, lockTime: time.Since(start), msgSizes: make(map[UniqueID]msgSize)}
+	msgLen := len(messages)
+	idStart, idEnd, err := rmq.idGenerator.Gen(uint32(msgLen))
+	if err != nil {
+		return nil, err
+	}
+	req.allocTime = time.Since(start)
+	if UniqueID(msgLen) != idEnd-idStart {
+		return nil, errors.New("Obtained id length is not equal that of message")
+	}
+
+	req.msgIDs = make([]UniqueID, msgLen)
+	req.visibleIDs = make([]UniqueID, 0, msgLen)
+	now := time.Now().UnixMilli()
+	produceTs := []byte(strconv.FormatInt(now, 10))
+	for i := 0; i < msgLen && idStart+UniqueID(i) < idEnd; i++ {
+		msgID := idStart + UniqueID(i)
+		req.msgIDs[i] = msgID
+		if deliverAt, ok := deliverAtOf(&messages[i]); ok && deliverAt > now {
+			val, err := json.Marshal(messages[i])
+			if err != nil {
+				return nil, err
+			}
+			req.put([]byte(delayKey(topic, deliverAt, msgID)), val)
+			req.scheduled = append(req.scheduled, deliverAt)
+			continue
+		}
+		payload, msgProperties, err := compressPayload(messages[i].Payload, messages[i].Properties)
+		if err != nil {
+			return nil, err
+		}
+		key := path.Join(topic, strconv.FormatInt(msgID, 10))
+		req.put([]byte(key), payload)
+		properties, err := json.Marshal(msgProperties)
+		if err != nil {
+			log.Warn("properties marshal failed",
+				zap.Int64("msgID", msgID),
+				zap.String("topicName", topic),
+				zap.Error(err))
+			return nil, err
+		}
+		pKey := path.Join("properties", topic, strconv.FormatInt(msgID, 10))
+		req.put([]byte(pKey), properties)
+		tsKey := path.Join(MsgTsTitle, topic, strconv.FormatInt(msgID, 10))
+		req.put([]byte(tsKey), produceTs)
+		req.visibleIDs = append(req.visibleIDs, msgID)
+		req.msgSizes[msgID] = msgSize{stored: int64(len(payload)), raw: int64(len(messages[i].Payload))}
+	}
+	return req, nil
+}
+
+// writeProduce writes the entries of the requests in one batch
+func (rmq *RocketMQServer) writeProduce(reqs ...*produceReq) error {
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for _, req := range reqs {
+		for i := range req.keys {
+			batch.Put(req.keys[i], req.values[i])
+		}
+	}
+	opts := gorocksdb.NewDefaultWriteOptions()
+	defer opts.Destroy()
+	return rmq.store.Write(opts, batch)
+}
+
+// applyProduce makes the written messages visible, it wakes up the consumers and readers of the topic
+// and updates the page info. The caller should hold the topic mutex
+func (rmq *RocketMQServer) applyProduce(req *produceReq) error {
+	req.writeTime = time.Since(req.start)
+	for _, deliverAt := range req.scheduled {
+		rmq.schedule(req.topic, deliverAt)
+	}
+	if len(req.visibleIDs) == 0 {
+		return nil
+	}
+	if vals, ok := rmq.consumers.Load(req.topic); ok {
+		for _, v := range vals.([]*rocksmq.Consumer) {
+			select {
+			case v.MsgMutex <- struct{}{}:
+				continue
+			default:
+				continue
+			}
+		}
+	}
+	rmq.notifyReaders(req.topic)
+	if err := rmq.updatePageInfo(req.topic, req.visibleIDs, req.msgSizes); err != nil {
+		return err
+	}
+	rmq.topicLastID.Store(req.topic, req.visibleIDs[len(req.visibleIDs)-1])
+	return nil
+}
+
+// enqueue hands the request over to the group commit, it never blocks so it is safe under the topic mutex
+func (rmq *RocketMQServer) enqueue(req *produceReq) {
+	req.done = make(chan error, 1)
+	rmq.commitMu.Lock()
+	rmq.commitQueue = append(rmq.commitQueue, req)
+	rmq.commitSize += req.size
+	rmq.commitMu.Unlock()
+	select {
+	case rmq.commitCh <- struct{}{}:
+	default:
+	}
+}
+
+// waitCommitted waits until the request is committed, or fails it if rocksmq is closed before
+func (rmq *RocketMQServer) waitCommitted(req *produceReq) error {
+	select {
+	case err := <-req.done:
+		return err
+	case <-rmq.commitDone:
+		select {
+		case err := <-req.done:
+			return err
+		default:
+			return errors.New(RmqNotServingErrMsg)
+		}
+	}
+}
+
+func (rmq *RocketMQServer) startGroupCommit() {
+	rmq.closeWg.Add(1)
+	go rmq.groupCommit()
+}
+
+// groupCommit writes the requests of concurrent Produce calls of any topic in one batch. A flush waits at most
+// the max latency for more requests, and happens right away once the queued requests reach the max batch size
+func (rmq *RocketMQServer) groupCommit() {
+	defer rmq.closeWg.Done()
+	defer close(rmq.commitDone)
+	params := paramtable.Get()
+	maxLatency := params.RocksmqCfg.GroupCommitMaxLatencyInMs.GetAsDuration(time.Millisecond)
+	maxSize := params.RocksmqCfg.GroupCommitMaxBatchSize.GetAsInt64()
+	for {
+		select {
+		case <-rmq.closeCh:
+			for reqs := rmq.takeQueued(maxSize); len(reqs) > 0; reqs = rmq.takeQueued(maxSize) {
+				rmq.flush(reqs)
+			}
+			return
+		case <-rmq.commitCh:
+		}
+		if maxLatency > 0 && rmq.queuedSize() < maxSize {
+			timer := time.NewTimer(maxLatency)
+		wait:
+			for {
+				select {
+				case <-timer.C:
+					break wait
+				case <-rmq.closeCh:
+					timer.Stop()
+					break wait
+				case <-rmq.commitCh:
+					if rmq.queuedSize() >= maxSize {
+						timer.Stop()
+						break wait
+					}
+				}
+			}
+		}
+		if reqs := rmq.takeQueued(maxSize); len(reqs) > 0 {
+			rmq.flush(reqs)
+		}
+		if rmq.queuedSize() > 0 {
+			select {
+			case rmq.commitCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (rmq *RocketMQServer) queuedSize() int64 {
+	rmq.commitMu.Lock()
+	defer rmq.commitMu.Unlock()
+	return rmq.commitSize
+}
+
+// takeQueued dequeues the requests up to maxSize bytes, at least one if any is queued
+func (rmq *RocketMQServer) takeQueued(maxSize int64) []*produceReq {
+	rmq.commitMu.Lock()
+	defer rmq.commitMu.Unlock()
+	var size int64
+	n := 0
+	for n < len(rmq.commitQueue) && (n == 0 || size+rmq.commitQueue[n].size <= maxSize) {
+		size += rmq.commitQueue[n].size
+		n++
+	}
+	reqs := rmq.commitQueue[:n:n]
+	rmq.commitQueue = rmq.commitQueue[n:]
+	rmq.commitSize -= size
+	return reqs
+}
+
+// flush commits the requests in one write. It holds the mutexes of their topics, so a topic is not destroyed
+// in the middle, and the requests of a topic are applied in the order of their ids
+func (rmq *RocketMQServer) flush(reqs []*produceReq) {
+	var topics []string
+	for _, req := range reqs {
+		topics = append(topics, req.topic)
+	}
+	sort.Strings(topics)
+	locks := make(map[string]*sync.Mutex)
+	for _, topic := range topics {
+		if _, ok := locks[topic]; ok {
+			continue
+		}
+		lock := rmq.topicLock(topic)
+		if lock == nil {
+			locks[topic] = nil
+			continue
+		}
+		lock.Lock()
+		// the topic may be destroyed while waiting for its mutex
+		if rmq.topicLock(topic) != lock {
+			lock.Unlock()
+			lock = nil
+		}
+		locks[topic] = lock
+	}
+	defer func() {
+		for _, lock := range locks {
+			if lock != nil {
+				lock.Unlock()
+			}
+		}
+	}()
+
+	committed := make([]*produceReq, 0, len(reqs))
+	for _, req := range reqs {
+		if locks[req.topic] == nil {
+			req.done <- fmt.Errorf("topic name = %s not exist", req.topic)
+			continue
+		}
+		committed = append(committed, req)
+	}
+	err := rmq.writeProduce(committed...)
+	for _, req := range committed {
+		if err != nil {
+			req.done <- err
+			continue
+		}
+		req.done <- rmq.applyProduce(req)
+	}
+	log.Debug("rocksmq group commit", zap.Int("requests", len(committed)), zap.Int("topics", len(locks)), zap.Error(err))
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/linkbase/middleware/kv/rocksdb"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/utils"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// keyedMsg is the key and the payload size of a message in a compacted topic
+type keyedMsg struct {
+	id   UniqueID
+	key  string
+	size msgSize
+}
+
+// compact rewrites the full pages of a compacted topic keeping only the newest message of each key, and drops
+// the keys whose newest message is a tombstone. The open page is left as it is, but its messages supersede the
+// older messages of their keys. Only the messages after the compacted watermark are read, the newest message of
+// each key before it is found by the key index
+func (ri *retentionInfo) compact(topic string) error {
+	start := time.Now()
+	pageEndIDs, err := ri.pageEndIDs(topic)
+	if err != nil {
+		return err
+	}
+	if len(pageEndIDs) == 0 {
+		return nil
+	}
+	compactEndID := pageEndIDs[len(pageEndIDs)-1]
+	watermark, err := ri.compactedWatermark(topic)
+	if err != nil {
+		return err
+	}
+	msgs, err := ri.scanKeyedMsgs(topic, watermark+1)
+	if err != nil {
+		return err
+	}
+
+	latest := make(map[string]keyedMsg)
+	for _, msg := range msgs {
+		if msg.key != "" && msg.id > latest[msg.key].id {
+			latest[msg.key] = msg
+		}
+	}
+	var removedIDs []UniqueID
+	removedSizes := make(map[UniqueID]msgSize)
+	for _, msg := range msgs {
+		if msg.id > compactEndID || msg.key == "" {
+			continue
+		}
+		if latest[msg.key].id == msg.id && msg.size.stored > 0 {
+			continue
+		}
+		removedIDs = append(removedIDs, msg.id)
+		removedSizes[msg.id] = msg.size
+	}
+	// the message of a key before the watermark is superseded by any message of the key after it
+	indexKvs := map[string]string{CompactedTitle + topic: strconv.FormatInt(compactEndID, 10)}
+	var indexRemovals []string
+	for key, msg := range latest {
+		indexKey := constructKey(CompactedKeyTitle, topic) + "/" + key
+		val, err := ri.kv.Load(indexKey)
+		if err != nil {
+			return err
+		}
+		if val != "" {
+			id, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return err
+			}
+			size, ok, err := ri.messageSize(topic, id)
+			if err != nil {
+				return err
+			}
+			if ok {
+				removedIDs = append(removedIDs, id)
+				removedSizes[id] = size
+			}
+		}
+		if msg.id <= compactEndID && msg.size.stored > 0 {
+			indexKvs[indexKey] = strconv.FormatInt(msg.id, 10)
+		} else if val != "" {
+			indexRemovals = append(indexRemovals, indexKey)
+		}
+	}
+
+	ll, ok := topicMu.Load(topic)
+	if !ok {
+		return fmt.Errorf("topic name = %s not exist", topic)
+	}
+	lock, ok := ll.(*sync.Mutex)
+	if !ok {
+		return fmt.Errorf("get mutex failed, topic name = %s", topic)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(removedIDs) == 0 {
+		log.Debug("Nothing to compact", zap.String("topic", topic), zap.Int64("time taken", time.Since(start).Milliseconds()))
+		return ri.saveKeyIndex(indexKvs, indexRemovals)
+	}
+	writeBatch := gorocksdb.NewWriteBatch()
+	defer writeBatch.Destroy()
+	for _, id := range removedIDs {
+		strID := strconv.FormatInt(id, 10)
+		writeBatch.Delete([]byte(path.Join(topic, strID)))
+		writeBatch.Delete([]byte(path.Join("properties", topic, strID)))
+		writeBatch.Delete([]byte(path.Join(MsgTsTitle, topic, strID)))
+	}
+	writeOpts := gorocksdb.NewDefaultWriteOptions()
+	defer writeOpts.Destroy()
+	if err = ri.db.Write(writeOpts, writeBatch); err != nil {
+		return err
+	}
+
+	if err = ri.shrinkPages(topic, pageEndIDs, removedSizes); err != nil {
+		return err
+	}
+	if err = ri.saveKeyIndex(indexKvs, indexRemovals); err != nil {
+		return err
+	}
+	log.Info("Compacted topic", zap.String("topic", topic), zap.Int64("compactEndID", compactEndID),
+		zap.Int("removed", len(removedIDs)), zap.Int("keys", len(latest)), zap.Int64("time taken", time.Since(start).Milliseconds()))
+	return nil
+}
+
+// pageEndIDs returns the end ids of the full pages of the topic in ascending order
+func (ri *retentionInfo) pageEndIDs(topic string) ([]UniqueID, error) {
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	pageMsgPrefix := constructKey(PageMsgSizeTitle, topic) + "/"
+	iter := rocksdb.NewRocksIteratorWithUpperBound(ri.kv.DB, utils.AddOne(pageMsgPrefix), readOpts)
+	defer iter.Close()
+	var pageIDs []UniqueID
+	for iter.Seek([]byte(pageMsgPrefix)); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		pageID, err := parsePageID(string(key.Data()))
+		key.Free()
+		if err != nil {
+			return nil, err
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(pageIDs, func(i, j int) bool { return pageIDs[i] < pageIDs[j] })
+	return pageIDs, nil
+}
+
+// compactedWatermark returns the end id of the pages compacted so far, it is DefaultMessageID before the first compaction
+func (ri *retentionInfo) compactedWatermark(topic string) (UniqueID, error) {
+	val, err := ri.kv.Load(CompactedTitle + topic)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+// saveKeyIndex moves the compacted watermark and updates the key index in one write
+func (ri *retentionInfo) saveKeyIndex(kvs map[string]string, removals []string) error {
+	writeBatch := gorocksdb.NewWriteBatch()
+	defer writeBatch.Destroy()
+	for key, val := range kvs {
+		writeBatch.Put([]byte(key), []byte(val))
+	}
+	for _, key := range removals {
+		writeBatch.Delete([]byte(key))
+	}
+	writeOpts := gorocksdb.NewDefaultWriteOptions()
+	defer writeOpts.Destroy()
+	return ri.kv.DB.Write(writeOpts, writeBatch)
+}
+
+// scanKeyedMsgs reads the key and the payload size of each message of the topic from startID on
+func (ri *retentionInfo) scanKeyedMsgs(topic string, startID UniqueID) ([]keyedMsg, error) {
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	prefix := topic + "/"
+	iter := rocksdb.NewRocksIteratorWithUpperBound(ri.db, utils.AddOne(prefix), readOpts)
+	defer iter.Close()
+	getOpts := gorocksdb.NewDefaultReadOptions()
+	defer getOpts.Destroy()
+	var msgs []keyedMsg
+	for iter.Seek([]byte(path.Join(topic, strconv.FormatInt(startID, 10)))); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		strID := string(key.Data())[len(prefix):]
+		key.Free()
+		val := iter.Value()
+		size := int64(len(val.Data()))
+		val.Free()
+		id, err := strconv.ParseInt(strID, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		propertiesValue, err := ri.db.GetBytes(getOpts, []byte(path.Join("properties", topic, strID)))
+		if err != nil {
+			return nil, err
+		}
+		properties := make(map[string]string)
+		if len(propertiesValue) != 0 {
+			if err = json.Unmarshal(propertiesValue, &properties); err != nil {
+				return nil, err
+			}
+		}
+		msgs = append(msgs, keyedMsg{id: id, key: properties[rocksmq.MessageKeyProperty],
+			size: msgSize{stored: size, raw: rawSizeOf(size, properties)}})
+	}
+	return msgs, iter.Err()
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/pierrec/lz4/v4"
+	"strconv"
+	"sync"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd creates the zstd encoder and decoder shared by every message, their EncodeAll and DecodeAll are concurrent safe
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdErr
+}
+
+// compressPayload compresses the payload of a message selecting a compression by CompressionProperty. It returns
+// the payload to store and its properties, which record the compression and the raw size. The payload is stored
+// as it is if it does not get smaller
+func compressPayload(payload []byte, properties map[string]string) ([]byte, map[string]string, error) {
+	codec, ok := properties[rocksmq.CompressionProperty]
+	if !ok {
+		return payload, properties, nil
+	}
+	stored := make(map[string]string, len(properties))
+	for k, v := range properties {
+		if k != rocksmq.CompressionProperty && k != rocksmq.RawSizeProperty {
+			stored[k] = v
+		}
+	}
+	var compressed []byte
+	switch rocksmq.Compression(codec) {
+	case rocksmq.CompressionNone:
+		return payload, stored, nil
+	case rocksmq.CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, nil, err
+		}
+		compressed = zstdEncoder.EncodeAll(payload, nil)
+	case rocksmq.CompressionLZ4:
+		buf := make([]byte, lz4.CompressBlockBound(len(payload)))
+		n, err := lz4.CompressBlock(payload, buf, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		// n is 0 if the payload is not compressible
+		compressed = buf[:n]
+	case rocksmq.CompressionSnappy:
+		compressed = snappy.Encode(nil, payload)
+	default:
+		return nil, nil, fmt.Errorf("unknown compression %s", codec)
+	}
+	if len(compressed) == 0 || len(compressed) >= len(payload) {
+		return payload, stored, nil
+	}
+	stored[rocksmq.CompressionProperty] = codec
+	stored[rocksmq.RawSizeProperty] = strconv.Itoa(len(payload))
+	return compressed, stored, nil
+}
+
+// decompressPayload restores the payload of a stored message, the compression properties are removed
+func decompressPayload(payload []byte, properties map[string]string) ([]byte, error) {
+	codec, ok := properties[rocksmq.CompressionProperty]
+	if !ok {
+		return payload, nil
+	}
+	rawSize, err := strconv.Atoi(properties[rocksmq.RawSizeProperty])
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw size of compressed payload: %w", err)
+	}
+	delete(properties, rocksmq.CompressionProperty)
+	delete(properties, rocksmq.RawSizeProperty)
+	switch rocksmq.Compression(codec) {
+	case rocksmq.CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(payload, make([]byte, 0, rawSize))
+	case rocksmq.CompressionLZ4:
+		raw := make([]byte, rawSize)
+		n, err := lz4.UncompressBlock(payload, raw)
+		if err != nil {
+			return nil, err
+		}
+		return raw[:n], nil
+	case rocksmq.CompressionSnappy:
+		return snappy.Decode(make([]byte, rawSize), payload)
+	default:
+		return nil, fmt.Errorf("unknown compression %s", codec)
+	}
+}
+
+// rawSizeOf returns the payload size of a stored message before compression
+func rawSizeOf(storedSize int64, properties map[string]string) int64 {
+	if size, err := strconv.ParseInt(properties[rocksmq.RawSizeProperty], 10, 64); err == nil {
+		return size
+	}
+	return storedSize
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/linkbase/middleware/kv/rocksdb"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/utils"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DelayTitle delay/topicName/deliverAt/msgId, the json encoded message scheduled for delivery at deliverAt,
+	// stored along with the messages and ordered by deliverAt in each topic
+	DelayTitle = "delay/"
+
+	// delayCheckInterval is the interval to release the scheduled messages which are due
+	delayCheckInterval = 100 * time.Millisecond
+
+	// releaseBatchSize is the number of scheduled messages released at a time
+	releaseBatchSize = 1024
+)
+
+// deliverAtOf returns the deliver time of a message in unix milliseconds, if it has one
+func deliverAtOf(msg *rocksmq.ProducerMessage) (int64, bool) {
+	val, ok := msg.Properties[rocksmq.DeliverAtProperty]
+	if !ok {
+		return 0, false
+	}
+	deliverAt, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return deliverAt, true
+}
+
+func delayPrefix(topic string) string {
+	return DelayTitle + topic + "/"
+}
+
+// delayKey is ordered by deliverAt, which is padded to the digits of unix milliseconds
+func delayKey(topic string, deliverAt int64, msgID UniqueID) string {
+	return fmt.Sprintf("%s%013d/%d", delayPrefix(topic), deliverAt, msgID)
+}
+
+// parseDelayKey splits a delay key into the topic and the deliver time
+func parseDelayKey(key string) (string, int64, error) {
+	parts := strings.Split(strings.TrimPrefix(key, DelayTitle), "/")
+	if len(parts) < 3 {
+		return "", 0, fmt.Errorf("invalid delay key %s", key)
+	}
+	deliverAt, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.Join(parts[:len(parts)-2], "/"), deliverAt, nil
+}
+
+// schedule records deliverAt as the earliest deliver time of the topic if it is earlier than the known one
+func (rmq *RocketMQServer) schedule(topic string, deliverAt int64) {
+	rmq.delayMu.Lock()
+	defer rmq.delayMu.Unlock()
+	if val, ok := rmq.delayed.Load(topic); ok && val.(int64) <= deliverAt {
+		return
+	}
+	rmq.delayed.Store(topic, deliverAt)
+}
+
+// isDue tells whether the topic has scheduled messages to deliver at now
+func (rmq *RocketMQServer) isDue(topic string, now int64) bool {
+	val, ok := rmq.delayed.Load(topic)
+	return ok && val.(int64) <= now
+}
+
+// restoreScheduled loads the earliest deliver time of each topic with scheduled messages
+func (rmq *RocketMQServer) restoreScheduled() error {
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	iter := rocksdb.NewRocksIteratorWithUpperBound(rmq.store, utils.AddOne(DelayTitle), readOpts)
+	defer iter.Close()
+	for iter.Seek([]byte(DelayTitle)); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		strKey := string(key.Data())
+		key.Free()
+		topic, deliverAt, err := parseDelayKey(strKey)
+		if err != nil {
+			return err
+		}
+		rmq.schedule(topic, deliverAt)
+	}
+	return iter.Err()
+}
+
+// scanScheduled reads at most n messages of the topic scheduled before the upper bound, in the order of deliver time.
+// If n is 0 it only finds the earliest deliver time
+func (rmq *RocketMQServer) scanScheduled(topic string, upper string, n int) ([]string, []rocksmq.ProducerMessage, int64, error) {
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	prefix := delayPrefix(topic)
+	iter := rocksdb.NewRocksIteratorWithUpperBound(rmq.store, upper, readOpts)
+	defer iter.Close()
+
+	var keys []string
+	var msgs []rocksmq.ProducerMessage
+	for iter.Seek([]byte(prefix)); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		strKey := string(key.Data())
+		key.Free()
+		if n == 0 {
+			_, deliverAt, err := parseDelayKey(strKey)
+			return nil, nil, deliverAt, err
+		}
+		if len(keys) >= n {
+			break
+		}
+		val := iter.Value()
+		msg := rocksmq.ProducerMessage{}
+		err := json.Unmarshal(val.Data(), &msg)
+		val.Free()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		keys = append(keys, strKey)
+		msgs = append(msgs, msg)
+	}
+	return keys, msgs, 0, iter.Err()
+}
+
+// releaseScheduled produces the scheduled messages of the topic which are due, they get new ids in the topic.
+// A message scheduled earlier than another is delivered first, messages due at the same time keep their order.
+// The index entries are removed after the messages are produced, so a crash in between delivers them again
+func (rmq *RocketMQServer) releaseScheduled(topic string) error {
+	rmq.releaseMu.Lock()
+	defer rmq.releaseMu.Unlock()
+	for {
+		now := time.Now().UnixMilli()
+		if !rmq.isDue(topic, now) {
+			return nil
+		}
+		upper := fmt.Sprintf("%s%013d", delayPrefix(topic), now+1)
+		keys, msgs, _, err := rmq.scanScheduled(topic, upper, releaseBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(msgs) > 0 {
+			if _, err = rmq.Produce(topic, msgs); err != nil {
+				return err
+			}
+			batch := gorocksdb.NewWriteBatch()
+			for _, key := range keys {
+				batch.Delete([]byte(key))
+			}
+			opts := gorocksdb.NewDefaultWriteOptions()
+			err = rmq.store.Write(opts, batch)
+			opts.Destroy()
+			batch.Destroy()
+			if err != nil {
+				return err
+			}
+			log.Debug("rocksmq released scheduled messages", zap.String("topic", topic), zap.Int("count", len(msgs)))
+		}
+
+		// the earliest deliver time is found under delayMu, so a message scheduled meanwhile is not lost
+		rmq.delayMu.Lock()
+		_, _, earliest, err := rmq.scanScheduled(topic, utils.AddOne(delayPrefix(topic)), 0)
+		if err != nil {
+			rmq.delayMu.Unlock()
+			return err
+		}
+		if earliest == 0 {
+			rmq.delayed.Delete(topic)
+		} else {
+			rmq.delayed.Store(topic, earliest)
+		}
+		rmq.delayMu.Unlock()
+		if len(msgs) < releaseBatchSize {
+			return nil
+		}
+	}
+}
+
+// removeScheduled drops the scheduled messages of the topic
+func (rmq *RocketMQServer) removeScheduled(topic string) error {
+	rmq.delayMu.Lock()
+	defer rmq.delayMu.Unlock()
+	rmq.delayed.Delete(topic)
+	prefix := delayPrefix(topic)
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	batch.DeleteRange([]byte(prefix), []byte(utils.AddOne(prefix)))
+	opts := gorocksdb.NewDefaultWriteOptions()
+	defer opts.Destroy()
+	return rmq.store.Write(opts, batch)
+}
+
+func (rmq *RocketMQServer) startDelivery() {
+	rmq.closeWg.Add(1)
+	go rmq.delivery()
+}
+
+// delivery releases the scheduled messages which are due, the consumers of their topics are woken up by Produce
+func (rmq *RocketMQServer) delivery() {
+	defer rmq.closeWg.Done()
+	ticker := time.NewTicker(delayCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rmq.closeCh:
+			return
+		case now := <-ticker.C:
+			var due []string
+			rmq.delayed.Range(func(key, _ interface{}) bool {
+				if rmq.isDue(key.(string), now.UnixMilli()) {
+					due = append(due, key.(string))
+				}
+				return true
+			})
+			for _, topic := range due {
+				if err := rmq.releaseScheduled(topic); err != nil {
+					log.Warn("rocksmq failed to release scheduled messages", zap.String("topic", topic), zap.Error(err))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/tecbot/gorocksdb"
+	"go.uber.org/zap"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// replayBatchSize is the number of dead letters replayed at a time
+	replayBatchSize = 256
+
+	// deadLetterPropertyPrefix is the prefix of the properties added to a dead letter
+	deadLetterPropertyPrefix = "dlq."
+)
+
+// checkDeadLetter validates the dead letter options of a consumer group and creates the dead letter topic
+func (rmq *RocketMQServer) checkDeadLetter(topic string, options rocksmq.ConsumerGroupOptions) error {
+	if options.DeadLetterTopic == "" {
+		return nil
+	}
+	if !options.AckMode {
+		return errors.New("dead letter topic requires ack mode")
+	}
+	if options.MaxFailures <= 0 {
+		return fmt.Errorf("invalid max failures %d, should be positive", options.MaxFailures)
+	}
+	if options.DeadLetterTopic == topic {
+		return fmt.Errorf("dead letter topic should not be the topic %s itself", topic)
+	}
+	return rmq.CreateTopic(options.DeadLetterTopic)
+}
+
+// deadLetterMessage builds the message produced to the dead letter topic, ok is false if the message is purged
+func (rmq *RocketMQServer) deadLetterMessage(ag *ackGroup, msgID UniqueID, p *pendingMsg) (rocksmq.ProducerMessage, bool, error) {
+	msgs, err := rmq.readMessages(ag.topic, msgID, 1)
+	if err != nil {
+		return rocksmq.ProducerMessage{}, false, err
+	}
+	if len(msgs) == 0 || msgs[0].MsgID != msgID {
+		return rocksmq.ProducerMessage{}, false, nil
+	}
+	properties := make(map[string]string, len(msgs[0].Properties)+5)
+	for k, v := range msgs[0].Properties {
+		properties[k] = v
+	}
+	properties[rocksmq.DeadLetterTopicKey] = ag.topic
+	properties[rocksmq.DeadLetterGroupKey] = ag.group
+	properties[rocksmq.DeadLetterMsgIDKey] = strconv.FormatInt(msgID, 10)
+	properties[rocksmq.DeadLetterFailuresKey] = strconv.Itoa(p.Failures)
+	properties[rocksmq.DeadLetterDeliveryCountKey] = strconv.Itoa(p.DeliveryCount)
+	return rocksmq.ProducerMessage{Payload: msgs[0].Payload, Properties: properties}, true, nil
+}
+
+// moveToDeadLetter produces the messages to the dead letter topic of the group and acks them
+func (rmq *RocketMQServer) moveToDeadLetter(ag *ackGroup, msgIDs []UniqueID, msgs []rocksmq.ProducerMessage) error {
+	if _, err := rmq.Produce(ag.options.DeadLetterTopic, msgs); err != nil {
+		return err
+	}
+	log.Info("move messages to dead letter topic", zap.String("topic", ag.topic), zap.String("group", ag.group),
+		zap.String("deadLetterTopic", ag.options.DeadLetterTopic), zap.Int64s("msgIDs", msgIDs))
+	return rmq.Ack(ag.topic, ag.group, msgIDs...)
+}
+
+// ReplayDeadLetter produces the messages of the dead letter topic back to the topics they come from,
+// the replayed messages are removed from the dead letter topic. It returns how many messages are replayed
+func (rmq *RocketMQServer) ReplayDeadLetter(deadLetterTopic string) (int, error) {
+	if rmq.isClosed() {
+		return 0, errors.New(RmqNotServingErrMsg)
+	}
+	if _, ok := topicMu.Load(deadLetterTopic); !ok {
+		return 0, fmt.Errorf("topic name = %s not exist", deadLetterTopic)
+	}
+
+	replayed := 0
+	startID := DefaultMessageID
+	for {
+		msgs, err := rmq.readMessages(deadLetterTopic, startID, replayBatchSize)
+		if err != nil {
+			return replayed, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		startID = msgs[len(msgs)-1].MsgID + 1
+
+		var topics []string
+		topicMsgs := make(map[string][]rocksmq.ProducerMessage)
+		topicIDs := make(map[string][]UniqueID)
+		for _, msg := range msgs {
+			topic := msg.Properties[rocksmq.DeadLetterTopicKey]
+			if topic == "" {
+				log.Warn("skip replaying message without source topic", zap.String("deadLetterTopic", deadLetterTopic),
+					zap.Int64("msgID", msg.MsgID))
+				continue
+			}
+			properties := make(map[string]string, len(msg.Properties))
+			for k, v := range msg.Properties {
+				if !strings.HasPrefix(k, deadLetterPropertyPrefix) {
+					properties[k] = v
+				}
+			}
+			if _, ok := topicMsgs[topic]; !ok {
+				topics = append(topics, topic)
+			}
+			topicMsgs[topic] = append(topicMsgs[topic], rocksmq.ProducerMessage{Payload: msg.Payload, Properties: properties})
+			topicIDs[topic] = append(topicIDs[topic], msg.MsgID)
+		}
+		for _, topic := range topics {
+			if _, err = rmq.Produce(topic, topicMsgs[topic]); err != nil {
+				return replayed, err
+			}
+			if err = rmq.deleteMessageIDs(deadLetterTopic, topicIDs[topic]); err != nil {
+				return replayed, err
+			}
+			replayed += len(topicIDs[topic])
+		}
+	}
+	log.Info("replay dead letter topic", zap.String("deadLetterTopic", deadLetterTopic), zap.Int("replayed", replayed))
+	return replayed, nil
+}
+
+// deleteMessageIDs deletes the messages with their properties and produce time records, and takes their sizes off
+// the pages holding them so that retention and the stats see the deletion
+func (rmq *RocketMQServer) deleteMessageIDs(topic string, msgIDs []UniqueID) error {
+	lock := rmq.topicLock(topic)
+	if lock == nil {
+		return fmt.Errorf("topic name = %s not exist", topic)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	pageEndIDs, err := rmq.retentionIndo.pageEndIDs(topic)
+	if err != nil {
+		return err
+	}
+	writeBatch := gorocksdb.NewWriteBatch()
+	defer writeBatch.Destroy()
+	removed := make(map[UniqueID]msgSize, len(msgIDs))
+	for _, msgID := range msgIDs {
+		size, ok, err := rmq.retentionIndo.messageSize(topic, msgID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		id := strconv.FormatInt(msgID, 10)
+		removed[msgID] = size
+		writeBatch.Delete([]byte(path.Join(topic, id)))
+		writeBatch.Delete([]byte(path.Join("properties", topic, id)))
+		writeBatch.Delete([]byte(path.Join(MsgTsTitle, topic, id)))
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	opts := gorocksdb.NewDefaultWriteOptions()
+	defer opts.Destroy()
+	if err = rmq.store.Write(opts, writeBatch); err != nil {
+		return err
+	}
+	return rmq.retentionIndo.shrinkPages(topic, pageEndIDs, removed)
+}
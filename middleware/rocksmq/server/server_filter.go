@@ -0,0 +1,70 @@
+package server
+
+import (
+	"github.com/linkbase/middleware/rocksmq"
+)
+
+const (
+	// filterReadBatch is the number of messages read at a time by a consumer group with a filter
+	filterReadBatch = 256
+	// filterMaxBatches bounds the batches a consume with a filter scans while it holds the topic mutex
+	filterMaxBatches = 4
+)
+
+// compileFilter compiles the filter expression of a consumer group, nil if the group has none
+func compileFilter(expr string) (*rocksmq.Filter, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return rocksmq.ParseFilter(expr)
+}
+
+func (rmq *RocketMQServer) getFilter(topic, group string) *rocksmq.Filter {
+	filter, ok := rmq.filters.Load(constructCurrentID(topic, group))
+	if !ok {
+		return nil
+	}
+	return filter.(*rocksmq.Filter)
+}
+
+// readFiltered reads at most n messages of the topic matching the filter starting from startID. It returns the
+// position to move the group to, which is past the skipped messages as well, startID if nothing is read.
+// The scan stops after filterMaxBatches batches, more tells the topic may have matching messages left even if
+// none are returned, so the caller should wake up the group to read on
+func (rmq *RocketMQServer) readFiltered(topic string, startID UniqueID, n int, filter *rocksmq.Filter) ([]rocksmq.ConsumerMessage, UniqueID, bool, error) {
+	if filter == nil {
+		msgs, err := rmq.readMessages(topic, startID, n)
+		if err != nil || len(msgs) == 0 {
+			return msgs, startID, false, err
+		}
+		return msgs, msgs[len(msgs)-1].MsgID + 1, false, nil
+	}
+	batch := n
+	if batch < filterReadBatch {
+		batch = filterReadBatch
+	}
+	nextID := startID
+	matched := make([]rocksmq.ConsumerMessage, 0, n)
+	for i := 0; len(matched) < n; i++ {
+		if i == filterMaxBatches {
+			return matched, nextID, true, nil
+		}
+		msgs, err := rmq.readMessages(topic, nextID, batch)
+		if err != nil {
+			return nil, startID, false, err
+		}
+		for _, msg := range msgs {
+			nextID = msg.MsgID + 1
+			if filter.Match(msg.Properties) {
+				matched = append(matched, msg)
+				if len(matched) == n {
+					break
+				}
+			}
+		}
+		if len(msgs) < batch {
+			break
+		}
+	}
+	return matched, nextID, false, nil
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PartitionsTitle partitions/topicName, the number of partitions of a partitioned topic, cleaned up on destroy topic
+const PartitionsTitle = "partitions/"
+
+// partitionMember is a consumer of a partitioned group, msgMutex is registered on every partition assigned to it
+type partitionMember struct {
+	name     string
+	msgMutex chan struct{}
+}
+
+// partitionedGroup is a consumer group of a partitioned topic, partition i is assigned to members[i % len(members)]
+type partitionedGroup struct {
+	topic      string
+	group      string
+	subType    rocksmq.SubscriptionType
+	partitions int
+	members    []*partitionMember
+}
+
+func (pg *partitionedGroup) assigned(member string) []int {
+	for i, m := range pg.members {
+		if m.name != member {
+			continue
+		}
+		partitions := make([]int, 0)
+		for p := i; p < pg.partitions; p += len(pg.members) {
+			partitions = append(partitions, p)
+		}
+		return partitions
+	}
+	return nil
+}
+
+// restorePartitions loads the partitioned topics
+func (rmq *RocketMQServer) restorePartitions() error {
+	keys, vals, err := rmq.kv.LoadWithPrefix(PartitionsTitle)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		n, err := strconv.Atoi(vals[i])
+		if err != nil {
+			return fmt.Errorf("invalid partitions of %s: %w", key, err)
+		}
+		rmq.partitions.Store(key[len(PartitionsTitle):], n)
+	}
+	return nil
+}
+
+func (rmq *RocketMQServer) getPartitions(topic string) int {
+	n, ok := rmq.partitions.Load(topic)
+	if !ok {
+		return 0
+	}
+	return n.(int)
+}
+
+// createPartitionedTopic creates every partition of the topic, the partitioned topic itself only exists as meta
+func (rmq *RocketMQServer) createPartitionedTopic(topic string, options *rocksmq.TopicOptions) error {
+	if n := rmq.getPartitions(topic); n > 0 {
+		log.Warn("rocksmq partitioned topic already exists", zap.String("topic", topic), zap.Int("partitions", n))
+		return nil
+	}
+	if _, ok := topicMu.Load(topic); ok {
+		return fmt.Errorf("topic %s already exists and is not partitioned", topic)
+	}
+	var opts []rocksmq.TopicOption
+	if options.Retention != nil {
+		opts = append(opts, rocksmq.WithRetention(*options.Retention))
+	}
+	if options.Compacted {
+		opts = append(opts, rocksmq.WithCompaction())
+	}
+	for p := 0; p < options.Partitions; p++ {
+		if err := rmq.CreateTopic(rocksmq.PartitionTopic(topic, p), opts...); err != nil {
+			return err
+		}
+	}
+	if err := rmq.kv.Save(PartitionsTitle+topic, strconv.Itoa(options.Partitions)); err != nil {
+		return err
+	}
+	rmq.partitions.Store(topic, options.Partitions)
+	log.Debug("Rocksmq create partitioned topic successfully", zap.String("topic", topic), zap.Int("partitions", options.Partitions))
+	return nil
+}
+
+// destroyPartitionedTopic destroys every partition of the topic and its consumer groups
+func (rmq *RocketMQServer) destroyPartitionedTopic(topic string, n int) error {
+	rmq.partitionMu.Lock()
+	for key, pg := range rmq.partitionGroups {
+		if pg.topic == topic {
+			rmq.releaseMembers(pg)
+			delete(rmq.partitionGroups, key)
+		}
+	}
+	rmq.partitionMu.Unlock()
+
+	for p := 0; p < n; p++ {
+		if err := rmq.DestroyTopic(rocksmq.PartitionTopic(topic, p)); err != nil {
+			return err
+		}
+	}
+	if err := rmq.kv.Remove(PartitionsTitle + topic); err != nil {
+		return err
+	}
+	rmq.partitions.Delete(topic)
+	return nil
+}
+
+// GetTopicPartitions returns the number of partitions of the topic, 0 means the topic is not partitioned
+func (rmq *RocketMQServer) GetTopicPartitions(topic string) (int, error) {
+	if rmq.isClosed() {
+		return 0, errors.New(RmqNotServingErrMsg)
+	}
+	if n := rmq.getPartitions(topic); n > 0 {
+		return n, nil
+	}
+	if _, ok := topicMu.Load(topic); !ok {
+		return 0, fmt.Errorf("topic name = %s not exist", topic)
+	}
+	return 0, nil
+}
+
+// JoinPartitionedGroup adds the member to the consumer group of the partitioned topic and rebalances the partitions,
+// msgMutex is signaled when the assigned partitions have new messages or the assignment changes.
+// An exclusive group takes a single member, failover and shared groups assign the partitions across the members.
+// The consumer group is created on the partitions without it, which are returned
+func (rmq *RocketMQServer) JoinPartitionedGroup(topic, group, member string, subType rocksmq.SubscriptionType,
+	msgMutex chan struct{}, opts ...rocksmq.ConsumerGroupOption) ([]int, error) {
+	if rmq.isClosed() {
+		return nil, errors.New(RmqNotServingErrMsg)
+	}
+	n := rmq.getPartitions(topic)
+	if n == 0 {
+		return nil, fmt.Errorf("topic %s is not partitioned", topic)
+	}
+	rmq.partitionMu.Lock()
+	defer rmq.partitionMu.Unlock()
+
+	key := constructCurrentID(topic, group)
+	pg, ok := rmq.partitionGroups[key]
+	if !ok {
+		pg = &partitionedGroup{topic: topic, group: group, subType: subType, partitions: n}
+	}
+	if err := checkSubscription(topic, group, pg.subType, len(pg.members), subType); err != nil {
+		return nil, err
+	}
+	if pg.assigned(member) != nil {
+		return nil, fmt.Errorf("member %s already joined consumer group %s of topic %s", member, group, topic)
+	}
+
+	var created []int
+	for p := 0; p < n; p++ {
+		partitionTopic := rocksmq.PartitionTopic(topic, p)
+		if _, ok := rmq.consumersID.Load(constructCurrentID(partitionTopic, group)); ok {
+			continue
+		}
+		if err := rmq.CreateConsumerGroup(partitionTopic, group, opts...); err != nil {
+			return nil, err
+		}
+		created = append(created, p)
+	}
+	pg.members = append(pg.members, &partitionMember{name: member, msgMutex: msgMutex})
+	rmq.partitionGroups[key] = pg
+	rmq.rebalance(pg)
+	log.Info("member joined partitioned consumer group", zap.String("topic", topic), zap.String("group", group),
+		zap.String("member", member), zap.Ints("partitions", pg.assigned(member)))
+	return created, nil
+}
+
+// LeavePartitionedGroup removes the member from the consumer group of the partitioned topic and closes its msgMutex,
+// the consumer group is kept on every partition after the last member leaves until it is destroyed there
+func (rmq *RocketMQServer) LeavePartitionedGroup(topic, group, member string) error {
+	rmq.partitionMu.Lock()
+	key := constructCurrentID(topic, group)
+	pg, ok := rmq.partitionGroups[key]
+	if !ok || pg.assigned(member) == nil {
+		rmq.partitionMu.Unlock()
+		return fmt.Errorf("member %s not in consumer group %s of topic %s", member, group, topic)
+	}
+	for i, m := range pg.members {
+		if m.name == member {
+			pg.members = append(pg.members[:i], pg.members[i+1:]...)
+			close(m.msgMutex)
+			break
+		}
+	}
+	if len(pg.members) > 0 {
+		rmq.rebalance(pg)
+		rmq.partitionMu.Unlock()
+		return nil
+	}
+	rmq.releaseMembers(pg)
+	delete(rmq.partitionGroups, key)
+	rmq.partitionMu.Unlock()
+	log.Info("last member left partitioned consumer group", zap.String("topic", topic), zap.String("group", group),
+		zap.String("member", member))
+	return nil
+}
+
+// GetAssignedPartitions returns the partitions assigned to the member
+func (rmq *RocketMQServer) GetAssignedPartitions(topic, group, member string) ([]int, error) {
+	rmq.partitionMu.Lock()
+	defer rmq.partitionMu.Unlock()
+	pg, ok := rmq.partitionGroups[constructCurrentID(topic, group)]
+	if !ok {
+		return nil, fmt.Errorf("consumer group %s of topic %s not exist", group, topic)
+	}
+	partitions := pg.assigned(member)
+	if partitions == nil {
+		return nil, fmt.Errorf("member %s not in consumer group %s of topic %s", member, group, topic)
+	}
+	return partitions, nil
+}
+
+// rebalance registers the msgMutex of the owner on each partition and wakes up every member
+func (rmq *RocketMQServer) rebalance(pg *partitionedGroup) {
+	for p := 0; p < pg.partitions; p++ {
+		owner := pg.members[p%len(pg.members)]
+		rmq.replaceConsumer(&rocksmq.Consumer{
+			Topic:     rocksmq.PartitionTopic(pg.topic, p),
+			GroupName: pg.group,
+			MsgMutex:  owner.msgMutex,
+		})
+	}
+	for _, m := range pg.members {
+		select {
+		case m.msgMutex <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// releaseMembers unregisters the partitions of the group and closes the msgMutex of the remaining members
+func (rmq *RocketMQServer) releaseMembers(pg *partitionedGroup) {
+	for p := 0; p < pg.partitions; p++ {
+		rmq.unregisterConsumer(rocksmq.PartitionTopic(pg.topic, p), pg.group)
+	}
+	for _, m := range pg.members {
+		close(m.msgMutex)
+	}
+	pg.members = nil
+}
+
+// replaceConsumer registers the consumer in place of the one registered on the same group
+func (rmq *RocketMQServer) replaceConsumer(consumer *rocksmq.Consumer) {
+	lock := rmq.topicLock(consumer.Topic)
+	if lock != nil {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	rmq.setConsumers(consumer.Topic, consumer.GroupName, consumer)
+}
+
+// unregisterConsumer removes the consumer registered on the group without closing its msgMutex
+func (rmq *RocketMQServer) unregisterConsumer(topic, group string) {
+	lock := rmq.topicLock(topic)
+	if lock != nil {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	rmq.setConsumers(topic, group)
+}
+
+// setConsumers replaces the consumers registered on the group, the caller should hold the topic mutex
+func (rmq *RocketMQServer) setConsumers(topic, group string, registered ...*rocksmq.Consumer) {
+	var consumers []*rocksmq.Consumer
+	if vals, ok := rmq.consumers.Load(topic); ok {
+		for _, v := range vals.([]*rocksmq.Consumer) {
+			if v.GroupName != group {
+				consumers = append(consumers, v)
+			}
+		}
+	}
+	rmq.consumers.Store(topic, append(consumers, registered...))
+}
+
+// isPartitionManaged tells whether the consumer group on the topic belongs to a partitioned group with members
+func (rmq *RocketMQServer) isPartitionManaged(topic, group string) bool {
+	idx := strings.LastIndex(topic, "-partition-")
+	if idx < 0 {
+		return false
+	}
+	rmq.partitionMu.Lock()
+	defer rmq.partitionMu.Unlock()
+	pg, ok := rmq.partitionGroups[constructCurrentID(topic[:idx], group)]
+	return ok && len(pg.members) > 0
+}
+
+// closePartitionedGroups releases every partitioned group without destroying the consumer groups
+func (rmq *RocketMQServer) closePartitionedGroups() {
+	rmq.partitionMu.Lock()
+	defer rmq.partitionMu.Unlock()
+	for key, pg := range rmq.partitionGroups {
+		rmq.releaseMembers(pg)
+		delete(rmq.partitionGroups, key)
+	}
+}
+
+func (rmq *RocketMQServer) topicLock(topic string) *sync.Mutex {
+	ll, ok := topicMu.Load(topic)
+	if !ok {
+		return nil
+	}
+	return ll.(*sync.Mutex)
+}
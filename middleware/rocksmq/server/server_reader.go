@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+)
+
+// ReaderNamePrefix is the prefix of the names of readers
+const ReaderNamePrefix = "reader-"
+
+// readerSeq makes the names of readers unique
+var readerSeq atomic.Int64
+
+// rocksmqReader is a non-durable cursor on a topic, it is neither persisted nor taken into account by retention
+type rocksmqReader struct {
+	topic string
+	name  string
+
+	mu sync.Mutex
+	// currentID is the position of the reader, the next message is the first one at or after it
+	currentID UniqueID
+	// readerMutex is signaled when messages are produced to the topic and closed when the reader is closed
+	readerMutex chan struct{}
+	closed      bool
+}
+
+func (r *rocksmqReader) position() (UniqueID, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.currentID, r.closed
+}
+
+func (r *rocksmqReader) notify() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.readerMutex <- struct{}{}:
+	default:
+	}
+}
+
+func (r *rocksmqReader) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.readerMutex)
+	}
+}
+
+func (rmq *RocketMQServer) getReader(topic, readerName string) (*rocksmqReader, error) {
+	if val, ok := rmq.readers.Load(topic); ok {
+		if r, ok := val.(*sync.Map).Load(readerName); ok {
+			return r.(*rocksmqReader), nil
+		}
+	}
+	return nil, fmt.Errorf("reader %s of topic %s not exist", readerName, topic)
+}
+
+// notifyReaders wakes up the readers of the topic
+func (rmq *RocketMQServer) notifyReaders(topic string) {
+	if val, ok := rmq.readers.Load(topic); ok {
+		val.(*sync.Map).Range(func(_, r interface{}) bool {
+			r.(*rocksmqReader).notify()
+			return true
+		})
+	}
+}
+
+// closeReaders closes the readers of the topic, or of every topic if topic is empty
+func (rmq *RocketMQServer) closeReaders(topic string) {
+	rmq.readers.Range(func(key, val interface{}) bool {
+		if topic != "" && key.(string) != topic {
+			return true
+		}
+		val.(*sync.Map).Range(func(_, r interface{}) bool {
+			r.(*rocksmqReader).close()
+			return true
+		})
+		rmq.readers.Delete(key)
+		return true
+	})
+}
+
+// CreateReader creates a reader of the topic starting from startMsgID, which may be rocksmq.EarliestMessageID
+// or rocksmq.LatestMessageID. The start message itself is read only if messageIDInclusive is true.
+// A reader creates no consumer group, so it neither pins messages nor moves any position
+func (rmq *RocketMQServer) CreateReader(topic string, startMsgID UniqueID, messageIDInclusive bool) (string, error) {
+	if rmq.isClosed() {
+		return "", errors.New(RmqNotServingErrMsg)
+	}
+	if _, ok := topicMu.Load(topic); !ok {
+		return "", fmt.Errorf("topic name = %s not exist", topic)
+	}
+	currentID, err := rmq.readerStartID(topic, startMsgID, messageIDInclusive)
+	if err != nil {
+		return "", err
+	}
+	reader := &rocksmqReader{
+		topic:       topic,
+		name:        fmt.Sprintf("%s%d", ReaderNamePrefix, readerSeq.Add(1)),
+		currentID:   currentID,
+		readerMutex: make(chan struct{}, 1),
+	}
+	val, _ := rmq.readers.LoadOrStore(topic, &sync.Map{})
+	val.(*sync.Map).Store(reader.name, reader)
+	log.Debug("Rocksmq create reader successfully", zap.String("topic", topic), zap.String("reader", reader.name),
+		zap.Int64("startID", currentID))
+	return reader.name, nil
+}
+
+// readerStartID resolves the position of a reader starting from startMsgID
+func (rmq *RocketMQServer) readerStartID(topic string, startMsgID UniqueID, messageIDInclusive bool) (UniqueID, error) {
+	switch startMsgID {
+	case rocksmq.EarliestMessageID:
+		return DefaultMessageID, nil
+	case rocksmq.LatestMessageID:
+		latest, err := rmq.getLatestMsg(topic)
+		if err != nil {
+			return DefaultMessageID, err
+		}
+		if latest == DefaultMessageID {
+			return DefaultMessageID, nil
+		}
+		startMsgID = latest
+	}
+	if messageIDInclusive {
+		return startMsgID, nil
+	}
+	return startMsgID + 1, nil
+}
+
+// ReaderSeek moves the reader to msgID, the message itself is read next
+func (rmq *RocketMQServer) ReaderSeek(topic, readerName string, msgID UniqueID) error {
+	reader, err := rmq.getReader(topic, readerName)
+	if err != nil {
+		return err
+	}
+	currentID, err := rmq.readerStartID(topic, msgID, true)
+	if err != nil {
+		return err
+	}
+	reader.mu.Lock()
+	reader.currentID = currentID
+	reader.mu.Unlock()
+	reader.notify()
+	return nil
+}
+
+// Next returns the next message of the reader, it blocks until a message is produced,
+// the reader is closed or ctx is done
+func (rmq *RocketMQServer) Next(ctx context.Context, topic, readerName string) (*rocksmq.ConsumerMessage, error) {
+	reader, err := rmq.getReader(topic, readerName)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if rmq.isClosed() {
+			return nil, errors.New(RmqNotServingErrMsg)
+		}
+		currentID, closed := reader.position()
+		if closed {
+			return nil, fmt.Errorf("reader %s of topic %s is closed", readerName, topic)
+		}
+		msgs, err := rmq.readMessages(topic, currentID, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 {
+			reader.mu.Lock()
+			// a concurrent seek wins over the message read before it
+			moved := reader.currentID != currentID
+			if !moved {
+				reader.currentID = msgs[0].MsgID + 1
+			}
+			reader.mu.Unlock()
+			if !moved {
+				return &msgs[0], nil
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-reader.readerMutex:
+		}
+	}
+}
+
+// HasNext tells whether the reader has a message to read without blocking
+func (rmq *RocketMQServer) HasNext(topic, readerName string) bool {
+	reader, err := rmq.getReader(topic, readerName)
+	if err != nil {
+		return false
+	}
+	currentID, closed := reader.position()
+	if closed {
+		return false
+	}
+	msgs, err := rmq.readMessages(topic, currentID, 1)
+	if err != nil {
+		log.Warn("rocksmq reader failed to check next message", zap.String("topic", topic),
+			zap.String("reader", readerName), zap.Error(err))
+		return false
+	}
+	return len(msgs) > 0
+}
+
+// NextBatch returns up to n messages of the reader and moves it past them, it returns none without blocking
+// when the reader is at the end of the topic
+func (rmq *RocketMQServer) NextBatch(topic, readerName string, n int) ([]rocksmq.ConsumerMessage, error) {
+	if rmq.isClosed() {
+		return nil, errors.New(RmqNotServingErrMsg)
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid batch size %d", n)
+	}
+	reader, err := rmq.getReader(topic, readerName)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		currentID, closed := reader.position()
+		if closed {
+			return nil, fmt.Errorf("reader %s of topic %s is closed", readerName, topic)
+		}
+		msgs, err := rmq.readMessages(topic, currentID, n)
+		if err != nil || len(msgs) == 0 {
+			return msgs, err
+		}
+		reader.mu.Lock()
+		// a concurrent seek wins over the messages read before it
+		moved := reader.currentID != currentID
+		if !moved {
+			reader.currentID = msgs[len(msgs)-1].MsgID + 1
+		}
+		reader.mu.Unlock()
+		if !moved {
+			return msgs, nil
+		}
+	}
+}
+
+// CloseReader closes the reader, a blocked Next returns an error
+func (rmq *RocketMQServer) CloseReader(topic, readerName string) {
+	val, ok := rmq.readers.Load(topic)
+	if !ok {
+		return
+	}
+	if r, ok := val.(*sync.Map).LoadAndDelete(readerName); ok {
+		r.(*rocksmqReader).close()
+	}
+}
@@ -1,13 +1,17 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/linkbase/middleware/kv/rocksdb"
 	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
 	"github.com/linkbase/utils"
+	"github.com/linkbase/utils/paramtable"
 	"github.com/tecbot/gorocksdb"
 	"go.uber.org/zap"
 	"path"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -20,7 +24,11 @@ const (
 type retentionInfo struct {
 	// key is topic name, value is last retention time
 	topicRetentionTime *utils.ConcurrentMap[string, int64]
-	mutex              sync.RWMutex
+	// key is topic name, value is the retention policy set explicitly for the topic
+	topicPolicy *utils.ConcurrentMap[string, rocksmq.RetentionPolicy]
+	// key is topic name, it exists if the topic is compacted
+	compactedTopics *utils.ConcurrentMap[string, bool]
+	mutex           sync.RWMutex
 
 	kv        *rocksdb.RocksdbKV
 	db        *gorocksdb.DB
@@ -32,6 +40,8 @@ type retentionInfo struct {
 func initRetentionInfo(kv *rocksdb.RocksdbKV, db *gorocksdb.DB) (*retentionInfo, error) {
 	ri := &retentionInfo{
 		topicRetentionTime: utils.NewConcurrentMap[string, int64](),
+		topicPolicy:        utils.NewConcurrentMap[string, rocksmq.RetentionPolicy](),
+		compactedTopics:    utils.NewConcurrentMap[string, bool](),
 		mutex:              sync.RWMutex{},
 		kv:                 kv,
 		db:                 db,
@@ -48,19 +58,71 @@ func initRetentionInfo(kv *rocksdb.RocksdbKV, db *gorocksdb.DB) (*retentionInfo,
 		ri.topicRetentionTime.Insert(topic, time.Now().Unix())
 		topicMu.Store(topic, new(sync.Mutex))
 	}
+	policyKeys, policyVals, err := ri.kv.LoadWithPrefix(RetentionTitle)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range policyKeys {
+		policy := rocksmq.RetentionPolicy{}
+		if err = json.Unmarshal([]byte(policyVals[i]), &policy); err != nil {
+			return nil, fmt.Errorf("invalid retention policy %s: %w", key, err)
+		}
+		ri.topicPolicy.Insert(key[len(RetentionTitle):], policy)
+	}
+	compactedKeys, _, err := ri.kv.LoadWithPrefix(CompactedTitle)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range compactedKeys {
+		ri.compactedTopics.Insert(key[len(CompactedTitle):], true)
+	}
 	return ri, nil
 }
 
+// defaultRetentionPolicy is the policy of topics without an explicit one, it follows the rocksmq config
+func defaultRetentionPolicy() rocksmq.RetentionPolicy {
+	params := paramtable.Get()
+	return rocksmq.RetentionPolicy{
+		TimeInMinutes: params.RocksmqCfg.RetentionTimeInMinutes.GetAsInt64(),
+		SizeInMB:      params.RocksmqCfg.RetentionSizeInMB.GetAsInt64(),
+		RetainUnacked: true,
+	}
+}
+
+func validateRetentionPolicy(policy rocksmq.RetentionPolicy) error {
+	if policy.TimeInMinutes < -1 {
+		return fmt.Errorf("invalid retention time %d, should be -1 or positive", policy.TimeInMinutes)
+	}
+	if policy.SizeInMB < -1 {
+		return fmt.Errorf("invalid retention size %d, should be -1 or positive", policy.SizeInMB)
+	}
+	return nil
+}
+
+func (ri *retentionInfo) getPolicy(topic string) rocksmq.RetentionPolicy {
+	if policy, ok := ri.topicPolicy.Get(topic); ok {
+		return policy
+	}
+	return defaultRetentionPolicy()
+}
+
 func (ri *retentionInfo) startRetentionInfo() {
 	ri.closeWg.Add(1)
 	go ri.retention()
 }
 
 func (ri *retentionInfo) retention() error {
-	ticker := time.NewTicker(10 * time.Minute)
+	params := paramtable.Get()
+	tickerInterval := params.RocksmqCfg.TickerTimeInSeconds.GetAsDuration(time.Second)
+	ticker := time.NewTicker(tickerInterval)
 	defer ticker.Stop()
-	compactionTicker := time.NewTicker(10 * time.Minute)
-	defer compactionTicker.Stop()
+	// a non positive compaction interval disables the manual compaction
+	var compactionC <-chan time.Time
+	if compactionInterval := params.RocksmqCfg.CompactionInterval.GetAsDuration(time.Second); compactionInterval > 0 {
+		compactionTicker := time.NewTicker(compactionInterval)
+		defer compactionTicker.Stop()
+		compactionC = compactionTicker.C
+	}
 	defer ri.closeWg.Done()
 
 	for {
@@ -68,19 +130,16 @@ func (ri *retentionInfo) retention() error {
 		case <-ri.closeCh:
 			log.Warn("rocksmq retention finish")
 			return nil
-		case <-compactionTicker.C:
+		case <-compactionC:
 			go ri.db.CompactRange(gorocksdb.Range{Start: nil, Limit: nil})
 			go ri.kv.DB.CompactRange(gorocksdb.Range{Start: nil, Limit: nil})
 		case t := <-ticker.C:
 			timeNow := t.Unix()
-			checkTime := int64(time.Minute * 60 / 10)
+			checkTime := int64(tickerInterval / time.Second)
 			ri.mutex.RLock()
 			ri.topicRetentionTime.Range(func(topic string, lastRetentionTS int64) bool {
-				if lastRetentionTS+checkTime < timeNow {
-					err := ri.expiredCleanUp(topic)
-					if err != nil {
-						log.Warn("Retention expired clean failed", zap.Error(err))
-					}
+				if lastRetentionTS+checkTime <= timeNow {
+					ri.retainTopic(topic)
 					ri.topicRetentionTime.Insert(topic, timeNow)
 				}
 				return true
@@ -90,6 +149,18 @@ func (ri *retentionInfo) retention() error {
 	}
 }
 
+// retainTopic compacts a compacted topic, then cleans up the expired pages of the topic as any other one
+func (ri *retentionInfo) retainTopic(topic string) {
+	if ri.compactedTopics.Contain(topic) {
+		if err := ri.compact(topic); err != nil {
+			log.Warn("Retention compaction failed", zap.String("topic", topic), zap.Error(err))
+		}
+	}
+	if err := ri.expiredCleanUp(topic); err != nil {
+		log.Warn("Retention expired clean failed", zap.Error(err))
+	}
+}
+
 func (ri *retentionInfo) expiredCleanUp(topic string) error {
 	start := time.Now()
 	var deletedAckedSize int64
@@ -98,8 +169,8 @@ func (ri *retentionInfo) expiredCleanUp(topic string) error {
 	var pageEndID UniqueID
 	var err error
 
-	fixedAckedTsKey := constructKey(AckedTsTitle, topic)
-	totalAckedSize, err := ri.calculateTopicAckedSize(topic)
+	policy := ri.getPolicy(topic)
+	totalAckedSize, err := ri.calculateTopicAckedSize(topic, policy)
 	if err != nil {
 		return err
 	}
@@ -126,19 +197,14 @@ func (ri *retentionInfo) expiredCleanUp(topic string) error {
 		if err != nil {
 			return err
 		}
-		ackedTsKey := fixedAckedTsKey + "/" + strconv.FormatInt(pageID, 10)
-		ackedTsVal, err := ri.kv.Load(ackedTsKey)
+		ackedTs, ok, err := ri.getPageAgingTs(topic, pageID, policy)
 		if err != nil {
 			return err
 		}
-		if ackedTsVal == "" {
+		if !ok {
 			break
 		}
-		ackedTs, err := strconv.ParseInt(ackedTsVal, 10, 64)
-		if err != nil {
-			return err
-		}
-		if msgTimeExpiredCheck(ackedTs) {
+		if msgTimeExpiredCheck(ackedTs, policy.TimeInMinutes) {
 			pageEndID = pageID
 			pValue := pageIter.Value()
 			size, err := strconv.ParseInt(string(pValue.Data()), 10, 64)
@@ -178,7 +244,7 @@ func (ri *retentionInfo) expiredCleanUp(topic string) error {
 			return err
 		}
 		curDeleteSize := deletedAckedSize + size
-		if msgSizeExpiredCheck(curDeleteSize, totalAckedSize) {
+		if msgSizeExpiredCheck(curDeleteSize, totalAckedSize, policy.SizeInMB) {
 			pageEndID, err = parsePageID(pKeyStr)
 			if err != nil {
 				return err
@@ -204,8 +270,33 @@ func (ri *retentionInfo) expiredCleanUp(topic string) error {
 	return ri.cleanData(topic, pageEndID)
 }
 
-func (ri *retentionInfo) calculateTopicAckedSize(topic string) (int64, error) {
-	fixedAckedTsKey := constructKey(AckedTsTitle, topic)
+// getPageAgingTs returns the ts a page ages from, which is its acked ts, or its full ts if unacked
+// messages are not retained. ok is false if the page can not be purged yet
+func (ri *retentionInfo) getPageAgingTs(topic string, pageID UniqueID, policy rocksmq.RetentionPolicy) (int64, bool, error) {
+	ackedTsKey := constructKey(AckedTsTitle, topic) + "/" + strconv.FormatInt(pageID, 10)
+	tsVal, err := ri.kv.Load(ackedTsKey)
+	if err != nil {
+		return 0, false, err
+	}
+	if tsVal == "" && !policy.RetainUnacked {
+		pageTsKey := constructKey(PageTsTitle, topic) + "/" + strconv.FormatInt(pageID, 10)
+		tsVal, err = ri.kv.Load(pageTsKey)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	if tsVal == "" {
+		return 0, false, nil
+	}
+	ts, err := strconv.ParseInt(tsVal, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return ts, true, nil
+}
+
+// calculateTopicAckedSize sums up the size of the leading pages which may be purged under policy
+func (ri *retentionInfo) calculateTopicAckedSize(topic string, policy rocksmq.RetentionPolicy) (int64, error) {
 	pageReadOpts := gorocksdb.NewDefaultReadOptions()
 	defer pageReadOpts.Destroy()
 
@@ -224,12 +315,11 @@ func (ri *retentionInfo) calculateTopicAckedSize(topic string) (int64, error) {
 			return -1, err
 		}
 
-		ackedTsKey := fixedAckedTsKey + "/" + strconv.FormatInt(pageID, 10)
-		ackedTsVal, err := ri.kv.Load(ackedTsKey)
+		_, ok, err := ri.getPageAgingTs(topic, pageID, policy)
 		if err != nil {
 			return -1, err
 		}
-		if ackedTsVal == "" {
+		if !ok {
 			break
 		}
 		// Get page size
@@ -259,6 +349,10 @@ func (ri *retentionInfo) cleanData(topic string, pageEndID UniqueID) error {
 	pageEndIDKey := pageMsgPrefix + "/" + strconv.FormatInt(pageEndID+1, 10)
 	writeBatch.DeleteRange([]byte(pageStartIDKey), []byte(pageEndIDKey))
 
+	pageStatsPrefix := constructKey(PageMsgStatsTitle, topic)
+	pageStatsEndIDKey := pageStatsPrefix + "/" + strconv.FormatInt(pageEndID+1, 10)
+	writeBatch.DeleteRange([]byte(pageStatsPrefix+"/"), []byte(pageStatsEndIDKey))
+
 	pageTsPrefix := constructKey(PageTsTitle, topic)
 	pageTsStartIDKey := pageTsPrefix + "/"
 	pageTsEndIDKey := pageTsPrefix + "/" + strconv.FormatInt(pageEndID+1, 10)
@@ -293,6 +387,90 @@ func (ri *retentionInfo) cleanData(topic string, pageEndID UniqueID) error {
 	return nil
 }
 
+// shrinkPages takes the removed messages, keyed by message id, off the sizes and the stats of the pages holding them.
+// The messages after the last full page are in the open page. The caller should hold the topic mutex
+func (ri *retentionInfo) shrinkPages(topic string, pageEndIDs []UniqueID, removed map[UniqueID]msgSize) error {
+	type pageKeys struct {
+		size  string
+		stats string
+	}
+	pageSizes := make(map[pageKeys]int64)
+	pageRemoved := make(map[pageKeys]pageStats)
+	for id, size := range removed {
+		keys := pageKeys{size: MessageSizeTitle + topic, stats: MessageStatsTitle + topic}
+		if i := sort.Search(len(pageEndIDs), func(i int) bool { return pageEndIDs[i] >= id }); i < len(pageEndIDs) {
+			pageID := strconv.FormatInt(pageEndIDs[i], 10)
+			keys = pageKeys{
+				size:  constructKey(PageMsgSizeTitle, topic) + "/" + pageID,
+				stats: constructKey(PageMsgStatsTitle, topic) + "/" + pageID,
+			}
+		}
+		pageSizes[keys] += size.stored
+		stats := pageRemoved[keys]
+		stats.Count++
+		stats.RawBytes += size.raw
+		pageRemoved[keys] = stats
+	}
+	kvs := make(map[string]string, 2*len(pageSizes))
+	for keys, removedSize := range pageSizes {
+		val, err := ri.kv.Load(keys.size)
+		if err != nil {
+			return err
+		}
+		size, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		if size -= removedSize; size < 0 {
+			size = 0
+		}
+		kvs[keys.size] = strconv.FormatInt(size, 10)
+
+		if val, err = ri.kv.Load(keys.stats); err != nil {
+			return err
+		}
+		stats, err := parsePageStats(val)
+		if err != nil {
+			return err
+		}
+		if stats.Count -= pageRemoved[keys].Count; stats.Count < 0 {
+			stats.Count = 0
+		}
+		if stats.RawBytes -= pageRemoved[keys].RawBytes; stats.RawBytes < 0 {
+			stats.RawBytes = 0
+		}
+		kvs[keys.stats] = stats.String()
+	}
+	return ri.kv.MultiSave(kvs)
+}
+
+// messageSize returns the stored and the raw payload size of a message, ok is false if it is gone
+func (ri *retentionInfo) messageSize(topic string, id UniqueID) (msgSize, bool, error) {
+	readOpts := gorocksdb.NewDefaultReadOptions()
+	defer readOpts.Destroy()
+	strID := strconv.FormatInt(id, 10)
+	val, err := ri.db.Get(readOpts, []byte(path.Join(topic, strID)))
+	if err != nil {
+		return msgSize{}, false, err
+	}
+	size, exists := int64(val.Size()), val.Exists()
+	val.Free()
+	if !exists {
+		return msgSize{}, false, nil
+	}
+	propertiesValue, err := ri.db.GetBytes(readOpts, []byte(path.Join("properties", topic, strID)))
+	if err != nil {
+		return msgSize{}, false, err
+	}
+	properties := make(map[string]string)
+	if len(propertiesValue) != 0 {
+		if err = json.Unmarshal(propertiesValue, &properties); err != nil {
+			return msgSize{}, false, err
+		}
+	}
+	return msgSize{stored: size, raw: rawSizeOf(size, properties)}, true, nil
+}
+
 func (ri *retentionInfo) Stop() {
 	ri.closeOnce.Do(func() {
 		close(ri.closeCh)
@@ -308,6 +486,10 @@ func DeleteMessages(db *gorocksdb.DB, topic string, startID, endID UniqueID) err
 	writeBatch := gorocksdb.NewWriteBatch()
 	defer writeBatch.Destroy()
 	writeBatch.DeleteRange([]byte(startKey), []byte(endKey))
+	// drop the produce time records of the deleted messages as well
+	tsStartKey := path.Join(MsgTsTitle, topic, strconv.FormatInt(startID, 10))
+	tsEndKey := path.Join(MsgTsTitle, topic, strconv.FormatInt(endID+1, 10))
+	writeBatch.DeleteRange([]byte(tsStartKey), []byte(tsEndKey))
 	opts := gorocksdb.NewDefaultWriteOptions()
 	defer opts.Destroy()
 	err := db.Write(opts, writeBatch)
@@ -318,20 +500,16 @@ func DeleteMessages(db *gorocksdb.DB, topic string, startID, endID UniqueID) err
 	return nil
 }
 
-func msgTimeExpiredCheck(ackedTs int64) bool {
-	//params := paramtable.Get() todo
-	retentionSeconds := int64(10 * 60)
-	if retentionSeconds < 0 {
+func msgTimeExpiredCheck(ackedTs int64, retentionMinutes int64) bool {
+	if retentionMinutes < 0 {
 		return false
 	}
-	return ackedTs+retentionSeconds < time.Now().Unix()
+	return ackedTs+retentionMinutes*60 < time.Now().Unix()
 }
 
-func msgSizeExpiredCheck(deletedAckedSize, ackedSize int64) bool {
-	//params := paramtable.Get()
-	size := int64(10)
-	if size < 0 {
+func msgSizeExpiredCheck(deletedAckedSize, ackedSize int64, retentionSizeInMB int64) bool {
+	if retentionSizeInMB < 0 {
 		return false
 	}
-	return ackedSize-deletedAckedSize > size*MB
+	return ackedSize-deletedAckedSize > retentionSizeInMB*MB
 }
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/log"
+	"github.com/linkbase/middleware/rocksmq"
+	"go.uber.org/zap"
+	"time"
+)
+
+// subMember is a consumer joined to a consumer group
+type subMember struct {
+	name     string
+	msgMutex chan struct{}
+	// queue holds the messages dispatched to a member of a shared subscription but not consumed by it yet
+	queue []rocksmq.ConsumerMessage
+}
+
+// subscription is the members of a consumer group with its subscription type, it is guarded by the topic mutex.
+// The first member is the active one of an exclusive or failover subscription
+type subscription struct {
+	topic   string
+	group   string
+	subType rocksmq.SubscriptionType
+	members []*subMember
+	// next is the member which is dispatched the next message of a shared subscription
+	next int
+}
+
+func (sub *subscription) member(name string) (int, *subMember) {
+	for i, m := range sub.members {
+		if m.name == name {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+// checkSubscription tells whether a member can join a group with n members subscribed as current
+func checkSubscription(topic, group string, current rocksmq.SubscriptionType, n int, subType rocksmq.SubscriptionType) error {
+	if subType < rocksmq.SubscriptionExclusive || subType > rocksmq.SubscriptionShared {
+		return fmt.Errorf("invalid subscription type %s", subType)
+	}
+	if n == 0 {
+		return nil
+	}
+	if current != subType {
+		return fmt.Errorf("consumer group %s of topic %s is subscribed as %s, not %s", group, topic, current, subType)
+	}
+	if subType == rocksmq.SubscriptionExclusive {
+		return fmt.Errorf("consumer group %s of topic %s is exclusive and already has a consumer", group, topic)
+	}
+	return nil
+}
+
+// register registers the msgMutex of the active member, or of every member of a shared subscription
+func (rmq *RocketMQServer) register(sub *subscription) {
+	var registered []*rocksmq.Consumer
+	for i, m := range sub.members {
+		if i > 0 && sub.subType != rocksmq.SubscriptionShared {
+			break
+		}
+		registered = append(registered, &rocksmq.Consumer{Topic: sub.topic, GroupName: sub.group, MsgMutex: m.msgMutex})
+	}
+	rmq.setConsumers(sub.topic, sub.group, registered...)
+}
+
+// JoinConsumerGroup adds the member to the existing consumer group with the subscription type,
+// msgMutex is signaled when the member has messages to consume and is closed when the group is destroyed
+func (rmq *RocketMQServer) JoinConsumerGroup(topic, group, member string, subType rocksmq.SubscriptionType, msgMutex chan struct{}) error {
+	if rmq.isClosed() {
+		return errors.New(RmqNotServingErrMsg)
+	}
+	lock := rmq.topicLock(topic)
+	if lock == nil {
+		return fmt.Errorf("topic name = %s not exist", topic)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	key := constructCurrentID(topic, group)
+	if _, ok := rmq.consumersID.Load(key); !ok {
+		return fmt.Errorf("consumer group %s of topic %s not exist", group, topic)
+	}
+	if subType == rocksmq.SubscriptionShared && rmq.getAckGroup(topic, group) == nil {
+		return fmt.Errorf("shared subscription requires consumer group %s of topic %s in ack mode", group, topic)
+	}
+	sub := &subscription{topic: topic, group: group, subType: subType}
+	if val, ok := rmq.subscriptions.Load(key); ok {
+		sub = val.(*subscription)
+	}
+	if err := checkSubscription(topic, group, sub.subType, len(sub.members), subType); err != nil {
+		return err
+	}
+	if _, m := sub.member(member); m != nil {
+		return fmt.Errorf("member %s already joined consumer group %s of topic %s", member, group, topic)
+	}
+	sub.subType = subType
+	sub.members = append(sub.members, &subMember{name: member, msgMutex: msgMutex})
+	rmq.subscriptions.Store(key, sub)
+	rmq.register(sub)
+	log.Info("member joined consumer group", zap.String("topic", topic), zap.String("group", group),
+		zap.String("member", member), zap.Stringer("subscriptionType", subType))
+	return nil
+}
+
+// LeaveConsumerGroup removes the member from the consumer group and closes its msgMutex.
+// The next member of a failover subscription takes over, the messages dispatched to a member of a shared
+// subscription are redelivered to the others. The consumer group is kept after the last member leaves,
+// it is only dropped by DestroyConsumerGroup
+func (rmq *RocketMQServer) LeaveConsumerGroup(topic, group, member string) error {
+	lock := rmq.topicLock(topic)
+	if lock == nil {
+		return fmt.Errorf("topic name = %s not exist", topic)
+	}
+	lock.Lock()
+	key := constructCurrentID(topic, group)
+	val, ok := rmq.subscriptions.Load(key)
+	if !ok {
+		lock.Unlock()
+		return fmt.Errorf("member %s not in consumer group %s of topic %s", member, group, topic)
+	}
+	sub := val.(*subscription)
+	idx, m := sub.member(member)
+	if m == nil {
+		lock.Unlock()
+		return fmt.Errorf("member %s not in consumer group %s of topic %s", member, group, topic)
+	}
+	sub.members = append(sub.members[:idx], sub.members[idx+1:]...)
+	close(m.msgMutex)
+	defer lock.Unlock()
+	if len(sub.members) == 0 {
+		rmq.subscriptions.Delete(key)
+		rmq.setConsumers(topic, group)
+		log.Info("last member left consumer group", zap.String("topic", topic), zap.String("group", group),
+			zap.String("member", member))
+		// the messages dispatched to the member are redelivered to the next one joining
+		return rmq.requeue(topic, group, m.queue)
+	}
+
+	rmq.register(sub)
+	if sub.subType == rocksmq.SubscriptionShared {
+		if idx < sub.next {
+			sub.next--
+		}
+		sub.next %= len(sub.members)
+		if err := rmq.requeue(topic, group, m.queue); err != nil {
+			return err
+		}
+	}
+	if idx == 0 || sub.subType == rocksmq.SubscriptionShared {
+		for _, other := range sub.members {
+			select {
+			case other.msgMutex <- struct{}{}:
+			default:
+			}
+		}
+	}
+	log.Info("member left consumer group", zap.String("topic", topic), zap.String("group", group),
+		zap.String("member", member), zap.String("active", sub.members[0].name))
+	return nil
+}
+
+// requeue makes the pending messages due, so that they are redelivered by the next consume
+func (rmq *RocketMQServer) requeue(topic, group string, msgs []rocksmq.ConsumerMessage) error {
+	ag := rmq.getAckGroup(topic, group)
+	if ag == nil {
+		return nil
+	}
+	kvs := make(map[string]string)
+	updated := make(map[UniqueID]*pendingMsg)
+	for _, msg := range msgs {
+		pending, ok := ag.pending[msg.MsgID]
+		if !ok {
+			continue
+		}
+		p := *pending
+		p.Deadline = 0
+		val, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		kvs[ag.pendingKey(msg.MsgID)] = string(val)
+		updated[msg.MsgID] = &p
+	}
+	if len(kvs) == 0 {
+		return nil
+	}
+	if err := rmq.kv.MultiSave(kvs); err != nil {
+		return err
+	}
+	for msgID, p := range updated {
+		ag.pending[msgID] = p
+	}
+	return nil
+}
+
+// ConsumeMember reads at most n messages for the member of a consumer group joined with a subscription type,
+// a standby member of a failover subscription reads nothing
+func (rmq *RocketMQServer) ConsumeMember(topic, group, member string, n int) ([]rocksmq.ConsumerMessage, error) {
+	if rmq.isClosed() {
+		return nil, errors.New(RmqNotServingErrMsg)
+	}
+	if err := rmq.releaseScheduled(topic); err != nil {
+		log.Warn("rocksmq failed to release scheduled messages", zap.String("topic", topic), zap.Error(err))
+	}
+	start := time.Now()
+	lock := rmq.topicLock(topic)
+	if lock == nil {
+		return nil, fmt.Errorf("topic name = %s not exist", topic)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	val, ok := rmq.subscriptions.Load(constructCurrentID(topic, group))
+	if !ok {
+		return nil, fmt.Errorf("member %s not in consumer group %s of topic %s", member, group, topic)
+	}
+	sub := val.(*subscription)
+	idx, m := sub.member(member)
+	if m == nil {
+		return nil, fmt.Errorf("member %s not in consumer group %s of topic %s", member, group, topic)
+	}
+	if sub.subType != rocksmq.SubscriptionShared {
+		if idx > 0 {
+			return []rocksmq.ConsumerMessage{}, nil
+		}
+		return rmq.consume(topic, group, n, start)
+	}
+	return rmq.consumeShared(sub, m, n)
+}
+
+// consumeShared hands out the messages dispatched to the member, when there are none a new batch is
+// read and dispatched round-robin across the members, the others are woken up for their share
+func (rmq *RocketMQServer) consumeShared(sub *subscription, m *subMember, n int) ([]rocksmq.ConsumerMessage, error) {
+	ag := rmq.getAckGroup(sub.topic, sub.group)
+	if ag == nil {
+		return nil, fmt.Errorf("consumer group %s of topic %s is not in ack mode", sub.group, sub.topic)
+	}
+	if len(m.queue) == 0 {
+		currentID, ok := rmq.getCurrentID(sub.topic, sub.group)
+		if !ok {
+			return nil, fmt.Errorf("currentID of topicName=%s, groupName=%s not exist", sub.topic, sub.group)
+		}
+		msgs, err := rmq.consumeWithAck(ag, currentID, n*len(sub.members))
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			target := sub.members[sub.next]
+			target.queue = append(target.queue, msg)
+			sub.next = (sub.next + 1) % len(sub.members)
+		}
+		for _, other := range sub.members {
+			if other != m && len(other.queue) > 0 {
+				select {
+				case other.msgMutex <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+
+	consumerMessage := make([]rocksmq.ConsumerMessage, 0, n)
+	for len(m.queue) > 0 && len(consumerMessage) < n {
+		msg := m.queue[0]
+		m.queue = m.queue[1:]
+		// skip the messages acked by another member after their redelivery
+		if _, ok := ag.pending[msg.MsgID]; ok {
+			consumerMessage = append(consumerMessage, msg)
+		}
+	}
+	if len(consumerMessage) > 0 {
+		rmq.lastConsume.Store(constructCurrentID(sub.topic, sub.group), time.Now())
+	}
+	return consumerMessage, nil
+}
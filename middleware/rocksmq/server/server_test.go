@@ -0,0 +1,1341 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/linkbase/middleware/kv"
+	"github.com/linkbase/middleware/rocksmq"
+	"github.com/linkbase/utils/paramtable"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRocksMQ(t *testing.T) (*RocketMQServer, string) {
+	name := path.Join(t.TempDir(), "rocksmq")
+	rmq, err := NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	return rmq, name
+}
+
+func TestRocksmq_ProduceConsume(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+
+	topic := "test_produce_consume"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	defer rmq.DestroyTopic(topic)
+
+	msgs := make([]rocksmq.ProducerMessage, 0, 10)
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, rocksmq.ProducerMessage{
+			Payload:    []byte("message_" + strconv.Itoa(i)),
+			Properties: map[string]string{"index": strconv.Itoa(i)},
+		})
+	}
+	ids, err := rmq.Produce(topic, msgs)
+	assert.NoError(t, err)
+	assert.Len(t, ids, 10)
+
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: make(chan struct{}, 1)}))
+
+	cMsgs, err := rmq.Consume(topic, group, 4)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 4)
+	assert.Equal(t, ids[0], cMsgs[0].MsgID)
+	assert.Equal(t, "message_0", string(cMsgs[0].Payload))
+	assert.Equal(t, "0", cMsgs[0].Properties["index"])
+
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 6)
+	assert.Equal(t, ids[9], cMsgs[5].MsgID)
+
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 0)
+
+	latest, err := rmq.GetLatestMsg(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[9], latest)
+}
+
+func TestRocksmq_GroupCommit(t *testing.T) {
+	paramtable.Init()
+	params := paramtable.Get()
+	defer params.Reset(params.RocksmqCfg.GroupCommitEnabled.Key)
+	defer params.Reset(params.RocksmqCfg.GroupCommitMaxLatencyInMs.Key)
+	defer params.Reset(params.RocksmqCfg.GroupCommitMaxBatchSize.Key)
+	for _, enabled := range []string{"false", "true"} {
+		params.Save(params.RocksmqCfg.GroupCommitEnabled.Key, enabled)
+		params.Save(params.RocksmqCfg.GroupCommitMaxLatencyInMs.Key, "20")
+		// a batch holds a few requests only
+		params.Save(params.RocksmqCfg.GroupCommitMaxBatchSize.Key, "1024")
+		rmq, _ := newTestRocksMQ(t)
+		assert.Equal(t, enabled == "true", rmq.groupCommitEnabled)
+
+		topics := []string{"test_group_commit_0", "test_group_commit_1", "test_group_commit_2"}
+		group := "test_group"
+		for _, topic := range topics {
+			assert.NoError(t, rmq.CreateTopic(topic))
+			assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				topic := topics[i%len(topics)]
+				var last UniqueID
+				for j := 0; j < 10; j++ {
+					ids, err := rmq.Produce(topic, []rocksmq.ProducerMessage{
+						{Payload: []byte(strconv.Itoa(i) + "_" + strconv.Itoa(j))},
+						{Payload: []byte(strconv.Itoa(i) + "_" + strconv.Itoa(j))},
+					})
+					assert.NoError(t, err)
+					assert.Len(t, ids, 2)
+					assert.Greater(t, ids[0], last)
+					last = ids[1]
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		for _, topic := range topics {
+			cMsgs, err := rmq.Consume(topic, group, 1000)
+			assert.NoError(t, err)
+			assert.Len(t, cMsgs, 200)
+			for i := 1; i < len(cMsgs); i++ {
+				assert.Greater(t, cMsgs[i].MsgID, cMsgs[i-1].MsgID)
+			}
+			latest, err := rmq.GetLatestMsg(topic)
+			assert.NoError(t, err)
+			assert.Equal(t, cMsgs[len(cMsgs)-1].MsgID, latest)
+		}
+		_, err := rmq.Produce("no_topic", []rocksmq.ProducerMessage{{Payload: []byte("a")}})
+		assert.Error(t, err)
+		rmq.Close()
+		_, err = rmq.Produce(topics[0], []rocksmq.ProducerMessage{{Payload: []byte("a")}})
+		assert.Error(t, err)
+	}
+}
+
+func TestRocksmq_Restart(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+
+	topic := "test_restart"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	ids, err := rmq.Produce(topic, []rocksmq.ProducerMessage{{Payload: []byte("a")}, {Payload: []byte("b")}})
+	assert.NoError(t, err)
+	rmq.Close()
+
+	rmq, err = NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+
+	latest, err := rmq.GetLatestMsg(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[1], latest)
+
+	// ids allocated after restart never go backward
+	newIDs, err := rmq.Produce(topic, []rocksmq.ProducerMessage{{Payload: []byte("c")}})
+	assert.NoError(t, err)
+	assert.Greater(t, newIDs[0], ids[1])
+
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: make(chan struct{}, 1)}))
+	cMsgs, err := rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 3)
+	assert.Equal(t, "a", string(cMsgs[0].Payload))
+	assert.Equal(t, "c", string(cMsgs[2].Payload))
+}
+
+func TestRocksmq_DelayedDelivery(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+
+	topic := "test_delayed_delivery"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+	deliverAt := func(d time.Duration) map[string]string {
+		return map[string]string{rocksmq.DeliverAtProperty: strconv.FormatInt(time.Now().Add(d).UnixMilli(), 10)}
+	}
+	_, err := rmq.Produce(topic, []rocksmq.ProducerMessage{
+		{Payload: []byte("later"), Properties: deliverAt(time.Second)},
+		{Payload: []byte("soon"), Properties: deliverAt(200 * time.Millisecond)},
+		{Payload: []byte("now")},
+		{Payload: []byte("past"), Properties: deliverAt(-time.Second)},
+	})
+	assert.NoError(t, err)
+
+	cMsgs, err := rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 2)
+	assert.Equal(t, "now", string(cMsgs[0].Payload))
+	assert.Equal(t, "past", string(cMsgs[1].Payload))
+
+	// the message due first is delivered without waiting for the one scheduled before it
+	msgMutex := make(chan struct{}, 1)
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: msgMutex}))
+	select {
+	case <-msgMutex:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer not woken up by the scheduled message")
+	}
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 1)
+	assert.Equal(t, "soon", string(cMsgs[0].Payload))
+	assert.NotEmpty(t, cMsgs[0].Properties[rocksmq.DeliverAtProperty])
+	rmq.Close()
+
+	// scheduled messages survive a restart
+	rmq, err = NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+	var payloads []string
+	assert.Eventually(t, func() bool {
+		cMsgs, err = rmq.Consume(topic, group, 10)
+		for _, msg := range cMsgs {
+			payloads = append(payloads, string(msg.Payload))
+		}
+		return err == nil && len(payloads) == 4
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, []string{"now", "past", "soon", "later"}, payloads)
+
+	// destroying the topic drops its scheduled messages
+	_, err = rmq.Produce(topic, []rocksmq.ProducerMessage{{Payload: []byte("dropped"), Properties: deliverAt(time.Hour)}})
+	assert.NoError(t, err)
+	assert.NoError(t, rmq.DestroyTopic(topic))
+	_, ok := rmq.delayed.Load(topic)
+	assert.False(t, ok)
+	_, msgs, _, err := rmq.scanScheduled(topic, "delay0", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestRocksmq_ReservedTopicNames(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+	for _, topic := range []string{"delay", "msg_ts", "properties"} {
+		assert.Error(t, rmq.CreateTopic(topic))
+		assert.Error(t, rmq.CreateTopic(topic, rocksmq.WithPartitions(2)))
+	}
+
+	// the scheduled messages and the produce times of a topic are not taken for the messages of another one
+	topic := "test_reserved_topic"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	deliverAt := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	_, err := rmq.Produce(topic, []rocksmq.ProducerMessage{
+		{Payload: []byte("now")},
+		{Payload: []byte("later"), Properties: map[string]string{rocksmq.DeliverAtProperty: deliverAt}},
+	})
+	assert.NoError(t, err)
+	rmq.Close()
+
+	rmq, err = NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	assert.Error(t, rmq.CreateTopic("delay"))
+	_, err = rmq.GetTopicPartitions("delay")
+	assert.Error(t, err)
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+	cMsgs, err := rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 1)
+	assert.Equal(t, "now", string(cMsgs[0].Payload))
+	stats, err := rmq.GetTopicStats(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Scheduled)
+}
+
+func TestRocksmq_SeekByTime(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+	// small pages so that the page index is used to skip the first batch
+	params := paramtable.Get()
+	params.Save(params.RocksmqCfg.PageSize.Key, "4")
+	defer params.Reset(params.RocksmqCfg.PageSize.Key)
+
+	topic := "test_seek_by_time"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	defer rmq.DestroyTopic(topic)
+
+	newMsgs := func(prefix string) []rocksmq.ProducerMessage {
+		msgs := make([]rocksmq.ProducerMessage, 0, 5)
+		for i := 0; i < 5; i++ {
+			msgs = append(msgs, rocksmq.ProducerMessage{Payload: []byte(prefix + strconv.Itoa(i))})
+		}
+		return msgs
+	}
+	before := time.Now()
+	ids1, err := rmq.Produce(topic, newMsgs("first_"))
+	assert.NoError(t, err)
+	// page ts has second granularity
+	time.Sleep(1100 * time.Millisecond)
+	middle := time.Now()
+	ids2, err := rmq.Produce(topic, newMsgs("second_"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: make(chan struct{}, 1)}))
+	cMsgs, err := rmq.Consume(topic, group, 20)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 10)
+
+	// rewind to the second batch
+	assert.NoError(t, rmq.SeekByTime(topic, group, middle))
+	cMsgs, err = rmq.Consume(topic, group, 20)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 5)
+	assert.Equal(t, ids2[0], cMsgs[0].MsgID)
+	assert.Equal(t, "second_0", string(cMsgs[0].Payload))
+
+	// rewind to the very beginning
+	assert.NoError(t, rmq.SeekByTime(topic, group, before))
+	cMsgs, err = rmq.Consume(topic, group, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, ids1[0], cMsgs[0].MsgID)
+
+	// nothing after a future ts
+	assert.NoError(t, rmq.SeekByTime(topic, group, time.Now().Add(time.Hour)))
+	cMsgs, err = rmq.Consume(topic, group, 20)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 0)
+
+	assert.Error(t, rmq.SeekByTime(topic, "no_group", before))
+	assert.Error(t, rmq.SeekByTime("no_topic", group, before))
+}
+
+func TestRocksmq_TopicRetention(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+
+	topic := "test_topic_retention"
+	policy := rocksmq.RetentionPolicy{TimeInMinutes: 10, SizeInMB: -1, RetainUnacked: false}
+	assert.NoError(t, rmq.CreateTopic(topic, rocksmq.WithRetention(policy)))
+	assert.NoError(t, rmq.CreateTopic("test_default_retention"))
+	assert.Error(t, rmq.CreateTopic("test_invalid_retention", rocksmq.WithRetention(rocksmq.RetentionPolicy{TimeInMinutes: -2})))
+
+	got, err := rmq.GetTopicRetention(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, policy, got)
+	got, err = rmq.GetTopicRetention("test_default_retention")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultRetentionPolicy(), got)
+	assert.True(t, got.RetainUnacked)
+	_, err = rmq.GetTopicRetention("no_topic")
+	assert.Error(t, err)
+
+	policy.SizeInMB = 100
+	assert.NoError(t, rmq.SetTopicRetention(topic, policy))
+	assert.Error(t, rmq.SetTopicRetention(topic, rocksmq.RetentionPolicy{SizeInMB: -2}))
+	assert.Error(t, rmq.SetTopicRetention("no_topic", policy))
+	rmq.Close()
+
+	// the policy survives a restart
+	rmq, err = NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	got, err = rmq.GetTopicRetention(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, policy, got)
+
+	assert.NoError(t, rmq.DestroyTopic(topic))
+	assert.NoError(t, rmq.CreateTopic(topic))
+	got, err = rmq.GetTopicRetention(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultRetentionPolicy(), got)
+}
+
+func TestRocksmq_CompactedTopic(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+	// a page is full every 3 messages of 2 bytes
+	params := paramtable.Get()
+	params.Save(params.RocksmqCfg.PageSize.Key, "4")
+	defer params.Reset(params.RocksmqCfg.PageSize.Key)
+
+	topic := "test_compacted_topic"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic, rocksmq.WithCompaction()))
+	keyed := func(key, payload string) rocksmq.ProducerMessage {
+		return rocksmq.ProducerMessage{Payload: []byte(payload), Properties: map[string]string{rocksmq.MessageKeyProperty: key}}
+	}
+	_, err := rmq.Produce(topic, []rocksmq.ProducerMessage{
+		keyed("k1", "a1"),
+		keyed("k2", "b1"),
+		keyed("k1", "a2"),
+		keyed("k3", "c1"),
+		keyed("k2", ""),
+		{Payload: []byte("x1")},
+		keyed("k1", "a3"),
+		// the open page is not compacted
+		keyed("k3", "c2"),
+	})
+	assert.NoError(t, err)
+	rmq.Close()
+
+	// the topic is still compacted after a restart
+	rmq, err = NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	assert.True(t, rmq.retentionIndo.compactedTopics.Contain(topic))
+	assert.NoError(t, rmq.retentionIndo.compact(topic))
+
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+	cMsgs, err := rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	var payloads []string
+	for _, msg := range cMsgs {
+		payloads = append(payloads, string(msg.Payload))
+	}
+	assert.Equal(t, []string{"x1", "a3", "c2"}, payloads)
+
+	// compacting again changes nothing
+	assert.NoError(t, rmq.retentionIndo.compact(topic))
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "other_group"))
+	cMsgs, err = rmq.Consume(topic, "other_group", 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 3)
+
+	// the next compaction starts from the watermark, the compacted messages are superseded through the key index
+	_, err = rmq.Produce(topic, []rocksmq.ProducerMessage{keyed("k1", "a4"), keyed("k4", "d1"), keyed("k3", ""), keyed("k5", "e1")})
+	assert.NoError(t, err)
+	pageEndIDs, err := rmq.retentionIndo.pageEndIDs(topic)
+	assert.NoError(t, err)
+	assert.NoError(t, rmq.retentionIndo.compact(topic))
+	watermark, err := rmq.retentionIndo.compactedWatermark(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, pageEndIDs[len(pageEndIDs)-1], watermark)
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "third_group"))
+	cMsgs, err = rmq.Consume(topic, "third_group", 10)
+	assert.NoError(t, err)
+	payloads = nil
+	for _, msg := range cMsgs {
+		payloads = append(payloads, string(msg.Payload))
+	}
+	assert.Equal(t, []string{"x1", "a4", "d1", "", "e1"}, payloads)
+	// the stats follow the compacted pages
+	stats, err := rmq.GetTopicStats(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), stats.MsgCount)
+	assert.Equal(t, int64(8), stats.Bytes)
+	assert.Equal(t, int64(8), stats.RawBytes)
+
+	// a compacted topic is retained as the others
+	assert.NoError(t, rmq.SetTopicRetention(topic, rocksmq.RetentionPolicy{TimeInMinutes: -1, SizeInMB: 0, RetainUnacked: false}))
+	rmq.retentionIndo.retainTopic(topic)
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "fourth_group"))
+	cMsgs, err = rmq.Consume(topic, "fourth_group", 10)
+	assert.NoError(t, err)
+	payloads = nil
+	for _, msg := range cMsgs {
+		payloads = append(payloads, string(msg.Payload))
+	}
+	assert.Equal(t, []string{"a4", "d1", "", "e1"}, payloads)
+
+	assert.NoError(t, rmq.DestroyTopic(topic))
+	assert.False(t, rmq.retentionIndo.compactedTopics.Contain(topic))
+	assert.NoError(t, rmq.CreateTopic(topic))
+	assert.False(t, rmq.retentionIndo.compactedTopics.Contain(topic))
+}
+
+func TestRocksmq_TopicStats(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+	params := paramtable.Get()
+	params.Save(params.RocksmqCfg.PageSize.Key, "4")
+	defer params.Reset(params.RocksmqCfg.PageSize.Key)
+
+	topic := "test_stats_topic"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	assert.NoError(t, rmq.CreateTopic("test_stats_partitioned", rocksmq.WithPartitions(2)))
+	topics, err := rmq.ListTopics()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test_stats_partitioned", topic}, topics)
+	_, err = rmq.GetTopicStats("not_exist")
+	assert.Error(t, err)
+
+	msgs := make([]rocksmq.ProducerMessage, 7)
+	for i := range msgs {
+		msgs[i] = rocksmq.ProducerMessage{Payload: []byte("m" + strconv.Itoa(i))}
+	}
+	ids, err := rmq.Produce(topic, msgs)
+	assert.NoError(t, err)
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "ack_group", rocksmq.WithAckMode(time.Minute)))
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "idle_group"))
+	cMsgs, err := rmq.Consume(topic, "ack_group", 3)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 3)
+
+	stats, err := rmq.GetTopicStats(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), stats.MsgCount)
+	assert.Equal(t, int64(14), stats.Bytes)
+	assert.Equal(t, ids[0], stats.FirstMsgID)
+	assert.Equal(t, ids[6], stats.LastMsgID)
+	assert.True(t, stats.PageCount > 0)
+	assert.False(t, stats.CreatedAt.IsZero())
+	assert.Equal(t, defaultRetentionPolicy(), stats.Retention)
+	assert.Len(t, stats.Groups, 2)
+	ackGroup, idleGroup := stats.Groups[0], stats.Groups[1]
+	assert.Equal(t, "ack_group", ackGroup.Group)
+	assert.True(t, ackGroup.AckMode)
+	assert.Equal(t, 3, ackGroup.Pending)
+	assert.Equal(t, ids[3], ackGroup.CurrentID)
+	assert.Equal(t, int64(4), ackGroup.BacklogMsgs)
+	assert.Equal(t, int64(8), ackGroup.BacklogBytes)
+	assert.False(t, ackGroup.LastConsume.IsZero())
+	assert.Equal(t, "idle_group", idleGroup.Group)
+	assert.Equal(t, int64(7), idleGroup.BacklogMsgs)
+	assert.Equal(t, int64(14), idleGroup.BacklogBytes)
+	assert.True(t, idleGroup.LastConsume.IsZero())
+
+	// a partitioned topic sums up its partitions
+	partitioned := "test_stats_partitioned"
+	for p := 0; p < 2; p++ {
+		assert.NoError(t, rmq.CreateConsumerGroup(rocksmq.PartitionTopic(partitioned, p), "test_group"))
+		_, err = rmq.Produce(rocksmq.PartitionTopic(partitioned, p), msgs[:p+1])
+		assert.NoError(t, err)
+	}
+	stats, err = rmq.GetTopicStats(partitioned)
+	assert.NoError(t, err)
+	assert.Len(t, stats.Partitions, 2)
+	assert.Equal(t, int64(3), stats.MsgCount)
+	assert.Equal(t, int64(6), stats.Bytes)
+	assert.Len(t, stats.Groups, 1)
+	assert.Equal(t, int64(3), stats.Groups[0].BacklogMsgs)
+}
+
+func TestRocksmq_Compression(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+
+	raw := []byte(strings.Repeat("row,batch,payload;", 100))
+	for _, codec := range []rocksmq.Compression{rocksmq.CompressionZstd, rocksmq.CompressionLZ4, rocksmq.CompressionSnappy, rocksmq.CompressionNone} {
+		topic := "test_compression_" + string(codec)
+		assert.NoError(t, rmq.CreateTopic(topic))
+		properties := map[string]string{rocksmq.CompressionProperty: string(codec), "k": "v"}
+		_, err := rmq.Produce(topic, []rocksmq.ProducerMessage{
+			{Payload: raw, Properties: properties},
+			// a payload which does not get smaller is stored as it is
+			{Payload: []byte("x"), Properties: properties},
+		})
+		assert.NoError(t, err)
+
+		assert.NoError(t, rmq.CreateConsumerGroup(topic, "test_group"))
+		cMsgs, err := rmq.Consume(topic, "test_group", 10)
+		assert.NoError(t, err)
+		assert.Len(t, cMsgs, 2)
+		assert.Equal(t, raw, cMsgs[0].Payload, codec)
+		assert.Equal(t, map[string]string{"k": "v"}, cMsgs[0].Properties)
+		assert.Equal(t, []byte("x"), cMsgs[1].Payload)
+
+		stats, err := rmq.GetTopicStats(topic)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(raw)+1), stats.RawBytes)
+		if codec == rocksmq.CompressionNone {
+			assert.Equal(t, stats.RawBytes, stats.Bytes)
+		} else {
+			assert.True(t, stats.CompressionRatio() > 2, codec)
+		}
+	}
+
+	_, err := rmq.Produce("test_compression_none", []rocksmq.ProducerMessage{
+		{Payload: raw, Properties: map[string]string{rocksmq.CompressionProperty: "gzip"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestRocksmq_BackupRestore(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+
+	topic := "test_backup"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	msgs := make([]rocksmq.ProducerMessage, 0, 10)
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, rocksmq.ProducerMessage{
+			Payload:    []byte(strings.Repeat("msg_"+strconv.Itoa(i), 10)),
+			Properties: map[string]string{rocksmq.CompressionProperty: string(rocksmq.CompressionSnappy)},
+		})
+	}
+	ids, err := rmq.Produce(topic, msgs)
+	assert.NoError(t, err)
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "ack_group", rocksmq.WithAckMode(time.Minute)))
+	cMsgs, err := rmq.Consume(topic, "ack_group", 3)
+	assert.NoError(t, err)
+	assert.NoError(t, rmq.AckCumulative(topic, "ack_group", cMsgs[2].MsgID))
+
+	params := paramtable.Get()
+	backupRoot := t.TempDir()
+	params.Save(params.RocksmqCfg.BackupPath.Key, backupRoot)
+	defer params.Reset(params.RocksmqCfg.BackupPath.Key)
+	// a backup is only written inside the backup path
+	assert.Error(t, rmq.Backup(t.TempDir()))
+	assert.Error(t, rmq.Backup("../outside"))
+	assert.Error(t, rmq.Backup(backupRoot))
+	assert.NoError(t, rmq.Backup("backup"))
+	assert.Error(t, rmq.Backup("backup"))
+	dir := path.Join(backupRoot, "backup")
+	assert.Error(t, rmq.Backup(dir))
+	// the messages produced after the backup are not in it
+	_, err = rmq.Produce(topic, []rocksmq.ProducerMessage{{Payload: []byte("after_backup")}})
+	assert.NoError(t, err)
+	rmq.Close()
+
+	assert.Error(t, RestoreRocksMQ(dir, name))
+	assert.Error(t, RestoreRocksMQ(t.TempDir(), path.Join(t.TempDir(), "rocksmq")))
+	restored := path.Join(t.TempDir(), "rocksmq")
+	assert.NoError(t, RestoreRocksMQ(dir, restored))
+	rmq, err = NewRocksMQ(restored, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "test_group"))
+	cMsgs, err = rmq.Consume(topic, "test_group", 20)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 10)
+	assert.Equal(t, ids[4], cMsgs[4].MsgID)
+	assert.Equal(t, msgs[4].Payload, cMsgs[4].Payload)
+	// the position of an ack group is kept
+	cMsgs, err = rmq.Consume(topic, "ack_group", 20)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 7)
+	assert.Equal(t, ids[3], cMsgs[0].MsgID)
+
+	// the ids go on from the backup
+	newIDs, err := rmq.Produce(topic, []rocksmq.ProducerMessage{{Payload: []byte("after_restore")}})
+	assert.NoError(t, err)
+	assert.Greater(t, newIDs[0], ids[9])
+}
+
+func TestRocksmq_ExportImport(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+
+	topic := "test_export"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	msgs := make([]rocksmq.ProducerMessage, 0, 5)
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, rocksmq.ProducerMessage{
+			Payload:    []byte("msg_" + strconv.Itoa(i)),
+			Properties: map[string]string{"i": strconv.Itoa(i), rocksmq.CompressionProperty: string(rocksmq.CompressionZstd)},
+		})
+	}
+	ids, err := rmq.Produce(topic, msgs)
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	n, err := rocksmq.ExportTopic(rmq, topic, ids[1], ids[3], buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	target := "test_import"
+	n, err = rocksmq.ImportTopic(rmq, target, bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.NoError(t, rmq.CreateConsumerGroup(target, "test_group"))
+	cMsgs, err := rmq.Consume(target, "test_group", 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 3)
+	for i, msg := range cMsgs {
+		assert.Equal(t, msgs[i+1].Payload, msg.Payload)
+		assert.Equal(t, map[string]string{"i": strconv.Itoa(i + 1)}, msg.Properties)
+	}
+
+	buf.Reset()
+	n, err = rocksmq.ExportTopic(rmq, topic, rocksmq.EarliestMessageID, rocksmq.LatestMessageID, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	_, err = rocksmq.ImportTopic(rmq, target, bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	assert.Error(t, err)
+	_, err = rocksmq.ImportTopic(rmq, target, strings.NewReader("not an export"))
+	assert.Error(t, err)
+
+	assert.NoError(t, rmq.CreateTopic("test_export_partitioned", rocksmq.WithPartitions(2)))
+	_, err = rocksmq.ExportTopic(rmq, "test_export_partitioned", rocksmq.EarliestMessageID, rocksmq.LatestMessageID, buf)
+	assert.Error(t, err)
+}
+
+func TestRocksmq_RetentionDropUnacked(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+	// every message fills up a page
+	params := paramtable.Get()
+	params.Save(params.RocksmqCfg.PageSize.Key, "4")
+	defer params.Reset(params.RocksmqCfg.PageSize.Key)
+
+	topic := "test_retention_unacked"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic, rocksmq.WithRetention(rocksmq.RetentionPolicy{TimeInMinutes: -1, SizeInMB: 0, RetainUnacked: true})))
+	defer rmq.DestroyTopic(topic)
+	msgs := make([]rocksmq.ProducerMessage, 0, 5)
+	for i := 0; i < 5; i++ {
+		msgs = append(msgs, rocksmq.ProducerMessage{Payload: []byte("msg_" + strconv.Itoa(i))})
+	}
+	ids, err := rmq.Produce(topic, msgs)
+	assert.NoError(t, err)
+
+	// nothing is acked, so nothing is purged
+	assert.NoError(t, rmq.retentionIndo.expiredCleanUp(topic))
+	latest, err := rmq.GetLatestMsg(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[4], latest)
+
+	assert.NoError(t, rmq.SetTopicRetention(topic, rocksmq.RetentionPolicy{TimeInMinutes: -1, SizeInMB: 0, RetainUnacked: false}))
+	assert.NoError(t, rmq.retentionIndo.expiredCleanUp(topic))
+
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group))
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: make(chan struct{}, 1)}))
+	cMsgs, err := rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 1)
+	assert.Equal(t, ids[4], cMsgs[0].MsgID)
+}
+
+func produceN(t *testing.T, rmq *RocketMQServer, topic string, n int) []UniqueID {
+	msgs := make([]rocksmq.ProducerMessage, 0, n)
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, rocksmq.ProducerMessage{Payload: []byte("msg_" + strconv.Itoa(i))})
+	}
+	ids, err := rmq.Produce(topic, msgs)
+	assert.NoError(t, err)
+	return ids
+}
+
+func msgIDsOf(msgs []rocksmq.ConsumerMessage) []UniqueID {
+	ids := make([]UniqueID, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.MsgID)
+	}
+	return ids
+}
+
+func TestRocksmq_AckMode(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+
+	topic := "test_ack_mode"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	defer rmq.DestroyTopic(topic)
+	ids := produceN(t, rmq, topic, 5)
+
+	assert.Error(t, rmq.CreateConsumerGroup(topic, "invalid/group", rocksmq.WithAckMode(0)))
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group, rocksmq.WithAckMode(200*time.Millisecond)))
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: make(chan struct{}, 1)}))
+
+	cMsgs, err := rmq.Consume(topic, group, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[:3], msgIDsOf(cMsgs))
+	assert.NoError(t, rmq.Ack(topic, group, ids[0]))
+	assert.NoError(t, rmq.Nack(topic, group, ids[1]))
+
+	// the nacked message comes first
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{ids[1], ids[3], ids[4]}, msgIDsOf(cMsgs))
+	assert.Equal(t, 1, cMsgs[0].RedeliveryCount)
+	assert.Equal(t, 0, cMsgs[1].RedeliveryCount)
+
+	// everything unacked is redelivered after the ack timeout
+	time.Sleep(300 * time.Millisecond)
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[1:], msgIDsOf(cMsgs))
+	assert.Equal(t, 2, cMsgs[0].RedeliveryCount)
+
+	assert.NoError(t, rmq.AckCumulative(topic, group, ids[4]))
+	time.Sleep(300 * time.Millisecond)
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 0)
+
+	// a group not in ack mode can not ack
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "plain_group"))
+	assert.Error(t, rmq.Ack(topic, "plain_group", ids[0]))
+}
+
+func TestRocksmq_AckModeRestart(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+
+	topic := "test_ack_mode_restart"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	ids := produceN(t, rmq, topic, 4)
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group, rocksmq.WithAckMode(time.Hour)))
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: make(chan struct{}, 1)}))
+	cMsgs, err := rmq.Consume(topic, group, 2)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 2)
+	assert.NoError(t, rmq.Ack(topic, group, ids[1]))
+	rmq.Close()
+
+	rmq, err = NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	exist, consumer, err := rmq.ExistConsumerGroup(topic, group)
+	assert.NoError(t, err)
+	assert.True(t, exist)
+	assert.Nil(t, consumer)
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: make(chan struct{}, 1)}))
+
+	// the position is kept and the pending message is still pending
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[2:], msgIDsOf(cMsgs))
+	assert.NoError(t, rmq.Nack(topic, group, ids[0]))
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{ids[0]}, msgIDsOf(cMsgs))
+	assert.Equal(t, 1, cMsgs[0].RedeliveryCount)
+
+	// an explicit destroy drops the persisted state
+	assert.NoError(t, rmq.DestroyConsumerGroup(topic, group))
+	keys, _, err := rmq.kv.LoadWithPrefix(PendingTitle + topic + "/")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestRocksmq_AckModeRetention(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+	// every message fills up a page
+	params := paramtable.Get()
+	params.Save(params.RocksmqCfg.PageSize.Key, "4")
+	defer params.Reset(params.RocksmqCfg.PageSize.Key)
+
+	topic := "test_ack_mode_retention"
+	assert.NoError(t, rmq.CreateTopic(topic, rocksmq.WithRetention(rocksmq.RetentionPolicy{TimeInMinutes: -1, SizeInMB: 0, RetainUnacked: true})))
+	ids := produceN(t, rmq, topic, 5)
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "fast_group", rocksmq.WithAckMode(time.Hour)))
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "slow_group", rocksmq.WithAckMode(time.Hour)))
+	rmq.Close()
+
+	rmq, err := NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	// only the fast group comes back, the slow group has no consumer
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: "fast_group", MsgMutex: make(chan struct{}, 1)}))
+	cMsgs, err := rmq.Consume(topic, "fast_group", 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 5)
+	assert.NoError(t, rmq.AckCumulative(topic, "fast_group", ids[4]))
+	assert.NoError(t, rmq.retentionIndo.expiredCleanUp(topic))
+
+	// the messages the slow group has not acked are not purged
+	cMsgs, err = rmq.Consume(topic, "slow_group", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, ids, msgIDsOf(cMsgs))
+}
+
+// failingKV fails MultiSave and MultiRemove while fail is set
+type failingKV struct {
+	kv.BaseKV
+	fail bool
+}
+
+func (f *failingKV) MultiSave(kvs map[string]string) error {
+	if f.fail {
+		return errors.New("mock save error")
+	}
+	return f.BaseKV.MultiSave(kvs)
+}
+
+func (f *failingKV) MultiRemove(keys []string) error {
+	if f.fail {
+		return errors.New("mock remove error")
+	}
+	return f.BaseKV.MultiRemove(keys)
+}
+
+func TestRocksmq_AckModeSaveFailure(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+
+	topic := "test_ack_mode_save_failure"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	ids := produceN(t, rmq, topic, 3)
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group, rocksmq.WithAckMode(time.Hour)))
+
+	fkv := &failingKV{BaseKV: rmq.kv, fail: true}
+	rmq.kv = fkv
+	_, err := rmq.Consume(topic, group, 2)
+	assert.Error(t, err)
+	// the group is left as it was, so the messages are delivered once the save succeeds
+	fkv.fail = false
+	cMsgs, err := rmq.Consume(topic, group, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[:2], msgIDsOf(cMsgs))
+	assert.Equal(t, 0, cMsgs[0].RedeliveryCount)
+
+	// failed acks and nacks leave the pending messages as they were
+	ag := rmq.getAckGroup(topic, group)
+	deadline := ag.pending[ids[0]].Deadline
+	fkv.fail = true
+	assert.Error(t, rmq.Ack(topic, group, ids[0]))
+	assert.Error(t, rmq.AckCumulative(topic, group, ids[1]))
+	assert.Error(t, rmq.Nack(topic, group, ids[0]))
+	assert.Len(t, ag.pending, 2)
+	assert.Equal(t, 0, ag.pending[ids[0]].Failures)
+	assert.Equal(t, deadline, ag.pending[ids[0]].Deadline)
+	rmq.kv = fkv.BaseKV
+	assert.NoError(t, rmq.Nack(topic, group, ids[0]))
+	assert.Equal(t, 1, ag.pending[ids[0]].Failures)
+	assert.NoError(t, rmq.Ack(topic, group, ids[1]))
+	assert.Len(t, ag.pending, 1)
+}
+
+func TestRocksmq_ConsumerFilter(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+
+	topic := "test_consumer_filter"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	produce := func(from, to int) []UniqueID {
+		var msgs []rocksmq.ProducerMessage
+		for i := from; i < to; i++ {
+			kind := "a"
+			if i%2 == 1 {
+				kind = "b"
+			}
+			msgs = append(msgs, rocksmq.ProducerMessage{Payload: []byte("msg_" + strconv.Itoa(i)),
+				Properties: map[string]string{"kind": kind, "n": strconv.Itoa(i)}})
+		}
+		ids, err := rmq.Produce(topic, msgs)
+		assert.NoError(t, err)
+		return ids
+	}
+	ids := produce(0, 6)
+	assert.Error(t, rmq.CreateConsumerGroup(topic, "invalid_group", rocksmq.WithFilter("n >")))
+
+	// the skipped messages move the position as well
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "plain_group", rocksmq.WithFilter("kind = 'a'")))
+	cMsgs, err := rmq.Consume(topic, "plain_group", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{ids[0], ids[2]}, msgIDsOf(cMsgs))
+	cMsgs, err = rmq.Consume(topic, "plain_group", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{ids[4]}, msgIDsOf(cMsgs))
+	currentID, _ := rmq.getCurrentID(topic, "plain_group")
+	assert.Equal(t, ids[5]+1, currentID)
+
+	// in ack mode the skipped messages never become pending
+	group := "ack_group"
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group, rocksmq.WithAckMode(time.Minute), rocksmq.WithFilter("n >= 4")))
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[4:], msgIDsOf(cMsgs))
+	ag := rmq.getAckGroup(topic, group)
+	assert.Len(t, ag.pending, 2)
+	assert.Equal(t, ids[4], ag.ackedPos)
+	assert.NoError(t, rmq.Ack(topic, group, ids[4:]...))
+	assert.Equal(t, ids[5]+1, ag.ackedPos)
+	rmq.Close()
+
+	// the filter of a group in ack mode is persisted
+	rmq, err = NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	ids = produce(3, 8)
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[1:], msgIDsOf(cMsgs))
+}
+
+func TestRocksmq_ConsumerFilterBoundedScan(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+
+	topic := "test_consumer_filter_bounded"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	skipped := filterReadBatch*filterMaxBatches + 10
+	msgs := make([]rocksmq.ProducerMessage, 0, skipped+1)
+	for i := 0; i < skipped; i++ {
+		msgs = append(msgs, rocksmq.ProducerMessage{Payload: []byte("b"), Properties: map[string]string{"kind": "b"}})
+	}
+	msgs = append(msgs, rocksmq.ProducerMessage{Payload: []byte("a"), Properties: map[string]string{"kind": "a"}})
+	ids, err := rmq.Produce(topic, msgs)
+	assert.NoError(t, err)
+
+	for _, group := range []string{"plain_group", "ack_group"} {
+		opts := []rocksmq.ConsumerGroupOption{rocksmq.WithFilter("kind = 'a'")}
+		if group == "ack_group" {
+			opts = append(opts, rocksmq.WithAckMode(time.Minute))
+		}
+		assert.NoError(t, rmq.CreateConsumerGroup(topic, group, opts...))
+		msgMutex := make(chan struct{}, 1)
+		assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: msgMutex}))
+
+		// a consume scans a bounded number of messages, it moves the position and wakes up the group to read on
+		cMsgs, err := rmq.Consume(topic, group, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, cMsgs)
+		currentID, _ := rmq.getCurrentID(topic, group)
+		assert.Equal(t, ids[filterReadBatch*filterMaxBatches], currentID)
+		assert.Len(t, msgMutex, 1)
+		<-msgMutex
+		cMsgs, err = rmq.Consume(topic, group, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []UniqueID{ids[skipped]}, msgIDsOf(cMsgs))
+		assert.Len(t, msgMutex, 0)
+	}
+}
+
+func TestRocksmq_DeadLetter(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+
+	topic := "test_dead_letter"
+	dlq := "test_dead_letter_dlq"
+	group := "test_group"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	defer rmq.DestroyTopic(topic)
+	defer rmq.DestroyTopic(dlq)
+	ids, err := rmq.Produce(topic, []rocksmq.ProducerMessage{
+		{Payload: []byte("poison"), Properties: map[string]string{"k": "v"}},
+		{Payload: []byte("good")},
+	})
+	assert.NoError(t, err)
+
+	assert.Error(t, rmq.CreateConsumerGroup(topic, "no_ack_group", rocksmq.WithDeadLetter(dlq, 2)))
+	assert.Error(t, rmq.CreateConsumerGroup(topic, "self_group", rocksmq.WithAckMode(0), rocksmq.WithDeadLetter(topic, 2)))
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, group, rocksmq.WithAckMode(time.Hour), rocksmq.WithDeadLetter(dlq, 2)))
+	assert.NoError(t, rmq.RegisterConsumer(&rocksmq.Consumer{Topic: topic, GroupName: group, MsgMutex: make(chan struct{}, 1)}))
+
+	cMsgs, err := rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, ids, msgIDsOf(cMsgs))
+	assert.NoError(t, rmq.Ack(topic, group, ids[1]))
+	assert.NoError(t, rmq.Nack(topic, group, ids[0]))
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{ids[0]}, msgIDsOf(cMsgs))
+
+	// the second failure moves the message to the dead letter topic
+	assert.NoError(t, rmq.Nack(topic, group, ids[0]))
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 0)
+
+	dead, err := rmq.readMessages(dlq, DefaultMessageID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, "poison", string(dead[0].Payload))
+	assert.Equal(t, "v", dead[0].Properties["k"])
+	assert.Equal(t, topic, dead[0].Properties[rocksmq.DeadLetterTopicKey])
+	assert.Equal(t, group, dead[0].Properties[rocksmq.DeadLetterGroupKey])
+	assert.Equal(t, strconv.FormatInt(ids[0], 10), dead[0].Properties[rocksmq.DeadLetterMsgIDKey])
+	assert.Equal(t, "2", dead[0].Properties[rocksmq.DeadLetterFailuresKey])
+	assert.Equal(t, "2", dead[0].Properties[rocksmq.DeadLetterDeliveryCountKey])
+
+	dlqSize, err := rmq.kv.Load(MessageSizeTitle + dlq)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "0", dlqSize)
+
+	// replay puts it back to the source topic without the dead letter properties
+	replayed, err := rmq.ReplayDeadLetter(dlq)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	cMsgs, err = rmq.Consume(topic, group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 1)
+	assert.Equal(t, "poison", string(cMsgs[0].Payload))
+	assert.Equal(t, map[string]string{"k": "v"}, cMsgs[0].Properties)
+	dead, err = rmq.readMessages(dlq, DefaultMessageID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, dead, 0)
+	dlqSize, err = rmq.kv.Load(MessageSizeTitle + dlq)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", dlqSize)
+	stats, err := rmq.GetTopicStats(dlq)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), stats.MsgCount)
+	assert.Equal(t, int64(0), stats.Bytes)
+
+	_, err = rmq.ReplayDeadLetter("no_topic")
+	assert.Error(t, err)
+}
+
+func TestRocksmq_PartitionedTopic(t *testing.T) {
+	rmq, name := newTestRocksMQ(t)
+
+	topic := "test_partitioned"
+	group := "test_group"
+	assert.Error(t, rmq.CreateTopic(topic, rocksmq.WithPartitions(-1)))
+	assert.NoError(t, rmq.CreateTopic(topic, rocksmq.WithPartitions(3)))
+	assert.NoError(t, rmq.CreateTopic(topic))
+	n, err := rmq.GetTopicPartitions(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	_, err = rmq.Produce(topic, []rocksmq.ProducerMessage{{Payload: []byte("a")}})
+	assert.Error(t, err)
+	rmq.Close()
+
+	rmq, err = NewRocksMQ(name, nil)
+	assert.NoError(t, err)
+	defer rmq.Close()
+	n, err = rmq.GetTopicPartitions(topic)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	for p := 0; p < n; p++ {
+		produceN(t, rmq, rocksmq.PartitionTopic(topic, p), p+1)
+	}
+
+	chA := make(chan struct{}, 1)
+	created, err := rmq.JoinPartitionedGroup(topic, group, "a", rocksmq.SubscriptionFailover, chA)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, created)
+	partitions, err := rmq.GetAssignedPartitions(topic, group, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, partitions)
+	_, err = rmq.JoinPartitionedGroup(topic, group, "a", rocksmq.SubscriptionFailover, chA)
+	assert.Error(t, err)
+
+	chB := make(chan struct{}, 1)
+	created, err = rmq.JoinPartitionedGroup(topic, group, "b", rocksmq.SubscriptionFailover, chB)
+	assert.NoError(t, err)
+	assert.Empty(t, created)
+	partitions, err = rmq.GetAssignedPartitions(topic, group, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 2}, partitions)
+	partitions, err = rmq.GetAssignedPartitions(topic, group, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, partitions)
+
+	// producing to a partition wakes up its owner
+	<-chB
+	produceN(t, rmq, rocksmq.PartitionTopic(topic, 1), 1)
+	_, ok := <-chB
+	assert.True(t, ok)
+
+	// partitions are consumed and sought on their own
+	cMsgs, err := rmq.Consume(rocksmq.PartitionTopic(topic, 1), group, 10)
+	assert.NoError(t, err)
+	assert.Len(t, cMsgs, 3)
+	latest, err := rmq.GetLatestMsg(rocksmq.PartitionTopic(topic, 2))
+	assert.NoError(t, err)
+	assert.NoError(t, rmq.Seek(rocksmq.PartitionTopic(topic, 2), group, latest))
+	cMsgs, err = rmq.Consume(rocksmq.PartitionTopic(topic, 2), group, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{latest}, msgIDsOf(cMsgs))
+
+	assert.Error(t, rmq.DestroyConsumerGroup(rocksmq.PartitionTopic(topic, 0), group))
+	assert.NoError(t, rmq.LeavePartitionedGroup(topic, group, "a"))
+	// skip the pending signal, then chA is closed
+	select {
+	case <-chA:
+	default:
+	}
+	_, ok = <-chA
+	assert.False(t, ok)
+	partitions, err = rmq.GetAssignedPartitions(topic, group, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, partitions)
+
+	// the last member leaving keeps the group on every partition, it is destroyed explicitly
+	assert.NoError(t, rmq.LeavePartitionedGroup(topic, group, "b"))
+	_, ok = rmq.consumersID.Load(constructCurrentID(rocksmq.PartitionTopic(topic, 0), group))
+	assert.True(t, ok)
+	assert.NoError(t, rmq.DestroyConsumerGroup(rocksmq.PartitionTopic(topic, 0), group))
+	_, ok = rmq.consumersID.Load(constructCurrentID(rocksmq.PartitionTopic(topic, 0), group))
+	assert.False(t, ok)
+
+	assert.NoError(t, rmq.DestroyTopic(topic))
+	_, err = rmq.GetTopicPartitions(topic)
+	assert.Error(t, err)
+	_, err = rmq.GetTopicPartitions(rocksmq.PartitionTopic(topic, 0))
+	assert.Error(t, err)
+}
+
+func TestInitRocksMQ(t *testing.T) {
+	name := path.Join(t.TempDir(), "global_rmq")
+	assert.NoError(t, InitRocksMQ(name))
+	defer CloseRocksMQ()
+	assert.NotNil(t, Rmq)
+	assert.False(t, Rmq.isClosed())
+
+	_, err := os.Stat(name + kvSuffix)
+	assert.NoError(t, err)
+}
+
+func TestRocksmq_SubscriptionTypes(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+
+	topic := "test_subscription"
+	assert.NoError(t, rmq.CreateTopic(topic))
+	assert.Error(t, rmq.JoinConsumerGroup(topic, "missing", "a", rocksmq.SubscriptionExclusive, make(chan struct{}, 1)))
+
+	// exclusive rejects a second member
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "exclusive"))
+	assert.NoError(t, rmq.JoinConsumerGroup(topic, "exclusive", "a", rocksmq.SubscriptionExclusive, make(chan struct{}, 1)))
+	assert.Error(t, rmq.JoinConsumerGroup(topic, "exclusive", "b", rocksmq.SubscriptionExclusive, make(chan struct{}, 1)))
+	assert.Error(t, rmq.JoinConsumerGroup(topic, "exclusive", "b", rocksmq.SubscriptionFailover, make(chan struct{}, 1)))
+	assert.Error(t, rmq.JoinConsumerGroup(topic, "exclusive", "b", rocksmq.SubscriptionType(5), make(chan struct{}, 1)))
+
+	// failover delivers to the first member until it leaves
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "failover"))
+	chA, chB := make(chan struct{}, 1), make(chan struct{}, 1)
+	assert.NoError(t, rmq.JoinConsumerGroup(topic, "failover", "a", rocksmq.SubscriptionFailover, chA))
+	assert.NoError(t, rmq.JoinConsumerGroup(topic, "failover", "b", rocksmq.SubscriptionFailover, chB))
+	ids := produceN(t, rmq, topic, 4)
+	<-chA
+	assert.Len(t, chB, 0)
+	cMsgs, err := rmq.ConsumeMember(topic, "failover", "b", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, cMsgs)
+	cMsgs, err = rmq.ConsumeMember(topic, "failover", "a", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[:2], msgIDsOf(cMsgs))
+	assert.NoError(t, rmq.LeaveConsumerGroup(topic, "failover", "a"))
+	_, ok := <-chA
+	assert.False(t, ok)
+	<-chB
+	cMsgs, err = rmq.ConsumeMember(topic, "failover", "b", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, ids[2:], msgIDsOf(cMsgs))
+	_, err = rmq.ConsumeMember(topic, "failover", "a", 10)
+	assert.Error(t, err)
+
+	// shared requires ack mode and round-robins the messages
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "plain"))
+	assert.Error(t, rmq.JoinConsumerGroup(topic, "plain", "a", rocksmq.SubscriptionShared, make(chan struct{}, 1)))
+	assert.NoError(t, rmq.CreateConsumerGroup(topic, "shared", rocksmq.WithAckMode(time.Minute)))
+	chA, chB, chC := make(chan struct{}, 1), make(chan struct{}, 1), make(chan struct{}, 1)
+	assert.NoError(t, rmq.JoinConsumerGroup(topic, "shared", "a", rocksmq.SubscriptionShared, chA))
+	assert.NoError(t, rmq.JoinConsumerGroup(topic, "shared", "b", rocksmq.SubscriptionShared, chB))
+	assert.NoError(t, rmq.JoinConsumerGroup(topic, "shared", "c", rocksmq.SubscriptionShared, chC))
+	cMsgs, err = rmq.ConsumeMember(topic, "shared", "a", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{ids[0], ids[3]}, msgIDsOf(cMsgs))
+	<-chB
+	cMsgs, err = rmq.ConsumeMember(topic, "shared", "b", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{ids[1]}, msgIDsOf(cMsgs))
+	assert.NoError(t, rmq.Ack(topic, "shared", ids[0], ids[1], ids[3]))
+
+	// the message dispatched to a member that leaves goes to the others
+	<-chC
+	assert.NoError(t, rmq.LeaveConsumerGroup(topic, "shared", "c"))
+	cMsgs, err = rmq.ConsumeMember(topic, "shared", "b", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{ids[2]}, msgIDsOf(cMsgs))
+	assert.Equal(t, 1, cMsgs[0].RedeliveryCount)
+
+	// the group and its ack state are kept after the last member leaves
+	assert.NoError(t, rmq.Nack(topic, "shared", ids[2]))
+	assert.NoError(t, rmq.LeaveConsumerGroup(topic, "shared", "a"))
+	assert.NoError(t, rmq.LeaveConsumerGroup(topic, "shared", "b"))
+	exist, _, err := rmq.ExistConsumerGroup(topic, "shared")
+	assert.NoError(t, err)
+	assert.True(t, exist)
+	chD := make(chan struct{}, 1)
+	assert.NoError(t, rmq.JoinConsumerGroup(topic, "shared", "d", rocksmq.SubscriptionShared, chD))
+	cMsgs, err = rmq.ConsumeMember(topic, "shared", "d", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []UniqueID{ids[2]}, msgIDsOf(cMsgs))
+	assert.NoError(t, rmq.LeaveConsumerGroup(topic, "shared", "d"))
+	assert.NoError(t, rmq.DestroyConsumerGroup(topic, "shared"))
+	exist, _, err = rmq.ExistConsumerGroup(topic, "shared")
+	assert.NoError(t, err)
+	assert.False(t, exist)
+	// skip the pending signal, then chB is closed
+	select {
+	case <-chB:
+	default:
+	}
+	_, ok = <-chB
+	assert.False(t, ok)
+}
+
+func TestRocksmq_Reader(t *testing.T) {
+	rmq, _ := newTestRocksMQ(t)
+	defer rmq.Close()
+
+	topic := "test_reader"
+	_, err := rmq.CreateReader(topic, rocksmq.EarliestMessageID, true)
+	assert.Error(t, err)
+	assert.NoError(t, rmq.CreateTopic(topic))
+	ids := produceN(t, rmq, topic, 3)
+
+	earliest, err := rmq.CreateReader(topic, rocksmq.EarliestMessageID, true)
+	assert.NoError(t, err)
+	latest, err := rmq.CreateReader(topic, rocksmq.LatestMessageID, true)
+	assert.NoError(t, err)
+	exclusive, err := rmq.CreateReader(topic, ids[0], false)
+	assert.NoError(t, err)
+	next := func(reader string) UniqueID {
+		msg, err := rmq.Next(context.Background(), topic, reader)
+		assert.NoError(t, err)
+		return msg.MsgID
+	}
+	assert.Equal(t, ids[0], next(earliest))
+	assert.Equal(t, ids[2], next(latest))
+	assert.Equal(t, ids[1], next(exclusive))
+	assert.False(t, rmq.HasNext(topic, latest))
+
+	// readers create no consumer group and are not counted by retention
+	exist, _, err := rmq.ExistConsumerGroup(topic, earliest)
+	assert.NoError(t, err)
+	assert.False(t, exist)
+
+	// Next blocks until a message is produced
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = rmq.Next(ctx, topic, latest)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	go produceN(t, rmq, topic, 1)
+	assert.Greater(t, next(latest), ids[2])
+
+	assert.NoError(t, rmq.ReaderSeek(topic, earliest, ids[2]))
+	assert.Equal(t, ids[2], next(earliest))
+	assert.True(t, rmq.HasNext(topic, earliest))
+
+	// NextBatch reads up to n messages and returns none at the end without blocking
+	batch, err := rmq.CreateReader(topic, rocksmq.EarliestMessageID, true)
+	assert.NoError(t, err)
+	msgs, err := rmq.NextBatch(topic, batch, 2)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, ids[0], msgs[0].MsgID)
+	assert.Equal(t, ids[1], msgs[1].MsgID)
+	msgs, err = rmq.NextBatch(topic, batch, 10)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, ids[2], msgs[0].MsgID)
+	msgs, err = rmq.NextBatch(topic, batch, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+	_, err = rmq.NextBatch(topic, batch, 0)
+	assert.Error(t, err)
+	rmq.CloseReader(topic, batch)
+	_, err = rmq.NextBatch(topic, batch, 10)
+	assert.Error(t, err)
+
+	// a closed reader wakes up its blocked Next
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := rmq.Next(context.Background(), topic, latest)
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	rmq.CloseReader(topic, latest)
+	assert.Error(t, <-errCh)
+	assert.Error(t, rmq.ReaderSeek(topic, latest, ids[0]))
+	assert.False(t, rmq.HasNext(topic, latest))
+
+	assert.NoError(t, rmq.DestroyTopic(topic))
+	_, err = rmq.Next(context.Background(), topic, earliest)
+	assert.Error(t, err)
+}
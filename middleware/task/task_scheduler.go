@@ -7,10 +7,15 @@ import (
 	"github.com/linkbase/middleware/log"
 	"go.uber.org/zap"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.opentelemetry.io/otel"
 )
 
+// errQueueDraining is returned when a task is enqueued after the scheduler starts draining
+var errQueueDraining = errors.New("task queue is draining")
+
 type taskQueue interface {
 	utChan() <-chan int
 	utEmpty() bool
@@ -37,6 +42,7 @@ type baseTaskQueue struct {
 	maxTaskNumMtx   sync.RWMutex
 	utBufChan       chan int // to block scheduler
 	tsoAllocatorIns tsoAllocator
+	draining        atomic.Bool
 }
 
 func (queue *baseTaskQueue) utChan() <-chan int {
@@ -130,6 +136,9 @@ func (queue *baseTaskQueue) getTaskByReqID(reqID UniqueID) task {
 }
 
 func (queue *baseTaskQueue) Enqueue(t task) error {
+	if queue.draining.Load() {
+		return errQueueDraining
+	}
 	err := t.OnEnqueue()
 	if err != nil {
 		return err
@@ -157,8 +166,11 @@ func (queue *baseTaskQueue) getMaxTaskNum() int64 {
 	return queue.maxTaskNum
 }
 
+// defaultMaxTaskNum is the capacity of the unissued tasks of each queue
+const defaultMaxTaskNum int64 = 1024
+
 func newBaseTaskQueue(allocator tsoAllocator) *baseTaskQueue {
-	var maxTaskNum int64 //todo
+	maxTaskNum := defaultMaxTaskNum
 	return &baseTaskQueue{
 		unissuedTasks:   list.New(),
 		activeTasks:     make(map[UniqueID]task),
@@ -323,6 +335,7 @@ type taskScheduler struct {
 	dqQueue *dqTaskQueue //dql task queue
 
 	wg     sync.WaitGroup
+	taskWg sync.WaitGroup // tasks popped from the queues but not finished
 	ctx    context.Context
 	cancel context.CancelFunc
 
@@ -332,20 +345,19 @@ type taskScheduler struct {
 
 type schedOpt func(scheduler *taskScheduler)
 
-func newTaskSche(ctx context.Context, tsoAllocatorIns tsoAllocator, opts ...schedOpt) (*taskScheduler, error) {
-	ctx1, cancel := context.WithCancel(ctx)
-	s := &taskScheduler{
-		ctx:    ctx1,
-		cancel: cancel,
-	}
-	s.ddQueue = newDdTaskQueue(tsoAllocatorIns)
-	s.dmQueue = newDmTaskQueue(tsoAllocatorIns)
-	s.dqQueue = newDqTaskQueue(tsoAllocatorIns)
+// Scheduler schedules the ddl, dml and dql tasks of a node
+type Scheduler interface {
+	Start() error
+	// Drain stops accepting new tasks and waits until the queued and running tasks are done
+	Drain(ctx context.Context) error
+	Close()
+}
 
-	for _, opt := range opts {
-		opt(s)
-	}
-	return nil, nil
+var _ Scheduler = (*taskScheduler)(nil)
+
+// NewScheduler creates a task scheduler, the tasks are stamped by tsoAllocatorIns
+func NewScheduler(ctx context.Context, tsoAllocatorIns tsoAllocator) (Scheduler, error) {
+	return newTaskScheduler(ctx, tsoAllocatorIns)
 }
 
 func newTaskScheduler(ctx context.Context,
@@ -393,6 +405,7 @@ func (sched *taskScheduler) getTaskByReqID(reqID UniqueID) task {
 }
 
 func (sched *taskScheduler) processTask(t task, q taskQueue) {
+	defer sched.taskWg.Done()
 	ctx, span := otel.Tracer("taskQueue").Start(t.TraceCtx(), t.Name())
 	defer span.End()
 
@@ -445,6 +458,7 @@ func (sched *taskScheduler) definitionLoop() {
 			return
 		case <-sched.ddQueue.utChan():
 			if !sched.ddQueue.utEmpty() {
+				sched.taskWg.Add(1)
 				t := sched.scheduleDdTask()
 				sched.processTask(t, sched.ddQueue)
 			}
@@ -460,6 +474,7 @@ func (sched *taskScheduler) manipulationLoop() {
 			return
 		case <-sched.dmQueue.utChan():
 			if !sched.dmQueue.utEmpty() {
+				sched.taskWg.Add(1)
 				t := sched.scheduleDmTask()
 				go sched.processTask(t, sched.dmQueue)
 			}
@@ -476,6 +491,7 @@ func (sched *taskScheduler) queryLoop() {
 			return
 		case <-sched.dqQueue.utChan():
 			if !sched.dqQueue.utEmpty() {
+				sched.taskWg.Add(1)
 				t := sched.scheduleDqTask()
 				go sched.processTask(t, sched.dqQueue)
 			} else {
@@ -498,6 +514,41 @@ func (sched *taskScheduler) Start() error {
 	return nil
 }
 
+// drainCheckInterval is the interval of checking whether the queues are drained
+const drainCheckInterval = 10 * time.Millisecond
+
+func (sched *taskScheduler) Drain(ctx context.Context) error {
+	queues := []*baseTaskQueue{sched.ddQueue.baseTaskQueue, sched.dmQueue.baseTaskQueue, sched.dqQueue.baseTaskQueue}
+	for _, q := range queues {
+		q.draining.Store(true)
+	}
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for _, q := range queues {
+		for !q.utEmpty() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+	}
+
+	// the unissued tasks are all popped, wait for the running ones
+	done := make(chan struct{})
+	go func() {
+		sched.taskWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
 func (sched *taskScheduler) Close() {
 	sched.cancel()
 	sched.wg.Wait()
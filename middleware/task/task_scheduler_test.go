@@ -2,8 +2,11 @@ package task
 
 import (
 	"context"
+	memkv "github.com/linkbase/middleware/kv/mem"
+	"github.com/linkbase/middleware/tso"
 	"github.com/stretchr/testify/assert"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -21,6 +24,8 @@ func (tso *mockTsoAllocator) AllocOne(ctx context.Context) (Timestamp, error) {
 	return (physical << 18) + uint64(tso.logicPart), nil
 }
 
+var _ tsoAllocator = (*tso.GlobalTSOAllocator)(nil)
+
 func newMockTsoAllocator() tsoAllocator {
 	return &mockTsoAllocator{}
 }
@@ -38,3 +43,87 @@ func TestBaseTaskQueue_AddActiveTask(t *testing.T) {
 	assert.NoError(t, err)
 	defer sched.Close()
 }
+
+func TestTaskScheduler_GlobalTSOAllocator(t *testing.T) {
+	ctx := context.Background()
+	tsoAllocator := tso.NewGlobalTSOAllocator("tso", memkv.NewMemoryKV())
+	assert.NoError(t, tsoAllocator.Initialize())
+
+	sched, err := newTaskScheduler(ctx, tsoAllocator)
+	assert.NoError(t, err)
+	assert.NoError(t, sched.Start())
+	defer sched.Close()
+
+	beginTs, err := sched.dmQueue.tsoAllocatorIns.AllocOne(ctx)
+	assert.NoError(t, err)
+	endTs, err := sched.dmQueue.tsoAllocatorIns.AllocOne(ctx)
+	assert.NoError(t, err)
+	assert.Greater(t, endTs, beginTs)
+}
+
+func TestNewScheduler(t *testing.T) {
+	sched, err := NewScheduler(context.Background(), newMockTsoAllocator())
+	assert.NoError(t, err)
+	assert.NoError(t, sched.Start())
+	sched.Close()
+
+	queue := newBaseTaskQueue(newMockTsoAllocator())
+	assert.Equal(t, defaultMaxTaskNum, queue.getMaxTaskNum())
+	assert.False(t, queue.utFull())
+}
+
+type mockTask struct {
+	id       UniqueID
+	ts       Timestamp
+	sleep    time.Duration
+	executed atomic.Bool
+}
+
+func (m *mockTask) TraceCtx() context.Context { return context.Background() }
+func (m *mockTask) ID() UniqueID              { return m.id }
+func (m *mockTask) SetID(id UniqueID)         { m.id = id }
+func (m *mockTask) Name() string              { return "mockTask" }
+func (m *mockTask) Type() MsgType             { return MsgType_Undefined }
+func (m *mockTask) BeginTs() Timestamp        { return m.ts }
+func (m *mockTask) EndTs() Timestamp          { return m.ts }
+func (m *mockTask) SetTs(ts Timestamp)        { m.ts = ts }
+func (m *mockTask) OnEnqueue() error          { return nil }
+func (m *mockTask) PreExecute(ctx context.Context) error {
+	return nil
+}
+func (m *mockTask) Execute(ctx context.Context) error {
+	time.Sleep(m.sleep)
+	m.executed.Store(true)
+	return nil
+}
+func (m *mockTask) PostExecute(ctx context.Context) error { return nil }
+func (m *mockTask) WaitToFinish() error                   { return nil }
+func (m *mockTask) Notify(err error)                      {}
+
+func TestTaskScheduler_Drain(t *testing.T) {
+	sched, err := newTaskScheduler(context.Background(), newMockTsoAllocator())
+	assert.NoError(t, err)
+	assert.NoError(t, sched.Start())
+	defer sched.Close()
+
+	tasks := []*mockTask{{sleep: 100 * time.Millisecond}, {sleep: 50 * time.Millisecond}}
+	for _, mt := range tasks {
+		assert.NoError(t, sched.dqQueue.Enqueue(mt))
+	}
+
+	assert.NoError(t, sched.Drain(context.Background()))
+	for _, mt := range tasks {
+		assert.True(t, mt.executed.Load())
+	}
+	assert.Error(t, sched.dqQueue.Enqueue(&mockTask{}))
+
+	// drain stops waiting when the context is done
+	sched2, err := newTaskScheduler(context.Background(), newMockTsoAllocator())
+	assert.NoError(t, err)
+	assert.NoError(t, sched2.Start())
+	defer sched2.Close()
+	assert.NoError(t, sched2.dqQueue.Enqueue(&mockTask{sleep: time.Second}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, sched2.Drain(ctx), context.DeadlineExceeded)
+}
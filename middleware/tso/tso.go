@@ -0,0 +1,150 @@
+package tso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/linkbase/middleware/kv"
+	"github.com/linkbase/middleware/log"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Timestamp = uint64
+
+const (
+	// LogicalBits is the number of bits of the logical counter in a timestamp
+	LogicalBits = 18
+	// MaxLogical is the number of timestamps which can be allocated in one physical millisecond
+	MaxLogical = 1 << LogicalBits
+
+	// saveWindow is how far the persisted physical upper bound runs ahead of the allocations,
+	// the kv is only written once per window
+	saveWindow = 3 * time.Second
+)
+
+// ComposeTS returns a timestamp composed of physical milliseconds and a logical counter
+func ComposeTS(physical, logical int64) Timestamp {
+	return Timestamp((physical << LogicalBits) + logical)
+}
+
+// ParseTS returns the physical time and the logical counter of a timestamp
+func ParseTS(ts Timestamp) (time.Time, int64) {
+	logical := int64(ts & (MaxLogical - 1))
+	physical := int64(ts >> LogicalBits)
+	return time.UnixMilli(physical), logical
+}
+
+// GlobalTSOAllocator is a hybrid logical clock timestamp oracle. A timestamp is the
+// physical milliseconds shifted by LogicalBits plus a logical counter, the counter
+// breaks ties inside one millisecond and the physical part never goes backwards even
+// if the wall clock does.
+// Before handing out a timestamp, an upper bound of its physical part is persisted in
+// kv, so after a restart the allocator resumes above everything allocated before.
+type GlobalTSOAllocator struct {
+	mu  sync.Mutex
+	key string
+	kv  kv.BaseKV
+
+	// physical is in milliseconds
+	physical int64
+	logical  int64
+	// lastSaved is the persisted physical upper bound in milliseconds
+	lastSaved int64
+}
+
+// NewGlobalTSOAllocator creates a GlobalTSOAllocator which saves its upper bound under key
+func NewGlobalTSOAllocator(key string, base kv.BaseKV) *GlobalTSOAllocator {
+	return &GlobalTSOAllocator{
+		key: key,
+		kv:  base,
+	}
+}
+
+// Initialize loads the persisted upper bound and starts the clock above it
+func (gta *GlobalTSOAllocator) Initialize() error {
+	gta.mu.Lock()
+	defer gta.mu.Unlock()
+	last, err := gta.loadUpperBound()
+	if err != nil {
+		return err
+	}
+	physical := time.Now().UnixMilli()
+	if physical < last {
+		log.Warn("wall clock is behind the persisted tso upper bound, start from the upper bound",
+			zap.Int64("now", physical), zap.Int64("upperBound", last))
+		physical = last
+	}
+	if err := gta.saveUpperBound(physical + saveWindow.Milliseconds()); err != nil {
+		return err
+	}
+	gta.physical = physical
+	gta.logical = 0
+	log.Info("GlobalTSOAllocator initialized", zap.String("key", gta.key),
+		zap.Int64("physical", physical), zap.Int64("upperBound", gta.lastSaved))
+	return nil
+}
+
+// Alloc allocates count continuous timestamps and returns the last one,
+// the batch is [ts-count+1, ts]
+func (gta *GlobalTSOAllocator) Alloc(count uint32) (Timestamp, error) {
+	if count == 0 {
+		return 0, errors.New("tso count should be positive")
+	}
+	if count >= MaxLogical {
+		return 0, fmt.Errorf("tso count %d exceeds the logical limit %d", count, MaxLogical)
+	}
+	gta.mu.Lock()
+	defer gta.mu.Unlock()
+	if gta.physical == 0 {
+		return 0, errors.New("GlobalTSOAllocator is not initialized")
+	}
+
+	physical, logical := gta.physical, gta.logical
+	if now := time.Now().UnixMilli(); now > physical {
+		physical, logical = now, 0
+	}
+	if logical+int64(count) >= MaxLogical {
+		// logical counter is exhausted, borrow the next millisecond
+		physical, logical = physical+1, 0
+	}
+	if physical >= gta.lastSaved {
+		if err := gta.saveUpperBound(physical + saveWindow.Milliseconds()); err != nil {
+			return 0, err
+		}
+	}
+	logical += int64(count)
+	gta.physical, gta.logical = physical, logical
+	return ComposeTS(physical, logical), nil
+}
+
+// AllocOne allocates one timestamp
+func (gta *GlobalTSOAllocator) AllocOne(ctx context.Context) (Timestamp, error) {
+	return gta.Alloc(1)
+}
+
+func (gta *GlobalTSOAllocator) loadUpperBound() (int64, error) {
+	exist, err := gta.kv.Has(gta.key)
+	if err != nil || !exist {
+		return 0, err
+	}
+	val, err := gta.kv.Load(gta.key)
+	if err != nil {
+		return 0, err
+	}
+	last, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tso upper bound %s=%s: %w", gta.key, val, err)
+	}
+	return last, nil
+}
+
+func (gta *GlobalTSOAllocator) saveUpperBound(upperBound int64) error {
+	if err := gta.kv.Save(gta.key, strconv.FormatInt(upperBound, 10)); err != nil {
+		return err
+	}
+	gta.lastSaved = upperBound
+	return nil
+}
@@ -1,8 +1,10 @@
 package etcd
 
 import (
+	"errors"
 	"github.com/linkbase/middleware/log"
 	"sync"
+	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/server/v3/embed"
@@ -10,6 +12,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// startTimeout is the max time of waiting the embedded etcd server to be ready
+const startTimeout = 60 * time.Second
+
 // EtcdServer is the singleton of embedded etcd server
 var (
 	initOnce   sync.Once
@@ -39,7 +44,9 @@ func InitEtcdServer(
 			if len(path) > 0 {
 				cfgFromFile, err := embed.ConfigFromFile(path)
 				if err != nil {
+					log.Error("failed to read embedded Etcd config", zap.String("path", path), zap.Error(err))
 					initError = err
+					return
 				}
 				cfg = cfgFromFile
 			} else {
@@ -52,6 +59,15 @@ func InitEtcdServer(
 			if err != nil {
 				log.Error("failed to init embedded Etcd server", zap.Error(err))
 				initError = err
+				return
+			}
+			select {
+			case <-e.Server.ReadyNotify():
+			case <-time.After(startTimeout):
+				e.Close()
+				initError = errors.New("embedded Etcd server took too long to start")
+				log.Error("failed to init embedded Etcd server", zap.Error(initError))
+				return
 			}
 			etcdServer = e
 			log.Info("finish init Etcd config", zap.String("path", path), zap.String("data", dataDir))
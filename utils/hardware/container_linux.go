@@ -0,0 +1,112 @@
+package hardware
+
+import (
+	"bufio"
+	"github.com/cockroachdb/errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	cgroupV2Root = "/sys/fs/cgroup"
+	cgroupV1Mem  = "/sys/fs/cgroup/memory"
+)
+
+// containerMarkers are the keywords of the cgroup paths of the common container runtimes
+var containerMarkers = []string{"docker", "kubepods", "containerd", "lxc", "libpod"}
+
+// inContainer checks if the service is running inside a container
+func inContainer() (bool, error) {
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return true, nil
+	}
+	b, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	content := string(b)
+	for _, marker := range containerMarkers {
+		if strings.Contains(content, marker) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isCgroupV2 checks if the unified cgroup hierarchy is mounted
+func isCgroupV2() bool {
+	_, err := os.Stat(cgroupV2Root + "/cgroup.controllers")
+	return err == nil
+}
+
+// getContainerMemLimit returns memory limit and error
+func getContainerMemLimit() (uint64, error) {
+	if isCgroupV2() {
+		v, err := readCgroupValue(cgroupV2Root + "/memory.max")
+		if err != nil {
+			return 0, err
+		}
+		if v == "max" {
+			return 0, errors.New("container memory is unlimited")
+		}
+		return strconv.ParseUint(v, 10, 64)
+	}
+	v, err := readCgroupValue(cgroupV1Mem + "/memory.limit_in_bytes")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// getContainerMemUsed returns memory usage and error, the inactive page cache is not counted
+func getContainerMemUsed() (uint64, error) {
+	usageFile, statFile, inactiveKey := cgroupV1Mem+"/memory.usage_in_bytes", cgroupV1Mem+"/memory.stat", "total_inactive_file"
+	if isCgroupV2() {
+		usageFile, statFile, inactiveKey = cgroupV2Root+"/memory.current", cgroupV2Root+"/memory.stat", "inactive_file"
+	}
+	v, err := readCgroupValue(usageFile)
+	if err != nil {
+		return 0, err
+	}
+	usage, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	inactive, err := readCgroupStat(statFile, inactiveKey)
+	if err != nil || inactive > usage {
+		return usage, nil
+	}
+	return usage - inactive, nil
+}
+
+func readCgroupValue(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readCgroupStat reads a "key value" line of a cgroup stat file
+func readCgroupStat(path string, key string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.Newf("%s not found in %s", key, path)
+}
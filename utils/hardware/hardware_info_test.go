@@ -0,0 +1,15 @@
+package hardware
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGetMemoryCount(t *testing.T) {
+	total := GetMemoryCount()
+	assert.Greater(t, total, uint64(0))
+	used := GetUsedMemoryCount()
+	assert.Greater(t, used, uint64(0))
+	assert.LessOrEqual(t, used, total)
+	assert.Greater(t, GetCPUNum(), 0)
+}
@@ -3,16 +3,185 @@ package paramtable
 import "sync"
 
 type ComponentParam struct {
-	once       sync.Once
+	once      sync.Once
+	baseTable *BaseTable
+
+	CommonCfg  CommonConfig
+	LogCfg     LogConfig
+	EtcdCfg    EtcdConfig
 	RocksmqCfg RocksmqConfig
+	ProxyCfg   ProxyConfig
+	QueryCfg   QueryConfig
+	SuperCfg   SupervisorConfig
+	RegCfg     RegistryConfig
 }
 
-func (p *ComponentParam) Init() {
+func (p *ComponentParam) Init(configFiles ...string) {
 	p.once.Do(func() {
-		p.init()
+		p.init(configFiles...)
 	})
 }
 
-func (p *ComponentParam) init() {
+func (p *ComponentParam) init(configFiles ...string) {
+	p.baseTable = NewBaseTable(configFiles...)
+	p.CommonCfg.Init(p.baseTable)
+	p.LogCfg.Init(p.baseTable)
+	p.EtcdCfg.Init(p.baseTable)
+	p.RocksmqCfg.Init(p.baseTable)
+	p.ProxyCfg.Init(p.baseTable)
+	p.QueryCfg.Init(p.baseTable)
+	p.SuperCfg.Init(p.baseTable)
+	p.RegCfg.Init(p.baseTable)
+}
+
+// Save overrides a config at runtime, mostly used by unittests
+func (p *ComponentParam) Save(key, value string) {
+	p.baseTable.Save(key, value)
+}
+
+// Reset removes the runtime override set by Save
+func (p *ComponentParam) Reset(key string) {
+	p.baseTable.Reset(key)
+}
+
+// --- common ---
+type CommonConfig struct {
+	// DataDir is the root directory of the local data of a node
+	DataDir ParamItem `refreshable:"false"`
+	// GracefulStopTimeout is the max time of draining the tasks when a node stops, in seconds
+	GracefulStopTimeout ParamItem `refreshable:"true"`
+}
+
+func (c *CommonConfig) Init(base *BaseTable) {
+	c.DataDir = ParamItem{
+		Key:          "common.dataDir",
+		Version:      "0.1.0",
+		DefaultValue: "/var/lib/linkbase",
+		Doc:          "the root directory of the local data, e.g. rocksmq, embedded etcd and tso",
+		Export:       true,
+	}
+	c.DataDir.Init(base.mgr)
+
+	c.GracefulStopTimeout = ParamItem{
+		Key:          "common.gracefulStopTimeout",
+		Version:      "0.1.0",
+		DefaultValue: "30",
+		Doc:          "seconds, the max time of draining the queued tasks when a node stops",
+		Export:       true,
+	}
+	c.GracefulStopTimeout.Init(base.mgr)
+}
+
+// --- proxy ---
+type ProxyConfig struct {
+	GRPCAddress ParamItem `refreshable:"false"`
+	HTTPAddress ParamItem `refreshable:"false"`
+}
+
+func (p *ProxyConfig) Init(base *BaseTable) {
+	p.GRPCAddress = ParamItem{
+		Key:          "proxy.grpc.address",
+		Version:      "0.1.0",
+		DefaultValue: "0.0.0.0:19530",
+		Doc:          "the address the grpc server of proxy listens on",
+		Export:       true,
+	}
+	p.GRPCAddress.Init(base.mgr)
+
+	p.HTTPAddress = ParamItem{
+		Key:          "proxy.http.address",
+		Version:      "0.1.0",
+		DefaultValue: "0.0.0.0:8080",
+		Doc:          "the address the http gateway of proxy listens on",
+		Export:       true,
+	}
+	p.HTTPAddress.Init(base.mgr)
+}
+
+// --- query ---
+type QueryConfig struct {
+	GRPCAddress ParamItem `refreshable:"false"`
+}
+
+func (q *QueryConfig) Init(base *BaseTable) {
+	q.GRPCAddress = ParamItem{
+		Key:          "query.grpc.address",
+		Version:      "0.1.0",
+		DefaultValue: "0.0.0.0:19531",
+		Doc:          "the address the grpc server of query node listens on",
+		Export:       true,
+	}
+	q.GRPCAddress.Init(base.mgr)
+}
+
+// --- supervisor ---
+type SupervisorConfig struct {
+	// Slaves is the topology of the slave nodes master launches on the same machine
+	Slaves         ParamItem `refreshable:"false"`
+	InitialBackoff ParamItem `refreshable:"false"`
+	MaxBackoff     ParamItem `refreshable:"false"`
+	ResetBackoff   ParamItem `refreshable:"false"`
+}
+
+func (s *SupervisorConfig) Init(base *BaseTable) {
+	s.Slaves = ParamItem{
+		Key:     "supervisor.slaves",
+		Version: "0.1.0",
+		Doc:     "comma separated server types master launches and watches, e.g. proxy,query, empty means none",
+		Export:  true,
+	}
+	s.Slaves.Init(base.mgr)
+
+	s.InitialBackoff = ParamItem{
+		Key:          "supervisor.backoff.initial",
+		Version:      "0.1.0",
+		DefaultValue: "1",
+		Doc:          "seconds, the delay before restarting a crashed slave, doubled on every crash",
+		Export:       true,
+	}
+	s.InitialBackoff.Init(base.mgr)
+
+	s.MaxBackoff = ParamItem{
+		Key:          "supervisor.backoff.max",
+		Version:      "0.1.0",
+		DefaultValue: "60",
+		Doc:          "seconds, the max delay before restarting a crashed slave",
+		Export:       true,
+	}
+	s.MaxBackoff.Init(base.mgr)
+
+	s.ResetBackoff = ParamItem{
+		Key:          "supervisor.backoff.reset",
+		Version:      "0.1.0",
+		DefaultValue: "60",
+		Doc:          "seconds, the backoff is reset once a slave keeps running this long",
+		Export:       true,
+	}
+	s.ResetBackoff.Init(base.mgr)
+}
+
+// --- registry ---
+type RegistryConfig struct {
+	TTL           ParamItem `refreshable:"false"`
+	StatsInterval ParamItem `refreshable:"false"`
+}
+
+func (r *RegistryConfig) Init(base *BaseTable) {
+	r.TTL = ParamItem{
+		Key:          "registry.ttl",
+		Version:      "0.1.0",
+		DefaultValue: "10",
+		Doc:          "seconds, a node leaves once it stops keeping its session lease alive this long",
+		Export:       true,
+	}
+	r.TTL.Init(base.mgr)
 
+	r.StatsInterval = ParamItem{
+		Key:          "registry.statsInterval",
+		Version:      "0.1.0",
+		DefaultValue: "30",
+		Doc:          "seconds, the interval of refreshing the hardware stats of a registered node",
+		Export:       true,
+	}
+	r.StatsInterval.Init(base.mgr)
 }
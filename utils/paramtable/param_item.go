@@ -91,6 +91,10 @@ func (pi *ParamItem) GetAsInt() int {
 	return getAsInt(pi.GetValue())
 }
 
+func (pi *ParamItem) GetAsInts() []int {
+	return getAsInts(pi.GetValue())
+}
+
 func (pi *ParamItem) GetAsInt32() int32 {
 	return int32(getAsInt64(pi.GetValue()))
 }
@@ -173,6 +177,21 @@ func getAsInt(v string) int {
 	return getAndConvert(v, strconv.Atoi, 0)
 }
 
+func getAsInts(v string) []int {
+	return getAndConvert(v, func(value string) ([]int, error) {
+		strs := strings.Split(value, ",")
+		ret := make([]int, 0, len(strs))
+		for _, str := range strs {
+			i, err := strconv.Atoi(strings.TrimSpace(str))
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, i)
+		}
+		return ret, nil
+	}, []int{})
+}
+
 func getAsInt64(v string) int64 {
 	return getAndConvert(v, func(value string) (int64, error) {
 		return strconv.ParseInt(value, 10, 64)
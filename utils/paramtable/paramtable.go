@@ -1 +1,69 @@
 package paramtable
+
+import (
+	"github.com/linkbase/utils/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvPrefix is the optional prefix of environment variables that override configs,
+// e.g. LINKBASE_ROCKSMQ_PATH overrides rocksmq.path
+const EnvPrefix = "linkbase"
+
+// configRefreshInterval is the interval of reloading the yaml config files
+const configRefreshInterval = 5 * time.Second
+
+// BaseTable holds the config manager all param items read from
+type BaseTable struct {
+	once        sync.Once
+	mgr         *config.Manager
+	configFiles []string
+}
+
+// NewBaseTable creates a BaseTable backed by environment variables and the given yaml files,
+// environment variables have higher priority than files
+func NewBaseTable(configFiles ...string) *BaseTable {
+	bt := &BaseTable{configFiles: configFiles}
+	bt.init()
+	return bt
+}
+
+func (bt *BaseTable) init() {
+	bt.once.Do(func() {
+		opts := []config.Option{config.WithEnvSource(formatEnvKey)}
+		if len(bt.configFiles) > 0 {
+			opts = append(opts, config.WithFilesSource(&config.FileInfo{
+				Files:           bt.configFiles,
+				RefreshInterval: configRefreshInterval,
+			}))
+		}
+		mgr, err := config.Init(opts...)
+		if err != nil {
+			panic(err)
+		}
+		bt.mgr = mgr
+	})
+}
+
+// Manager returns the underlying config manager
+func (bt *BaseTable) Manager() *config.Manager {
+	return bt.mgr
+}
+
+// Save overrides the value of key at runtime, it has the highest priority
+func (bt *BaseTable) Save(key, value string) {
+	bt.mgr.SetConfig(key, value)
+}
+
+// Reset removes the runtime override of key
+func (bt *BaseTable) Reset(key string) {
+	bt.mgr.ResetConfig(key)
+}
+
+func formatEnvKey(key string) string {
+	ret := strings.ToLower(key)
+	ret = strings.TrimPrefix(ret, EnvPrefix)
+	ret = strings.ReplaceAll(ret, "_", "")
+	return ret
+}
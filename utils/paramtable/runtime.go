@@ -2,8 +2,10 @@ package paramtable
 
 var params ComponentParam
 
-func Init() {
-	params.Init()
+// Init initializes the global params, configFiles are the optional yaml files to read,
+// only the first call takes effect
+func Init(configFiles ...string) {
+	params.Init(configFiles...)
 }
 
 func Get() *ComponentParam {
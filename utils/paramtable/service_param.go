@@ -1,10 +1,151 @@
 package paramtable
 
+import "strconv"
+
+// --- log ---
+type LogConfig struct {
+	Level      ParamItem `refreshable:"false"`
+	Format     ParamItem `refreshable:"false"`
+	Stdout     ParamItem `refreshable:"false"`
+	RootPath   ParamItem `refreshable:"false"`
+	MaxSize    ParamItem `refreshable:"false"`
+	MaxAge     ParamItem `refreshable:"false"`
+	MaxBackups ParamItem `refreshable:"false"`
+}
+
+func (l *LogConfig) Init(base *BaseTable) {
+	l.Level = ParamItem{
+		Key:          "log.level",
+		Version:      "0.1.0",
+		DefaultValue: "info",
+		Doc:          "only supports debug, info, warn, error, panic, or fatal",
+		Export:       true,
+	}
+	l.Level.Init(base.mgr)
+
+	l.Format = ParamItem{
+		Key:          "log.format",
+		Version:      "0.1.0",
+		DefaultValue: "text",
+		Doc:          "text or json",
+		Export:       true,
+	}
+	l.Format.Init(base.mgr)
+
+	l.Stdout = ParamItem{
+		Key:          "log.stdout",
+		Version:      "0.1.0",
+		DefaultValue: "true",
+		Doc:          "whether to print logs to stdout",
+		Export:       true,
+	}
+	l.Stdout.Init(base.mgr)
+
+	l.RootPath = ParamItem{
+		Key:     "log.file.rootPath",
+		Version: "0.1.0",
+		Doc:     "root dir path to put logs, default \"\" means no log file will print",
+		Export:  true,
+	}
+	l.RootPath.Init(base.mgr)
+
+	l.MaxSize = ParamItem{
+		Key:          "log.file.maxSize",
+		Version:      "0.1.0",
+		DefaultValue: "300",
+		Doc:          "MB",
+		Export:       true,
+	}
+	l.MaxSize.Init(base.mgr)
+
+	l.MaxAge = ParamItem{
+		Key:          "log.file.maxAge",
+		Version:      "0.1.0",
+		DefaultValue: "10",
+		Doc:          "Maximum time for log retention in day.",
+		Export:       true,
+	}
+	l.MaxAge.Init(base.mgr)
+
+	l.MaxBackups = ParamItem{
+		Key:          "log.file.maxBackups",
+		Version:      "0.1.0",
+		DefaultValue: "20",
+		Export:       true,
+	}
+	l.MaxBackups.Init(base.mgr)
+}
+
+// --- etcd ---
+type EtcdConfig struct {
+	UseEmbedEtcd ParamItem `refreshable:"false"`
+	Endpoints    ParamItem `refreshable:"false"`
+	ConfigPath   ParamItem `refreshable:"false"`
+	DataDir      ParamItem `refreshable:"false"`
+	LogPath      ParamItem `refreshable:"false"`
+	LogLevel     ParamItem `refreshable:"false"`
+}
+
+func (e *EtcdConfig) Init(base *BaseTable) {
+	e.UseEmbedEtcd = ParamItem{
+		Key:          "etcd.use.embed",
+		Version:      "0.1.0",
+		DefaultValue: "true",
+		Doc:          "whether to start an embedded etcd in master",
+		Export:       true,
+	}
+	e.UseEmbedEtcd.Init(base.mgr)
+
+	e.Endpoints = ParamItem{
+		Key:          "etcd.endpoints",
+		Version:      "0.1.0",
+		DefaultValue: "localhost:2379",
+		Export:       true,
+	}
+	e.Endpoints.Init(base.mgr)
+
+	e.ConfigPath = ParamItem{
+		Key:     "etcd.config.path",
+		Version: "0.1.0",
+		Doc:     "the config file of the embedded etcd, empty means the default config",
+		Export:  true,
+	}
+	e.ConfigPath.Init(base.mgr)
+
+	e.DataDir = ParamItem{
+		Key:          "etcd.data.dir",
+		Version:      "0.1.0",
+		DefaultValue: "/var/lib/linkbase/etcd",
+		Doc:          "embedded etcd only",
+		Export:       true,
+	}
+	e.DataDir.Init(base.mgr)
+
+	e.LogPath = ParamItem{
+		Key:          "etcd.log.path",
+		Version:      "0.1.0",
+		DefaultValue: "stdout",
+		Doc:          "path is one of: default, stdout, stderr or a file path",
+		Export:       true,
+	}
+	e.LogPath.Init(base.mgr)
+
+	e.LogLevel = ParamItem{
+		Key:          "etcd.log.level",
+		Version:      "0.1.0",
+		DefaultValue: "info",
+		Export:       true,
+	}
+	e.LogLevel.Init(base.mgr)
+}
+
 // --- rocksmq ---
 type RocksmqConfig struct {
 	Path          ParamItem `refreshable:"false"`
 	LRUCacheRatio ParamItem `refreshable:"false"`
 	PageSize      ParamItem `refreshable:"false"`
+	// BackupPath is the dir the backups are taken into, a backup can not be written anywhere else
+	BackupPath ParamItem `refreshable:"false"`
 	// RetentionTimeInMinutes is the time of retention
 	RetentionTimeInMinutes ParamItem `refreshable:"false"`
 	// RetentionSizeInMB is the size of retention
@@ -13,9 +154,146 @@ type RocksmqConfig struct {
 	CompactionInterval ParamItem `refreshable:"false"`
 	// TickerTimeInSeconds is the time of expired check, default 10 minutes
 	TickerTimeInSeconds ParamItem `refreshable:"false"`
+	// AckTimeoutInSeconds is how long a message consumed in ack mode waits for its ack before redelivery
+	AckTimeoutInSeconds ParamItem `refreshable:"true"`
+	// Address is where master serves rocksmq as a grpc broker, remote clients dial it
+	Address ParamItem `refreshable:"false"`
+	// GroupCommitEnabled makes concurrent produces of any topic written to rocksdb in one batch
+	GroupCommitEnabled ParamItem `refreshable:"false"`
+	// GroupCommitMaxLatencyInMs is how long a group commit waits for more produces before it writes
+	GroupCommitMaxLatencyInMs ParamItem `refreshable:"false"`
+	// GroupCommitMaxBatchSize is the bytes a group commit writes at most
+	GroupCommitMaxBatchSize ParamItem `refreshable:"false"`
 	// CompressionTypes is compression type of each level
 	// len of CompressionTypes means num of rocksdb level.
 	// only support {0,7}, 0 means no compress, 7 means zstd
 	// default [0,7].
 	CompressionTypes ParamItem `refreshable:"false"`
 }
+
+func (r *RocksmqConfig) Init(base *BaseTable) {
+	r.Path = ParamItem{
+		Key:          "rocksmq.path",
+		Version:      "0.1.0",
+		DefaultValue: "/var/lib/linkbase/rdb_data",
+		Doc:          "the path where the rocksmq data is stored",
+		Export:       true,
+	}
+	r.Path.Init(base.mgr)
+
+	r.BackupPath = ParamItem{
+		Key:          "rocksmq.backupPath",
+		Version:      "0.1.0",
+		DefaultValue: "/var/lib/linkbase/rdb_backup",
+		Doc:          "the path where the rocksmq backups are taken, the backup dir is relative to it or inside it",
+		Export:       true,
+	}
+	r.BackupPath.Init(base.mgr)
+
+	r.LRUCacheRatio = ParamItem{
+		Key:          "rocksmq.lrucacheratio",
+		Version:      "0.1.0",
+		DefaultValue: "0.06",
+		Doc:          "rocksdb cache memory ratio",
+		Export:       true,
+	}
+	r.LRUCacheRatio.Init(base.mgr)
+
+	r.PageSize = ParamItem{
+		Key:          "rocksmq.rocksmqPageSize",
+		Version:      "0.1.0",
+		DefaultValue: strconv.FormatInt(64<<20, 10),
+		Doc:          "64 MB, 64 * 1024 * 1024 bytes, the size of each page of messages in rocksmq",
+		Export:       true,
+	}
+	r.PageSize.Init(base.mgr)
+
+	r.RetentionTimeInMinutes = ParamItem{
+		Key:          "rocksmq.retentionTimeInMinutes",
+		Version:      "0.1.0",
+		DefaultValue: "4320",
+		Doc:          "3 days, 3 * 24 * 60 minutes, the retention time of the message in rocksmq, used by topics without their own retention policy.",
+		Export:       true,
+	}
+	r.RetentionTimeInMinutes.Init(base.mgr)
+
+	r.RetentionSizeInMB = ParamItem{
+		Key:          "rocksmq.retentionSizeInMB",
+		Version:      "0.1.0",
+		DefaultValue: "8192",
+		Doc:          "8 GB, 8 * 1024 MB, the size of each topic in rocksmq, used by topics without their own retention policy",
+		Export:       true,
+	}
+	r.RetentionSizeInMB.Init(base.mgr)
+
+	r.CompactionInterval = ParamItem{
+		Key:          "rocksmq.compactionInterval",
+		Version:      "0.1.0",
+		DefaultValue: "86400",
+		Doc:          "1 day, trigger rocksdb compaction every day to remove deleted data, 0 disables it",
+		Export:       true,
+	}
+	r.CompactionInterval.Init(base.mgr)
+
+	r.TickerTimeInSeconds = ParamItem{
+		Key:          "rocksmq.timtickerInterval",
+		Version:      "0.1.0",
+		DefaultValue: "600",
+		Doc:          "10 minutes, the interval of the expired message check",
+	}
+	r.TickerTimeInSeconds.Init(base.mgr)
+
+	r.AckTimeoutInSeconds = ParamItem{
+		Key:          "rocksmq.ackTimeoutInSeconds",
+		Version:      "0.1.0",
+		DefaultValue: "60",
+		Doc:          "1 minute, the time a message consumed in ack mode waits for its ack before it is redelivered",
+		Export:       true,
+	}
+	r.AckTimeoutInSeconds.Init(base.mgr)
+
+	r.Address = ParamItem{
+		Key:          "rocksmq.address",
+		Version:      "0.1.0",
+		DefaultValue: "127.0.0.1:19532",
+		Doc:          "the address the rocksmq broker of master listens on, the slaves dial it to share the broker. The broker has no authentication, only listen beyond loopback on a trusted network",
+		Export:       true,
+	}
+	r.Address.Init(base.mgr)
+
+	r.GroupCommitEnabled = ParamItem{
+		Key:          "rocksmq.groupCommitEnabled",
+		Version:      "0.1.0",
+		DefaultValue: "false",
+		Doc:          "write the messages of concurrent produces in one rocksdb batch, off by default",
+		Export:       true,
+	}
+	r.GroupCommitEnabled.Init(base.mgr)
+
+	r.GroupCommitMaxLatencyInMs = ParamItem{
+		Key:          "rocksmq.groupCommitMaxLatencyInMs",
+		Version:      "0.1.0",
+		DefaultValue: "0",
+		Doc:          "how long a group commit waits for more produces, 0 writes as soon as the previous group commit is done",
+		Export:       true,
+	}
+	r.GroupCommitMaxLatencyInMs.Init(base.mgr)
+
+	r.GroupCommitMaxBatchSize = ParamItem{
+		Key:          "rocksmq.groupCommitMaxBatchSize",
+		Version:      "0.1.0",
+		DefaultValue: strconv.FormatInt(4<<20, 10),
+		Doc:          "4 MB, 4 * 1024 * 1024 bytes, a group commit writes right away once the queued produces reach it",
+		Export:       true,
+	}
+	r.GroupCommitMaxBatchSize.Init(base.mgr)
+
+	r.CompressionTypes = ParamItem{
+		Key:          "rocksmq.compressionTypes",
+		Version:      "0.1.0",
+		DefaultValue: "0,0,7,7,7",
+		Doc:          "compaction compression type, only support use 0,7. 0 means not compress, 7 will use zstd. Length of types means num of rocksdb level.",
+		Export:       true,
+	}
+	r.CompressionTypes.Init(base.mgr)
+}